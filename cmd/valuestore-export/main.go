@@ -0,0 +1,82 @@
+// Command valuestore-export writes the contents of a stopped value or group
+// store to a stream that valuestore-import can load into another store, such
+// as one with a different configuration.
+//
+// Usage:
+//
+//	valuestore-export [options] path > stream
+//
+// The store is opened with its usual configuration, so the VALUESTORE_* and
+// GROUPSTORE_* environment variables apply.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gholt/store"
+)
+
+func main() {
+	pathtoc := flag.String("pathtoc", "", "directory of the TOC files, if different from path")
+	group := flag.Bool("group", false, "export a group store rather than a value store")
+	output := flag.String("o", "", "file to write to rather than standard output")
+	startKeyA := flag.Uint64("start", 0, "lowest keyA to export")
+	stopKeyA := flag.Uint64("stop", 0, "highest keyA to export; 0 for no limit")
+	min := flag.Int64("min", 0, "oldest timestampmicro to export; 0 for no limit")
+	max := flag.Int64("max", 0, "newest timestampmicro to export; 0 for no limit")
+	skipDeleted := flag.Bool("skip-deleted", false, "leave out deletion markers")
+	kp := store.StaticKeyProvider{}
+	flag.Var(kp, "key", "id:hex of a key for encrypted files; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		fp, err := os.Create(*output)
+		if err != nil {
+			fail(err)
+		}
+		defer fp.Close()
+		w = fp
+	}
+	var keyProvider store.KeyProvider
+	if len(kp) > 0 {
+		keyProvider = kp
+	}
+	opts := store.ExportOptions{StartKeyA: *startKeyA, StopKeyA: *stopKeyA, MinTimestampMicro: *min, MaxTimestampMicro: *max, SkipDeleted: *skipDeleted}
+	var s interface {
+		Export(io.Writer, store.ExportOptions) (int, error)
+		Close() error
+	}
+	var err error
+	if *group {
+		s, _, err = store.NewGroupStore(&store.GroupStoreConfig{Path: flag.Arg(0), PathTOC: *pathtoc, KeyProvider: keyProvider})
+	} else {
+		s, _, err = store.NewValueStore(&store.ValueStoreConfig{Path: flag.Arg(0), PathTOC: *pathtoc, KeyProvider: keyProvider})
+	}
+	if err != nil {
+		fail(err)
+	}
+	n, err := s.Export(w, opts)
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d entries exported\n", n)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,77 @@
+// Command valuestore-fsck checks the files of a stopped value and/or group
+// store, printing a report for each file pair and optionally moving bad pairs
+// out of the way so the store won't load them.
+//
+// Usage:
+//
+//	valuestore-fsck [-path dir ...] [-pathtoc dir] [-quarantine dir] [-key id:hex ...] path
+//
+// Stores with more than one of Paths need each of them given, the first as
+// path and the rest with -path, in the same order.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gholt/store"
+)
+
+func main() {
+	var paths []string
+	flag.Func("path", "another directory of data files, as with Paths; may be repeated", func(s string) error {
+		paths = append(paths, s)
+		return nil
+	})
+	pathtoc := flag.String("pathtoc", "", "directory of the TOC files, if different from path")
+	quarantine := flag.String("quarantine", "", "directory to move bad file pairs into")
+	kp := store.StaticKeyProvider{}
+	flag.Var(kp, "key", "id:hex of a key for encrypted files; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts := &store.FsckOptions{QuarantinePath: *quarantine}
+	if len(kp) > 0 {
+		opts.KeyProvider = kp
+	}
+	dirs := append([]string{flag.Arg(0)}, paths...)
+	var reports []*store.FsckReport
+	for _, fsck := range []func([]string, string, *store.FsckOptions) ([]*store.FsckReport, error){store.FsckValueStore, store.FsckGroupStore} {
+		r, err := fsck(dirs, *pathtoc, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		reports = append(reports, r...)
+	}
+	bad := 0
+	for _, report := range reports {
+		name := report.Name
+		if name == "" {
+			name = report.TOCName
+		}
+		if report.OK() {
+			fmt.Printf("%s: ok, %d entries\n", name, report.Entries)
+			continue
+		}
+		bad++
+		fmt.Printf("%s: BAD, %d entries, %d bad entries\n", name, report.Entries, report.BadEntries)
+		for _, err := range report.Errors {
+			fmt.Printf("    %s\n", err)
+		}
+		if report.Quarantined {
+			fmt.Printf("    moved to %s\n", *quarantine)
+		}
+	}
+	fmt.Printf("%d file pairs checked, %d bad\n", len(reports), bad)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,84 @@
+// Command valuestore-import loads a stream written by valuestore-export into
+// a stopped value or group store, keeping whichever of the imported and
+// existing entries is newest.
+//
+// Usage:
+//
+//	valuestore-import [options] path < stream
+//
+// The store is opened with its usual configuration, so the VALUESTORE_* and
+// GROUPSTORE_* environment variables apply.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gholt/store"
+)
+
+func main() {
+	pathtoc := flag.String("pathtoc", "", "directory of the TOC files, if different from path")
+	group := flag.Bool("group", false, "import into a group store rather than a value store")
+	input := flag.String("i", "", "file to read from rather than standard input")
+	startKeyA := flag.Uint64("start", 0, "lowest keyA to import")
+	stopKeyA := flag.Uint64("stop", 0, "highest keyA to import; 0 for no limit")
+	min := flag.Int64("min", 0, "oldest timestampmicro to import; 0 for no limit")
+	max := flag.Int64("max", 0, "newest timestampmicro to import; 0 for no limit")
+	skipDeleted := flag.Bool("skip-deleted", false, "leave out deletion markers")
+	kp := store.StaticKeyProvider{}
+	flag.Var(kp, "key", "id:hex of a key for encrypted files; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		fp, err := os.Open(*input)
+		if err != nil {
+			fail(err)
+		}
+		defer fp.Close()
+		r = fp
+	}
+	var keyProvider store.KeyProvider
+	if len(kp) > 0 {
+		keyProvider = kp
+	}
+	opts := store.ImportOptions{StartKeyA: *startKeyA, StopKeyA: *stopKeyA, MinTimestampMicro: *min, MaxTimestampMicro: *max, SkipDeleted: *skipDeleted}
+	var s interface {
+		EnableWrites()
+		Import(io.Reader, store.ImportOptions) (int, error)
+		Close() error
+	}
+	var err error
+	if *group {
+		s, _, err = store.NewGroupStore(&store.GroupStoreConfig{Path: flag.Arg(0), PathTOC: *pathtoc, KeyProvider: keyProvider})
+	} else {
+		s, _, err = store.NewValueStore(&store.ValueStoreConfig{Path: flag.Arg(0), PathTOC: *pathtoc, KeyProvider: keyProvider})
+	}
+	if err != nil {
+		fail(err)
+	}
+	s.EnableWrites()
+	n, err := s.Import(r, opts)
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d entries imported\n", n)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
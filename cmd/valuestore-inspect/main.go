@@ -0,0 +1,210 @@
+// Command valuestore-inspect shows what a value or group store has on disk.
+// It only ever reads the files, so it is safe to point at copies of live
+// directories.
+//
+// Usage:
+//
+//	valuestore-inspect [options] files path
+//	valuestore-inspect [options] toc file.valuetoc|file.grouptoc
+//	valuestore-inspect [options] history path keyA keyB [nameKeyA nameKeyB]
+//	valuestore-inspect [options] resolve path keyA keyB [nameKeyA nameKeyB]
+//
+// Stores with more than one of Paths need each of them given, the first as
+// path and the rest with -path, in the same order.
+//
+// Keys may be given in decimal or, with a 0x prefix, hex. The history and
+// resolve commands need the name keys, and -group, for group stores.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gholt/store"
+)
+
+var (
+	paths     []string
+	pathtoc   = flag.String("pathtoc", "", "directory of the TOC files, if different from path")
+	group     = flag.Bool("group", false, "inspect group store files rather than value store files")
+	jsonOut   = flag.Bool("json", false, "output JSON, one object per line")
+	values    = flag.Bool("values", false, "include values in history output")
+	keyFlag   = store.StaticKeyProvider{}
+	exitValue = 0
+)
+
+func main() {
+	flag.Func("path", "another directory of data files, as with Paths; may be repeated", func(s string) error {
+		paths = append(paths, s)
+		return nil
+	})
+	flag.Var(keyFlag, "key", "id:hex of a key for encrypted files; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] files|toc|history|resolve args...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var kp store.KeyProvider
+	if len(keyFlag) > 0 {
+		kp = keyFlag
+	}
+	switch args[0] {
+	case "files":
+		files(append([]string{args[1]}, paths...))
+	case "toc":
+		if strings.HasSuffix(args[1], ".grouptoc") {
+			*group = true
+		}
+		toc(args[1], kp)
+	case "history", "resolve":
+		n := 4
+		if *group {
+			n = 6
+		}
+		if len(args) != n {
+			flag.Usage()
+			os.Exit(2)
+		}
+		k := make([]uint64, len(args)-2)
+		for i := range k {
+			var err error
+			if k[i], err = strconv.ParseUint(args[i+2], 0, 64); err != nil {
+				fail(err)
+			}
+		}
+		history(args[0] == "resolve", append([]string{args[1]}, paths...), kp, k)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(exitValue)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func warn(errs []error) {
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+		exitValue = 1
+	}
+}
+
+func output(v interface{}, text string) {
+	if *jsonOut {
+		b, err := json.Marshal(v)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		fmt.Println(text)
+	}
+}
+
+func files(dirs []string) {
+	if *group {
+		files, err := store.InspectGroupFiles(dirs, *pathtoc)
+		if err != nil {
+			fail(err)
+		}
+		for _, f := range files {
+			output(f, fileText(f.TOCName, f.Name, f.NameTimestamp, f.Size, f.Entries))
+		}
+		return
+	}
+	files, err := store.InspectValueFiles(dirs, *pathtoc)
+	if err != nil {
+		fail(err)
+	}
+	for _, f := range files {
+		output(f, fileText(f.TOCName, f.Name, f.NameTimestamp, f.Size, f.Entries))
+	}
+}
+
+func fileText(tocName string, name string, nameTimestamp int64, size int64, entries int) string {
+	if name == "" {
+		name = "(missing)"
+	}
+	age := time.Since(time.Unix(0, nameTimestamp)).Truncate(time.Second)
+	return fmt.Sprintf("%s %s %d bytes, %d entries, %s old", tocName, name, size, entries, age)
+}
+
+func toc(tocName string, kp store.KeyProvider) {
+	if *group {
+		warn(store.InspectGroupTOC(tocName, kp, func(e *store.GroupInspectEntry) {
+			output(e, groupEntryText(e))
+		}))
+		return
+	}
+	warn(store.InspectValueTOC(tocName, kp, func(e *store.ValueInspectEntry) {
+		output(e, valueEntryText(e))
+	}))
+}
+
+func history(resolve bool, dirs []string, kp store.KeyProvider, k []uint64) {
+	if *group {
+		history, errs := store.InspectGroupHistory(dirs, *pathtoc, kp, k[0], k[1], k[2], k[3], *values && !resolve)
+		warn(errs)
+		if resolve {
+			if e := store.ResolveGroupHistory(history); e != nil {
+				output(e, groupEntryText(e))
+			} else {
+				output(nil, "not found")
+			}
+			return
+		}
+		for _, e := range history {
+			output(e, groupEntryText(e))
+		}
+		return
+	}
+	history, errs := store.InspectValueHistory(dirs, *pathtoc, kp, k[0], k[1], *values && !resolve)
+	warn(errs)
+	if resolve {
+		if e := store.ResolveValueHistory(history); e != nil {
+			output(e, valueEntryText(e))
+		} else {
+			output(nil, "not found")
+		}
+		return
+	}
+	for _, e := range history {
+		output(e, valueEntryText(e))
+	}
+}
+
+func valueEntryText(e *store.ValueInspectEntry) string {
+	return fmt.Sprintf("%s %016x %016x %s offset %d length %d%s", e.TOCName, e.KeyA, e.KeyB, timestampText(e.TimestampMicro, e.Flags), e.Offset, e.Length, valueText(e.Value))
+}
+
+func groupEntryText(e *store.GroupInspectEntry) string {
+	return fmt.Sprintf("%s %016x %016x %016x %016x %s offset %d length %d%s", e.TOCName, e.KeyA, e.KeyB, e.NameKeyA, e.NameKeyB, timestampText(e.TimestampMicro, e.Flags), e.Offset, e.Length, valueText(e.Value))
+}
+
+func timestampText(timestampMicro int64, flags []string) string {
+	s := time.Unix(0, timestampMicro*1000).UTC().Format(time.RFC3339Nano)
+	if len(flags) > 0 {
+		s += " [" + strings.Join(flags, ",") + "]"
+	}
+	return s
+}
+
+func valueText(value []byte) string {
+	if value == nil {
+		return ""
+	}
+	return " value " + strconv.Quote(string(value))
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// KeyProvider supplies the keys used to encrypt files at rest; see
+// ValueStoreConfig.KeyProvider. Keys must be 16, 24, or 32 bytes, selecting
+// AES-128, AES-192, or AES-256 in GCM mode.
+type KeyProvider interface {
+	// CurrentKey returns the key, and its ID, that newly written files should
+	// be encrypted with. The ID is recorded in each file's header.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key for an ID recorded in an existing file's header.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider of a fixed set of keys by ID, where the
+// current key is the one with the highest ID. It is also a flag.Value, each
+// Set adding an id:hex key, as used by the valuestore-* commands.
+type StaticKeyProvider map[uint32][]byte
+
+func (kp StaticKeyProvider) String() string {
+	return fmt.Sprintf("%d keys", len(kp))
+}
+
+func (kp StaticKeyProvider) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected id:hex, got %q", s)
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	kp[uint32(id)] = key
+	return nil
+}
+
+func (kp StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	var current uint32
+	for id := range kp {
+		if id > current {
+			current = id
+		}
+	}
+	key, ok := kp[current]
+	if !ok {
+		return 0, nil, errors.New("no keys")
+	}
+	return current, key, nil
+}
+
+func (kp StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := kp[id]
+	if !ok {
+		return nil, fmt.Errorf("no key for key id %d", id)
+	}
+	return key, nil
+}
+
+// _ENCRYPTION_OVERHEAD is the nonce and tag stored in each checksum interval
+// of an encrypted file, reducing how much data each interval holds.
+const _ENCRYPTION_OVERHEAD = 12 + 16
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBlock encrypts, in place, the data block with the given index; the
+// first prefix bytes (the file header for the first block) are left in the
+// clear. block must have capacity for _ENCRYPTION_OVERHEAD more bytes, and
+// the sealed block, prefix + nonce + ciphertext and tag, is returned.
+func sealBlock(aead cipher.AEAD, block []byte, prefix int, index uint64) []byte {
+	start := prefix + aead.NonceSize()
+	n := copy(block[start:cap(block)], block[prefix:])
+	nonce := block[prefix:start]
+	rand.Read(nonce)
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], index)
+	return block[:start+len(aead.Seal(block[start:start], nonce, block[start:start+n], ad[:]))]
+}
+
+// openBlock reverses sealBlock, in place, returning the data block or an
+// error if the block could not be authenticated.
+func openBlock(aead cipher.AEAD, block []byte, prefix int, index uint64) ([]byte, error) {
+	start := prefix + aead.NonceSize()
+	if len(block) < start+aead.Overhead() {
+		return nil, errors.New("encrypted block too short")
+	}
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], index)
+	data, err := aead.Open(block[start:start], block[prefix:start], block[start:], ad[:])
+	if err != nil {
+		return nil, err
+	}
+	return block[:prefix+copy(block[prefix:], data)], nil
+}
+
+// blockCipherReader decrypts a file encrypted with sealBlock, presenting the
+// same offsets the data had before encryption. The underlying reader should
+// already be handling checksums so that each interval bytes from it is one
+// sealed block.
+type blockCipherReader struct {
+	r        io.ReadSeeker
+	aead     cipher.AEAD
+	interval int64
+	prefix   int
+	buf      []byte
+	block    []byte
+	index    int64
+	pos      int64
+}
+
+func newBlockCipherReader(r io.ReadSeeker, aead cipher.AEAD, interval int, prefix int) *blockCipherReader {
+	return &blockCipherReader{r: r, aead: aead, interval: int64(interval), prefix: prefix, buf: make([]byte, interval), index: -1}
+}
+
+func (r *blockCipherReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+		r.pos = offset
+	case 1:
+		r.pos += offset
+	default:
+		return r.pos, errors.New("unsupported whence")
+	}
+	return r.pos, nil
+}
+
+func (r *blockCipherReader) Read(p []byte) (int, error) {
+	size := r.interval - _ENCRYPTION_OVERHEAD
+	n := 0
+	for n < len(p) {
+		index := r.pos / size
+		if index != r.index {
+			if err := r.load(index); err != nil {
+				return n, err
+			}
+		}
+		off := int(r.pos - index*size)
+		if off >= len(r.block) {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+		c := copy(p[n:], r.block[off:])
+		n += c
+		r.pos += int64(c)
+	}
+	return n, nil
+}
+
+func (r *blockCipherReader) load(index int64) error {
+	r.index = -1
+	r.block = nil
+	if _, err := r.r.Seek(index*r.interval, 0); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(r.r, r.buf)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	prefix := 0
+	if index == 0 {
+		prefix = r.prefix
+	}
+	if r.block, err = openBlock(r.aead, r.buf[:n], prefix, uint64(index)); err != nil {
+		return err
+	}
+	r.index = index
+	return nil
+}
+
+func (r *blockCipherReader) Close() error {
+	return closeIfCloser(r.r)
+}
+
+// blockCipherWriter encrypts data with sealBlock as it is written to w, which
+// should be a checksummed writer using the same interval so that each sealed
+// block fills exactly one checksum interval.
+type blockCipherWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	size   int
+	prefix int
+	buf    []byte
+	index  uint64
+}
+
+func newBlockCipherWriter(w io.WriteCloser, aead cipher.AEAD, interval int, prefix int) *blockCipherWriter {
+	return &blockCipherWriter{w: w, aead: aead, size: interval - _ENCRYPTION_OVERHEAD, prefix: prefix, buf: make([]byte, 0, interval)}
+}
+
+func (w *blockCipherWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):w.size], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+		if len(w.buf) == w.size {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *blockCipherWriter) flush() error {
+	prefix := 0
+	if w.index == 0 {
+		prefix = w.prefix
+	}
+	_, err := w.w.Write(sealBlock(w.aead, w.buf, prefix, w.index))
+	w.buf = w.buf[:0]
+	w.index++
+	return err
+}
+
+func (w *blockCipherWriter) Close() error {
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			w.w.Close()
+			return err
+		}
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"io"
+)
+
+// Durability selects how hard a store works to keep acknowledged writes
+// through a crash; see ValueStoreConfig.Durability.
+type Durability int
+
+const (
+	// DurabilityNone leaves getting written files to stable storage up to
+	// the operating system. Write returns once the value is buffered in
+	// memory and Flush only hands the buffers to the operating system.
+	DurabilityNone Durability = iota
+	// DurabilityFlush fsyncs each file as it is finished, so once Flush
+	// returns everything written before the call is on stable storage.
+	DurabilityFlush
+	// DurabilitySync is DurabilityFlush with Write, Delete, and the like
+	// also waiting until their value and TOC entry are on stable storage.
+	// Concurrent writes share each sync, which fsyncs the files being
+	// written in place. Each sync pads out the checksum interval being
+	// filled in those files, so small synchronous writes can each use up to
+	// ChecksumInterval bytes of the value and TOC files.
+	DurabilitySync
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityFlush:
+		return "flush"
+	case DurabilitySync:
+		return "sync"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// syncFile syncs fp to stable storage, if it can be synced as an *os.File
+// can.
+func syncFile(fp interface{}) error {
+	if syncer, ok := fp.(interface {
+		Sync() error
+	}); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// syncCloser syncs the file it wraps to stable storage before closing it, if
+// the file can be synced as an *os.File can.
+type syncCloser struct {
+	io.WriteCloser
+}
+
+func (s syncCloser) Sync() error {
+	return syncFile(s.WriteCloser)
+}
+
+func (s syncCloser) Close() error {
+	if err := s.Sync(); err != nil {
+		s.WriteCloser.Close()
+		return err
+	}
+	return s.WriteCloser.Close()
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"io"
+	"os"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+)
+
+// FS is the file system a store keeps its files in; see ValueStoreConfig.FS.
+// Names are always the store's Path or PathTOC joined with a file name.
+type FS interface {
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadSeeker, error)
+	// Create creates the named file for writing, truncating it if it exists.
+	Create(name string) (io.WriteCloser, error)
+	// Remove removes the named file.
+	Remove(name string) error
+	// Rename moves oldname to newname, replacing newname if it exists.
+	Rename(oldname string, newname string) error
+	// Link makes newname another name for the file oldname. Returning an
+	// error is fine; callers fall back to copying.
+	Link(oldname string, newname string) error
+	// MkdirAll creates the named directory along with any parents needed.
+	MkdirAll(name string) error
+	// ReadDirNames returns the names of the entries in the named directory.
+	ReadDirNames(name string) ([]string, error)
+	// Stat returns the os.FileInfo for the named file.
+	Stat(name string) (os.FileInfo, error)
+	// DiskUsage returns the bytes free and the total bytes of the device
+	// containing the named directory.
+	DiskUsage(name string) (free uint64, size uint64)
+	// SyncDir commits the entries of the named directory, such as files just
+	// created or renamed into it, to stable storage.
+	SyncDir(name string) error
+}
+
+// OSFS is the default FS, using the os package.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (io.ReadSeeker, error) {
+	return os.Open(name)
+}
+
+func (OSFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OSFS) Link(oldname string, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OSFS) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0755)
+}
+
+func (OSFS) ReadDirNames(name string) ([]string, error) {
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fp.Readdirnames(-1)
+	fp.Close()
+	return names, err
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) DiskUsage(name string) (uint64, uint64) {
+	u := du.NewDiskUsage(name)
+	return u.Free(), u.Size()
+}
+
+func (OSFS) SyncDir(name string) error {
+	fp, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = fp.Sync()
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// linkOrCopy hard links src to dst within fs, falling back to copying it,
+// and returns whether it had to copy and the size of the file.
+func linkOrCopy(fs FS, src string, dst string) (bool, int64, error) {
+	fi, err := fs.Stat(src)
+	if err != nil {
+		return false, 0, err
+	}
+	if err = fs.Link(src, dst); err == nil {
+		return false, fi.Size(), nil
+	}
+	if _, err = fs.Stat(dst); err == nil {
+		return true, 0, &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	}
+	in, err := fs.Open(src)
+	if err != nil {
+		return true, 0, err
+	}
+	defer closeIfCloser(in)
+	out, err := fs.Create(dst)
+	if err != nil {
+		return true, 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = syncFile(out)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return true, n, err
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// GroupBatchEntry is a single item given to WriteBatch or DeleteBatch.
+type GroupBatchEntry struct {
+	KeyA uint64
+	KeyB uint64
+
+	NameKeyA uint64
+	NameKeyB uint64
+
+	TimestampMicro int64
+	// Value is ignored by DeleteBatch.
+	Value []byte
+}
+
+// GroupBatchResult is the outcome for the GroupBatchEntry at the same index
+// given to WriteBatch or DeleteBatch.
+type GroupBatchResult struct {
+	// TimestampMicro is the previously stored timestampmicro, just as Write
+	// or Delete would have returned.
+	TimestampMicro int64
+	Err            error
+}
+
+// WriteBatch is the same as calling Write for each of the entries but avoids
+// waiting on each individual write before submitting the next; the results
+// are returned in the same order as the entries.
+func (store *DefaultGroupStore) WriteBatch(entries []GroupBatchEntry) []GroupBatchResult {
+	atomic.AddInt32(&store.writeBatches, 1)
+	return store.batch(entries, false)
+}
+
+// DeleteBatch is the same as calling Delete for each of the entries but
+// avoids waiting on each individual delete before submitting the next; the
+// results are returned in the same order as the entries. Entry values are
+// ignored.
+func (store *DefaultGroupStore) DeleteBatch(entries []GroupBatchEntry) []GroupBatchResult {
+	atomic.AddInt32(&store.deleteBatches, 1)
+	return store.batch(entries, true)
+}
+
+func (store *DefaultGroupStore) batch(entries []GroupBatchEntry, deletes bool) []GroupBatchResult {
+	results := make([]GroupBatchResult, len(entries))
+	shards := make([][]int, len(store.freeWriteReqChans))
+	closed := atomic.LoadUint32(&store.closed) != 0
+	for j := range entries {
+		if deletes {
+			atomic.AddInt32(&store.deletes, 1)
+		} else {
+			atomic.AddInt32(&store.writes, 1)
+		}
+		timestampmicro := entries[j].TimestampMicro
+		if closed {
+			results[j].Err = ErrClosed
+		} else if timestampmicro < TIMESTAMPMICRO_MIN {
+			results[j].Err = fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+		} else if timestampmicro > TIMESTAMPMICRO_MAX {
+			results[j].Err = fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+		} else if entries[j].NameKeyA == _GROUP_DELETION_NAME_KEY && entries[j].NameKeyB == _GROUP_DELETION_NAME_KEY {
+			results[j].Err = ErrReservedName
+		}
+		if results[j].Err != nil {
+			if deletes {
+				atomic.AddInt32(&store.deleteErrors, 1)
+			} else {
+				atomic.AddInt32(&store.writeErrors, 1)
+			}
+			continue
+		}
+		i := int(entries[j].KeyA>>1) % len(shards)
+		shards[i] = append(shards[i], j)
+	}
+	wg := &sync.WaitGroup{}
+	for i, indexes := range shards {
+		if len(indexes) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, indexes []int) {
+			store.batchShard(i, entries, indexes, results, deletes)
+			wg.Done()
+		}(i, indexes)
+	}
+	wg.Wait()
+	// One sync covers every write in the batch.
+	for j := range results {
+		if results[j].Err != nil {
+			continue
+		}
+		if err := store.syncWrites(context.Background()); err != nil {
+			for j := range results {
+				if results[j].Err == nil {
+					results[j].Err = err
+					if deletes {
+						atomic.AddInt32(&store.deleteErrors, 1)
+					} else {
+						atomic.AddInt32(&store.writeErrors, 1)
+					}
+				}
+			}
+		}
+		break
+	}
+	return results
+}
+
+// batchShard submits all the indexed entries to the memWriter for shard i,
+// only waiting on earlier responses when it runs out of free write requests.
+func (store *DefaultGroupStore) batchShard(i int, entries []GroupBatchEntry, indexes []int, results []GroupBatchResult, deletes bool) {
+	inflight := make([]*groupWriteReq, len(indexes))
+	timestampbitss := make([]uint64, len(indexes))
+	collected := 0
+	collect := func() {
+		writeReq := inflight[collected]
+		j := indexes[collected]
+		timestampmicro := entries[j].TimestampMicro
+		ptimestampbits, err := store.finishWriteReq(i, writeReq, timestampbitss[collected], <-writeReq.errChan)
+		results[j].TimestampMicro = int64(ptimestampbits >> _TSB_UTIL_BITS)
+		results[j].Err = err
+		if deletes {
+			if err != nil {
+				atomic.AddInt32(&store.deleteErrors, 1)
+			} else if timestampmicro <= results[j].TimestampMicro {
+				atomic.AddInt32(&store.deletesOverridden, 1)
+			}
+		} else {
+			if err != nil {
+				atomic.AddInt32(&store.writeErrors, 1)
+			} else if timestampmicro <= results[j].TimestampMicro {
+				atomic.AddInt32(&store.writesOverridden, 1)
+			}
+		}
+		inflight[collected] = nil
+		collected++
+	}
+	for k, j := range indexes {
+		entry := &entries[j]
+		var timestampbits uint64
+		if deletes {
+			timestampbits = (uint64(entry.TimestampMicro) << _TSB_UTIL_BITS) | _TSB_DELETION
+		} else {
+			timestampbits = uint64(entry.TimestampMicro) << _TSB_UTIL_BITS
+		}
+		otimestampbits, omanifest := store.supersededStreamManifest(entry.KeyA, entry.KeyB, entry.NameKeyA, entry.NameKeyB, timestampbits)
+		var writeReq *groupWriteReq
+		select {
+		case writeReq = <-store.freeWriteReqChans[i]:
+		default:
+			if collected < k {
+				collect()
+			}
+			writeReq = <-store.freeWriteReqChans[i]
+		}
+		writeReq.keyA = entry.KeyA
+		writeReq.keyB = entry.KeyB
+
+		writeReq.nameKeyA = entry.NameKeyA
+		writeReq.nameKeyB = entry.NameKeyB
+
+		writeReq.timestampbits = timestampbits
+		if deletes {
+			writeReq.value = nil
+			writeReq.internal = true
+		} else {
+			writeReq.value = entry.Value
+			writeReq.internal = false
+		}
+		writeReq.otimestampbits = otimestampbits
+		writeReq.omanifest = omanifest
+		timestampbitss[k] = timestampbits
+		inflight[k] = writeReq
+		store.pendingWriteReqChans[i] <- writeReq
+	}
+	for collected < len(indexes) {
+		collect()
+	}
+}
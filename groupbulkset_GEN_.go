@@ -62,7 +62,7 @@ func (store *DefaultGroupStore) bulkSetConfig(cfg *GroupStoreConfig) {
 // EnableInBulkSet will resume handling incoming bulk set requests.
 func (store *DefaultGroupStore) EnableInBulkSet() {
 	store.bulkSetState.inNotifyChanLock.Lock()
-	if store.bulkSetState.inNotifyChan == nil {
+	if store.bulkSetState.inNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.bulkSetState.inNotifyChan = make(chan *bgNotification, 1)
 		go store.inBulkSetLauncher(store.bulkSetState.inNotifyChan)
 	}
@@ -235,7 +235,7 @@ func (store *DefaultGroupStore) inBulkSet(wg *sync.WaitGroup) {
 			// Note that deletions are acted upon as internal requests (work
 			// even if writes are disabled due to disk fullness) and new data
 			// writes are not.
-			ptimestampbits, err = store.write(keyA, keyB, nameKeyA, nameKeyB, timestampbits, body[_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH:_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+l], timestampbits&_TSB_DELETION != 0)
+			ptimestampbits, err = store.writeReplicated(keyA, keyB, nameKeyA, nameKeyB, timestampbits, body[_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH:_GROUP_BULK_SET_MSG_ENTRY_HEADER_LENGTH+l], timestampbits&_TSB_DELETION != 0)
 			if err != nil {
 				atomic.AddInt32(&store.inBulkSetWriteErrors, 1)
 			} else if ptimestampbits >= timestampbits {
@@ -53,7 +53,7 @@ func (store *DefaultGroupStore) bulkSetAckConfig(cfg *GroupStoreConfig) {
 // EnableInBulkSetAck will resume handling incoming bulk set ack messages.
 func (store *DefaultGroupStore) EnableInBulkSetAck() {
 	store.bulkSetAckState.inNotifyChanLock.Lock()
-	if store.bulkSetAckState.inNotifyChan == nil {
+	if store.bulkSetAckState.inNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.bulkSetAckState.inNotifyChan = make(chan *bgNotification, 1)
 		go store.inBulkSetAckLauncher(store.bulkSetAckState.inNotifyChan)
 	}
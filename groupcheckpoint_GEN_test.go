@@ -0,0 +1,155 @@
+package store
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestGroupCheckpoint(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		dir := t.TempDir()
+		open := func() *DefaultGroupStore {
+			return newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+				if encrypted {
+					cfg.KeyProvider = &testGroupKeyProvider{current: 1, keys: map[uint32][]byte{1: make([]byte, 16)}}
+				}
+			})
+		}
+		// Each session's writes go to their own file.
+		store := open()
+		for i := uint64(1); i <= 100; i++ {
+			if _, err := store.Write(i, i, i, i, 1000, []byte("one")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		store = open()
+		for i := uint64(50); i <= 150; i++ {
+			if _, err := store.Write(i, i, i, i, 2000, []byte("two")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.Delete(1, 1, 1, 1, 3000); err != nil {
+			t.Fatal(err)
+		}
+		store.Flush()
+		if err := store.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := store.Stats(false).(*GroupStoreStats); stats.Checkpoints != 1 {
+			t.Fatal(stats.Checkpoints)
+		}
+		// Writes after the checkpoint come from replaying their TOC file.
+		if _, err := store.Write(2, 2, 2, 2, 4000, []byte("three")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Write(200, 200, 200, 200, 4000, []byte("three")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var checkpointName string
+		var tocNames []string
+		for _, fi := range names {
+			if strings.HasSuffix(fi.Name(), ".groupcheckpoint") {
+				checkpointName = path.Join(dir, fi.Name())
+			} else if strings.HasSuffix(fi.Name(), ".grouptoc") {
+				tocNames = append(tocNames, path.Join(dir, fi.Name()))
+			}
+		}
+		if checkpointName == "" || len(tocNames) != 3 {
+			t.Fatal(checkpointName, tocNames)
+		}
+		checkpoint, err := ioutil.ReadFile(checkpointName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify := func() {
+			store := open()
+			defer store.Close()
+			for i := uint64(1); i <= 200; i++ {
+				ts, v, err := store.Read(i, i, i, i, nil)
+				switch {
+				case i == 1:
+					if err != ErrNotFound || ts != 3000 {
+						t.Fatal(encrypted, i, ts, err)
+					}
+				case i == 2 || i == 200:
+					if err != nil || ts != 4000 || string(v) != "three" {
+						t.Fatal(encrypted, i, ts, string(v), err)
+					}
+				case i < 50:
+					if err != nil || ts != 1000 || string(v) != "one" {
+						t.Fatal(encrypted, i, ts, string(v), err)
+					}
+				case i <= 150:
+					if err != nil || ts != 2000 || string(v) != "two" {
+						t.Fatal(encrypted, i, ts, string(v), err)
+					}
+				default:
+					if err != ErrNotFound || ts != 0 {
+						t.Fatal(encrypted, i, ts, err)
+					}
+				}
+			}
+		}
+		// A damaged checkpoint falls back to replaying every TOC file.
+		damaged := append([]byte(nil), checkpoint...)
+		damaged[_GROUP_FILE_HEADER_SIZE+100] ^= 0xff
+		if err := ioutil.WriteFile(checkpointName, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		verify()
+		// With the checkpoint intact, the TOC files it covers aren't needed.
+		if err := ioutil.WriteFile(checkpointName, checkpoint, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range tocNames[:2] {
+			if err := ioutil.WriteFile(name, []byte("damaged"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		verify()
+	}
+}
+
+func TestGroupCheckpointUnflushed(t *testing.T) {
+	dir := t.TempDir()
+	store := newGroupTestStore(t, dir, nil)
+	defer store.Close()
+	if _, err := store.Write(1, 2, 3, 4, 1000, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(1, 2, 3, 4, 2000, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	// The newest entry is only in memory as the checkpoint is written, yet
+	// the older one is in a file the checkpoint covers.
+	if _, err := store.Write(1, 2, 3, 4, 3000, []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// Opening another store on the same files, as after a crash, has to
+	// find the key one way or the other.
+	store2 := newGroupTestStore(t, dir, nil)
+	defer store2.Close()
+	if ts, _, err := store2.Read(1, 2, 3, 4, nil); err != nil || ts < 2000 {
+		t.Fatal(ts, err)
+	}
+}
@@ -2,7 +2,6 @@ package store
 
 import (
 	"fmt"
-	"os"
 	"path"
 	"sort"
 	"strconv"
@@ -49,7 +48,7 @@ func (store *DefaultGroupStore) CompactionPass() {
 // for files with a percentage of XX deleted entries.
 func (store *DefaultGroupStore) EnableCompaction() {
 	store.compactionState.notifyChanLock.Lock()
-	if store.compactionState.notifyChan == nil {
+	if store.compactionState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.compactionState.notifyChan = make(chan *bgNotification, 1)
 		go store.compactionLauncher(store.compactionState.notifyChan)
 	}
@@ -128,13 +127,7 @@ func (store *DefaultGroupStore) compactionPass(notifyChan chan *bgNotification)
 			store.logDebug("compaction pass took %s\n", time.Now().Sub(begin))
 		}()
 	}
-	fp, err := os.Open(store.pathtoc)
-	if err != nil {
-		store.logError("%s\n", err)
-		return nil
-	}
-	names, err := fp.Readdirnames(-1)
-	fp.Close()
+	names, err := store.fs.ReadDirNames(store.pathtoc)
 	if err != nil {
 		store.logError("%s\n", err)
 		return nil
@@ -200,14 +193,16 @@ func (store *DefaultGroupStore) compactionCandidate(name string) (int64, bool) {
 
 func (store *DefaultGroupStore) compactionWorker(jobChan chan *groupCompactionJob, wg *sync.WaitGroup) {
 	for c := range jobChan {
-		total, err := groupTOCStat(c.fullPath, os.Stat, osOpenReadSeeker)
+		total, err := groupTOCStat(c.fullPath, store.fs.Stat, store.fs.Open)
 		if err != nil {
 			store.logError("Unable to stat %s because: %v\n", c.fullPath, err)
 			continue
 		}
 		// TODO: This 1000 should be in the Config.
 		// If total is less than 100, it'll automatically get compacted.
-		if total < 1000 {
+		if store.needsRekey(c.fullPath) {
+			atomic.AddInt32(&store.rekeyCompactions, 1)
+		} else if total < 1000 {
 			atomic.AddInt32(&store.smallFileCompactions, 1)
 		} else {
 			toCheck := uint32(total)
@@ -234,12 +229,15 @@ func (store *DefaultGroupStore) compactionWorker(jobChan chan *groupCompactionJo
 			store.logCritical("%s\n", err)
 			continue
 		}
-		if err = os.Remove(c.fullPath); err != nil {
+		store.snapshotLock.RLock()
+		if err = store.fs.Remove(c.fullPath); err != nil {
 			store.logCritical("Unable to remove %s %s\n", c.fullPath, err)
 		}
-		if err = os.Remove(c.fullPath[:len(c.fullPath)-len("toc")]); err != nil {
-			store.logCritical("Unable to remove %s %s\n", c.fullPath[:len(c.fullPath)-len("toc")], err)
+		dataPath := store.groupFilePath(path.Base(c.fullPath[:len(c.fullPath)-len("toc")]))
+		if err = store.fs.Remove(dataPath); err != nil {
+			store.logCritical("Unable to remove %s %s\n", dataPath, err)
 		}
+		store.snapshotLock.RUnlock()
 		if err = store.closeLocBlock(c.candidateBlockID); err != nil {
 			store.logCritical("error closing in-memory block for %s: %s\n", c.fullPath, err)
 		}
@@ -250,6 +248,38 @@ func (store *DefaultGroupStore) compactionWorker(jobChan chan *groupCompactionJo
 	wg.Done()
 }
 
+// needsRekey returns true if the TOC file at fullPath, or its value file,
+// isn't encrypted with the KeyProvider's current key; such files are
+// compacted regardless of how many of their entries are stale.
+func (store *DefaultGroupStore) needsRekey(fullPath string) bool {
+	if store.keyProvider == nil {
+		return false
+	}
+	currentKeyID, _, err := store.keyProvider.CurrentKey()
+	if err != nil {
+		return false
+	}
+	for _, name := range []string{fullPath, store.groupFilePath(path.Base(fullPath[:len(fullPath)-len("toc")]))} {
+		fpr, err := store.fs.Open(name)
+		if err != nil {
+			return false
+		}
+		readHeader := readGroupHeader
+		if name == fullPath {
+			readHeader = readGroupHeaderTOC
+		}
+		header, _, err := readHeader(fpr)
+		closeIfCloser(fpr)
+		if err != nil {
+			return false
+		}
+		if keyID, encrypted := groupHeaderKeyID(header); !encrypted || keyID != currentKeyID {
+			return true
+		}
+	}
+	return false
+}
+
 func (store *DefaultGroupStore) sampleTOC(fullPath string, candidateBlockID uint32, toCheck uint32) (uint32, uint32, error) {
 	stale := uint32(0)
 	checked := uint32(0)
@@ -299,11 +329,11 @@ func (store *DefaultGroupStore) sampleTOC(fullPath string, candidateBlockID uint
 			wg.Done()
 		}(pendingBatchChans[i], freeBatchChans[i])
 	}
-	fpr, err := osOpenReadSeeker(fullPath)
+	fpr, err := store.fs.Open(fullPath)
 	if err != nil {
 		return 0, 0, err
 	}
-	_, errs := groupReadTOCEntriesBatched(fpr, candidateBlockID, freeBatchChans, pendingBatchChans, controlChan)
+	_, errs := groupReadTOCEntriesBatched(fpr, store.keyProvider, candidateBlockID, freeBatchChans, pendingBatchChans, controlChan)
 	for _, err := range errs {
 		store.logError("Compaction check error with %s: %s", fullPath, err)
 		// TODO: The auditor should catch this eventually, but we should be
@@ -383,12 +413,12 @@ func (store *DefaultGroupStore) compactFile(fullPath string, candidateBlockID ui
 		}
 		wg.Wait()
 	}
-	fpr, err := osOpenReadSeeker(fullPath)
+	fpr, err := store.fs.Open(fullPath)
 	if err != nil {
 		spindown()
 		return cr, fmt.Errorf("Compaction error opening %s: %s\n", fullPath, err)
 	}
-	fdc, errs := groupReadTOCEntriesBatched(fpr, candidateBlockID, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	fdc, errs := groupReadTOCEntriesBatched(fpr, store.keyProvider, candidateBlockID, freeBatchChans, pendingBatchChans, make(chan struct{}))
 	for _, err := range errs {
 		store.logError("Compaction error with %s: %s", fullPath, err)
 		// NOTE: No need to notify the auditor since an attempt was just made
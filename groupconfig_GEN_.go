@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"time"
@@ -46,6 +47,15 @@ type GroupStoreConfig struct {
 	// PathTOC sets the path where grouptoc files will be written. Defaults to
 	// the Path value.
 	PathTOC string
+	// Paths, if set, lists the directories group files will be spread
+	// across instead of just Path, such as one per device. Files are found
+	// in whichever directory holds them, so losing a directory only loses
+	// the data in its files. Path defaults to the first of Paths.
+	Paths []string
+	// PathsByFreeSpace causes each new group file to go into the directory
+	// of Paths with the most free space, rather than taking turns. Defaults
+	// to false.
+	PathsByFreeSpace bool
 	// ValueCap indicates the maximum number of bytes any given value may be.
 	// Defaults to 1,048,576 bytes.
 	ValueCap int
@@ -67,6 +77,26 @@ type GroupStoreConfig struct {
 	// ChecksumInterval indicates how many bytes are output to a file before a
 	// 4-byte checksum is also output. Defaults to 65,532 bytes.
 	ChecksumInterval int
+	// CompressionLevel, if greater than zero, causes values to be compressed
+	// with DEFLATE at that level (1-9) as they are written to disk. Values
+	// that don't shrink are stored as is. Files written with compression use
+	// a newer file format, though files in the older format are still read.
+	// Defaults to 0, no compression.
+	CompressionLevel int
+	// KeyProvider, if set, causes new value and TOC files to be encrypted with
+	// AES-GCM using its current key, with the key's ID recorded in each
+	// file's header so older files can still be read after the key changes.
+	// Compaction will rewrite files that aren't under the current key.
+	// Defaults to nil, no encryption; encrypted files cannot be read without
+	// a KeyProvider.
+	KeyProvider KeyProvider
+	// FS is the file system the group and TOC files are kept in. Defaults to
+	// OSFS; MemFS keeps everything in memory instead.
+	FS FS
+	// Durability selects whether files are fsynced and whether writes wait
+	// for that; see DurabilityNone, DurabilityFlush, and DurabilitySync.
+	// Defaults to DurabilityNone.
+	Durability Durability
 	// PageSize controls the size of each chunk of memory allocated. Defaults
 	// to 4,194,304 bytes.
 	PageSize      int
@@ -95,9 +125,18 @@ type GroupStoreConfig struct {
 	// FileReaders indicates how many open file descriptors are allowed per
 	// file for reading. Defaults to Workers.
 	FileReaders int
+	// MmapReads causes reads from closed group files to go through a read
+	// only memory mapping of each file rather than the FileReaders file
+	// descriptors, letting reads of the same file proceed without locking.
+	// Files that can't be mapped, such as with an FS other than OSFS, are read
+	// as usual.
+	MmapReads bool
 	// RecoveryBatchSize indicates how many keys to set in a batch while
 	// performing recovery (initial start up). Defaults to 1,048,576 keys.
 	RecoveryBatchSize int
+	// RecoveryReaders indicates how many TOC files may be read at the same
+	// time while performing recovery. Defaults to Workers.
+	RecoveryReaders int
 	// TombstoneDiscardInterval overrides the BackgroundInterval value just for
 	// discard passes (discarding expired tombstones [deletion markers]).
 	TombstoneDiscardInterval int
@@ -251,6 +290,11 @@ type GroupStoreConfig struct {
 	// AuditAgeThreshold indicates how old a given file must be before it
 	// is considered for an audit. Defaults to 604,800 seconds (1 week).
 	AuditAgeThreshold int
+	// CheckpointInterval indicates the number of seconds between checkpoints
+	// of the key locations, which let recovery on start up skip replaying the
+	// TOC files they cover. Defaults to 3,600 seconds (1 hour); a negative
+	// value disables the periodic checkpoints.
+	CheckpointInterval int
 }
 
 func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
@@ -274,12 +318,41 @@ func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
 	if cfg.Rand == nil {
 		cfg.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
+	if cfg.FS == nil {
+		cfg.FS = OSFS{}
+	}
+	if env := os.Getenv("GROUPSTORE_DURABILITY"); env != "" {
+		for _, d := range []Durability{DurabilityNone, DurabilityFlush, DurabilitySync} {
+			if env == d.String() {
+				cfg.Durability = d
+			}
+		}
+	}
+	if cfg.Durability < DurabilityNone || cfg.Durability > DurabilitySync {
+		cfg.Durability = DurabilityNone
+	}
 	if env := os.Getenv("GROUPSTORE_PATH"); env != "" {
 		cfg.Path = env
 	}
+	if env := os.Getenv("GROUPSTORE_PATHS"); env != "" {
+		cfg.Paths = filepath.SplitList(env)
+	}
+	if cfg.Path == "" && len(cfg.Paths) > 0 {
+		cfg.Path = cfg.Paths[0]
+	}
 	if cfg.Path == "" {
 		cfg.Path = "."
 	}
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = []string{cfg.Path}
+	} else {
+		cfg.Paths = append([]string(nil), cfg.Paths...)
+	}
+	if env := os.Getenv("GROUPSTORE_PATHS_BY_FREE_SPACE"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.PathsByFreeSpace = val
+		}
+	}
 	if env := os.Getenv("GROUPSTORE_PATH_TOC"); env != "" {
 		cfg.PathTOC = env
 	}
@@ -333,6 +406,22 @@ func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
 	if cfg.ChecksumInterval < _GROUP_FILE_HEADER_SIZE {
 		cfg.ChecksumInterval = _GROUP_FILE_HEADER_SIZE
 	}
+	// Each encrypted interval must still have room for the header and at
+	// least one entry.
+	if cfg.KeyProvider != nil && cfg.ChecksumInterval < _GROUP_FILE_HEADER_SIZE+_GROUP_FILE_ENTRY_SIZE+_ENCRYPTION_OVERHEAD {
+		cfg.ChecksumInterval = _GROUP_FILE_HEADER_SIZE + _GROUP_FILE_ENTRY_SIZE + _ENCRYPTION_OVERHEAD
+	}
+	if env := os.Getenv("GROUPSTORE_COMPRESSION_LEVEL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.CompressionLevel = val
+		}
+	}
+	if cfg.CompressionLevel < 0 {
+		cfg.CompressionLevel = 0
+	}
+	if cfg.CompressionLevel > 9 {
+		cfg.CompressionLevel = 9
+	}
 	if env := os.Getenv("GROUPSTORE_PAGE_SIZE"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.PageSize = val
@@ -419,6 +508,11 @@ func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
 	if cfg.FileReaders < 1 {
 		cfg.FileReaders = 1
 	}
+	if env := os.Getenv("GROUPSTORE_MMAP_READS"); env != "" {
+		if val, err := strconv.ParseBool(env); err == nil {
+			cfg.MmapReads = val
+		}
+	}
 	if env := os.Getenv("GROUPSTORE_RECOVERY_BATCH_SIZE"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.RecoveryBatchSize = val
@@ -430,6 +524,17 @@ func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
 	if cfg.RecoveryBatchSize < 1 {
 		cfg.RecoveryBatchSize = 1
 	}
+	if env := os.Getenv("GROUPSTORE_RECOVERY_READERS"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.RecoveryReaders = val
+		}
+	}
+	if cfg.RecoveryReaders == 0 {
+		cfg.RecoveryReaders = cfg.Workers
+	}
+	if cfg.RecoveryReaders < 1 {
+		cfg.RecoveryReaders = 1
+	}
 	if env := os.Getenv("GROUPSTORE_TOMBSTONE_DISCARD_INTERVAL"); env != "" {
 		if val, err := strconv.Atoi(env); err == nil {
 			cfg.TombstoneDiscardInterval = val
@@ -833,5 +938,16 @@ func resolveGroupStoreConfig(c *GroupStoreConfig) *GroupStoreConfig {
 	if cfg.AuditAgeThreshold < 1 {
 		cfg.AuditAgeThreshold = 1
 	}
+	if env := os.Getenv("GROUPSTORE_CHECKPOINT_INTERVAL"); env != "" {
+		if val, err := strconv.Atoi(env); err == nil {
+			cfg.CheckpointInterval = val
+		}
+	}
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = 3600
+	}
+	if cfg.CheckpointInterval < 0 {
+		cfg.CheckpointInterval = 0
+	}
 	return cfg
 }
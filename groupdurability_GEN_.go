@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+type groupSyncState struct {
+	lock    sync.Mutex
+	running bool
+	// next is closed once the sync covering the writes waiting on it is
+	// done; writes arriving while a sync is running wait for the one after.
+	next    chan struct{}
+	errLock sync.Mutex
+	err     error
+}
+
+// createFile creates the named file with the store's FS; unless durability
+// is DurabilityNone the new directory entry is synced and the file will be
+// fsynced when closed.
+func (store *DefaultGroupStore) createFile(name string) (io.WriteCloser, error) {
+	fp, err := store.fs.Create(name)
+	if err != nil || store.durability == DurabilityNone {
+		return fp, err
+	}
+	if err = store.syncDir(path.Dir(name)); err != nil {
+		fp.Close()
+		store.fs.Remove(name)
+		return nil, err
+	}
+	return syncCloser{fp}, nil
+}
+
+// syncDir syncs the directory, unless durability is DurabilityNone, so files
+// created or renamed into it are still there after a crash.
+func (store *DefaultGroupStore) syncDir(dir string) error {
+	if store.durability == DurabilityNone {
+		return nil
+	}
+	return store.fs.SyncDir(dir)
+}
+
+// sync sends a sync request down the write pipeline and waits for it to come
+// out the other end: each stage passes on what it holds and the group file
+// and TOC files being written are fsynced in place, without finishing them
+// as flush would.
+func (store *DefaultGroupStore) sync() {
+	store.flushLock.Lock()
+	defer store.flushLock.Unlock()
+	for _, c := range store.pendingWriteReqChans {
+		c <- syncGroupWriteReq
+	}
+	<-store.syncedChan
+}
+
+// syncWrites waits, with DurabilitySync, for a sync started after the call
+// so that any writes already accepted are on stable storage. Concurrent
+// callers share syncs, giving group commit. Once any file has failed to be
+// written out, every call returns that error; the store should be restarted
+// to recover from what is on disk.
+func (store *DefaultGroupStore) syncWrites(ctx context.Context) error {
+	if store.durability != DurabilitySync {
+		return nil
+	}
+	store.syncState.lock.Lock()
+	if store.syncState.next == nil {
+		store.syncState.next = make(chan struct{})
+	}
+	done := store.syncState.next
+	if !store.syncState.running {
+		store.syncState.running = true
+		go store.syncer()
+	}
+	store.syncState.lock.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return ErrClosed
+	}
+	store.syncState.errLock.Lock()
+	err := store.syncState.err
+	store.syncState.errLock.Unlock()
+	return err
+}
+
+// syncer syncs for as long as there are writes waiting on syncWrites.
+func (store *DefaultGroupStore) syncer() {
+	for {
+		store.syncState.lock.Lock()
+		done := store.syncState.next
+		store.syncState.next = nil
+		if done == nil {
+			store.syncState.running = false
+			store.syncState.lock.Unlock()
+			return
+		}
+		store.syncState.lock.Unlock()
+		if atomic.LoadUint32(&store.closed) == 0 {
+			store.sync()
+			atomic.AddInt32(&store.syncs, 1)
+		}
+		close(done)
+	}
+}
+
+// durabilityFailed records err, from writing out a group or TOC file, as the
+// error syncWrites returns from now on.
+func (store *DefaultGroupStore) durabilityFailed(err error) {
+	store.syncState.errLock.Lock()
+	if store.syncState.err == nil {
+		store.syncState.err = err
+	}
+	store.syncState.errLock.Unlock()
+}
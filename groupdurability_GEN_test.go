@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGroupStoreDurability(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityFlush, DurabilitySync} {
+		fs := &syncCountingFS{MemFS: NewMemFS()}
+		newStore := func() *DefaultGroupStore {
+			return newGroupTestStore(t, "/store", func(cfg *GroupStoreConfig) {
+				cfg.FS = fs
+				cfg.Durability = durability
+			})
+		}
+		store := newStore()
+		wg := &sync.WaitGroup{}
+		for i := uint64(1); i <= 20; i++ {
+			wg.Add(1)
+			go func(i uint64) {
+				if _, err := store.Write(i, i, i, i, 1000, []byte("value")); err != nil {
+					t.Error(err)
+				}
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		syncs := atomic.LoadInt32(&fs.syncs)
+		stats := store.Stats(false).(*GroupStoreStats)
+		if durability == DurabilitySync {
+			// Every write is on stable storage, so another store can already
+			// recover them.
+			if syncs == 0 || stats.Syncs == 0 || stats.Syncs > 20 {
+				t.Fatal(durability, syncs, stats.Syncs)
+			}
+			other := newStore()
+			for i := uint64(1); i <= 20; i++ {
+				if ts, v, err := other.Read(i, i, i, i, nil); err != nil || ts != 1000 || string(v) != "value" {
+					t.Fatal(durability, i, ts, string(v), err)
+				}
+			}
+			other.Close()
+		} else if syncs != 0 || stats.Syncs != 0 {
+			t.Fatal(durability, syncs, stats.Syncs)
+		}
+		store.Flush()
+		syncs = atomic.LoadInt32(&fs.syncs)
+		dirSyncs := atomic.LoadInt32(&fs.dirSyncs)
+		if (durability == DurabilityNone) != (syncs == 0) || (durability == DurabilityNone) != (dirSyncs == 0) {
+			t.Fatal(durability, syncs, dirSyncs)
+		}
+		// Once a sync fails, synchronous writes keep failing.
+		fs.err = errors.New("sync failed")
+		_, err := store.Write(100, 100, 100, 100, 1000, []byte("value"))
+		if durability == DurabilitySync {
+			if err != fs.err {
+				t.Fatal(err)
+			}
+			if _, err := store.Write(101, 101, 101, 101, 1000, []byte("value")); err != fs.err {
+				t.Fatal(err)
+			}
+		} else if err != nil {
+			t.Fatal(durability, err)
+		}
+		store.Close()
+	}
+}
+
+func TestGroupStoreDurabilitySyncInPlace(t *testing.T) {
+	for _, tc := range []struct {
+		encrypted  bool
+		compressed bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		fs := &syncCountingFS{MemFS: NewMemFS()}
+		newStore := func() *DefaultGroupStore {
+			return newGroupTestStore(t, "/store", func(cfg *GroupStoreConfig) {
+				cfg.FS = fs
+				cfg.Durability = DurabilitySync
+				if tc.encrypted {
+					cfg.KeyProvider = &testGroupKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+				}
+				if tc.compressed {
+					cfg.CompressionLevel = 6
+				}
+			})
+		}
+		store := newStore()
+		// Each of these writes is synced on its own, but they should all
+		// still go to the same files.
+		for i := uint64(1); i <= 100; i++ {
+			if _, err := store.Write(i, i, i, i, 1000, []byte("value")); err != nil {
+				t.Fatal(tc, err)
+			}
+		}
+		if stats := store.Stats(false).(*GroupStoreStats); stats.Syncs != 100 {
+			t.Fatal(tc, stats.Syncs)
+		}
+		names, err := fs.ReadDirNames("/store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files, tocFiles int
+		for _, name := range names {
+			if strings.HasSuffix(name, ".group") {
+				files++
+			} else if strings.HasSuffix(name, ".grouptoc") {
+				tocFiles++
+			}
+		}
+		if files != 1 || tocFiles != 1 {
+			t.Fatal(tc, files, tocFiles)
+		}
+		// The files are still being written, but everything synced so far
+		// can be recovered from them.
+		other := newStore()
+		for i := uint64(1); i <= 100; i++ {
+			if ts, v, err := other.Read(i, i, i, i, nil); err != nil || ts != 1000 || string(v) != "value" {
+				t.Fatal(tc, i, ts, string(v), err)
+			}
+		}
+		other.Close()
+		store.Close()
+	}
+}
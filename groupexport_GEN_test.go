@@ -0,0 +1,86 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGroupExportImport(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func(name string) *DefaultGroupStore {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return newGroupTestStore(t, path.Join(dir, name), nil)
+	}
+	a := newStore("a")
+	defer a.Close()
+	for i := uint64(1); i <= 20; i++ {
+		if _, err := a.Write(i, i, i, i, 1000, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Delete(5, 5, 5, 5, 2000); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	n, err := a.Export(buf, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatal(n)
+	}
+	stream := append([]byte(nil), buf.Bytes()...)
+	b := newStore("b")
+	defer b.Close()
+	if _, err := b.Write(2, 2, 2, 2, 5000, []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = b.Import(bytes.NewReader(stream), ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatal(n)
+	}
+	if ts, v, err := b.Read(1, 1, 1, 1, nil); err != nil || ts != 1000 || !bytes.Equal(v, []byte{1}) {
+		t.Fatal(ts, v, err)
+	}
+	if ts, v, err := b.Read(2, 2, 2, 2, nil); err != nil || ts != 5000 || string(v) != "newer" {
+		t.Fatal(ts, v, err)
+	}
+	if ts, _, err := b.Lookup(5, 5, 5, 5); err != ErrNotFound || ts != 2000 {
+		t.Fatal(ts, err)
+	}
+	// Key range and timestamp window.
+	buf.Reset()
+	if n, err = a.Export(buf, ExportOptions{StartKeyA: 10, StopKeyA: 12}); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	if n, err = a.Export(ioutil.Discard, ExportOptions{MinTimestampMicro: 1500}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err = a.Export(ioutil.Discard, ExportOptions{SkipDeleted: true}); err != nil || n != 19 {
+		t.Fatal(n, err)
+	}
+	c := newStore("c")
+	defer c.Close()
+	if n, err = c.Import(bytes.NewReader(stream), ImportOptions{StartKeyA: 3, StopKeyA: 6, MaxTimestampMicro: 1000}); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	if _, _, err := c.Lookup(5, 5, 5, 5); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	// Damaged and truncated streams.
+	damaged := append([]byte(nil), stream...)
+	damaged[_GROUP_EXPORT_HEADER_SIZE+3] ^= 0xff
+	if _, err := c.Import(bytes.NewReader(damaged), ImportOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := c.Import(bytes.NewReader(stream[:len(stream)-20]), ImportOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
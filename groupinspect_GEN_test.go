@@ -0,0 +1,111 @@
+package store
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGroupInspect(t *testing.T) {
+	dir := t.TempDir()
+	// Each write goes to its own file, as newer writes still in memory
+	// would replace older ones before they ever reach disk.
+	for i := 0; i < 3; i++ {
+		store := newGroupTestStore(t, dir, nil)
+		switch i {
+		case 0:
+			if _, err := store.Write(1, 2, 3, 4, 1000, []byte("one")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Write(5, 6, 7, 8, 1000, []byte("other")); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if _, err := store.Write(1, 2, 3, 4, 2000, []byte("two")); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			if _, err := store.Delete(1, 2, 3, 4, 3000); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Move a group file to a second directory, as a store with more than one
+	// of Paths would have.
+	dir2 := t.TempDir()
+	names, err := filepath.Glob(path.Join(dir, "*.group"))
+	if err != nil || len(names) == 0 {
+		t.Fatal(names, err)
+	}
+	if err = os.Rename(names[0], path.Join(dir2, path.Base(names[0]))); err != nil {
+		t.Fatal(err)
+	}
+	files, err := InspectGroupFiles([]string{dir, dir2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := 0
+	inDir2 := 0
+	for _, file := range files {
+		if file.Name == "" || file.Size == 0 {
+			t.Fatal(file)
+		}
+		if strings.HasPrefix(file.Name, dir2) {
+			inDir2++
+		}
+		var n int
+		if errs := InspectGroupTOC(file.TOCName, nil, func(entry *GroupInspectEntry) { n++ }); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		if n != file.Entries {
+			t.Fatal(n, file.Entries)
+		}
+		entries += n
+	}
+	if len(files) != 3 || entries != 4 || inDir2 != 1 {
+		t.Fatal(len(files), entries, inDir2)
+	}
+	reports, err := FsckGroupStore([]string{dir, dir2}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			t.Fatal(report.Name, report.TOCName, report.Errors)
+		}
+	}
+	if len(reports) != 3 {
+		t.Fatal(len(reports))
+	}
+	history, errs := InspectGroupHistory([]string{dir, dir2}, "", nil, 1, 2, 3, 4, true)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(history) != 3 {
+		t.Fatal(len(history))
+	}
+	if history[0].TimestampMicro != 1000 || string(history[0].Value) != "one" || len(history[0].Flags) != 0 {
+		t.Fatal(history[0])
+	}
+	if history[1].TimestampMicro != 2000 || string(history[1].Value) != "two" {
+		t.Fatal(history[1])
+	}
+	if history[2].TimestampMicro != 3000 || history[2].Value != nil || len(history[2].Flags) != 1 || history[2].Flags[0] != "deletion" {
+		t.Fatal(history[2])
+	}
+	if resolved := ResolveGroupHistory(history); resolved != history[2] {
+		t.Fatal(resolved)
+	}
+	if resolved := ResolveGroupHistory(history[:2]); resolved != history[1] {
+		t.Fatal(resolved)
+	}
+	history[1].TimestampBits |= _TSB_LOCAL_REMOVAL
+	if resolved := ResolveGroupHistory(history[:2]); resolved != nil {
+		t.Fatal(resolved)
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// KeyedGroupStore wraps a GroupStore so that it may be used with []byte
+// keys and names rather than 128 bit keys; they are turned into
+// keyA, keyB and nameKeyA, nameKeyB with a Hasher.
+type KeyedGroupStore struct {
+	store            GroupStore
+	hasher           Hasher
+	detectCollisions bool
+}
+
+// NewKeyedGroupStore returns a KeyedGroupStore wrapping store; a nil hasher
+// will use Murmur3Hasher.
+//
+// If detectCollisions is true, the original key and name are stored along with
+// each value and Get will return ErrKeyCollision when they don't match what
+// was requested. This reduces the space available for the value itself by
+// the length of the key and name plus a few bytes. The same
+// detectCollisions setting must be used for the life of the stored data.
+func NewKeyedGroupStore(store GroupStore, hasher Hasher, detectCollisions bool) *KeyedGroupStore {
+	if hasher == nil {
+		hasher = Murmur3Hasher{}
+	}
+	return &KeyedGroupStore{store: store, hasher: hasher, detectCollisions: detectCollisions}
+}
+
+// Get returns timestampmicro, value, err for key, name; see GroupStore.Read.
+func (ks *KeyedGroupStore) Get(key []byte, name []byte) (int64, []byte, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	nameKeyA, nameKeyB := ks.hasher.Hash(name)
+
+	timestampmicro, value, err := ks.store.Read(keyA, keyB, nameKeyA, nameKeyB, nil)
+	if err != nil || !ks.detectCollisions {
+		return timestampmicro, value, err
+	}
+	for _, k := range [][]byte{key, name} {
+		n, i := binary.Uvarint(value)
+		if i <= 0 || n > uint64(len(value)-i) || !bytes.Equal(value[i:i+int(n)], k) {
+			return timestampmicro, nil, ErrKeyCollision
+		}
+		value = value[i+int(n):]
+	}
+	return timestampmicro, value, nil
+}
+
+// Put stores timestampmicro, value for key, name; see GroupStore.Write.
+func (ks *KeyedGroupStore) Put(key []byte, name []byte, timestampmicro int64, value []byte) (int64, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	nameKeyA, nameKeyB := ks.hasher.Hash(name)
+
+	if ks.detectCollisions {
+		v := make([]byte, 0, binary.MaxVarintLen64*2+len(key)+len(name)+len(value))
+		var scratch [binary.MaxVarintLen64]byte
+		for _, k := range [][]byte{key, name} {
+			v = append(v, scratch[:binary.PutUvarint(scratch[:], uint64(len(k)))]...)
+			v = append(v, k...)
+		}
+		value = append(v, value...)
+	}
+	return ks.store.Write(keyA, keyB, nameKeyA, nameKeyB, timestampmicro, value)
+}
+
+// Del marks key, name as deleted at timestampmicro; see GroupStore.Delete.
+func (ks *KeyedGroupStore) Del(key []byte, name []byte, timestampmicro int64) (int64, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	nameKeyA, nameKeyB := ks.hasher.Hash(name)
+
+	return ks.store.Delete(keyA, keyB, nameKeyA, nameKeyB, timestampmicro)
+}
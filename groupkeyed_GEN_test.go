@@ -0,0 +1,54 @@
+package store
+
+import (
+	"testing"
+)
+
+type constantGroupHasher struct{}
+
+func (constantGroupHasher) Hash(key []byte) (uint64, uint64) {
+	return 1, 2
+}
+
+func TestKeyedGroupStore(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	ks := NewKeyedGroupStore(store, nil, false)
+	if _, err := ks.Put([]byte("key"), []byte("name"), 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	timestampMicro, value, err := ks.Get([]byte("key"), []byte("name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 || string(value) != "testing" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	keyA, keyB := Murmur3Hasher{}.Hash([]byte("key"))
+
+	nameKeyA, nameKeyB := Murmur3Hasher{}.Hash([]byte("name"))
+
+	if _, value, err = store.Read(keyA, keyB, nameKeyA, nameKeyB, nil); err != nil || string(value) != "testing" {
+		t.Fatal(string(value), err)
+	}
+	if _, err := ks.Del([]byte("key"), []byte("name"), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ks.Get([]byte("key"), []byte("name")); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	ks = NewKeyedGroupStore(store, constantGroupHasher{}, true)
+	if _, err := ks.Put([]byte("one"), []byte("name"), 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, value, err = ks.Get([]byte("one"), []byte("name")); err != nil || string(value) != "testing" {
+		t.Fatal(string(value), err)
+	}
+	if _, _, err := ks.Get([]byte("two"), []byte("name")); err != ErrKeyCollision {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ks.Get([]byte("one"), []byte("other")); err != ErrKeyCollision {
+		t.Fatal(err)
+	}
+
+}
@@ -76,7 +76,7 @@ func (store *DefaultGroupStore) pullReplicationConfig(cfg *GroupStoreConfig) {
 // requests.
 func (store *DefaultGroupStore) EnableInPullReplication() {
 	store.pullReplicationState.inNotifyChanLock.Lock()
-	if store.pullReplicationState.inNotifyChan == nil {
+	if store.pullReplicationState.inNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.pullReplicationState.inNotifyChan = make(chan *bgNotification, 1)
 		go store.inPullReplicationLauncher(store.pullReplicationState.inNotifyChan)
 	}
@@ -124,7 +124,7 @@ func (store *DefaultGroupStore) OutPullReplicationPass() {
 // EnableOutPullReplication will resume outgoing pull replication requests.
 func (store *DefaultGroupStore) EnableOutPullReplication() {
 	store.pullReplicationState.outNotifyChanLock.Lock()
-	if store.pullReplicationState.outNotifyChan == nil {
+	if store.pullReplicationState.outNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.pullReplicationState.outNotifyChan = make(chan *bgNotification, 1)
 		go store.outPullReplicationLauncher(store.pullReplicationState.outNotifyChan)
 	}
@@ -254,7 +254,8 @@ func (store *DefaultGroupStore) inPullReplication(wg *sync.WaitGroup) {
 		// computed via its config.ReplicationIgnoreRecent setting. We want to
 		// use the exact same cutoff in our checks and possible response.
 		cutoff := prm.cutoff()
-		tombstoneCutoff := (uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS) - store.tombstoneDiscardState.age
+		nowmicro := brimtime.TimeToUnixMicro(time.Now())
+		tombstoneCutoff := (uint64(nowmicro) << _TSB_UTIL_BITS) - store.tombstoneDiscardState.age
 		ktbf := prm.ktBloomFilter()
 		l := int64(store.bulkSetState.msgCap)
 		callback := func(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, length uint32) bool {
@@ -304,7 +305,9 @@ func (store *DefaultGroupStore) inPullReplication(wg *sync.WaitGroup) {
 				} else if err != nil {
 					continue
 				}
-				if t&_TSB_LOCAL_REMOVAL == 0 {
+				// Expired values are left for the tombstone discard pass to
+				// replace with deletion markers, which will then be sent.
+				if t&_TSB_LOCAL_REMOVAL == 0 && !expiredValue(t, v, nowmicro) {
 					if !bsm.add(k[i], k[i+1], k[i+2], k[i+3], t, v) {
 						break
 					}
@@ -55,7 +55,7 @@ func (store *DefaultGroupStore) OutPushReplicationPass() {
 // EnableOutPushReplication will resume outgoing push replication requests.
 func (store *DefaultGroupStore) EnableOutPushReplication() {
 	store.pushReplicationState.outNotifyChanLock.Lock()
-	if store.pushReplicationState.outNotifyChan == nil {
+	if store.pushReplicationState.outNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.pushReplicationState.outNotifyChan = make(chan *bgNotification, 1)
 		go store.outPushReplicationLauncher(store.pushReplicationState.outNotifyChan)
 	}
@@ -165,7 +165,8 @@ func (store *DefaultGroupStore) outPushReplicationPass(notifyChan chan *bgNotifi
 				rangeEnd = math.MaxUint64
 			}
 		}
-		timestampbitsNow := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+		nowmicro := brimtime.TimeToUnixMicro(time.Now())
+		timestampbitsNow := uint64(nowmicro) << _TSB_UTIL_BITS
 		cutoff := timestampbitsNow - store.replicationIgnoreRecent
 		tombstoneCutoff := timestampbitsNow - store.tombstoneDiscardState.age
 		availableBytes := int64(store.bulkSetState.msgCap)
@@ -209,6 +210,11 @@ func (store *DefaultGroupStore) outPushReplicationPass(notifyChan chan *bgNotifi
 			} else if err != nil {
 				continue
 			}
+			// Expired values are left for the tombstone discard pass to
+			// replace with deletion markers, which will then be sent.
+			if expiredValue(timestampbits, valbuf, nowmicro) {
+				continue
+			}
 			if timestampbits&_TSB_LOCAL_REMOVAL == 0 && timestampbits < cutoff && (timestampbits&_TSB_DELETION == 0 || timestampbits >= tombstoneCutoff) {
 				if !bsm.add(list[i], list[i+1], list[i+2], list[i+3], timestampbits, valbuf) {
 					break
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"container/heap"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,8 +20,6 @@ import (
 
 	"github.com/gholt/locmap"
 	"github.com/gholt/ring"
-	"github.com/spaolacci/murmur3"
-	"gopkg.in/gholt/brimutil.v1"
 )
 
 // DefaultGroupStore instances are created with NewGroupStore.
@@ -40,21 +40,33 @@ type DefaultGroupStore struct {
 	pendingTOCBlockChan     chan []byte
 	activeTOCA              uint64
 	activeTOCB              uint64
+	flushLock               sync.Mutex
 	flushedChan             chan struct{}
+	syncedChan              chan struct{}
 	locBlocks               []groupLocBlock
 	locBlockIDer            uint64
 	path                    string
 	pathtoc                 string
+	paths                   []string
+	pathsByFreeSpace        bool
+	pathsNext               uint32
 	locmap                  locmap.GroupLocMap
 	workers                 int
 	recoveryBatchSize       int
+	recoveryReaders         int
 	valueCap                uint32
 	pageSize                uint32
 	minValueAlloc           int
 	writePagesPerWorker     int
 	fileCap                 uint32
 	fileReaders             int
+	mmapReads               bool
 	checksumInterval        uint32
+	compressionLevel        int
+	keyProvider             KeyProvider
+	fs                      FS
+	durability              Durability
+	syncState               groupSyncState
 	msgRing                 ring.MsgRing
 	tombstoneDiscardState   groupTombstoneDiscardState
 	auditState              groupAuditState
@@ -68,21 +80,50 @@ type DefaultGroupStore struct {
 	userDisabled            bool
 	flusherState            groupFlusherState
 	diskWatcherState        groupDiskWatcherState
+	checkpointState         groupCheckpointState
 	restartChan             chan error
+	closeLock               sync.Mutex
+	// snapshotLock is held by Snapshot while it gathers files; compaction and
+	// audit take a read lock while removing files.
+	snapshotLock      sync.RWMutex
+	closed            uint32
+	shutdownDoneChan  chan struct{}
+	subscriptionsLock sync.RWMutex
+	subscriptions     []*groupSubscription
+	subscriptionCount int32
 
 	statsLock                    sync.Mutex
 	lookups                      int32
 	lookupErrors                 int32
+	lookupTimeouts               int32
 	lookupGroups                 int32
 	lookupGroupItems             int32
+	lookupGroupPages             int32
+	readGroups                   int32
+	readGroupItems               int32
 	reads                        int32
 	readErrors                   int32
+	readTimeouts                 int32
+	readStreams                  int32
+	readStreamErrors             int32
 	writes                       int32
 	writeErrors                  int32
+	writeTimeouts                int32
 	writesOverridden             int32
+	writeBatches                 int32
+	writeIfs                     int32
+	writeIfErrors                int32
+	writeIfConflicts             int32
+	writeIfTimeouts              int32
+	writeStreams                 int32
+	writeStreamErrors            int32
 	deletes                      int32
 	deleteErrors                 int32
+	deleteTimeouts               int32
 	deletesOverridden            int32
+	deleteBatches                int32
+	deleteGroups                 int32
+	deleteGroupItems             int32
 	outBulkSets                  int32
 	outBulkSetValues             int32
 	outBulkSetPushes             int32
@@ -105,8 +146,19 @@ type DefaultGroupStore struct {
 	inPullReplicationDrops       int32
 	inPullReplicationInvalids    int32
 	expiredDeletions             int32
+	expiredValues                int32
+	droppedChanges               int32
 	compactions                  int32
 	smallFileCompactions         int32
+	rekeyCompactions             int32
+	snapshots                    int32
+	recoveryTOCFiles             int64
+	recoveryKeyLocations         int64
+	recoveryDuration             int64
+	checkpoints                  int32
+	syncs                        int32
+	compressedBytes              uint64
+	uncompressedBytes            uint64
 
 	// Used by the flusher only
 	modifications int32
@@ -123,12 +175,36 @@ type groupWriteReq struct {
 	value         []byte
 	errChan       chan error
 	internal      bool
+	// conditional indicates the write should only be applied if the current
+	// timestamp matches expectedbits; see WriteIfContext.
+	conditional  bool
+	expectedbits uint64
+	// replicated indicates the write came from another store; see
+	// writeReplicated.
+	replicated bool
+	// otimestampbits and omanifest are for the stream manifest this write
+	// would replace, if any; see supersededStreamManifest.
+	otimestampbits uint64
+	omanifest      []byte
 }
 
+// _GROUP_RECOVERY_PROGRESS_INTERVAL is how often recovery logs its
+// progress.
+const _GROUP_RECOVERY_PROGRESS_INTERVAL = 10 * time.Second
+
 var enableGroupWriteReq *groupWriteReq = &groupWriteReq{}
 var disableGroupWriteReq *groupWriteReq = &groupWriteReq{}
 var flushGroupWriteReq *groupWriteReq = &groupWriteReq{}
+var syncGroupWriteReq *groupWriteReq = &groupWriteReq{}
+var shutdownGroupWriteReq *groupWriteReq = &groupWriteReq{}
 var flushGroupMemBlock *groupMemBlock = &groupMemBlock{}
+var syncGroupMemBlock *groupMemBlock = &groupMemBlock{}
+var shutdownGroupMemBlock *groupMemBlock = &groupMemBlock{}
+
+// syncGroupTOCBlock is passed on to the tocWriter by each memClearer that
+// reaches a sync; it is told apart by its length as real TOC blocks always
+// have an entry after their 8 byte timestamp.
+var syncGroupTOCBlock []byte = make([]byte, 8)
 
 type groupLocBlock interface {
 	timestampnano() int64
@@ -148,9 +224,8 @@ type groupLocBlock interface {
 // bad entries due to the corruption.
 //
 // Note that a lot of buffering, multiple cores, and background processes can
-// be in use and therefore DisableAll() and Flush() should be called prior to
-// the process exiting to ensure all processing is done and the buffers are
-// flushed.
+// be in use and therefore Close() should be called prior to the process
+// exiting to ensure all processing is done and the buffers are flushed.
 func NewGroupStore(c *GroupStoreConfig) (*DefaultGroupStore, chan error, error) {
 	cfg := resolveGroupStoreConfig(c)
 	lcmap := cfg.GroupLocMap
@@ -167,10 +242,14 @@ func NewGroupStore(c *GroupStoreConfig) (*DefaultGroupStore, chan error, error)
 		rand:                    cfg.Rand,
 		locBlocks:               make([]groupLocBlock, math.MaxUint16),
 		path:                    cfg.Path,
+		paths:                   cfg.Paths,
+		pathsByFreeSpace:        cfg.PathsByFreeSpace,
+		pathsNext:               uint32(cfg.Rand.Intn(len(cfg.Paths))),
 		pathtoc:                 cfg.PathTOC,
 		locmap:                  lcmap,
 		workers:                 cfg.Workers,
 		recoveryBatchSize:       cfg.RecoveryBatchSize,
+		recoveryReaders:         cfg.RecoveryReaders,
 		replicationIgnoreRecent: (uint64(cfg.ReplicationIgnoreRecent) * uint64(time.Second) / 1000) << _TSB_UTIL_BITS,
 		valueCap:                uint32(cfg.ValueCap),
 		pageSize:                uint32(cfg.PageSize),
@@ -178,9 +257,15 @@ func NewGroupStore(c *GroupStoreConfig) (*DefaultGroupStore, chan error, error)
 		writePagesPerWorker:     cfg.WritePagesPerWorker,
 		fileCap:                 uint32(cfg.FileCap),
 		fileReaders:             cfg.FileReaders,
+		mmapReads:               cfg.MmapReads,
 		checksumInterval:        uint32(cfg.ChecksumInterval),
+		compressionLevel:        cfg.CompressionLevel,
+		keyProvider:             cfg.KeyProvider,
+		fs:                      cfg.FS,
+		durability:              cfg.Durability,
 		msgRing:                 cfg.MsgRing,
 		restartChan:             make(chan error),
+		shutdownDoneChan:        make(chan struct{}),
 	}
 	store.freeableMemBlockChans = make([]chan *groupMemBlock, store.workers)
 	for i := 0; i < cap(store.freeableMemBlockChans); i++ {
@@ -193,6 +278,7 @@ func NewGroupStore(c *GroupStoreConfig) (*DefaultGroupStore, chan error, error)
 	store.freeTOCBlockChan = make(chan []byte, store.workers*2)
 	store.pendingTOCBlockChan = make(chan []byte, store.workers)
 	store.flushedChan = make(chan struct{}, 1)
+	store.syncedChan = make(chan struct{}, 1)
 	for i := 0; i < cap(store.freeMemBlockChan); i++ {
 		memBlock := &groupMemBlock{
 			store:  store,
@@ -235,6 +321,7 @@ func NewGroupStore(c *GroupStoreConfig) (*DefaultGroupStore, chan error, error)
 	store.bulkSetAckConfig(cfg)
 	store.flusherConfig(cfg)
 	store.diskWatcherConfig(cfg)
+	store.checkpointConfig(cfg)
 	err := store.recovery()
 	if err != nil {
 		return nil, nil, err
@@ -265,6 +352,7 @@ func (store *DefaultGroupStore) DisableAllBackground() {
 		store.DisableInBulkSet,
 		store.DisableInBulkSetAck,
 		store.DisableTombstoneDiscard,
+		store.DisableCheckpointer,
 	} {
 		wg.Add(1)
 		go func(ii int, ff func()) {
@@ -276,6 +364,9 @@ func (store *DefaultGroupStore) DisableAllBackground() {
 }
 
 func (store *DefaultGroupStore) EnableAll() {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return
+	}
 	wg := &sync.WaitGroup{}
 	for _, f := range []func(){
 		store.EnableWrites,
@@ -289,6 +380,7 @@ func (store *DefaultGroupStore) EnableAll() {
 		store.EnableAudit,
 		store.EnableFlusher,
 		store.EnableDiskWatcher,
+		store.EnableCheckpointer,
 	} {
 		wg.Add(1)
 		go func(ff func()) {
@@ -307,6 +399,10 @@ func (store *DefaultGroupStore) DisableWrites() {
 
 func (store *DefaultGroupStore) disableWrites(userCall bool) {
 	store.disableEnableWritesLock.Lock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		store.disableEnableWritesLock.Unlock()
+		return
+	}
 	if userCall {
 		store.userDisabled = true
 	}
@@ -323,6 +419,10 @@ func (store *DefaultGroupStore) EnableWrites() {
 
 func (store *DefaultGroupStore) enableWrites(userCall bool) {
 	store.disableEnableWritesLock.Lock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		store.disableEnableWritesLock.Unlock()
+		return
+	}
 	if userCall || !store.userDisabled {
 		store.userDisabled = false
 		for _, c := range store.pendingWriteReqChans {
@@ -333,23 +433,114 @@ func (store *DefaultGroupStore) enableWrites(userCall bool) {
 }
 
 // Flush will ensure buffered data (at the time of the call) is written to
-// disk.
+// disk. With DurabilityNone that means handed to the operating system; with
+// DurabilityFlush or DurabilitySync the files are also fsynced before Flush
+// returns.
 func (store *DefaultGroupStore) Flush() {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return
+	}
+	store.flush()
+}
+
+func (store *DefaultGroupStore) flush() {
+	// Flushes and syncs are done one at a time; the stages of the write
+	// pipeline count their requests and interleaved ones could be
+	// miscounted.
+	store.flushLock.Lock()
+	defer store.flushLock.Unlock()
 	for _, c := range store.pendingWriteReqChans {
 		c <- flushGroupWriteReq
 	}
 	<-store.flushedChan
 }
 
+// Close will disable all background tasks, flush any buffered data to disk,
+// and then stop all the internal goroutines and close all open files. Once
+// closed, the store should be discarded; calls that would need the store to be
+// open will return ErrClosed or do nothing.
+//
+// Close should not be called while other calls to the store are in progress.
+func (store *DefaultGroupStore) Close() error {
+	store.closeLock.Lock()
+	defer store.closeLock.Unlock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return ErrClosed
+	}
+	store.DisableAll()
+	// Subscriptions are canceled before flushing so a blocking subscriber
+	// that has stopped receiving can't stall the flush.
+	store.unsubscribeAll()
+	store.Flush()
+	if store.msgRing != nil {
+		store.msgRing.SetMsgHandler(_GROUP_BULK_SET_MSG_TYPE, nil)
+		store.msgRing.SetMsgHandler(_GROUP_BULK_SET_ACK_MSG_TYPE, nil)
+		store.msgRing.SetMsgHandler(_GROUP_PULL_REPLICATION_MSG_TYPE, nil)
+	}
+	store.disableEnableWritesLock.Lock()
+	atomic.StoreUint32(&store.closed, 1)
+	store.disableEnableWritesLock.Unlock()
+	// Each Enable* checks closed under its own lock, so disabling again stops
+	// anything enabled since DisableAll and nothing can be enabled after.
+	store.DisableAllBackground()
+	// Since everything has been flushed, each stage of the write pipeline is
+	// idle and can be shut down in order.
+	for _, c := range store.pendingWriteReqChans {
+		c <- shutdownGroupWriteReq
+	}
+	for range store.pendingWriteReqChans {
+		<-store.shutdownDoneChan
+	}
+	store.fileMemBlockChan <- shutdownGroupMemBlock
+	<-store.shutdownDoneChan
+	for _, c := range store.freeableMemBlockChans {
+		c <- shutdownGroupMemBlock
+	}
+	for range store.freeableMemBlockChans {
+		<-store.shutdownDoneChan
+	}
+	close(store.pendingTOCBlockChan)
+	<-store.shutdownDoneChan
+	var reterr error
+	for _, block := range store.locBlocks {
+		if block == nil {
+			continue
+		}
+		if err := block.close(); err != nil && reterr == nil {
+			reterr = err
+		}
+	}
+	return reterr
+}
+
 // Lookup will return timestampmicro, length, err for keyA, keyB, nameKeyA, nameKeyB.
 //
 // Note that err == ErrNotFound with timestampmicro == 0 indicates keyA, keyB, nameKeyA, nameKeyB
 // was not known at all whereas err == ErrNotFound with timestampmicro != 0
 // indicates keyA, keyB, nameKeyA, nameKeyB
-// was known and had a deletion marker (aka tombstone).
+// was known and had a deletion marker (aka tombstone). Values written with
+// WriteStream give ErrStream along with their timestampmicro.
 func (store *DefaultGroupStore) Lookup(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (int64, uint32, error) {
+	return store.LookupContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB)
+}
+
+// LookupContext is the same as Lookup but will return ctx.Err() instead if
+// ctx is done before the lookup begins.
+func (store *DefaultGroupStore) LookupContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (int64, uint32, error) {
 	atomic.AddInt32(&store.lookups, 1)
-	timestampbits, _, length, err := store.lookup(keyA, keyB, nameKeyA, nameKeyB)
+	if err := ctx.Err(); err != nil {
+		atomic.AddInt32(&store.lookupTimeouts, 1)
+		return 0, 0, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.lookupErrors, 1)
+		return 0, 0, ErrClosed
+	}
+	timestampbits, length, err := store.lookupUnexpired(keyA, keyB, nameKeyA, nameKeyB)
+	if err == nil && timestampbits&_TSB_MANIFEST != 0 {
+		length = 0
+		err = ErrStream
+	}
 	if err != nil {
 		atomic.AddInt32(&store.lookupErrors, 1)
 	}
@@ -369,27 +560,444 @@ type LookupGroupItem struct {
 	NameKeyB       uint64
 	TimestampMicro uint64
 	Length         uint32
+	// Stream is set for values written with WriteStream, which have to be
+	// read with ReadStream; Length is 0 for these.
+	Stream bool
 }
 
 // LookupGroup returns all the nameKeyA, nameKeyB, TimestampMicro items
 // matching under keyA, keyB.
 func (store *DefaultGroupStore) LookupGroup(keyA uint64, keyB uint64) []LookupGroupItem {
 	atomic.AddInt32(&store.lookupGroups, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return nil
+	}
 	items := store.locmap.GetGroup(keyA, keyB)
 	if len(items) == 0 {
 		return nil
 	}
 	atomic.AddInt32(&store.lookupGroupItems, int32(len(items)))
-	rv := make([]LookupGroupItem, len(items))
-	for i, item := range items {
-		rv[i].NameKeyA = item.NameKeyA
-		rv[i].NameKeyB = item.NameKeyB
-		rv[i].TimestampMicro = item.Timestamp >> _TSB_UTIL_BITS
-		rv[i].Length = item.Length
+	rv := make([]LookupGroupItem, 0, len(items))
+	for _, item := range items {
+		length := item.Length
+		if item.Timestamp&_TSB_EXPIRES != 0 && item.Timestamp&_TSB_DELETION == 0 {
+			if expired, err := store.expired(keyA, keyB, item.NameKeyA, item.NameKeyB, item.Timestamp, item.BlockID, item.Offset); err != nil || expired {
+				continue
+			}
+			length -= _EXPIRES_LENGTH
+		}
+		stream := item.Timestamp&_TSB_MANIFEST != 0
+		if stream {
+			length = 0
+		}
+		rv = append(rv, LookupGroupItem{
+			NameKeyA:       item.NameKeyA,
+			NameKeyB:       item.NameKeyB,
+			TimestampMicro: item.Timestamp >> _TSB_UTIL_BITS,
+			Length:         length,
+			Stream:         stream,
+		})
 	}
 	return rv
 }
 
+// LookupGroupPage returns up to limit items matching under keyA, keyB ordered
+// by nameKeyA, nameKeyB, along with a cursor to pass in to get the next page;
+// a nil cursor starts at the beginning and a nil next cursor indicates there
+// are no more items. Unlike LookupGroup, memory use is bounded by limit rather
+// than by the size of the group, so this is suited to very large groups.
+//
+// The locmap doesn't keep items in nameKey order, so each page still has to
+// pass over the whole group to find the limit items following the cursor;
+// but only those are kept and sorted, each other item costing a single
+// comparison.
+//
+// Expired values are discarded after the page is chosen, so fewer than limit
+// items may be returned even when there are more pages.
+func (store *DefaultGroupStore) LookupGroupPage(keyA uint64, keyB uint64, cursor []byte, limit int) ([]LookupGroupItem, []byte, error) {
+	atomic.AddInt32(&store.lookupGroupPages, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return nil, nil, ErrClosed
+	}
+	if limit < 1 {
+		return nil, nil, fmt.Errorf("limit %d < 1", limit)
+	}
+	var afterA, afterB uint64
+	if cursor != nil {
+		if len(cursor) != 16 {
+			return nil, nil, fmt.Errorf("invalid cursor of length %d", len(cursor))
+		}
+		afterA = binary.BigEndian.Uint64(cursor)
+		afterB = binary.BigEndian.Uint64(cursor[8:])
+	}
+	// entries is kept as a heap with the highest nameKey first, so once it
+	// holds limit items anything not below that one can be skipped.
+	entries := make(groupNameKeyHeap, 0, limit)
+	more := false
+	store.locmap.ScanCallback(keyA, keyA, 0, _TSB_INACTIVE, math.MaxUint64, math.MaxUint64, func(keyA2 uint64, keyB2 uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, length uint32) bool {
+		if keyB2 != keyB {
+			return true
+		}
+		if cursor != nil && (nameKeyA < afterA || (nameKeyA == afterA && nameKeyB <= afterB)) {
+			return true
+		}
+		e := groupScanEntry{keyA: keyA2, keyB: keyB2, nameKeyA: nameKeyA, nameKeyB: nameKeyB, timestampbits: timestampbits, length: length}
+		if len(entries) < limit {
+			heap.Push(&entries, e)
+			return true
+		}
+		more = true
+		if nameKeyLess(&e, &entries[0]) {
+			entries[0] = e
+			heap.Fix(&entries, 0)
+		}
+		return true
+	})
+	sort.Slice(entries, func(i int, j int) bool {
+		return nameKeyLess(&entries[i], &entries[j])
+	})
+	if len(entries) == 0 {
+		return nil, nil, nil
+	}
+	var next []byte
+	if more {
+		last := &entries[len(entries)-1]
+		next = make([]byte, 16)
+		binary.BigEndian.PutUint64(next, last.nameKeyA)
+		binary.BigEndian.PutUint64(next[8:], last.nameKeyB)
+	}
+	atomic.AddInt32(&store.lookupGroupItems, int32(len(entries)))
+	rv := make([]LookupGroupItem, 0, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		length := e.length
+		if e.timestampbits&_TSB_EXPIRES != 0 {
+			_, id, offset, _ := store.locmap.Get(keyA, keyB, e.nameKeyA, e.nameKeyB)
+			if expired, err := store.expired(keyA, keyB, e.nameKeyA, e.nameKeyB, e.timestampbits, id, offset); err != nil || expired {
+				continue
+			}
+			length -= _EXPIRES_LENGTH
+		}
+		stream := e.timestampbits&_TSB_MANIFEST != 0
+		if stream {
+			length = 0
+		}
+		rv = append(rv, LookupGroupItem{
+			NameKeyA:       e.nameKeyA,
+			NameKeyB:       e.nameKeyB,
+			TimestampMicro: e.timestampbits >> _TSB_UTIL_BITS,
+			Length:         length,
+			Stream:         stream,
+		})
+	}
+	return rv, next, nil
+}
+
+// groupNameKeyHeap is a container/heap of scan entries with the highest
+// nameKeyA, nameKeyB at the top.
+type groupNameKeyHeap []groupScanEntry
+
+func (h groupNameKeyHeap) Len() int {
+	return len(h)
+}
+
+func (h groupNameKeyHeap) Less(i int, j int) bool {
+	return nameKeyLess(&h[j], &h[i])
+}
+
+func (h groupNameKeyHeap) Swap(i int, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *groupNameKeyHeap) Push(x interface{}) {
+	*h = append(*h, x.(groupScanEntry))
+}
+
+func (h *groupNameKeyHeap) Pop() interface{} {
+	e := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return e
+}
+
+func nameKeyLess(x *groupScanEntry, y *groupScanEntry) bool {
+	if x.nameKeyA != y.nameKeyA {
+		return x.nameKeyA < y.nameKeyA
+	}
+	return x.nameKeyB < y.nameKeyB
+}
+
+// GroupSize returns the number of items under keyA, keyB without gathering
+// them. Values written with WriteWithTTL are counted until their expirations
+// are processed by the tombstone discard pass.
+func (store *DefaultGroupStore) GroupSize(keyA uint64, keyB uint64) int {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return 0
+	}
+	count := 0
+	store.locmap.ScanCallback(keyA, keyA, 0, _TSB_INACTIVE, math.MaxUint64, math.MaxUint64, func(keyA2 uint64, keyB2 uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, length uint32) bool {
+		if keyB2 == keyB {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// ReadGroupOptions is given to ReadGroup to restrict which items are
+// returned.
+type ReadGroupOptions struct {
+	// Offset is the number of items to skip and Limit is the maximum number of
+	// items to return, 0 meaning no limit; items are ordered by nameKeyA,
+	// nameKeyB.
+	Offset int
+	Limit  int
+	// MaxValueLength, if not 0, causes values longer than it to not be read;
+	// such items are still returned but with a nil Value.
+	MaxValueLength uint32
+}
+
+type GroupItem struct {
+	NameKeyA       uint64
+	NameKeyB       uint64
+	TimestampMicro uint64
+	Length         uint32
+	Value          []byte
+	// Stream is set for values written with WriteStream, which have to be
+	// read with ReadStream; Length is 0 and Value nil for these.
+	Stream bool
+}
+
+type groupReadGroupEntry struct {
+	index         int
+	timestampbits uint64
+	blockID       uint32
+	offset        uint32
+	length        uint32
+	value         []byte
+}
+
+// ReadGroup returns all the items matching under keyA, keyB along with their
+// values, ordered by nameKeyA, nameKeyB. The values are read in the order
+// they are stored on disk, so values in the same file are read sequentially.
+// Values written with WriteStream are not read; their items have Stream set
+// instead.
+//
+// Offset and Limit are applied before expired values are discarded, so fewer
+// than Limit items may be returned even when more exist.
+func (store *DefaultGroupStore) ReadGroup(keyA uint64, keyB uint64, opts ReadGroupOptions) ([]GroupItem, error) {
+	atomic.AddInt32(&store.readGroups, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return nil, ErrClosed
+	}
+	items := store.locmap.GetGroup(keyA, keyB)
+	sort.Slice(items, func(i int, j int) bool {
+		if items[i].NameKeyA != items[j].NameKeyA {
+			return items[i].NameKeyA < items[j].NameKeyA
+		}
+		return items[i].NameKeyB < items[j].NameKeyB
+	})
+	if opts.Offset > 0 {
+		if opts.Offset >= len(items) {
+			return nil, nil
+		}
+		items = items[opts.Offset:]
+	}
+	if opts.Limit > 0 && len(items) > opts.Limit {
+		items = items[:opts.Limit]
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	atomic.AddInt32(&store.readGroupItems, int32(len(items)))
+	rv := make([]GroupItem, len(items))
+	discard := make([]bool, len(items))
+	entries := make([]groupReadGroupEntry, 0, len(items))
+	for i, item := range items {
+		rv[i] = GroupItem{
+			NameKeyA:       item.NameKeyA,
+			NameKeyB:       item.NameKeyB,
+			TimestampMicro: item.Timestamp >> _TSB_UTIL_BITS,
+			Length:         item.Length,
+		}
+		if item.Timestamp&_TSB_EXPIRES != 0 {
+			rv[i].Length -= _EXPIRES_LENGTH
+		}
+		if item.Timestamp&_TSB_MANIFEST != 0 {
+			rv[i].Length = 0
+			rv[i].Stream = true
+			continue
+		}
+		if opts.MaxValueLength > 0 && rv[i].Length > opts.MaxValueLength {
+			// The value won't be read, so expiration has to be checked
+			// separately.
+			if item.Timestamp&_TSB_EXPIRES != 0 {
+				if expired, err := store.expired(keyA, keyB, item.NameKeyA, item.NameKeyB, item.Timestamp, item.BlockID, item.Offset); err != nil || expired {
+					discard[i] = true
+				}
+			}
+			continue
+		}
+		entries = append(entries, groupReadGroupEntry{
+			index:         i,
+			timestampbits: item.Timestamp,
+			blockID:       item.BlockID,
+			offset:        item.Offset,
+			length:        item.Length,
+		})
+	}
+	sort.Slice(entries, func(i int, j int) bool {
+		if entries[i].blockID != entries[j].blockID {
+			return entries[i].blockID < entries[j].blockID
+		}
+		return entries[i].offset < entries[j].offset
+	})
+	for len(entries) > 0 {
+		run := 1
+		for run < len(entries) && entries[run].blockID == entries[0].blockID {
+			run++
+		}
+		block := store.locBlock(entries[0].blockID)
+		if fl, ok := block.(*groupStoreFile); ok {
+			if err := fl.readGroup(keyA, entries[:run]); err != nil {
+				return nil, err
+			}
+		} else {
+			// Memory blocks are cheap to read from and may have had their
+			// contents moved to disk, so each entry is looked up again.
+			for j := 0; j < run; j++ {
+				e := &entries[j]
+				var err error
+				e.timestampbits, e.value, err = block.read(keyA, keyB, rv[e.index].NameKeyA, rv[e.index].NameKeyB, e.timestampbits, e.offset, e.length, nil)
+				if err == ErrNotFound {
+					discard[e.index] = true
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		for j := 0; j < run; j++ {
+			e := &entries[j]
+			if discard[e.index] {
+				continue
+			}
+			var ok bool
+			if e.value, ok = store.unexpiredValue(e.timestampbits, e.value); !ok {
+				discard[e.index] = true
+				continue
+			}
+			rv[e.index].TimestampMicro = e.timestampbits >> _TSB_UTIL_BITS
+			rv[e.index].Length = uint32(len(e.value))
+			rv[e.index].Value = e.value
+		}
+		entries = entries[run:]
+	}
+	j := 0
+	for i := range rv {
+		if !discard[i] {
+			rv[j] = rv[i]
+			j++
+		}
+	}
+	return rv[:j], nil
+}
+
+// _GROUP_DELETION_NAME_KEY is the nameKeyA and nameKeyB of the deletion
+// marker DeleteGroup writes for the whole group.
+const _GROUP_DELETION_NAME_KEY = math.MaxUint64
+
+// DeleteGroup writes deletion markers (aka tombstones) with timestampmicro for
+// every item under keyA, keyB that is older than timestampmicro, returning the
+// number of items removed. Items written concurrently with a newer
+// timestampmicro are left intact, just as with Delete, and the deletion
+// markers are replicated like any others.
+//
+// A deletion marker for the group as a whole is also kept, under the reserved
+// nameKeyA, nameKeyB of math.MaxUint64, math.MaxUint64, for as long as any
+// other deletion marker is; writes and deletes of that item itself give
+// ErrReservedName. Items older than timestampmicro that arrive later,
+// whether written concurrently with DeleteGroup or replicated in from a store
+// that had not yet seen the deletion, are deleted as they are stored.
+func (store *DefaultGroupStore) DeleteGroup(keyA uint64, keyB uint64, timestampmicro int64) (int, error) {
+	atomic.AddInt32(&store.deleteGroups, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return 0, ErrClosed
+	}
+	if timestampmicro < TIMESTAMPMICRO_MIN {
+		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+	}
+	if timestampmicro > TIMESTAMPMICRO_MAX {
+		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+	}
+	// The group marker goes in before the items are gathered: a racing write
+	// either stores its item in time to be gathered or finds the marker once
+	// stored; see groupWritten.
+	if _, err := store.write(keyA, keyB, _GROUP_DELETION_NAME_KEY, _GROUP_DELETION_NAME_KEY, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true); err != nil {
+		return 0, err
+	}
+	count, err := store.deleteGroupMembers(keyA, keyB, timestampmicro)
+	if err == nil && count == 0 {
+		// Otherwise the batch's sync covered the group marker as well.
+		err = store.syncWrites(context.Background())
+	}
+	return count, err
+}
+
+// deleteGroupMembers writes deletion markers with timestampmicro for every
+// item under keyA, keyB older than timestampmicro, returning how many were
+// removed.
+func (store *DefaultGroupStore) deleteGroupMembers(keyA uint64, keyB uint64, timestampmicro int64) (int, error) {
+	var entries []GroupBatchEntry
+	for _, item := range store.locmap.GetGroup(keyA, keyB) {
+		if item.NameKeyA == _GROUP_DELETION_NAME_KEY && item.NameKeyB == _GROUP_DELETION_NAME_KEY {
+			continue
+		}
+		if int64(item.Timestamp>>_TSB_UTIL_BITS) < timestampmicro {
+			entries = append(entries, GroupBatchEntry{KeyA: keyA, KeyB: keyB, NameKeyA: item.NameKeyA, NameKeyB: item.NameKeyB, TimestampMicro: timestampmicro})
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	var count int
+	var reterr error
+	for _, result := range store.batch(entries, true) {
+		if result.Err != nil {
+			if reterr == nil {
+				reterr = result.Err
+			}
+		} else if result.TimestampMicro < timestampmicro {
+			count++
+		}
+	}
+	atomic.AddInt32(&store.deleteGroupItems, int32(count))
+	return count, reterr
+}
+
+// groupWritten is called once timestampbits has been stored for keyA, keyB,
+// nameKeyA, nameKeyB and enforces any group deletion marker: an item no newer
+// than the marker is deleted, and a marker replicated in from another store
+// deletes the older items here.
+func (store *DefaultGroupStore) groupWritten(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, replicated bool) {
+	if nameKeyA == _GROUP_DELETION_NAME_KEY && nameKeyB == _GROUP_DELETION_NAME_KEY {
+		if replicated && timestampbits&_TSB_DELETION != 0 && timestampbits&_TSB_LOCAL_REMOVAL == 0 {
+			if _, err := store.deleteGroupMembers(keyA, keyB, int64(timestampbits>>_TSB_UTIL_BITS)); err != nil {
+				store.logError("error applying replicated group deletion: %s\n", err)
+			}
+		}
+		return
+	}
+	if timestampbits&(_TSB_DELETION|_TSB_LOCAL_REMOVAL|_TSB_COMPACTION_REWRITE) != 0 {
+		return
+	}
+	markerbits, _, _, _ := store.locmap.Get(keyA, keyB, _GROUP_DELETION_NAME_KEY, _GROUP_DELETION_NAME_KEY)
+	if markerbits&_TSB_DELETION == 0 || markerbits&_TSB_LOCAL_REMOVAL != 0 || markerbits>>_TSB_UTIL_BITS < timestampbits>>_TSB_UTIL_BITS {
+		return
+	}
+	if _, err := store.write(keyA, keyB, nameKeyA, nameKeyB, (markerbits>>_TSB_UTIL_BITS<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true); err != nil {
+		store.logError("error applying group deletion: %s\n", err)
+	}
+}
+
 // Read will return timestampmicro, value, err for keyA, keyB, nameKeyA, nameKeyB;
 // if an incoming value is provided, the read value will be appended to it and
 // the whole returned (useful to reuse an existing []byte).
@@ -397,15 +1005,93 @@ func (store *DefaultGroupStore) LookupGroup(keyA uint64, keyB uint64) []LookupGr
 // Note that err == ErrNotFound with timestampmicro == 0 indicates keyA, keyB, nameKeyA, nameKeyB
 // was not known at all whereas err == ErrNotFound with timestampmicro != 0
 // indicates keyA, keyB, nameKeyA, nameKeyB was known and had a deletion marker (aka tombstone).
+// Values written with WriteStream give ErrStream along with their
+// timestampmicro; use ReadStream or ReadTo for those.
 func (store *DefaultGroupStore) Read(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (int64, []byte, error) {
+	return store.ReadContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, value)
+}
+
+// ReadContext is the same as Read but will return ctx.Err() instead if ctx
+// is done before the read begins.
+func (store *DefaultGroupStore) ReadContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (int64, []byte, error) {
 	atomic.AddInt32(&store.reads, 1)
-	timestampbits, value, err := store.read(keyA, keyB, nameKeyA, nameKeyB, value)
+	if err := ctx.Err(); err != nil {
+		atomic.AddInt32(&store.readTimeouts, 1)
+		return 0, value, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.readErrors, 1)
+		return 0, value, ErrClosed
+	}
+	start := len(value)
+	timestampbits, value, err := store.readUnexpired(keyA, keyB, nameKeyA, nameKeyB, value)
+	if err == nil && timestampbits&_TSB_MANIFEST != 0 {
+		value = value[:start]
+		err = ErrStream
+	}
 	if err != nil {
 		atomic.AddInt32(&store.readErrors, 1)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), value, err
 }
 
+// ReadTo is the same as Read except that the value is written to w rather than
+// returned. For values already flushed to disk, the value is copied from the
+// file in pieces so the whole value is never held in memory at once; values
+// still in memory are written from a copy. Values written with WriteStream are
+// also written to w in full.
+//
+// Any error from w is returned as is, in which case part of the value may have
+// already been written.
+func (store *DefaultGroupStore) ReadTo(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, w io.Writer) (int64, error) {
+	atomic.AddInt32(&store.reads, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.readErrors, 1)
+		return 0, ErrClosed
+	}
+	timestampbits, err := store.readTo(keyA, keyB, nameKeyA, nameKeyB, w)
+	if err != nil {
+		atomic.AddInt32(&store.readErrors, 1)
+	}
+	return int64(timestampbits >> _TSB_UTIL_BITS), err
+}
+
+func (store *DefaultGroupStore) readTo(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, w io.Writer) (uint64, error) {
+	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB, nameKeyA, nameKeyB)
+	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+		return timestampbits, ErrNotFound
+	}
+	if timestampbits&_TSB_MANIFEST != 0 {
+		rc, err := store.ReadStream(keyA, keyB, nameKeyA, nameKeyB)
+		if err != nil {
+			return timestampbits, err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		return timestampbits, err
+	}
+	fl, ok := store.locBlock(id).(*groupStoreFile)
+	if !ok {
+		timestampbits, value, err := store.readUnexpired(keyA, keyB, nameKeyA, nameKeyB, nil)
+		if err != nil {
+			return timestampbits, err
+		}
+		_, err = w.Write(value)
+		return timestampbits, err
+	}
+	if timestampbits&_TSB_EXPIRES != 0 {
+		expired, err := store.expired(keyA, keyB, nameKeyA, nameKeyB, timestampbits, id, offset)
+		if err != nil {
+			return timestampbits, err
+		}
+		if expired {
+			return timestampbits, ErrNotFound
+		}
+		return timestampbits, fl.readTo(keyA, offset, length, _EXPIRES_LENGTH, w)
+	}
+	return timestampbits, fl.readTo(keyA, offset, length, 0, w)
+}
+
 func (store *DefaultGroupStore) read(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (uint64, []byte, error) {
 	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB, nameKeyA, nameKeyB)
 	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
@@ -418,8 +1104,16 @@ func (store *DefaultGroupStore) read(keyA uint64, keyB uint64, nameKeyA uint64,
 // and returns the previously stored timestampmicro or returns any error; a
 // newer timestampmicro already in place is not reported as an error. Note that
 // with a write and a delete for the exact same timestampmicro, the delete
-// wins.
+// wins. With DurabilitySync, Write waits until the value is on stable storage.
 func (store *DefaultGroupStore) Write(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampmicro int64, value []byte) (int64, error) {
+	return store.WriteContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, timestampmicro, value)
+}
+
+// WriteContext is the same as Write but will give up and return ctx.Err()
+// if ctx is done before the write has been accepted and acknowledged by the
+// internal writers. Note that a write given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultGroupStore) WriteContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampmicro int64, value []byte) (int64, error) {
 	atomic.AddInt32(&store.writes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.writeErrors, 1)
@@ -429,9 +1123,22 @@ func (store *DefaultGroupStore) Write(keyA uint64, keyB uint64, nameKeyA uint64,
 		atomic.AddInt32(&store.writeErrors, 1)
 		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
 	}
-	timestampbits, err := store.write(keyA, keyB, nameKeyA, nameKeyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false)
-	if err != nil {
+
+	if nameKeyA == _GROUP_DELETION_NAME_KEY && nameKeyB == _GROUP_DELETION_NAME_KEY {
 		atomic.AddInt32(&store.writeErrors, 1)
+		return 0, ErrReservedName
+	}
+
+	timestampbits, err := store.writeContext(ctx, keyA, keyB, nameKeyA, nameKeyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false, false, false, 0)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
+	if err != nil {
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.writeTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.writeErrors, 1)
+		}
 	} else if timestampmicro <= int64(timestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.writesOverridden, 1)
 	}
@@ -439,8 +1146,37 @@ func (store *DefaultGroupStore) Write(keyA uint64, keyB uint64, nameKeyA uint64,
 }
 
 func (store *DefaultGroupStore) write(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, value []byte, internal bool) (uint64, error) {
+	return store.writeContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, timestampbits, value, internal, false, false, 0)
+}
+
+// writeReplicated is the same as write but for data that arrived from another
+// store through replication; this is only used to inform subscribers of where
+// changes came from.
+func (store *DefaultGroupStore) writeReplicated(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, value []byte, internal bool) (uint64, error) {
+	return store.writeContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, timestampbits, value, internal, true, false, 0)
+}
+
+func (store *DefaultGroupStore) writeContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, value []byte, internal bool, replicated bool, conditional bool, expectedbits uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return 0, ErrClosed
+	}
+	otimestampbits, omanifest := store.supersededStreamManifest(keyA, keyB, nameKeyA, nameKeyB, timestampbits)
 	i := int(keyA>>1) % len(store.freeWriteReqChans)
-	writeReq := <-store.freeWriteReqChans[i]
+	var writeReq *groupWriteReq
+	select {
+	case writeReq = <-store.freeWriteReqChans[i]:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if ctx.Done() != nil && len(value) > 0 {
+		// If we give up on this request after handing it off, the memWriter
+		// may still be using the value after we've returned to the caller, so
+		// it needs its own copy.
+		value = append([]byte(nil), value...)
+	}
 	writeReq.keyA = keyA
 	writeReq.keyB = keyB
 
@@ -450,24 +1186,132 @@ func (store *DefaultGroupStore) write(keyA uint64, keyB uint64, nameKeyA uint64,
 	writeReq.timestampbits = timestampbits
 	writeReq.value = value
 	writeReq.internal = internal
-	store.pendingWriteReqChans[i] <- writeReq
-	err := <-writeReq.errChan
+	writeReq.replicated = replicated
+	writeReq.conditional = conditional
+	writeReq.expectedbits = expectedbits
+	writeReq.otimestampbits = otimestampbits
+	writeReq.omanifest = omanifest
+	select {
+	case store.pendingWriteReqChans[i] <- writeReq:
+	case <-ctx.Done():
+		writeReq.value = nil
+		writeReq.omanifest = nil
+		store.freeWriteReqChans[i] <- writeReq
+		return 0, ctx.Err()
+	}
+	select {
+	case err := <-writeReq.errChan:
+		return store.finishWriteReq(i, writeReq, timestampbits, err)
+	case <-ctx.Done():
+		// The memWriter still owns the writeReq and will respond on its
+		// errChan eventually; only then can it go back to the free list.
+		go func() {
+			store.finishWriteReq(i, writeReq, timestampbits, <-writeReq.errChan)
+		}()
+		return 0, ctx.Err()
+	}
+}
+
+// finishWriteReq returns writeReq, answered by the memWriter with err, to the
+// free list for shard i and then follows up on timestampbits having been
+// stored, such as removing the chunk entries of a stream manifest it
+// replaced or enforcing a group deletion marker. Every path that hands off a
+// writeReq must finish it this way.
+func (store *DefaultGroupStore) finishWriteReq(i int, writeReq *groupWriteReq, timestampbits uint64, err error) (uint64, error) {
 	ptimestampbits := writeReq.timestampbits
+	keyA := writeReq.keyA
+	keyB := writeReq.keyB
+
+	nameKeyA := writeReq.nameKeyA
+	nameKeyB := writeReq.nameKeyB
+	replicated := writeReq.replicated
+
+	otimestampbits := writeReq.otimestampbits
+	omanifest := writeReq.omanifest
 	writeReq.value = nil
+	writeReq.conditional = false
+	writeReq.replicated = false
+	writeReq.otimestampbits = 0
+	writeReq.omanifest = nil
 	store.freeWriteReqChans[i] <- writeReq
 	// This is for the flusher
 	if err == nil && ptimestampbits < timestampbits {
 		atomic.AddInt32(&store.modifications, 1)
 	}
+	if err == nil && otimestampbits != 0 && ptimestampbits == otimestampbits {
+		store.deleteStreamManifestChunks(keyA, keyB, nameKeyA, nameKeyB, otimestampbits, omanifest, int64(timestampbits>>_TSB_UTIL_BITS))
+	}
+
+	if err == nil && ptimestampbits < timestampbits {
+		store.groupWritten(keyA, keyB, nameKeyA, nameKeyB, timestampbits, replicated)
+	}
+
 	return ptimestampbits, err
 }
 
+// WriteIf is the same as Write except the write will only be stored if the
+// current timestampmicro for keyA, keyB, nameKeyA, nameKeyB is
+// expectedTimestampMicro, with 0 meaning no entry currently exists; otherwise
+// ErrConflict and the current timestampmicro will be returned. Note that a
+// deletion marker (aka tombstone) has a timestampmicro, as Lookup reports.
+func (store *DefaultGroupStore) WriteIf(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, expectedTimestampMicro int64, newTimestampMicro int64, value []byte) (int64, error) {
+	return store.WriteIfContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, expectedTimestampMicro, newTimestampMicro, value)
+}
+
+// WriteIfContext is the same as WriteIf but will give up and return ctx.Err()
+// if ctx is done before the write has been accepted and acknowledged by the
+// internal writers. Note that a write given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultGroupStore) WriteIfContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, expectedTimestampMicro int64, newTimestampMicro int64, value []byte) (int64, error) {
+	atomic.AddInt32(&store.writeIfs, 1)
+	if newTimestampMicro < TIMESTAMPMICRO_MIN {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d < %d", newTimestampMicro, TIMESTAMPMICRO_MIN)
+	}
+	if newTimestampMicro > TIMESTAMPMICRO_MAX {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d > %d", newTimestampMicro, TIMESTAMPMICRO_MAX)
+	}
+	if newTimestampMicro <= expectedTimestampMicro {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d <= expected %d", newTimestampMicro, expectedTimestampMicro)
+	}
+
+	if nameKeyA == _GROUP_DELETION_NAME_KEY && nameKeyB == _GROUP_DELETION_NAME_KEY {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, ErrReservedName
+	}
+
+	ptimestampbits, err := store.writeContext(ctx, keyA, keyB, nameKeyA, nameKeyB, uint64(newTimestampMicro)<<_TSB_UTIL_BITS, value, false, false, true, uint64(expectedTimestampMicro)<<_TSB_UTIL_BITS)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
+	if err == ErrConflict {
+		atomic.AddInt32(&store.writeIfConflicts, 1)
+	} else if err != nil {
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.writeIfTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.writeIfErrors, 1)
+		}
+	}
+	return int64(ptimestampbits >> _TSB_UTIL_BITS), err
+}
+
 // Delete stores timestampmicro for keyA, keyB, nameKeyA, nameKeyB
 // and returns the previously stored timestampmicro or returns any error; a
 // newer timestampmicro already in place is not reported as an error. Note that
 // with a write and a delete for the exact same timestampmicro, the delete
 // wins.
 func (store *DefaultGroupStore) Delete(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampmicro int64) (int64, error) {
+	return store.DeleteContext(context.Background(), keyA, keyB, nameKeyA, nameKeyB, timestampmicro)
+}
+
+// DeleteContext is the same as Delete but will give up and return ctx.Err()
+// if ctx is done before the delete has been accepted and acknowledged by the
+// internal writers. Note that a delete given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultGroupStore) DeleteContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampmicro int64) (int64, error) {
 	atomic.AddInt32(&store.deletes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.deleteErrors, 1)
@@ -477,9 +1321,22 @@ func (store *DefaultGroupStore) Delete(keyA uint64, keyB uint64, nameKeyA uint64
 		atomic.AddInt32(&store.deleteErrors, 1)
 		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
 	}
-	ptimestampbits, err := store.write(keyA, keyB, nameKeyA, nameKeyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
-	if err != nil {
+
+	if nameKeyA == _GROUP_DELETION_NAME_KEY && nameKeyB == _GROUP_DELETION_NAME_KEY {
 		atomic.AddInt32(&store.deleteErrors, 1)
+		return 0, ErrReservedName
+	}
+
+	ptimestampbits, err := store.writeContext(ctx, keyA, keyB, nameKeyA, nameKeyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true, false, false, 0)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
+	if err != nil {
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.deleteTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.deleteErrors, 1)
+		}
 	} else if timestampmicro <= int64(ptimestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.deletesOverridden, 1)
 	}
@@ -528,6 +1385,10 @@ func (store *DefaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBl
 	var tbOffset int
 	for {
 		memBlock := <-freeableMemBlockChan
+		if memBlock == shutdownGroupMemBlock {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if memBlock == flushGroupMemBlock {
 			if tb != nil {
 				store.pendingTOCBlockChan <- tb
@@ -536,6 +1397,14 @@ func (store *DefaultGroupStore) memClearer(freeableMemBlockChan chan *groupMemBl
 			store.pendingTOCBlockChan <- nil
 			continue
 		}
+		if memBlock == syncGroupMemBlock {
+			if tb != nil {
+				store.pendingTOCBlockChan <- tb
+				tb = nil
+			}
+			store.pendingTOCBlockChan <- syncGroupTOCBlock
+			continue
+		}
 		fl := store.locBlock(memBlock.fileID)
 		if tb != nil && tbTS != fl.timestampnano() {
 			store.pendingTOCBlockChan <- tb
@@ -602,6 +1471,10 @@ func (store *DefaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 	var memBlockMemOffset int
 	for {
 		writeReq := <-pendingWriteReqChan
+		if writeReq == shutdownGroupWriteReq {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if writeReq == enableGroupWriteReq {
 			enabled = true
 			continue
@@ -618,10 +1491,28 @@ func (store *DefaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 			store.fileMemBlockChan <- flushGroupMemBlock
 			continue
 		}
+		if writeReq == syncGroupWriteReq {
+			if memBlock != nil && len(memBlock.toc) > 0 {
+				store.fileMemBlockChan <- memBlock
+				memBlock = nil
+			}
+			store.fileMemBlockChan <- syncGroupMemBlock
+			continue
+		}
 		if !enabled && !writeReq.internal {
 			writeReq.errChan <- ErrDisabled
 			continue
 		}
+		if writeReq.conditional {
+			// Since this memWriter is the only one that handles this key, no
+			// other write can slip in between this check and the Set below.
+			ctimestampbits, _, _, _ := store.locmap.Get(writeReq.keyA, writeReq.keyB, writeReq.nameKeyA, writeReq.nameKeyB)
+			if ctimestampbits>>_TSB_UTIL_BITS != writeReq.expectedbits>>_TSB_UTIL_BITS {
+				writeReq.timestampbits = ctimestampbits
+				writeReq.errChan <- ErrConflict
+				continue
+			}
+		}
 		length := len(writeReq.value)
 		if length > int(store.valueCap) {
 			writeReq.errChan <- fmt.Errorf("value length of %d > %d", length, store.valueCap)
@@ -663,6 +1554,9 @@ func (store *DefaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 
 			memBlockTOCOffset += _GROUP_FILE_ENTRY_SIZE
 			memBlockMemOffset += alloc
+			if atomic.LoadInt32(&store.subscriptionCount) > 0 && writeReq.timestampbits&(_TSB_COMPACTION_REWRITE|_TSB_LOCAL_REMOVAL) == 0 {
+				store.notifySubscribers(writeReq, ptimestampbits)
+			}
 		} else {
 			memBlock.discardLock.Lock()
 			memBlock.values = memBlock.values[:memBlockMemOffset]
@@ -676,10 +1570,31 @@ func (store *DefaultGroupStore) memWriter(pendingWriteReqChan chan *groupWriteRe
 func (store *DefaultGroupStore) fileWriter() {
 	var fl *groupStoreFile
 	memWritersFlushLeft := len(store.pendingWriteReqChans)
+	memWritersSyncLeft := len(store.pendingWriteReqChans)
+	// unsynced is whether fl has been written to since it was last synced.
+	var unsynced bool
 	var tocLen uint64
-	var valueLen uint64
+	// valueLenFor is the most a memBlock can add to the group file.
+	valueLenFor := func(memBlock *groupMemBlock) uint64 {
+		valueLen := uint64(len(memBlock.values))
+		if store.compressionLevel > 0 {
+			// Each value gets a frame header and, at worst, is stored
+			// uncompressed.
+			valueLen += uint64(len(memBlock.toc) / _GROUP_FILE_ENTRY_SIZE * _GROUP_FRAME_SIZE)
+		}
+		if store.compressionLevel > 0 || store.durability == DurabilitySync {
+			// Then the checksum interval may be padded out, after the
+			// memBlock or by a sync.
+			valueLen += uint64(store.checksumInterval)
+		}
+		return valueLen
+	}
 	for {
 		memBlock := <-store.fileMemBlockChan
+		if memBlock == shutdownGroupMemBlock {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if memBlock == flushGroupMemBlock {
 			memWritersFlushLeft--
 			if memWritersFlushLeft > 0 {
@@ -689,6 +1604,9 @@ func (store *DefaultGroupStore) fileWriter() {
 				err := fl.closeWriting()
 				if err != nil {
 					store.logCritical("error closing %s: %s\n", fl.name, err)
+					store.durabilityFailed(err)
+				} else {
+					fl.mapReads()
 				}
 				fl = nil
 			}
@@ -698,27 +1616,94 @@ func (store *DefaultGroupStore) fileWriter() {
 			memWritersFlushLeft = len(store.pendingWriteReqChans)
 			continue
 		}
-		if fl != nil && (tocLen+uint64(len(memBlock.toc)) >= uint64(store.fileCap) || valueLen+uint64(len(memBlock.values)) > uint64(store.fileCap)) {
+		if memBlock == syncGroupMemBlock {
+			memWritersSyncLeft--
+			if memWritersSyncLeft > 0 {
+				continue
+			}
+			if fl != nil && unsynced {
+				if err := fl.sync(); err != nil {
+					store.logCritical("error syncing %s: %s\n", fl.name, err)
+					store.durabilityFailed(err)
+				}
+				unsynced = false
+			}
+			for i := 0; i < len(store.freeableMemBlockChans); i++ {
+				store.freeableMemBlockChans[i] <- syncGroupMemBlock
+			}
+			memWritersSyncLeft = len(store.pendingWriteReqChans)
+			continue
+		}
+		if fl != nil && (tocLen+uint64(len(memBlock.toc)) >= uint64(store.fileCap) || uint64(atomic.LoadUint32(&fl.writerOffset))+valueLenFor(memBlock) > uint64(store.fileCap)) {
 			err := fl.closeWriting()
 			if err != nil {
 				store.logCritical("error closing %s: %s\n", fl.name, err)
+				store.durabilityFailed(err)
+			} else {
+				fl.mapReads()
 			}
 			fl = nil
 		}
 		if fl == nil {
 			var err error
-			fl, err = createGroupReadWriteFile(store, osCreateWriteCloser, osOpenReadSeeker)
+			fl, err = createGroupReadWriteFile(store, store.createFile, store.fs.Open)
 			if err != nil {
 				store.logCritical("fileWriter: %s\n", err)
 				break
 			}
 			tocLen = _GROUP_FILE_HEADER_SIZE
-			valueLen = _GROUP_FILE_HEADER_SIZE
 		}
-		fl.write(memBlock)
+		// The memBlock may be handed off for reuse by fl.write, so its length
+		// is taken beforehand; the group file's length is taken from fl's
+		// offset instead, as compression and padding change it.
 		tocLen += uint64(len(memBlock.toc))
-		valueLen += uint64(len(memBlock.values))
+		fl.write(memBlock)
+		unsynced = true
+	}
+}
+
+// groupFilePath returns the full path of the named group file, in
+// whichever of the store's paths holds it; the first path is assumed if none
+// do.
+func (store *DefaultGroupStore) groupFilePath(name string) string {
+	return groupFilePathIn(store.paths, name, store.fs.Stat)
+}
+
+// groupFilePathIn is groupFilePath for the given paths, as also used by
+// FsckGroupStore and InspectGroupFiles when no store is running.
+func groupFilePathIn(paths []string, name string, stat func(name string) (os.FileInfo, error)) string {
+	if len(paths) > 1 {
+		for _, p := range paths {
+			if _, err := stat(path.Join(p, name)); err == nil {
+				return path.Join(p, name)
+			}
+		}
+	}
+	return path.Join(paths[0], name)
+}
+
+// newGroupFileDirs returns the store's paths in the order a new group file
+// should try them: by most free space if pathsByFreeSpace is set, otherwise
+// taking turns. Those after the first are for when creating the file fails,
+// such as when a device is lost.
+func (store *DefaultGroupStore) newGroupFileDirs() []string {
+	dirs := make([]string, len(store.paths))
+	if store.pathsByFreeSpace {
+		copy(dirs, store.paths)
+		frees := make(map[string]uint64, len(dirs))
+		for _, dir := range dirs {
+			frees[dir], _ = store.fs.DiskUsage(dir)
+		}
+		sort.SliceStable(dirs, func(i int, j int) bool {
+			return frees[dirs[i]] > frees[dirs[j]]
+		})
+		return dirs
 	}
+	next := int(atomic.AddUint32(&store.pathsNext, 1) - 1)
+	for i := range dirs {
+		dirs[i] = store.paths[(next+i)%len(store.paths)]
+	}
+	return dirs
 }
 
 func (store *DefaultGroupStore) tocWriter() {
@@ -726,21 +1711,62 @@ func (store *DefaultGroupStore) tocWriter() {
 	// toc writerB is kept around in case a "late" key arrives to be flushed
 	// whom's value is actually in the previous value file.
 	memClearersFlushLeft := len(store.freeableMemBlockChans)
+	memClearersSyncLeft := len(store.freeableMemBlockChans)
+	// fpA and fpB are the files under writerA and writerB, for syncing, and
+	// unsyncedA and unsyncedB are whether they've been written to since.
 	var writerA io.WriteCloser
+	var fpA io.WriteCloser
 	var offsetA uint64
+	var unsyncedA bool
 	var writerB io.WriteCloser
+	var fpB io.WriteCloser
 	var offsetB uint64
+	var unsyncedB bool
 	var err error
-	head := []byte("GROUPSTORETOC v0                ")
-	binary.BigEndian.PutUint32(head[28:], uint32(store.checksumInterval))
 	// Make sure any trailing data is covered by a checksum by writing an
 	// additional block of zeros (entry offsets of zero are ignored on
 	// recovery).
-	term := make([]byte, store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := newGroupTermBlock(store.checksumInterval, store.keyProvider != nil)
+	// A TOC file that fails to close, such as when it can't be synced, is
+	// noted but doesn't stop later TOC blocks from being written.
+	closeWriter := func(writer io.WriteCloser) {
+		if err := writer.Close(); err != nil {
+			store.logCritical("tocWriter: %s\n", err)
+			store.durabilityFailed(err)
+		}
+	}
+	// syncWriter pads the TOC file out with zeroed entries, which recovery
+	// ignores, until the checksum interval holding its last entry is
+	// complete and so written to fp; then fp is synced. This relies on the
+	// TOC writer being synchronous, as it is with DurabilitySync.
+	blockSize := uint64(store.checksumInterval)
+	if store.keyProvider != nil {
+		blockSize -= _ENCRYPTION_OVERHEAD
+	}
+	padding := make([]byte, blockSize+_GROUP_FILE_ENTRY_SIZE)
+	syncWriter := func(writer io.WriteCloser, fp io.WriteCloser, offset *uint64) {
+		if n := *offset % blockSize; n != 0 {
+			n = (blockSize - n + _GROUP_FILE_ENTRY_SIZE - 1) / _GROUP_FILE_ENTRY_SIZE * _GROUP_FILE_ENTRY_SIZE
+			if _, err := writer.Write(padding[:n]); err != nil {
+				store.logCritical("tocWriter: %s\n", err)
+				store.durabilityFailed(err)
+				return
+			}
+			*offset += n
+		}
+		if err := syncFile(fp); err != nil {
+			store.logCritical("tocWriter: %s\n", err)
+			store.durabilityFailed(err)
+		}
+	}
 OuterLoop:
 	for {
-		t := <-store.pendingTOCBlockChan
+		t, ok := <-store.pendingTOCBlockChan
+		if !ok {
+			// Closed by Close after a flush, so there are no open writers.
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if t == nil {
 			memClearersFlushLeft--
 			if memClearersFlushLeft > 0 {
@@ -750,28 +1776,45 @@ OuterLoop:
 				if _, err = writerB.Write(term); err != nil {
 					break OuterLoop
 				}
-				if err = writerB.Close(); err != nil {
-					break OuterLoop
-				}
+				closeWriter(writerB)
 				writerB = nil
+				fpB = nil
 				atomic.StoreUint64(&store.activeTOCB, 0)
 				offsetB = 0
+				unsyncedB = false
 			}
 			if writerA != nil {
 				if _, err = writerA.Write(term); err != nil {
 					break OuterLoop
 				}
-				if err = writerA.Close(); err != nil {
-					break OuterLoop
-				}
+				closeWriter(writerA)
 				writerA = nil
+				fpA = nil
 				atomic.StoreUint64(&store.activeTOCA, 0)
 				offsetA = 0
+				unsyncedA = false
 			}
 			store.flushedChan <- struct{}{}
 			memClearersFlushLeft = len(store.freeableMemBlockChans)
 			continue
 		}
+		if len(t) == len(syncGroupTOCBlock) {
+			memClearersSyncLeft--
+			if memClearersSyncLeft > 0 {
+				continue
+			}
+			if unsyncedB {
+				syncWriter(writerB, fpB, &offsetB)
+				unsyncedB = false
+			}
+			if unsyncedA {
+				syncWriter(writerA, fpA, &offsetA)
+				unsyncedA = false
+			}
+			store.syncedChan <- struct{}{}
+			memClearersSyncLeft = len(store.freeableMemBlockChans)
+			continue
+		}
 		if len(t) > 8 {
 			bts := binary.BigEndian.Uint64(t)
 			switch bts {
@@ -780,11 +1823,13 @@ OuterLoop:
 					break OuterLoop
 				}
 				offsetA += uint64(len(t) - 8)
+				unsyncedA = true
 			case atomic.LoadUint64(&store.activeTOCB):
 				if _, err = writerB.Write(t[8:]); err != nil {
 					break OuterLoop
 				}
 				offsetB += uint64(len(t) - 8)
+				unsyncedB = true
 			default:
 				// An assumption is made here: If the timestampnano for this
 				// toc block doesn't match the last two seen timestampnanos
@@ -794,33 +1839,33 @@ OuterLoop:
 					if _, err = writerB.Write(term); err != nil {
 						break OuterLoop
 					}
-					if err = writerB.Close(); err != nil {
-						break OuterLoop
-					}
+					closeWriter(writerB)
 				}
 				atomic.StoreUint64(&store.activeTOCB, atomic.LoadUint64(&store.activeTOCA))
 				writerB = writerA
+				fpB = fpA
 				offsetB = offsetA
+				unsyncedB = unsyncedA
 				atomic.StoreUint64(&store.activeTOCA, bts)
-				var fp *os.File
-				fp, err = os.Create(path.Join(store.pathtoc, fmt.Sprintf("%d.grouptoc", bts)))
+				fpA, err = store.createFile(path.Join(store.pathtoc, fmt.Sprintf("%d.grouptoc", bts)))
 				if err != nil {
 					break OuterLoop
 				}
-				writerA = brimutil.NewMultiCoreChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32, store.workers)
-				if _, err = writerA.Write(head); err != nil {
+				if writerA, err = newGroupTOCWriter(store, fpA); err != nil {
 					break OuterLoop
 				}
 				if _, err = writerA.Write(t[8:]); err != nil {
 					break OuterLoop
 				}
 				offsetA = _GROUP_FILE_HEADER_SIZE + uint64(len(t)-8)
+				unsyncedA = true
 			}
 		}
 		store.freeTOCBlockChan <- t[:0]
 	}
 	if err != nil {
 		store.logCritical("tocWriter: %s\n", err)
+		store.durabilityFailed(err)
 	}
 	if writerA != nil {
 		writerA.Close()
@@ -876,19 +1921,14 @@ func (store *DefaultGroupStore) recovery() error {
 		}
 		wg.Wait()
 	}
-	fp, err := os.Open(store.pathtoc)
+	names, err := store.fs.ReadDirNames(store.pathtoc)
 	if err != nil {
 		spindown()
 		return err
 	}
-	names, err := fp.Readdirnames(-1)
-	fp.Close()
-	if err != nil {
-		spindown()
-		return err
-	}
-	fromDiskCount := 0
 	sort.Strings(names)
+	var tocNames []string
+	var tocTimestamps []int64
 	for i := 0; i < len(names); i++ {
 		if !strings.HasSuffix(names[i], ".grouptoc") {
 			continue
@@ -902,31 +1942,113 @@ func (store *DefaultGroupStore) recovery() error {
 			store.logError("bad timestamp in name: %#v\n", names[i])
 			continue
 		}
-		fpr, err := osOpenReadSeeker(path.Join(store.pathtoc, names[i]))
-		if err != nil {
-			store.logError("error opening %s: %s\n", names[i], err)
+		tocNames = append(tocNames, names[i])
+		tocTimestamps = append(tocTimestamps, namets)
+	}
+	// With a checkpoint, the TOC files it covers don't need to be replayed,
+	// though their group files are opened first so the checkpoint's entries
+	// can refer to them.
+	checkpointName, covered := store.recoveryCheckpoint(names)
+	blockIDs := make(map[int64]uint32)
+	for i, namets := range tocTimestamps {
+		if !covered[namets] {
 			continue
 		}
-		fl, err := newGroupReadFile(store, namets, osOpenReadSeeker)
+		fl, err := newGroupReadFile(store, namets, store.fs.Open)
 		if err != nil {
-			store.logError("error opening %s: %s\n", names[i][:len(names[i])-3], err)
-			closeIfCloser(fpr)
+			store.logError("error opening %s: %s\n", tocNames[i][:len(tocNames[i])-3], err)
 			continue
 		}
-		fdc, errs := groupReadTOCEntriesBatched(fpr, fl.id, freeBatchChans, pendingBatchChans, make(chan struct{}))
-		fromDiskCount += fdc
-		for _, err := range errs {
-			store.logError("error with %s: %s", names[i], err)
-			// TODO: The auditor should catch this eventually, but we should be
-			// proactive and notify the auditor of the issue here.
+		blockIDs[namets] = fl.id
+	}
+	if checkpointName != "" {
+		fdc, err := store.recoveryLoadCheckpoint(checkpointName, blockIDs, freeBatchChans, pendingBatchChans)
+		atomic.AddInt64(&store.recoveryKeyLocations, int64(fdc))
+		if err != nil {
+			// Replaying every TOC file on top of what was loaded still ends up
+			// with the newest entries, just as without the checkpoint.
+			store.logError("error with checkpoint %s, replaying all TOC files: %s\n", checkpointName, err)
+			covered = nil
+		} else if store.logDebug != nil {
+			store.logDebug("%d key locations loaded from %s covering %d TOC files\n", fdc, checkpointName, len(covered))
+		}
+	}
+	// Several TOC files can be read at once since the locmap keeps the entry
+	// with the newest timestamp no matter the order entries are set in.
+	tocChan := make(chan int, len(tocTimestamps))
+	for i, namets := range tocTimestamps {
+		if !covered[namets] {
+			tocChan <- i
 		}
-		closeIfCloser(fpr)
 	}
+	close(tocChan)
+	tocCount := len(tocChan)
+	progressDoneChan := make(chan struct{})
+	go store.recoveryProgress(start, tocCount, progressDoneChan)
+	readersWG := &sync.WaitGroup{}
+	for r := 0; r < store.recoveryReaders; r++ {
+		readersWG.Add(1)
+		go func() {
+			for i := range tocChan {
+				store.recoveryReadTOC(tocNames[i], tocTimestamps[i], blockIDs, freeBatchChans, pendingBatchChans)
+				atomic.AddInt64(&store.recoveryTOCFiles, 1)
+			}
+			readersWG.Done()
+		}()
+	}
+	readersWG.Wait()
 	spindown()
+	close(progressDoneChan)
+	dur := time.Now().Sub(start)
+	atomic.StoreInt64(&store.recoveryDuration, int64(dur))
 	if store.logDebug != nil {
-		dur := time.Now().Sub(start)
+		fromDiskCount := atomic.LoadInt64(&store.recoveryKeyLocations)
 		stats := store.Stats(false).(*GroupStoreStats)
 		store.logInfo("%d key locations loaded in %s, %.0f/s; %d caused change; %d resulting locations referencing %d bytes.\n", fromDiskCount, dur, float64(fromDiskCount)/(float64(dur)/float64(time.Second)), causedChangeCount, stats.Values, stats.ValueBytes)
 	}
 	return nil
 }
+
+// recoveryReadTOC sets the entries of a TOC file in the locmap using the
+// batches of recovery, opening its group file unless blockIDs already has
+// it.
+func (store *DefaultGroupStore) recoveryReadTOC(name string, namets int64, blockIDs map[int64]uint32, freeBatchChans []chan []groupTOCEntry, pendingBatchChans []chan []groupTOCEntry) {
+	fpr, err := store.fs.Open(path.Join(store.pathtoc, name))
+	if err != nil {
+		store.logError("error opening %s: %s\n", name, err)
+		return
+	}
+	defer closeIfCloser(fpr)
+	blockID, ok := blockIDs[namets]
+	if !ok {
+		fl, err := newGroupReadFile(store, namets, store.fs.Open)
+		if err != nil {
+			store.logError("error opening %s: %s\n", name[:len(name)-3], err)
+			return
+		}
+		blockID = fl.id
+	}
+	fdc, errs := groupReadTOCEntriesBatched(fpr, store.keyProvider, blockID, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	atomic.AddInt64(&store.recoveryKeyLocations, int64(fdc))
+	for _, err := range errs {
+		store.logError("error with %s: %s", name, err)
+		// TODO: The auditor should catch this eventually, but we should be
+		// proactive and notify the auditor of the issue here.
+	}
+}
+
+// recoveryProgress logs how recovery is going every so often until doneChan
+// is closed.
+func (store *DefaultGroupStore) recoveryProgress(start time.Time, tocCount int, doneChan chan struct{}) {
+	ticker := time.NewTicker(_GROUP_RECOVERY_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			keyLocations := atomic.LoadInt64(&store.recoveryKeyLocations)
+			store.logInfo("recovery: %d of %d TOC files done, %d key locations loaded, %.0f/s\n", atomic.LoadInt64(&store.recoveryTOCFiles), tocCount, keyLocations, float64(keyLocations)/time.Now().Sub(start).Seconds())
+		}
+	}
+}
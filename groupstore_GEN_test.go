@@ -1,6 +1,20 @@
 package store
 
-import "github.com/gholt/locmap"
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gholt/locmap"
+)
 
 func lowMemGroupStoreConfig() *GroupStoreConfig {
 	locmap := locmap.NewGroupLocMap(&locmap.GroupLocMapConfig{
@@ -22,3 +36,1001 @@ func lowMemGroupStoreConfig() *GroupStoreConfig {
 		OutPullReplicationBloomN:  1000,
 	}
 }
+
+// newGroupTestStore returns a store at dir with writes enabled, using
+// lowMemGroupStoreConfig as changed by configure, if not nil. The store is
+// closed when the test finishes, if the test didn't close it already.
+func newGroupTestStore(t *testing.T, dir string, configure func(cfg *GroupStoreConfig)) *DefaultGroupStore {
+	cfg := lowMemGroupStoreConfig()
+	cfg.Path = dir
+	cfg.MsgRing = &msgRingPlaceholder{}
+	if configure != nil {
+		configure(cfg)
+	}
+	store, _, err := NewGroupStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	store.EnableWrites()
+	return store
+}
+
+// stallGroupMemWriters holds on to every free memBlock so the memWriters
+// stop at the next write they're given, until the returned func is called.
+func stallGroupMemWriters(store *DefaultGroupStore) func() {
+	// After a flush the memWriters have no memBlock of their own and every
+	// memBlock comes back to the free list.
+	store.Flush()
+	memBlocks := make([]*groupMemBlock, cap(store.freeMemBlockChan))
+	for i := range memBlocks {
+		memBlocks[i] = <-store.freeMemBlockChan
+	}
+	return func() {
+		for _, memBlock := range memBlocks {
+			store.freeMemBlockChan <- memBlock
+		}
+	}
+}
+
+func TestGroupStoreContextCanceled(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	store.DisableWrites()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 3, 4, 1000, []byte("testing")); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteIfContext(ctx, 1, 2, 3, 4, 0, 1000, []byte("testing")); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteContext(ctx, 1, 2, 3, 4, 1000); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, _, err := store.LookupContext(ctx, 1, 2, 3, 4); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, _, err := store.ReadContext(ctx, 1, 2, 3, 4, nil); err != context.Canceled {
+		t.Fatal(err)
+	}
+	stats := store.Stats(false).(*GroupStoreStats)
+	if stats.WriteTimeouts != 1 || stats.WriteErrors != 0 {
+		t.Fatal(stats.WriteTimeouts, stats.WriteErrors)
+	}
+	if stats.WriteIfTimeouts != 1 || stats.WriteIfErrors != 0 {
+		t.Fatal(stats.WriteIfTimeouts, stats.WriteIfErrors)
+	}
+	if stats.DeleteTimeouts != 1 || stats.DeleteErrors != 0 {
+		t.Fatal(stats.DeleteTimeouts, stats.DeleteErrors)
+	}
+	if stats.LookupTimeouts != 1 || stats.LookupErrors != 0 {
+		t.Fatal(stats.LookupTimeouts, stats.LookupErrors)
+	}
+	if stats.ReadTimeouts != 1 || stats.ReadErrors != 0 {
+		t.Fatal(stats.ReadTimeouts, stats.ReadErrors)
+	}
+	store.EnableWrites()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 3, 4, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := store.ReadContext(ctx, 1, 2, 3, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "testing" {
+		t.Fatal(string(value))
+	}
+}
+
+func TestGroupStoreContextDeadline(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	release := stallGroupMemWriters(store)
+	i := int(uint64(1)>>1) % len(store.freeWriteReqChans)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 3, 4, 1000, []byte("testing")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if len(store.freeWriteReqChans[i]) == cap(store.freeWriteReqChans[i]) {
+		t.Fatal("write request was not handed off")
+	}
+	release()
+	// Once the memWriter answers, the abandoned write request has to make it
+	// back to the free list.
+	for j := 0; len(store.freeWriteReqChans[i]) != cap(store.freeWriteReqChans[i]); j++ {
+		if j == 1000 {
+			t.Fatal(len(store.freeWriteReqChans[i]), cap(store.freeWriteReqChans[i]))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := store.Stats(false).(*GroupStoreStats); stats.WriteTimeouts != 1 || stats.WriteErrors != 0 {
+		t.Fatal(stats.WriteTimeouts, stats.WriteErrors)
+	}
+	if _, err := store.Write(1, 2, 3, 4, 2000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreWriteIf(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	if _, err := store.WriteIf(1, 2, 3, 4, 0, 1000, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	timestampMicro, err := store.WriteIf(1, 2, 3, 4, 0, 2000, []byte("two"))
+	if err != ErrConflict {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 {
+		t.Fatal(timestampMicro)
+	}
+	if _, err := store.WriteIf(1, 2, 3, 4, 1000, 1000, []byte("two")); err == nil {
+		t.Fatal(err)
+	}
+	timestampMicro, err = store.WriteIf(1, 2, 3, 4, 1000, 2000, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 {
+		t.Fatal(timestampMicro)
+	}
+	timestampMicro, value, err := store.Read(1, 2, 3, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 2000 || string(value) != "two" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	stats := store.Stats(false).(*GroupStoreStats)
+	if stats.WriteIfs != 4 || stats.WriteIfConflicts != 1 || stats.WriteIfErrors != 1 {
+		t.Fatal(stats.WriteIfs, stats.WriteIfConflicts, stats.WriteIfErrors)
+	}
+}
+
+func TestGroupStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	store := newGroupTestStore(t, dir, nil)
+	if _, err := store.Write(1, 2, 3, 4, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(1, 2, 3, 4, 2000, []byte("testing")); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Read(1, 2, 3, 4, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Lookup(1, 2, 3, 4); err != ErrClosed {
+		t.Fatal(err)
+	}
+	// These should all just do nothing rather than block or panic.
+	store.Flush()
+	store.EnableWrites()
+	store.DisableWrites()
+	// Nor should background work start up again.
+	store.EnableAll()
+	store.EnableCompaction()
+	if store.compactionState.notifyChan != nil || store.auditState.notifyChan != nil || store.flusherState.notifyChan != nil {
+		t.Fatal("background work enabled after Close")
+	}
+	// A new store on the same path should find what was written.
+	store = newGroupTestStore(t, dir, nil)
+	timestampMicro, value, err := store.Read(1, 2, 3, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 || string(value) != "testing" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreReadTo(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	if _, err := store.Write(1, 2, 3, 4, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteWithTTL(5, 6, 7, 8, 1000, []byte("expires"), time.Duration(math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	for _, flushed := range []bool{false, true} {
+		if flushed {
+			store.Flush()
+		}
+		buf := &bytes.Buffer{}
+		timestampMicro, err := store.ReadTo(1, 2, 3, 4, buf)
+		if err != nil {
+			t.Fatal(flushed, err)
+		}
+		if timestampMicro != 1000 || buf.String() != "testing" {
+			t.Fatal(flushed, timestampMicro, buf.String())
+		}
+		buf.Reset()
+		if _, err := store.ReadTo(5, 6, 7, 8, buf); err != nil {
+			t.Fatal(flushed, err)
+		}
+		if buf.String() != "expires" {
+			t.Fatal(flushed, buf.String())
+		}
+	}
+	if _, err := store.ReadTo(9, 9, 9, 9, &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreCompression(t *testing.T) {
+	dir := t.TempDir()
+	store := newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+		cfg.CompressionLevel = 6
+	})
+	v1 := bytes.Repeat([]byte("compressible"), 50)
+	if _, err := store.Write(1, 2, 3, 4, 1000, v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(5, 6, 7, 8, 1000, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteWithTTL(9, 10, 11, 12, 1000, v1, time.Duration(math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	check := func(store *DefaultGroupStore) {
+		if _, v, err := store.Read(1, 2, 3, 4, nil); err != nil || !bytes.Equal(v, v1) {
+			t.Fatal(string(v), err)
+		}
+		if _, v, err := store.Read(5, 6, 7, 8, nil); err != nil || string(v) != "x" {
+			t.Fatal(string(v), err)
+		}
+		if _, v, err := store.Read(9, 10, 11, 12, nil); err != nil || !bytes.Equal(v, v1) {
+			t.Fatal(string(v), err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := store.ReadTo(1, 2, 3, 4, buf); err != nil || !bytes.Equal(buf.Bytes(), v1) {
+			t.Fatal(buf.String(), err)
+		}
+		buf.Reset()
+		if _, err := store.ReadTo(9, 10, 11, 12, buf); err != nil || !bytes.Equal(buf.Bytes(), v1) {
+			t.Fatal(buf.String(), err)
+		}
+	}
+	check(store)
+	stats := store.Stats(false).(*GroupStoreStats)
+	if stats.UncompressedBytes == 0 || stats.CompressedBytes >= stats.UncompressedBytes {
+		t.Fatal(stats.CompressedBytes, stats.UncompressedBytes)
+	}
+	// Audit has to go by the stored lengths of the compressed values; a
+	// highly compressible value last in the file shows the difference.
+	if _, err := store.Write(17, 18, 19, 20, 1000, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Compressed files must still load with compression turned off, alongside
+	// newly written uncompressed files.
+	store = newGroupTestStore(t, dir, nil)
+	check(store)
+	store.auditState.ageThreshold = 0
+	if n := store.auditPass(true, make(chan *bgNotification)); n != nil {
+		t.Fatal("audit failed")
+	}
+	if _, err := store.Write(13, 14, 15, 16, 1000, v1); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if _, v, err := store.Read(13, 14, 15, 16, nil); err != nil || !bytes.Equal(v, v1) {
+		t.Fatal(string(v), err)
+	}
+	check(store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreCompressionPadding(t *testing.T) {
+	fs := NewMemFS()
+	store := newGroupTestStore(t, "/store", func(cfg *GroupStoreConfig) {
+		cfg.CompressionLevel = 6
+		cfg.WritePagesPerWorker = 8
+		cfg.FS = fs
+	})
+	v := bytes.Repeat([]byte("compressible"), 50)
+	for i := uint64(1); i <= 1000; i++ {
+		if _, err := store.Write(i, i, i, i, 1000, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := store.Stats(false).(*GroupStoreStats)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fs.ReadDirNames("/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, name := range names {
+		if strings.HasSuffix(name, ".group") {
+			fi, err := fs.Stat(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += fi.Size()
+		}
+	}
+	// Padding out the checksum interval behind every memBlock would make the
+	// file several times the size of the compressed values.
+	if stats.CompressedBytes == 0 || size > 2*int64(stats.CompressedBytes) {
+		t.Fatal(size, stats.CompressedBytes)
+	}
+}
+
+func TestGroupStoreCompressionFileCap(t *testing.T) {
+	for _, tc := range []struct {
+		compressionLevel int
+		durability       Durability
+	}{
+		{6, DurabilityNone},
+		{6, DurabilitySync},
+		// Each sync pads out the checksum interval even when uncompressed.
+		{0, DurabilitySync},
+	} {
+		// FileCap is kept off the checksum interval so padding out to the
+		// interval could overshoot it.
+		fileCap := 16*1024 + 512
+		fs := NewMemFS()
+		store := newGroupTestStore(t, "/store", func(cfg *GroupStoreConfig) {
+			cfg.CompressionLevel = tc.compressionLevel
+			cfg.Durability = tc.durability
+			cfg.FileCap = fileCap
+			cfg.FS = fs
+		})
+		// The frames of the values, and any padding out to the checksum
+		// interval, have to fit within FileCap too.
+		rnd := rand.New(rand.NewSource(1))
+		v := make([]byte, 100)
+		for i := uint64(1); i <= 1000; i++ {
+			rnd.Read(v)
+			if _, err := store.Write(i, i, i, i, 1000, v); err != nil {
+				t.Fatal(tc, err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(tc, err)
+		}
+		names, err := fs.ReadDirNames("/store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := 0
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".group") {
+				continue
+			}
+			files++
+			fi, err := fs.Stat(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp, err := fs.Open(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, checksumInterval, err := readGroupHeader(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, _, err := groupReadTrailer(fp, fi.Size(), checksumInterval, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The terminating block isn't counted against FileCap.
+			if size-int64(checksumInterval) > int64(fileCap) {
+				t.Fatal(tc, name, size)
+			}
+		}
+		if files < 2 {
+			t.Fatal(tc, files)
+		}
+	}
+}
+
+type testGroupKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (kp *testGroupKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return kp.current, kp.keys[kp.current], nil
+}
+
+func (kp *testGroupKeyProvider) Key(id uint32) ([]byte, error) {
+	if key, ok := kp.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestGroupStoreEncryption(t *testing.T) {
+	dir := t.TempDir()
+	kp := &testGroupKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 16)}}
+	newStore := func() *DefaultGroupStore {
+		return newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+			cfg.KeyProvider = kp
+		})
+	}
+	store := newStore()
+	// Enough values to span several checksum intervals.
+	v := bytes.Repeat([]byte("plaintext"), 30)
+	for i := uint64(1); i <= 20; i++ {
+		if _, err := store.Write(i, i, i, i, 1000, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(store *DefaultGroupStore, keyID uint32) {
+		for i := uint64(1); i <= 20; i++ {
+			if _, v2, err := store.Read(i, i, i, i, nil); err != nil || !bytes.Equal(v2, v) {
+				t.Fatal(i, string(v2), err)
+			}
+		}
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range names {
+			b, err := ioutil.ReadFile(dir + "/" + fi.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte("plaintext")) {
+				t.Fatal(fi.Name())
+			}
+			if id, encrypted := groupHeaderKeyID(b); !encrypted || id != keyID {
+				t.Fatal(fi.Name(), id, encrypted)
+			}
+		}
+	}
+	store.Flush()
+	check(store, 1)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newStore()
+	check(store, 1)
+	// Rotating the key should have compaction rewrite everything under it.
+	kp.current = 2
+	store.compactionState.ageThreshold = 0
+	store.CompactionPass()
+	store.Flush()
+	if stats := store.Stats(false).(*GroupStoreStats); stats.RekeyCompactions == 0 {
+		t.Fatal(stats.RekeyCompactions)
+	}
+	check(store, 2)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func() *DefaultGroupStore {
+		return newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+			cfg.RecoveryReaders = 4
+		})
+	}
+	// Each session writes its own file, with later sessions overwriting some
+	// of the keys of earlier ones, so however the files are read at once the
+	// newest entries must be left.
+	for session := uint64(1); session <= 8; session++ {
+		store := newStore()
+		for i := session * 10; i < session*10+50; i++ {
+			if _, err := store.Write(i, i, i, i, int64(session*1000), []byte{byte(session)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := newStore()
+	defer store.Close()
+	stats := store.Stats(false).(*GroupStoreStats)
+	if stats.RecoveryTOCFiles != 8 || stats.RecoveryKeyLocations != 8*50 || stats.RecoveryDuration <= 0 {
+		t.Fatal(stats.RecoveryTOCFiles, stats.RecoveryKeyLocations, stats.RecoveryDuration)
+	}
+	for i := uint64(10); i < 130; i++ {
+		session := i / 10
+		if session > 8 {
+			session = 8
+		}
+		ts, v, err := store.Read(i, i, i, i, nil)
+		if err != nil || ts != int64(session*1000) || !bytes.Equal(v, []byte{byte(session)}) {
+			t.Fatal(i, ts, v, err)
+		}
+	}
+}
+
+func TestGroupStoreMemFS(t *testing.T) {
+	fs := NewMemFS()
+	newStore := func(path string) *DefaultGroupStore {
+		return newGroupTestStore(t, path, func(cfg *GroupStoreConfig) {
+			// The paths used exist only in fs.
+			cfg.FS = fs
+		})
+	}
+	store := newStore("/nonexistent/store")
+	for i := uint64(1); i <= 100; i++ {
+		if _, err := store.Write(i, i, i, i, 1000, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newStore("/nonexistent/store")
+	for i := uint64(50); i <= 150; i++ {
+		if _, err := store.Write(i, i, i, i, 2000, []byte("two")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Flush()
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Snapshot("/nonexistent/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Files != 4 || info.Copied != 0 {
+		t.Fatal(info)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/nonexistent/store", "/nonexistent/snapshot"} {
+		store = newStore(path)
+		for i := uint64(1); i <= 150; i++ {
+			ts, v, err := store.Read(i, i, i, i, nil)
+			wantTS, want := int64(1000), []byte{byte(i)}
+			if i >= 50 {
+				wantTS, want = 2000, []byte("two")
+			}
+			if err != nil || ts != wantTS || !bytes.Equal(v, want) {
+				t.Fatal(path, i, ts, v, err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat("/nonexistent"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStorePaths(t *testing.T) {
+	fs := NewMemFS()
+	paths := []string{"/a", "/b", "/c"}
+	newStore := func() *DefaultGroupStore {
+		return newGroupTestStore(t, "", func(cfg *GroupStoreConfig) {
+			cfg.Paths = paths
+			cfg.PathTOC = "/toc"
+			cfg.FS = fs
+			// Small files so the writes are spread over many.
+			cfg.FileCap = 1
+		})
+	}
+	value := func(i uint64) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 600)
+	}
+	store := newStore()
+	for i := uint64(1); i <= 60; i++ {
+		if _, err := store.Write(i, i, i, i, 1000, value(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			store.Flush()
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if names, _ := fs.ReadDirNames(p); len(names) == 0 {
+			t.Fatal(p, "has no files")
+		}
+	}
+	store = newStore()
+	for i := uint64(1); i <= 60; i++ {
+		if ts, v, err := store.Read(i, i, i, i, nil); err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+			t.Fatal(i, ts, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Losing a directory only loses the values in its files.
+	lost, _ := fs.ReadDirNames(paths[1])
+	for _, name := range lost {
+		if err := fs.Remove(path.Join(paths[1], name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = newStore()
+	defer store.Close()
+	found := 0
+	for i := uint64(1); i <= 60; i++ {
+		ts, v, err := store.Read(i, i, i, i, nil)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+			t.Fatal(i, ts, err)
+		}
+		found++
+	}
+	if found == 0 || found == 60 {
+		t.Fatal(found)
+	}
+	if _, err := store.Write(100, 100, 100, 100, 2000, value(100)); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if ts, v, err := store.Read(100, 100, 100, 100, nil); err != nil || ts != 2000 || !bytes.Equal(v, value(100)) {
+		t.Fatal(ts, err)
+	}
+}
+
+func TestGroupStoreMmapReads(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config func(cfg *GroupStoreConfig)
+	}{
+		{"plain", func(cfg *GroupStoreConfig) {}},
+		{"compressed", func(cfg *GroupStoreConfig) { cfg.CompressionLevel = 6 }},
+		{"encrypted", func(cfg *GroupStoreConfig) {
+			cfg.KeyProvider = &testGroupKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		}},
+	} {
+		dir := t.TempDir()
+		newStore := func() *DefaultGroupStore {
+			return newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+				cfg.MmapReads = true
+				tc.config(cfg)
+			})
+		}
+		// Enough values to span several checksum intervals.
+		value := func(i uint64) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 50*int(i))
+		}
+		check := func(store *DefaultGroupStore) {
+			mapped := 0
+			for _, block := range store.locBlocks {
+				if fl, ok := block.(*groupStoreFile); ok {
+					if m := fl.mapped(); m != nil {
+						m.release()
+						mapped++
+					}
+				}
+			}
+			if mapped == 0 {
+				t.Fatal(tc.name, "no files mapped")
+			}
+			for i := uint64(1); i <= 20; i++ {
+				if ts, v, err := store.Read(1, 1, i, i, nil); err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+					t.Fatal(tc.name, i, ts, err)
+				}
+				buf := &bytes.Buffer{}
+				if _, err := store.ReadTo(1, 1, i, i, buf); err != nil || !bytes.Equal(buf.Bytes(), value(i)) {
+					t.Fatal(tc.name, i, err)
+				}
+			}
+			if tc.name == "compressed" {
+				// Reads reuse flate readers rather than each allocating a
+				// new one, with its 32K window.
+				v := make([]byte, 0, len(value(20)))
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				for j := 0; j < 100; j++ {
+					if _, _, err := store.Read(1, 1, 20, 20, v); err != nil {
+						t.Fatal(tc.name, err)
+					}
+				}
+				runtime.ReadMemStats(&after)
+				if n := (after.TotalAlloc - before.TotalAlloc) / 100; n > 16*1024 {
+					t.Fatal(tc.name, n)
+				}
+			}
+
+			items, err := store.ReadGroup(1, 1, ReadGroupOptions{})
+			if err != nil || len(items) != 20 {
+				t.Fatal(tc.name, len(items), err)
+			}
+			for _, item := range items {
+				if !bytes.Equal(item.Value, value(item.NameKeyA)) {
+					t.Fatal(tc.name, item.NameKeyA)
+				}
+			}
+
+		}
+		store := newStore()
+		for i := uint64(1); i <= 20; i++ {
+			if _, err := store.Write(1, 1, i, i, 1000, value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store.Flush()
+		check(store)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		store = newStore()
+		check(store)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A corrupted interval must still be caught.
+	dir := t.TempDir()
+	store := newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+		cfg.MmapReads = true
+	})
+	if _, err := store.Write(1, 2, 3, 4, 1000, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		if !strings.HasSuffix(fi.Name(), ".group") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[_GROUP_FILE_HEADER_SIZE] ^= 0xff
+		if err := ioutil.WriteFile(path.Join(dir, fi.Name()), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = newGroupTestStore(t, dir, func(cfg *GroupStoreConfig) {
+		cfg.MmapReads = true
+	})
+	defer store.Close()
+	if _, _, err := store.Read(1, 2, 3, 4, nil); err == nil || err == ErrNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupStoreReadGroup(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	// Written in reverse so the on disk order differs from the name order.
+	for i := uint64(9); i > 4; i-- {
+		if _, err := store.Write(1, 2, i, i, 1000, []byte("value"+string(rune('0'+i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Flush()
+	for i := uint64(4); i > 0; i-- {
+		if _, err := store.Write(1, 2, i, i, 1000, []byte("value"+string(rune('0'+i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Write(1, 2, 0, 0, 1000, []byte("a much longer value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(1, 2, 3, 3, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(1, 3, 1, 1, 1000, []byte("other group")); err != nil {
+		t.Fatal(err)
+	}
+	items, err := store.ReadGroup(1, 2, ReadGroupOptions{MaxValueLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 9 {
+		t.Fatal(len(items))
+	}
+	if items[0].NameKeyA != 0 || items[0].Value != nil || items[0].Length != 19 {
+		t.Fatal(items[0])
+	}
+	for _, item := range items[1:] {
+		if item.NameKeyA == 3 || item.TimestampMicro != 1000 || string(item.Value) != "value"+string(rune('0'+item.NameKeyA)) || item.Length != 6 {
+			t.Fatal(item)
+		}
+	}
+	items, err = store.ReadGroup(1, 2, ReadGroupOptions{Offset: 3, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 4 || items[0].NameKeyA != 4 || items[3].NameKeyA != 7 {
+		t.Fatal(items)
+	}
+	if items, err = store.ReadGroup(1, 2, ReadGroupOptions{Offset: 9}); err != nil || len(items) != 0 {
+		t.Fatal(items, err)
+	}
+}
+
+func TestGroupStoreDeleteGroup(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	for i := uint64(0); i < 10; i++ {
+		if _, err := store.Write(1, 2, i, i, int64(1000+i), []byte("testing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Write(1, 3, 1, 1, 1000, []byte("other group")); err != nil {
+		t.Fatal(err)
+	}
+	count, err := store.DeleteGroup(1, 2, 1005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatal(count)
+	}
+	items := store.LookupGroup(1, 2)
+	if len(items) != 5 {
+		t.Fatal(items)
+	}
+	for _, item := range items {
+		if item.TimestampMicro < 1005 {
+			t.Fatal(item)
+		}
+	}
+	timestampMicro, _, err := store.Lookup(1, 2, 0, 0)
+	if err != ErrNotFound || timestampMicro != 1005 {
+		t.Fatal(timestampMicro, err)
+	}
+	if items = store.LookupGroup(1, 3); len(items) != 1 {
+		t.Fatal(items)
+	}
+	if count, err = store.DeleteGroup(1, 2, 1005); err != nil || count != 0 {
+		t.Fatal(count, err)
+	}
+	// Items arriving afterwards, as a racing write might, are still deleted
+	// unless newer.
+	if _, err = store.Write(1, 2, 50, 50, 1001, []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro, _, err = store.Lookup(1, 2, 50, 50); err != ErrNotFound || timestampMicro != 1005 {
+		t.Fatal(timestampMicro, err)
+	}
+	// However the late write is handed off.
+	if results := store.WriteBatch([]GroupBatchEntry{
+		{KeyA: 1, KeyB: 2, NameKeyA: 52, NameKeyB: 52, TimestampMicro: 1001, Value: []byte("late")},
+	}); results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if _, err = store.WriteIf(1, 2, 53, 53, 0, 1001, []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	release := stallGroupMemWriters(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err = store.WriteContext(ctx, 1, 2, 54, 54, 1001, []byte("late")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	cancel()
+	release()
+	for _, nameKey := range []uint64{52, 53, 54} {
+		for j := 0; ; j++ {
+			if timestampMicro, _, err = store.Lookup(1, 2, nameKey, nameKey); err == ErrNotFound && timestampMicro == 1005 {
+				break
+			}
+			if j == 1000 {
+				t.Fatal(nameKey, timestampMicro, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, err = store.Write(1, 2, 51, 51, 2000, []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if size := store.GroupSize(1, 2); size != 6 {
+		t.Fatal(size)
+	}
+	// The group deletion marker itself is off limits.
+	if _, err = store.Write(1, 2, math.MaxUint64, math.MaxUint64, 4000, []byte("marker")); err != ErrReservedName {
+		t.Fatal(err)
+	}
+	if _, err = store.WriteIf(1, 2, math.MaxUint64, math.MaxUint64, 1005, 4000, []byte("marker")); err != ErrReservedName {
+		t.Fatal(err)
+	}
+	if _, err = store.WriteWithTTL(1, 2, math.MaxUint64, math.MaxUint64, 4000, []byte("marker"), time.Hour); err != ErrReservedName {
+		t.Fatal(err)
+	}
+	if _, err = store.WriteStream(1, 2, math.MaxUint64, math.MaxUint64, 4000, strings.NewReader("marker")); err != ErrReservedName {
+		t.Fatal(err)
+	}
+	if _, err = store.Delete(1, 2, math.MaxUint64, math.MaxUint64, 4000); err != ErrReservedName {
+		t.Fatal(err)
+	}
+	entries := []GroupBatchEntry{
+		{KeyA: 1, KeyB: 2, NameKeyA: math.MaxUint64, NameKeyB: math.MaxUint64, TimestampMicro: 4000},
+	}
+	if results := store.WriteBatch(entries); results[0].Err != ErrReservedName {
+		t.Fatal(results[0].Err)
+	}
+	if results := store.DeleteBatch(entries); results[0].Err != ErrReservedName {
+		t.Fatal(results[0].Err)
+	}
+	if timestampMicro, _, err = store.Lookup(1, 2, math.MaxUint64, math.MaxUint64); err != ErrNotFound || timestampMicro != 1005 {
+		t.Fatal(timestampMicro, err)
+	}
+	// A group deletion replicated in from elsewhere applies here too.
+	if _, err = store.writeReplicated(1, 2, _GROUP_DELETION_NAME_KEY, _GROUP_DELETION_NAME_KEY, (3000<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if items = store.LookupGroup(1, 2); len(items) != 0 {
+		t.Fatal(items)
+	}
+	if items = store.LookupGroup(1, 3); len(items) != 1 {
+		t.Fatal(items)
+	}
+}
+
+func TestGroupStoreLookupGroupPage(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	for i := uint64(100); i > 0; i-- {
+		if _, err := store.Write(1, 2, i%7, i, 1000, []byte("testing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Write(1, 3, 1, 1, 1000, []byte("other group")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(1, 2, 1, 1, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if size := store.GroupSize(1, 2); size != 99 {
+		t.Fatal(size)
+	}
+	var cursor []byte
+	var last LookupGroupItem
+	count := 0
+	pages := 0
+	for {
+		var items []LookupGroupItem
+		var err error
+		items, cursor, err = store.LookupGroupPage(1, 2, cursor, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, item := range items {
+			if count > 0 && (item.NameKeyA < last.NameKeyA || (item.NameKeyA == last.NameKeyA && item.NameKeyB <= last.NameKeyB)) {
+				t.Fatal(last, item)
+			}
+			if item.TimestampMicro != 1000 || item.Length != 7 {
+				t.Fatal(item)
+			}
+			last = item
+			count++
+		}
+		if cursor == nil {
+			break
+		}
+	}
+	if count != 99 || pages != 10 {
+		t.Fatal(count, pages)
+	}
+	if _, _, err := store.LookupGroupPage(1, 2, []byte("bad"), 10); err == nil {
+		t.Fatal("expected error")
+	}
+}
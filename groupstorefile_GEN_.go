@@ -2,6 +2,8 @@ package store
 
 import (
 	"bytes"
+	"compress/flate"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,8 +21,24 @@ import (
 
 //    "GROUPSTORETOC v0            ":28, checksumInterval:4
 // or "GROUPSTORE v0               ":28, checksumInterval:4
+// or "GROUPSTORE v1               ":28, checksumInterval:4
+// Encrypted files add " E" to the text and record the key ID:
+//
+//	"GROUPSTORE v0 E        ":24, keyID:4, checksumInterval:4
+//
+// with each checksum interval after the header sealed with sealBlock.
 const _GROUP_FILE_HEADER_SIZE = 32
 
+// In v1 value files each value is stored in a frame, with the TOC offset
+// pointing to the frame and the TOC length remaining the value's length.
+// method:1, storedLength:4, stored:storedLength
+const _GROUP_FRAME_SIZE = 5
+
+const (
+	_GROUP_FRAME_RAW   = 0
+	_GROUP_FRAME_FLATE = 1
+)
+
 // keyA:8, keyB:8, nameKeyA:8, nameKeyB:8, timestampbits:8, offset:4, length:4
 const _GROUP_FILE_ENTRY_SIZE = 48
 
@@ -28,21 +46,36 @@ const _GROUP_FILE_ENTRY_SIZE = 48
 const _GROUP_FILE_TRAILER_SIZE = 8
 
 type groupStoreFile struct {
-	store                     *DefaultGroupStore
-	name                      string
-	id                        uint32
-	nameTimestamp             int64
+	store            *DefaultGroupStore
+	name             string
+	id               uint32
+	nameTimestamp    int64
+	version          int
+	aead             cipher.AEAD
+	checksumInterval uint32
+	// mmap is set once fl is mapped for reads; mmapClosed is set by
+	// closeFiles so no mapping is set up afterwards. Both are covered by
+	// mmapLock.
+	mmapLock                  sync.Mutex
+	mmap                      *mmapReader
+	mmapClosed                bool
 	readerFPs                 []brimutil.ChecksummedReader
 	readerLocks               []sync.Mutex
 	readerLens                [][]byte
+	readerFlates              []io.ReadCloser
 	writerFP                  io.WriteCloser
 	writerOffset              uint32
+	writerBlockSize           uint32
 	writerFreeBufChan         chan *groupStoreFileWriteBuf
 	writerChecksumBufChan     chan *groupStoreFileWriteBuf
 	writerToDiskBufChan       chan *groupStoreFileWriteBuf
 	writerDoneChan            chan struct{}
 	writerCurrentBuf          *groupStoreFileWriteBuf
+	writerFlate               *flate.Writer
+	writerFlateBuf            bytes.Buffer
 	freeableMemBlockChanIndex int
+	closeOnce                 sync.Once
+	closeErr                  error
 }
 
 type groupStoreFileWriteBuf struct {
@@ -50,14 +83,18 @@ type groupStoreFileWriteBuf struct {
 	buf       []byte
 	offset    uint32
 	memBlocks []*groupMemBlock
+	// synced is set, with no buf, for a sync request; see sync.
+	synced chan error
 }
 
 func newGroupReadFile(store *DefaultGroupStore, nameTimestamp int64, openReadSeeker func(name string) (io.ReadSeeker, error)) (*groupStoreFile, error) {
 	fl := &groupStoreFile{store: store, nameTimestamp: nameTimestamp}
-	fl.name = path.Join(store.path, fmt.Sprintf("%019d.group", fl.nameTimestamp))
+	fl.name = store.groupFilePath(fmt.Sprintf("%019d.group", fl.nameTimestamp))
 	fl.readerFPs = make([]brimutil.ChecksummedReader, store.fileReaders)
 	fl.readerLocks = make([]sync.Mutex, len(fl.readerFPs))
 	fl.readerLens = make([][]byte, len(fl.readerFPs))
+	fl.readerFlates = make([]io.ReadCloser, len(fl.readerFPs))
+	var header []byte
 	var checksumInterval uint32
 	for i := 0; i < len(fl.readerFPs); i++ {
 		fp, err := openReadSeeker(fl.name)
@@ -65,13 +102,23 @@ func newGroupReadFile(store *DefaultGroupStore, nameTimestamp int64, openReadSee
 			return nil, err
 		}
 		if i == 0 {
-			if _, checksumInterval, err = readGroupHeader(fp); err != nil {
+			if header, checksumInterval, err = readGroupHeader(fp); err != nil {
+				return nil, err
+			}
+			fl.version = groupHeaderVersion(header)
+			if fl.aead, err = groupHeaderAEAD(header, store.keyProvider); err != nil {
+				closeIfCloser(fp)
 				return nil, err
 			}
 		}
 		fl.readerFPs[i] = brimutil.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
+		if fl.aead != nil {
+			fl.readerFPs[i] = newBlockCipherReader(fl.readerFPs[i], fl.aead, int(checksumInterval), _GROUP_FILE_HEADER_SIZE)
+		}
 		fl.readerLens[i] = make([]byte, 4)
 	}
+	fl.checksumInterval = checksumInterval
+	fl.mapReads()
 	var err error
 	fl.id, err = store.addLocBlock(fl)
 	if err != nil {
@@ -83,8 +130,39 @@ func newGroupReadFile(store *DefaultGroupStore, nameTimestamp int64, openReadSee
 
 func createGroupReadWriteFile(store *DefaultGroupStore, createWriteCloser func(name string) (io.WriteCloser, error), openReadSeeker func(name string) (io.ReadSeeker, error)) (*groupStoreFile, error) {
 	fl := &groupStoreFile{store: store, nameTimestamp: time.Now().UnixNano()}
-	fl.name = path.Join(store.path, fmt.Sprintf("%019d.group", fl.nameTimestamp))
-	fp, err := createWriteCloser(fl.name)
+	text := "GROUPSTORE v0"
+	if store.compressionLevel > 0 {
+		text = "GROUPSTORE v1"
+		fl.version = 1
+		var err error
+		if fl.writerFlate, err = flate.NewWriter(&fl.writerFlateBuf, store.compressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	fl.checksumInterval = store.checksumInterval
+	fl.writerBlockSize = store.checksumInterval
+	var keyID uint32
+	if store.keyProvider != nil {
+		var key []byte
+		var err error
+		if keyID, key, err = store.keyProvider.CurrentKey(); err != nil {
+			return nil, err
+		}
+		if fl.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		fl.writerBlockSize -= _ENCRYPTION_OVERHEAD
+	}
+	head := newGroupHeader(text, store.checksumInterval, fl.aead != nil, keyID)
+	var fp io.WriteCloser
+	var err error
+	for _, dir := range store.newGroupFileDirs() {
+		fl.name = path.Join(dir, fmt.Sprintf("%019d.group", fl.nameTimestamp))
+		if fp, err = createWriteCloser(fl.name); err == nil {
+			break
+		}
+		store.logError("unable to create %s: %s\n", fl.name, err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -97,8 +175,6 @@ func createGroupReadWriteFile(store *DefaultGroupStore, createWriteCloser func(n
 	fl.writerToDiskBufChan = make(chan *groupStoreFileWriteBuf, store.workers)
 	fl.writerDoneChan = make(chan struct{})
 	fl.writerCurrentBuf = <-fl.writerFreeBufChan
-	head := []byte("GROUPSTORE v0                   ")
-	binary.BigEndian.PutUint32(head[28:], store.checksumInterval)
 	fl.writerCurrentBuf.offset = uint32(copy(fl.writerCurrentBuf.buf, head))
 	atomic.StoreUint32(&fl.writerOffset, fl.writerCurrentBuf.offset)
 	go fl.writer()
@@ -108,6 +184,7 @@ func createGroupReadWriteFile(store *DefaultGroupStore, createWriteCloser func(n
 	fl.readerFPs = make([]brimutil.ChecksummedReader, store.fileReaders)
 	fl.readerLocks = make([]sync.Mutex, len(fl.readerFPs))
 	fl.readerLens = make([][]byte, len(fl.readerFPs))
+	fl.readerFlates = make([]io.ReadCloser, len(fl.readerFPs))
 	for i := 0; i < len(fl.readerFPs); i++ {
 		fp, err := openReadSeeker(fl.name)
 		if err != nil {
@@ -118,6 +195,9 @@ func createGroupReadWriteFile(store *DefaultGroupStore, createWriteCloser func(n
 			return nil, err
 		}
 		fl.readerFPs[i] = brimutil.NewChecksummedReader(fp, int(store.checksumInterval), murmur3.New32)
+		if fl.aead != nil {
+			fl.readerFPs[i] = newBlockCipherReader(fl.readerFPs[i], fl.aead, int(store.checksumInterval), _GROUP_FILE_HEADER_SIZE)
+		}
 		fl.readerLens[i] = make([]byte, 4)
 	}
 	fl.id, err = store.addLocBlock(fl)
@@ -135,9 +215,6 @@ func (fl *groupStoreFile) read(keyA uint64, keyB uint64, nameKeyA uint64, nameKe
 	if timestampbits&_TSB_DELETION != 0 {
 		return timestampbits, value, ErrNotFound
 	}
-	i := int(keyA>>1) % len(fl.readerFPs)
-	fl.readerLocks[i].Lock()
-	fl.readerFPs[i].Seek(int64(offset), 0)
 	end := len(value) + int(length)
 	if end <= cap(value) {
 		value = value[:end]
@@ -146,14 +223,201 @@ func (fl *groupStoreFile) read(keyA uint64, keyB uint64, nameKeyA uint64, nameKe
 		copy(value2, value)
 		value = value2
 	}
-	if _, err := io.ReadFull(fl.readerFPs[i], value[len(value)-int(length):]); err != nil {
-		fl.readerLocks[i].Unlock()
+	if err := fl.readValueAt(int(keyA>>1)%len(fl.readerFPs), offset, value[len(value)-int(length):]); err != nil {
 		return timestampbits, value, err
 	}
-	fl.readerLocks[i].Unlock()
 	return timestampbits, value, nil
 }
 
+// readAt fills value with the start of the value stored at offset, using
+// reader i; the caller must hold fl.readerLocks[i].
+func (fl *groupStoreFile) readAt(i int, offset uint32, value []byte) error {
+	fl.readerFPs[i].Seek(int64(offset), 0)
+	return fl.readValue(fl.readerFPs[i], &fl.readerFlates[i], offset, value)
+}
+
+// readValueAt is readAt for callers not holding a reader lock: the memory
+// mapping is used if fl has one, otherwise reader i under its lock.
+func (fl *groupStoreFile) readValueAt(i int, offset uint32, value []byte) error {
+	if m := fl.mapped(); m != nil {
+		flr, _ := flateReaders.Get().(io.ReadCloser)
+		err := fl.readValue(io.NewSectionReader(m, int64(offset), math.MaxInt64-int64(offset)), &flr, offset, value)
+		if flr != nil {
+			flateReaders.Put(flr)
+		}
+		m.release()
+		return err
+	}
+	fl.readerLocks[i].Lock()
+	err := fl.readAt(i, offset, value)
+	fl.readerLocks[i].Unlock()
+	return err
+}
+
+// readValue fills value with the start of the value stored at offset, reading
+// from r which is positioned there. For v1 files this handles the frame and
+// any decompression, reusing the flate reader in *flr if flr isn't nil.
+func (fl *groupStoreFile) readValue(r io.Reader, flr *io.ReadCloser, offset uint32, value []byte) error {
+	if fl.version == 0 {
+		_, err := io.ReadFull(r, value)
+		return err
+	}
+	var frame [_GROUP_FRAME_SIZE]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return err
+	}
+	switch frame[0] {
+	case _GROUP_FRAME_RAW:
+		_, err := io.ReadFull(r, value)
+		return err
+	case _GROUP_FRAME_FLATE:
+		lr := io.LimitReader(r, int64(binary.BigEndian.Uint32(frame[1:])))
+		var fr io.ReadCloser
+		if flr != nil {
+			fr = *flr
+		}
+		if fr == nil {
+			fr = flate.NewReader(lr)
+			if flr != nil {
+				*flr = fr
+			}
+		} else if err := fr.(flate.Resetter).Reset(lr, nil); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(fr, value)
+		return err
+	}
+	return fmt.Errorf("unknown frame method %d at offset %d in %s", frame[0], offset, fl.name)
+}
+
+// mapReads memory maps fl for reads if the store has MmapReads set; fl must
+// no longer be written to. Failing to map isn't an error, reads just keep
+// using the file's readers.
+func (fl *groupStoreFile) mapReads() {
+	if !fl.store.mmapReads {
+		return
+	}
+	fp, err := fl.store.fs.Open(fl.name)
+	if err != nil {
+		if fl.store.logDebug != nil {
+			fl.store.logDebug("unable to open %s for memory mapping: %s\n", fl.name, err)
+		}
+		return
+	}
+	m, err := newMmapReader(fp, int(fl.checksumInterval), fl.aead, _GROUP_FILE_HEADER_SIZE)
+	closeIfCloser(fp)
+	if err != nil {
+		if fl.store.logDebug != nil {
+			fl.store.logDebug("unable to memory map %s: %s\n", fl.name, err)
+		}
+		return
+	}
+	fl.mmapLock.Lock()
+	if fl.mmapClosed {
+		// fl was closed in the meantime.
+		fl.mmapLock.Unlock()
+		m.close()
+		return
+	}
+	fl.mmap = m
+	fl.mmapLock.Unlock()
+}
+
+// mapped returns fl's memory mapping, which the caller must release once
+// done, or nil if reads should use the file's readers.
+func (fl *groupStoreFile) mapped() *mmapReader {
+	fl.mmapLock.Lock()
+	m := fl.mmap
+	fl.mmapLock.Unlock()
+	if m == nil || !m.acquire() {
+		return nil
+	}
+	return m
+}
+
+// readTo writes the value of length bytes at offset to w, less its first skip
+// bytes. The reader lock, or memory mapping, is only held while filling each
+// piece of the buffer so a slow w doesn't hold up other readers or closing.
+// For v1 files the whole value is read before being written to w.
+func (fl *groupStoreFile) readTo(keyA uint64, offset uint32, length uint32, skip uint32, w io.Writer) error {
+	if fl.version > 0 {
+		value := make([]byte, length)
+		if err := fl.readValueAt(int(keyA>>1)%len(fl.readerFPs), offset, value); err != nil {
+			return err
+		}
+		_, err := w.Write(value[skip:])
+		return err
+	}
+	offset += skip
+	length -= skip
+	size := length
+	if size > 65536 {
+		size = 65536
+	}
+	buf := make([]byte, size)
+	i := int(keyA>>1) % len(fl.readerFPs)
+	for length > 0 {
+		n := uint32(len(buf))
+		if n > length {
+			n = length
+		}
+		var err error
+		if m := fl.mapped(); m != nil {
+			_, err = m.ReadAt(buf[:n], int64(offset))
+			m.release()
+		} else {
+			fl.readerLocks[i].Lock()
+			fl.readerFPs[i].Seek(int64(offset), 0)
+			_, err = io.ReadFull(fl.readerFPs[i], buf[:n])
+			fl.readerLocks[i].Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// readGroup reads the values for entries, all under keyA, with a single reader
+// lock acquisition, or memory mapping acquisition; entries should be sorted by
+// offset so the reads are sequential.
+func (fl *groupStoreFile) readGroup(keyA uint64, entries []groupReadGroupEntry) error {
+	if m := fl.mapped(); m != nil {
+		defer m.release()
+		flr, _ := flateReaders.Get().(io.ReadCloser)
+		defer func() {
+			if flr != nil {
+				flateReaders.Put(flr)
+			}
+		}()
+		for j := range entries {
+			e := &entries[j]
+			e.value = make([]byte, e.length)
+			if err := fl.readValue(io.NewSectionReader(m, int64(e.offset), math.MaxInt64-int64(e.offset)), &flr, e.offset, e.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	i := int(keyA>>1) % len(fl.readerFPs)
+	fl.readerLocks[i].Lock()
+	for j := range entries {
+		e := &entries[j]
+		e.value = make([]byte, e.length)
+		if err := fl.readAt(i, e.offset, e.value); err != nil {
+			fl.readerLocks[i].Unlock()
+			return err
+		}
+	}
+	fl.readerLocks[i].Unlock()
+	return nil
+}
+
 func (fl *groupStoreFile) write(memBlock *groupMemBlock) {
 	if memBlock == nil {
 		return
@@ -168,18 +432,20 @@ func (fl *groupStoreFile) write(memBlock *groupMemBlock) {
 		}
 		return
 	}
-	left := len(memBlock.values)
-	for left > 0 {
-		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], memBlock.values[len(memBlock.values)-left:])
-		atomic.AddUint32(&fl.writerOffset, uint32(n))
-		fl.writerCurrentBuf.offset += uint32(n)
-		if fl.writerCurrentBuf.offset >= fl.store.checksumInterval {
-			s := fl.writerCurrentBuf.seq
-			fl.writerChecksumBufChan <- fl.writerCurrentBuf
-			fl.writerCurrentBuf = <-fl.writerFreeBufChan
-			fl.writerCurrentBuf.seq = s + 1
+	if fl.version == 0 {
+		fl.writeBytes(memBlock.values)
+	} else {
+		fl.writeFrames(memBlock)
+		// Compressed values may leave this memBlock, and those before it,
+		// waiting on a partial buffer until later memBlocks fill it. Once so
+		// many are waiting that the memWriters could run out of memBlocks,
+		// and so never send the ones that would fill it, the buffer is padded
+		// out instead. The TOC won't reference the padding.
+		if fl.writerCurrentBuf.offset != 0 && len(fl.writerCurrentBuf.memBlocks)+1 >= cap(fl.store.freeMemBlockChan)-len(fl.store.pendingWriteReqChans) {
+			fl.writerCurrentBuf.memBlocks = append(fl.writerCurrentBuf.memBlocks, memBlock)
+			fl.writeBytes(make([]byte, fl.writerBlockSize-fl.writerCurrentBuf.offset))
+			return
 		}
-		left -= n
 	}
 	if fl.writerCurrentBuf.offset == 0 {
 		fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
@@ -192,6 +458,70 @@ func (fl *groupStoreFile) write(memBlock *groupMemBlock) {
 	}
 }
 
+// writeFrames writes each of memBlock's values as a v1 frame, compressing
+// those that shrink, and updates the TOC offsets in memBlock to refer to the
+// frames (still relative to memBlock.fileOffset).
+func (fl *groupStoreFile) writeFrames(memBlock *groupMemBlock) {
+	var frame [_GROUP_FRAME_SIZE]byte
+	for memBlockTOCOffset := 0; memBlockTOCOffset < len(memBlock.toc); memBlockTOCOffset += _GROUP_FILE_ENTRY_SIZE {
+
+		entry := memBlock.toc[memBlockTOCOffset+40:]
+
+		offset := binary.BigEndian.Uint32(entry)
+		length := binary.BigEndian.Uint32(entry[4:])
+		binary.BigEndian.PutUint32(entry, atomic.LoadUint32(&fl.writerOffset)-memBlock.fileOffset)
+		stored := memBlock.values[offset : offset+length]
+		frame[0] = _GROUP_FRAME_RAW
+		if length > 0 {
+			fl.writerFlateBuf.Reset()
+			fl.writerFlate.Reset(&fl.writerFlateBuf)
+			fl.writerFlate.Write(stored)
+			fl.writerFlate.Close()
+			if fl.writerFlateBuf.Len() < len(stored) {
+				frame[0] = _GROUP_FRAME_FLATE
+				stored = fl.writerFlateBuf.Bytes()
+			}
+		}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(stored)))
+		fl.writeBytes(frame[:])
+		fl.writeBytes(stored)
+		atomic.AddUint64(&fl.store.compressedBytes, uint64(len(stored)))
+		atomic.AddUint64(&fl.store.uncompressedBytes, uint64(length))
+	}
+}
+
+func (fl *groupStoreFile) writeBytes(b []byte) {
+	left := len(b)
+	for left > 0 {
+		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.writerBlockSize], b[len(b)-left:])
+		atomic.AddUint32(&fl.writerOffset, uint32(n))
+		fl.writerCurrentBuf.offset += uint32(n)
+		if fl.writerCurrentBuf.offset >= fl.writerBlockSize {
+			s := fl.writerCurrentBuf.seq
+			fl.writerChecksumBufChan <- fl.writerCurrentBuf
+			fl.writerCurrentBuf = <-fl.writerFreeBufChan
+			fl.writerCurrentBuf.seq = s + 1
+		}
+		left -= n
+	}
+}
+
+// sync pads out the checksum interval being filled, if anything is in it, so
+// that it's sent on to disk along with the memBlocks waiting on it, and then
+// waits for the writer to have written everything so far and synced the file.
+// The TOC won't reference the padding.
+func (fl *groupStoreFile) sync() error {
+	if fl.writerChecksumBufChan == nil {
+		return nil
+	}
+	if fl.writerCurrentBuf.offset != 0 {
+		fl.writeBytes(make([]byte, fl.writerBlockSize-fl.writerCurrentBuf.offset))
+	}
+	synced := make(chan error, 1)
+	fl.writerToDiskBufChan <- &groupStoreFileWriteBuf{seq: fl.writerCurrentBuf.seq, synced: synced}
+	return <-synced
+}
+
 func (fl *groupStoreFile) closeWriting() error {
 	if fl.writerChecksumBufChan == nil {
 		return nil
@@ -206,13 +536,16 @@ func (fl *groupStoreFile) closeWriting() error {
 	// Make sure any trailing data is covered by a checksum by writing an
 	// additional block of zeros (since this is a value file and the TOC won't
 	// reference these additional locations, they are effectively ignored).
-	term := make([]byte, fl.store.checksumInterval)
+	term := make([]byte, fl.writerBlockSize)
 	copy(term[len(term)-8:], []byte("TERM v0 "))
 	left := len(term)
 	for left > 0 {
-		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], term[len(term)-left:])
+		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.writerBlockSize], term[len(term)-left:])
 		left -= n
 		fl.writerCurrentBuf.offset += uint32(n)
+		if fl.aead != nil {
+			fl.writerCurrentBuf.offset = uint32(len(fl.seal(fl.writerCurrentBuf.buf[:fl.writerCurrentBuf.offset], fl.writerCurrentBuf.seq)))
+		}
 		if left > 0 {
 			binary.BigEndian.PutUint32(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:], murmur3.Sum32(fl.writerCurrentBuf.buf[:fl.writerCurrentBuf.offset]))
 			fl.writerCurrentBuf.offset += 4
@@ -224,6 +557,7 @@ func (fl *groupStoreFile) closeWriting() error {
 			break
 		}
 		fl.writerCurrentBuf.offset = 0
+		fl.writerCurrentBuf.seq++
 	}
 	if err := fl.writerFP.Close(); err != nil {
 		if reterr == nil {
@@ -246,8 +580,31 @@ func (fl *groupStoreFile) closeWriting() error {
 	return reterr
 }
 
+// close may be called more than once, such as by compaction and then again by
+// the store's Close; only the first call has any effect.
 func (fl *groupStoreFile) close() error {
+	fl.closeOnce.Do(func() {
+		fl.closeErr = fl.closeFiles()
+	})
+	return fl.closeErr
+}
+
+func (fl *groupStoreFile) closeFiles() error {
 	reterr := fl.closeWriting()
+	// Once cleared no new reads will use the mapping; close waits for any
+	// in progress before unmapping.
+	fl.mmapLock.Lock()
+	m := fl.mmap
+	fl.mmap = nil
+	fl.mmapClosed = true
+	fl.mmapLock.Unlock()
+	if m != nil {
+		if err := m.close(); err != nil {
+			if reterr == nil {
+				reterr = err
+			}
+		}
+	}
 	for i, fp := range fl.readerFPs {
 		// This will let any ongoing reads complete.
 		fl.readerLocks[i].Lock()
@@ -273,15 +630,34 @@ func (fl *groupStoreFile) writingChecksummer() {
 		if buf == nil {
 			break
 		}
+		if fl.aead != nil {
+			fl.seal(buf.buf[:fl.writerBlockSize], buf.seq)
+		}
 		binary.BigEndian.PutUint32(buf.buf[fl.store.checksumInterval:], murmur3.Sum32(buf.buf[:fl.store.checksumInterval]))
 		fl.writerToDiskBufChan <- buf
 	}
 	fl.writerDoneChan <- struct{}{}
 }
 
+// seal encrypts the block with the given sequence number in place; the first
+// block's header is left in the clear.
+func (fl *groupStoreFile) seal(block []byte, seq int) []byte {
+	prefix := 0
+	if seq == 0 {
+		prefix = _GROUP_FILE_HEADER_SIZE
+	}
+	return sealBlock(fl.aead, block, prefix, uint64(seq))
+}
+
 func (fl *groupStoreFile) writer() {
 	var seq int
 	lastWasNil := false
+	// Once a write fails, later buffers are dropped rather than written, but
+	// are otherwise handled as usual so nothing waiting on them is stuck.
+	var err error
+	// syncReq is a sync request held until the buffers before it are
+	// written; see sync.
+	var syncReq *groupStoreFileWriteBuf
 	for {
 		buf := <-fl.writerToDiskBufChan
 		if buf == nil {
@@ -293,27 +669,40 @@ func (fl *groupStoreFile) writer() {
 			continue
 		}
 		lastWasNil = false
-		if buf.seq != seq {
+		if buf.synced != nil {
+			syncReq = buf
+		} else if buf.seq != seq {
 			fl.writerToDiskBufChan <- buf
 			continue
-		}
-		if _, err := fl.writerFP.Write(buf.buf); err != nil {
-			fl.store.logCritical("%s %s\n", fl.name, err)
-			break
-		}
-		if len(buf.memBlocks) > 0 {
-			for _, memBlock := range buf.memBlocks {
-				fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
-				fl.freeableMemBlockChanIndex++
-				if fl.freeableMemBlockChanIndex >= len(fl.store.freeableMemBlockChans) {
-					fl.freeableMemBlockChanIndex = 0
+		} else {
+			if err == nil {
+				if _, err = fl.writerFP.Write(buf.buf); err != nil {
+					fl.store.logCritical("%s %s\n", fl.name, err)
+					fl.store.durabilityFailed(err)
+				}
+			}
+			if len(buf.memBlocks) > 0 {
+				for _, memBlock := range buf.memBlocks {
+					fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
+					fl.freeableMemBlockChanIndex++
+					if fl.freeableMemBlockChanIndex >= len(fl.store.freeableMemBlockChans) {
+						fl.freeableMemBlockChanIndex = 0
+					}
 				}
+				buf.memBlocks = buf.memBlocks[:0]
 			}
-			buf.memBlocks = buf.memBlocks[:0]
+			buf.offset = 0
+			fl.writerFreeBufChan <- buf
+			seq++
+		}
+		if syncReq != nil && syncReq.seq == seq {
+			if err == nil {
+				syncReq.synced <- syncFile(fl.writerFP)
+			} else {
+				syncReq.synced <- err
+			}
+			syncReq = nil
 		}
-		buf.offset = 0
-		fl.writerFreeBufChan <- buf
-		seq++
 	}
 	fl.writerDoneChan <- struct{}{}
 }
@@ -321,27 +710,30 @@ func (fl *groupStoreFile) writer() {
 // Returns the header bytes and checksum interval stored in the header for a
 // value file or any error discovered; fpr is assumed to be at file position 0.
 func readGroupHeader(fpr io.Reader) ([]byte, uint32, error) {
-	return _readGroupHeader(fpr, false)
+	return _readGroupHeader(fpr, "")
 }
 
 // Returns the header bytes and checksum interval stored in the header for a
 // TOC file or any error discovered; fpr is assumed to be at file position 0.
 func readGroupHeaderTOC(fpr io.Reader) ([]byte, uint32, error) {
-	return _readGroupHeader(fpr, true)
+	return _readGroupHeader(fpr, "GROUPSTORETOC v0")
 }
 
-func _readGroupHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
+// _readGroupHeader reads a header expected to start with text, or with
+// either value file version's text if text is empty.
+func _readGroupHeader(fpr io.Reader, text string) ([]byte, uint32, error) {
 	buf := make([]byte, _GROUP_FILE_HEADER_SIZE)
 	if n, err := io.ReadFull(fpr, buf); err != nil {
 		return buf[:n], 0, err
 	}
-	var cmp []byte
-	if toc {
-		cmp = []byte("GROUPSTORETOC v0            ")
-	} else {
-		cmp = []byte("GROUPSTORE v0               ")
+	if text == "" {
+		text = "GROUPSTORE v0"
+		if groupHeaderVersion(buf) == 1 {
+			text = "GROUPSTORE v1"
+		}
 	}
-	if !bytes.Equal(buf[:28], cmp) {
+	keyID, encrypted := groupHeaderKeyID(buf)
+	if !bytes.Equal(buf[:28], newGroupHeader(text, 0, encrypted, keyID)[:28]) {
 		return buf, 0, errors.New("unknown file type in header")
 	}
 	checksumInterval := binary.BigEndian.Uint32(buf[28:])
@@ -351,6 +743,105 @@ func _readGroupHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	return buf, checksumInterval, nil
 }
 
+// groupHeaderVersion returns the format version of a value file from its
+// header bytes; 0 is the original format and 1 adds value frames.
+func groupHeaderVersion(header []byte) int {
+	if bytes.HasPrefix(header, []byte("GROUPSTORE v1")) {
+		return 1
+	}
+	return 0
+}
+
+// newGroupHeader returns a file header starting with text, such as
+// "GROUPSTORE v0"; if encrypted, the text is marked and keyID recorded.
+func newGroupHeader(text string, checksumInterval uint32, encrypted bool, keyID uint32) []byte {
+	head := bytes.Repeat([]byte(" "), _GROUP_FILE_HEADER_SIZE)
+	if encrypted {
+		copy(head, text+" E")
+		binary.BigEndian.PutUint32(head[24:], keyID)
+	} else {
+		copy(head, text)
+	}
+	binary.BigEndian.PutUint32(head[28:], checksumInterval)
+	return head
+}
+
+// newGroupTermBlock returns the block of zeros ending in "TERM v0 " written
+// at the end of TOC files so that any trailing data is covered by a checksum.
+func newGroupTermBlock(checksumInterval uint32, encrypted bool) []byte {
+	term := make([]byte, checksumInterval)
+	if encrypted {
+		term = term[_ENCRYPTION_OVERHEAD:]
+	}
+	copy(term[len(term)-_GROUP_FILE_TRAILER_SIZE:], []byte("TERM v0 "))
+	return term
+}
+
+// groupHeaderKeyID returns the key ID from a file header and whether the file
+// is encrypted at all.
+func groupHeaderKeyID(header []byte) (uint32, bool) {
+	if len(header) < _GROUP_FILE_HEADER_SIZE || !bytes.HasSuffix(bytes.TrimRight(header[:24], " "), []byte(" E")) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(header[24:]), true
+}
+
+// groupHeaderAEAD returns the AEAD for decrypting the file with the given
+// header, or nil if the file isn't encrypted.
+func groupHeaderAEAD(header []byte, keyProvider KeyProvider) (cipher.AEAD, error) {
+	keyID, encrypted := groupHeaderKeyID(header)
+	if !encrypted {
+		return nil, nil
+	}
+	if keyProvider == nil {
+		return nil, fmt.Errorf("file encrypted with key %d but no KeyProvider configured", keyID)
+	}
+	key, err := keyProvider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// newGroupTOCWriter returns a writer for a new TOC file, encrypting it if
+// the store has a KeyProvider, with the header already written.
+func newGroupTOCWriter(store *DefaultGroupStore, fp io.WriteCloser) (io.WriteCloser, error) {
+	return newGroupChecksummedWriter(store, fp, "GROUPSTORETOC v0")
+}
+
+// newGroupChecksummedWriter returns a checksummed writer, encrypting if the
+// store has a KeyProvider, with a header starting with text already written.
+func newGroupChecksummedWriter(store *DefaultGroupStore, fp io.WriteCloser, text string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	if store.durability == DurabilitySync {
+		// Syncs need each checksum interval written to fp as soon as it's
+		// complete, which the multicore writer doesn't promise.
+		w = brimutil.NewChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32)
+	} else {
+		w = brimutil.NewMultiCoreChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32, store.workers)
+	}
+	var keyID uint32
+	if store.keyProvider != nil {
+		var key []byte
+		var err error
+		if keyID, key, err = store.keyProvider.CurrentKey(); err != nil {
+			w.Close()
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = newBlockCipherWriter(w, aead, int(store.checksumInterval), _GROUP_FILE_HEADER_SIZE)
+	}
+	if _, err := w.Write(newGroupHeader(text, store.checksumInterval, store.keyProvider != nil, keyID)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
 type groupTOCEntry struct {
 	KeyA uint64
 	KeyB uint64
@@ -364,21 +855,30 @@ type groupTOCEntry struct {
 	Length        uint32
 }
 
-func groupReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChans []chan []groupTOCEntry, pendingBatchChans []chan []groupTOCEntry, controlChan chan struct{}) (int, []error) {
+func groupReadTOCEntriesBatched(fpr io.ReadSeeker, keyProvider KeyProvider, blockID uint32, freeBatchChans []chan []groupTOCEntry, pendingBatchChans []chan []groupTOCEntry, controlChan chan struct{}) (int, []error) {
 	// There is an assumption that the checksum interval is greater than the
 	// _GROUP_FILE_HEADER_SIZE and that the _GROUP_FILE_ENTRY_SIZE is
 	// greater than the _GROUP_FILE_TRAILER_SIZE.
 	var errs []error
 	var checksumInterval int
-	if _, ci, err := readGroupHeaderTOC(fpr); err != nil {
+	var aead cipher.AEAD
+	if header, ci, err := readGroupHeaderTOC(fpr); err != nil {
+		return 0, append(errs, err)
+	} else if aead, err = groupHeaderAEAD(header, keyProvider); err != nil {
 		return 0, append(errs, err)
 	} else {
 		checksumInterval = int(ci)
 	}
+	overhead := 0
+	if aead != nil {
+		overhead = _ENCRYPTION_OVERHEAD
+	}
 	fpr.Seek(0, 0)
 	buf := make([]byte, checksumInterval+4+_GROUP_FILE_ENTRY_SIZE)
 	rpos := 0
 	checksumErrors := 0
+	decryptErrors := 0
+	var index uint64
 	workers := uint64(len(freeBatchChans))
 	batches := make([][]groupTOCEntry, workers)
 	batches[0] = <-freeBatchChans[0]
@@ -407,12 +907,29 @@ L1:
 			rbuf = rbuf[:len(rbuf)-4]
 			if binary.BigEndian.Uint32(cbuf) != murmur3.Sum32(rbuf) {
 				checksumErrors++
-				rbuf = buf[:rpos+len(rbuf)]
+				rbuf = buf[:rpos+len(rbuf)-overhead]
 				skipNext = _GROUP_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _GROUP_FILE_ENTRY_SIZE)
 				rpos = 0
+				index++
 				continue
 			}
 		}
+		if aead != nil && len(rbuf) > 0 {
+			prefix := 0
+			if index == 0 {
+				prefix = _GROUP_FILE_HEADER_SIZE
+			}
+			var err error
+			if rbuf, err = openBlock(aead, rbuf, prefix, index); err != nil {
+				decryptErrors++
+				rbuf = buf[:rpos+checksumInterval-overhead]
+				skipNext = _GROUP_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _GROUP_FILE_ENTRY_SIZE)
+				rpos = 0
+				index++
+				continue
+			}
+		}
+		index++
 		if skipNext != 0 {
 			rbuf = rbuf[skipNext:]
 			skipNext = 0
@@ -435,7 +952,21 @@ L1:
 				keyB := binary.BigEndian.Uint64(rbuf[8:])
 				k := keyB % workers
 				if batches[k] == nil {
-					batches[k] = <-freeBatchChans[k]
+					select {
+					case batches[k] = <-freeBatchChans[k]:
+					default:
+						// Hand off any partly filled batches before waiting
+						// so that when several files are read at once, the
+						// readers can't all be waiting on batches held by
+						// each other.
+						for i := 0; i < len(batches); i++ {
+							if batches[i] != nil {
+								pendingBatchChans[i] <- batches[i][:batchesPos[i]]
+								batches[i] = nil
+							}
+						}
+						batches[k] = <-freeBatchChans[k]
+					}
 					batches[k] = batches[k][:cap(batches[k])]
 					batchesPos[k] = 0
 				}
@@ -468,6 +999,9 @@ L1:
 	if checksumErrors > 0 {
 		errs = append(errs, fmt.Errorf("there were %d checksum errors", checksumErrors))
 	}
+	if decryptErrors > 0 {
+		errs = append(errs, fmt.Errorf("there were %d blocks that failed decryption", decryptErrors))
+	}
 	return fromDiskCount, errs
 }
 
@@ -481,15 +1015,21 @@ func groupTOCStat(path string, statter func(name string) (os.FileInfo, error), o
 	if err != nil {
 		return 0, err
 	}
-	_, checksumInterval, err := readGroupHeaderTOC(fpr)
+	header, checksumInterval, err := readGroupHeaderTOC(fpr)
 	closeIfCloser(fpr)
 	if err != nil {
 		return 0, err
 	}
 	size := fileInfo.Size()
 	checksumsRemoved := size - size/(int64(checksumInterval)+4)*4
-	// NOTE: Store always writes the trailer as a full checksum interval block.
-	headerAndTrailerRemoved := checksumsRemoved - _GROUP_FILE_HEADER_SIZE - int64(checksumInterval)
+	blockSize := int64(checksumInterval)
+	if _, encrypted := groupHeaderKeyID(header); encrypted {
+		blockSize -= _ENCRYPTION_OVERHEAD
+		blocks := (size + int64(checksumInterval) + 3) / (int64(checksumInterval) + 4)
+		checksumsRemoved -= blocks * _ENCRYPTION_OVERHEAD
+	}
+	// NOTE: Store always writes the trailer as a full block.
+	headerAndTrailerRemoved := checksumsRemoved - _GROUP_FILE_HEADER_SIZE - blockSize
 	return int(headerAndTrailerRemoved / _GROUP_FILE_ENTRY_SIZE), nil
 }
 
@@ -499,7 +1039,8 @@ type groupCorruptRange struct {
 }
 
 // Scans a file for checksum errors and returns all the corrupt ranges and
-// errors encountered.
+// errors encountered. For encrypted files the ranges are in terms of the
+// decrypted offsets.
 func groupChecksumVerify(fpr io.Reader) ([]*groupCorruptRange, []error) {
 	header, checksumInterval, err := readGroupHeader(fpr)
 	if err != nil {
@@ -510,8 +1051,12 @@ func groupChecksumVerify(fpr io.Reader) ([]*groupCorruptRange, []error) {
 	if _, err := io.ReadFull(fpr, buf[len(header):]); err != nil {
 		return []*groupCorruptRange{&groupCorruptRange{0, math.MaxUint32}}, []error{err}
 	}
+	blockSize := checksumInterval
+	if _, encrypted := groupHeaderKeyID(header); encrypted {
+		blockSize -= _ENCRYPTION_OVERHEAD
+	}
 	start := uint32(0)
-	stop := checksumInterval - 1
+	stop := blockSize - 1
 	var corruptions []*groupCorruptRange
 	var errs []error
 	for {
@@ -519,7 +1064,7 @@ func groupChecksumVerify(fpr io.Reader) ([]*groupCorruptRange, []error) {
 			corruptions = append(corruptions, &groupCorruptRange{start, stop})
 		}
 		start = stop + 1
-		stop = stop + checksumInterval
+		stop = stop + blockSize
 		if _, err := io.ReadFull(fpr, buf); err != nil {
 			corruptions = append(corruptions, &groupCorruptRange{start, math.MaxUint32})
 			errs = append(errs, err)
@@ -529,21 +1074,77 @@ func groupChecksumVerify(fpr io.Reader) ([]*groupCorruptRange, []error) {
 	return corruptions, errs
 }
 
-func groupInCorruptRange(offset uint32, length uint32, corruptions []*groupCorruptRange) bool {
+func groupInCorruptRange(offset uint32, length int64, corruptions []*groupCorruptRange) bool {
 	// Offset == 0 means a filler offset as offset zero is always the header.
 	// Length == 0 means it really doesn't matter if it's in a corrupted range
 	// since it's zero bytes long anyway.
 	if offset == 0 || length == 0 {
 		return false
 	}
-	end := offset + length - 1
+	end := int64(offset) + length - 1
 	for _, corruption := range corruptions {
 		if offset >= corruption.start && offset <= corruption.stop {
 			return true
 		}
-		if end >= corruption.start && end <= corruption.stop {
+		if end >= int64(corruption.start) && end <= int64(corruption.stop) {
 			return true
 		}
 	}
 	return false
 }
+
+// openGroupFrames opens name with open for use with groupEntryCorrupt,
+// returning a reader of the group file as a groupStoreFile reads it along
+// with the file to close once done. For v0 files, which have no frames, the
+// reader is nil.
+func openGroupFrames(open func(name string) (io.ReadSeeker, error), name string, keyProvider KeyProvider) (io.ReadSeeker, io.ReadSeeker, error) {
+	fp, err := open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, checksumInterval, err := readGroupHeader(fp)
+	if err != nil {
+		closeIfCloser(fp)
+		return nil, nil, err
+	}
+	if groupHeaderVersion(header) == 0 {
+		closeIfCloser(fp)
+		return nil, nil, nil
+	}
+	aead, err := groupHeaderAEAD(header, keyProvider)
+	if err != nil {
+		closeIfCloser(fp)
+		return nil, nil, err
+	}
+	var frames io.ReadSeeker = brimutil.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
+	if aead != nil {
+		frames = newBlockCipherReader(frames, aead, int(checksumInterval), _GROUP_FILE_HEADER_SIZE)
+	}
+	return frames, fp, nil
+}
+
+// groupEntryCorrupt reports whether the value of a TOC entry falls within any
+// of corruptions or, if limit isn't 0, extends past limit. For v1 files,
+// frames is from openGroupFrames and the length the value is stored with,
+// which may be compressed, is read from its frame header; frames is nil for
+// v0 files, where values are stored with just their length.
+func groupEntryCorrupt(frames io.ReadSeeker, offset uint32, length uint32, limit int64, corruptions []*groupCorruptRange) bool {
+	stored := int64(length)
+	if frames != nil {
+		if groupInCorruptRange(offset, _GROUP_FRAME_SIZE, corruptions) {
+			return true
+		}
+		var frame [_GROUP_FRAME_SIZE]byte
+		if _, err := frames.Seek(int64(offset), 0); err != nil {
+			return true
+		}
+		if _, err := io.ReadFull(frames, frame[:]); err != nil {
+			return true
+		}
+		stored = _GROUP_FRAME_SIZE + int64(binary.BigEndian.Uint32(frame[1:]))
+	}
+	if limit > 0 && int64(offset)+stored > limit {
+		return true
+	}
+	return groupInCorruptRange(offset, stored, corruptions)
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestGroupStream(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	v1 := make([]byte, 5000)
+	for i := range v1 {
+		v1[i] = byte(i)
+	}
+	if _, err := store.WriteStream(1, 2, 3, 4, 1000, bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.ReadStream(1, 2, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if !bytes.Equal(v, v1) {
+		t.Fatal(len(v))
+	}
+	if timestampMicro, _, err := store.Read(1, 2, 3, 4, nil); err != ErrStream || timestampMicro != 1000 {
+		t.Fatal(timestampMicro, err)
+	}
+	if timestampMicro, length, err := store.Lookup(1, 2, 3, 4); err != ErrStream || timestampMicro != 1000 || length != 0 {
+		t.Fatal(timestampMicro, length, err)
+	}
+
+	if items := store.LookupGroup(1, 2); len(items) != 1 || !items[0].Stream || items[0].Length != 0 {
+		t.Fatal(items)
+	}
+	if items, err := store.ReadGroup(1, 2, ReadGroupOptions{}); err != nil || len(items) != 1 || !items[0].Stream || items[0].Value != nil {
+		t.Fatal(items, err)
+	}
+
+	// An older stream should be ignored and leave no chunks behind.
+	timestampMicro, err := store.WriteStream(1, 2, 3, 4, 999, bytes.NewReader(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 {
+		t.Fatal(timestampMicro)
+	}
+	ckeyA, ckeyB, cnameKeyA, cnameKeyB := groupStreamChunkKeys(1, 2, 3, 4, 999, 0)
+	if _, _, err := store.Read(ckeyA, ckeyB, cnameKeyA, cnameKeyB, nil); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	// A newer stream replaces the old one and its chunks.
+	v2 := []byte("short")
+	if _, err := store.WriteStream(1, 2, 3, 4, 2000, bytes.NewReader(v2)); err != nil {
+		t.Fatal(err)
+	}
+	ckeyA, ckeyB, cnameKeyA, cnameKeyB = groupStreamChunkKeys(1, 2, 3, 4, 1000, 4)
+	if _, _, err := store.Read(ckeyA, ckeyB, cnameKeyA, cnameKeyB, nil); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	rc, err = store.ReadStream(1, 2, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = ioutil.ReadAll(rc); err != nil || !bytes.Equal(v, v2) {
+		t.Fatal(string(v), err)
+	}
+	// Plain values can be read as streams too.
+	if _, err := store.Write(5, 6, 7, 8, 1000, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = store.ReadStream(5, 6, 7, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = ioutil.ReadAll(rc); err != nil || string(v) != "plain" {
+		t.Fatal(string(v), err)
+	}
+	// Any write replacing a stream, here a plain delete, removes its chunks.
+	if _, err := store.Delete(1, 2, 3, 4, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadStream(1, 2, 3, 4); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	ckeyA, ckeyB, cnameKeyA, cnameKeyB = groupStreamChunkKeys(1, 2, 3, 4, 2000, 0)
+	if _, _, err := store.Read(ckeyA, ckeyB, cnameKeyA, cnameKeyB, nil); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	if items := store.LookupGroup(1, 2); len(items) != 0 {
+		t.Fatal(items)
+	}
+
+}
+
+func TestGroupStreamCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := newGroupTestStore(t, dir, nil)
+	v1 := make([]byte, 5000)
+	for i := range v1 {
+		v1[i] = byte(i)
+	}
+	if _, err := store.WriteStream(1, 2, 3, 4, 1000, bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Compaction rewriting the stream's entries must not be taken as
+	// replacing them.
+	store = newGroupTestStore(t, dir, nil)
+	defer store.Close()
+	store.compactionState.ageThreshold = 0
+	store.CompactionPass()
+	store.Flush()
+	if stats := store.Stats(false).(*GroupStoreStats); stats.SmallFileCompactions == 0 {
+		t.Fatal(stats.SmallFileCompactions)
+	}
+	rc, err := store.ReadStream(1, 2, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if !bytes.Equal(v, v1) {
+		t.Fatal(len(v))
+	}
+}
+
+func TestGroupStreamReplaced(t *testing.T) {
+	store := newGroupTestStore(t, t.TempDir(), nil)
+	defer store.Close()
+	// Each way of replacing a stream has to remove its chunks, however the
+	// write is handed off.
+	for n, replace := range []func(timestampMicro int64) error{
+		func(timestampMicro int64) error {
+			return store.WriteBatch([]GroupBatchEntry{
+				{KeyA: 1, KeyB: 2, NameKeyA: 3, NameKeyB: 4, TimestampMicro: timestampMicro, Value: []byte("batch")},
+			})[0].Err
+		},
+		func(timestampMicro int64) error {
+			return store.DeleteBatch([]GroupBatchEntry{
+				{KeyA: 1, KeyB: 2, NameKeyA: 3, NameKeyB: 4, TimestampMicro: timestampMicro},
+			})[0].Err
+		},
+
+		func(timestampMicro int64) error {
+			_, err := store.DeleteGroup(1, 2, timestampMicro)
+			return err
+		},
+
+		func(timestampMicro int64) error {
+			_, err := store.WriteIf(1, 2, 3, 4, timestampMicro-1, timestampMicro, []byte("if"))
+			return err
+		},
+		func(timestampMicro int64) error {
+			// Give up on the write once it has been handed off.
+			release := stallGroupMemWriters(store)
+			defer release()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, err := store.WriteContext(ctx, 1, 2, 3, 4, timestampMicro, []byte("abandoned")); err != context.DeadlineExceeded {
+				return fmt.Errorf("expected %v; got %v", context.DeadlineExceeded, err)
+			}
+			return nil
+		},
+	} {
+		streamMicro := int64(n+1) * 1000
+		if _, err := store.WriteStream(1, 2, 3, 4, streamMicro, bytes.NewReader(make([]byte, 3000))); err != nil {
+			t.Fatal(n, err)
+		}
+		if err := replace(streamMicro + 1); err != nil {
+			t.Fatal(n, err)
+		}
+		ckeyA, ckeyB, cnameKeyA, cnameKeyB := groupStreamChunkKeys(1, 2, 3, 4, streamMicro, 0)
+		for j := 0; ; j++ {
+			_, _, err := store.Read(ckeyA, ckeyB, cnameKeyA, cnameKeyB, nil)
+			if err == ErrNotFound {
+				break
+			}
+			if j == 1000 {
+				t.Fatal(n, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// GroupChange describes a change made to the store; see Subscribe.
+type GroupChange struct {
+	KeyA uint64
+	KeyB uint64
+
+	NameKeyA uint64
+	NameKeyB uint64
+
+	// PreviousTimestampMicro is the timestampmicro that was replaced, or 0 if
+	// the key was not known before.
+	PreviousTimestampMicro int64
+	TimestampMicro         int64
+	// Deleted indicates the change was a deletion marker (aka tombstone)
+	// rather than a value.
+	Deleted bool
+	Origin  ChangeOrigin
+}
+
+type groupSubscription struct {
+	filter     SubscribeFilter
+	changeChan chan GroupChange
+	doneChan   chan struct{}
+	doneOnce   sync.Once
+}
+
+// Subscribe returns a channel that will receive a GroupChange for each
+// write or delete that actually changes the store and matches the filter, and
+// a function that cancels the subscription. Writes that are ignored because a
+// newer timestamp is already stored are not sent, nor are internal changes
+// such as compaction rewrites and local removals after handoffs.
+//
+// Changes are sent in the order they are applied for any given key, but
+// changes for different keys may arrive out of order. The channel is closed
+// once the subscription is canceled or the store is closed.
+func (store *DefaultGroupStore) Subscribe(filter SubscribeFilter) (<-chan GroupChange, func()) {
+	buffer := filter.Buffer
+	if buffer < 1 {
+		buffer = 1024
+	}
+	sub := &groupSubscription{
+		filter:     filter,
+		changeChan: make(chan GroupChange, buffer),
+		doneChan:   make(chan struct{}),
+	}
+	store.subscriptionsLock.Lock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		store.subscriptionsLock.Unlock()
+		close(sub.changeChan)
+		return sub.changeChan, func() {}
+	}
+	store.subscriptions = append(store.subscriptions, sub)
+	atomic.AddInt32(&store.subscriptionCount, 1)
+	store.subscriptionsLock.Unlock()
+	return sub.changeChan, func() { store.unsubscribe(sub) }
+}
+
+func (store *DefaultGroupStore) unsubscribe(sub *groupSubscription) {
+	// Closing doneChan first releases any memWriter blocked sending to this
+	// subscription, which would otherwise be holding the read lock.
+	sub.doneOnce.Do(func() { close(sub.doneChan) })
+	store.subscriptionsLock.Lock()
+	for i, s := range store.subscriptions {
+		if s == sub {
+			copy(store.subscriptions[i:], store.subscriptions[i+1:])
+			store.subscriptions[len(store.subscriptions)-1] = nil
+			store.subscriptions = store.subscriptions[:len(store.subscriptions)-1]
+			atomic.AddInt32(&store.subscriptionCount, -1)
+			close(sub.changeChan)
+			break
+		}
+	}
+	store.subscriptionsLock.Unlock()
+}
+
+// unsubscribeAll is called by Close to cancel all subscriptions.
+func (store *DefaultGroupStore) unsubscribeAll() {
+	store.subscriptionsLock.RLock()
+	subs := make([]*groupSubscription, len(store.subscriptions))
+	copy(subs, store.subscriptions)
+	store.subscriptionsLock.RUnlock()
+	for _, sub := range subs {
+		store.unsubscribe(sub)
+	}
+}
+
+// notifySubscribers is called by the memWriter for writeReq once it has
+// replaced ptimestampbits in the locmap.
+func (store *DefaultGroupStore) notifySubscribers(writeReq *groupWriteReq, ptimestampbits uint64) {
+	change := GroupChange{
+		KeyA: writeReq.keyA,
+		KeyB: writeReq.keyB,
+
+		NameKeyA: writeReq.nameKeyA,
+		NameKeyB: writeReq.nameKeyB,
+
+		PreviousTimestampMicro: int64(ptimestampbits >> _TSB_UTIL_BITS),
+		TimestampMicro:         int64(writeReq.timestampbits >> _TSB_UTIL_BITS),
+		Deleted:                writeReq.timestampbits&_TSB_DELETION != 0,
+		Origin:                 ChangeOriginLocal,
+	}
+	if writeReq.replicated {
+		change.Origin = ChangeOriginReplication
+	}
+	store.subscriptionsLock.RLock()
+	for _, sub := range store.subscriptions {
+		if writeReq.replicated && !sub.filter.Replicated {
+			continue
+		}
+		if change.KeyA < sub.filter.StartKeyA || (sub.filter.StopKeyA != 0 && change.KeyA > sub.filter.StopKeyA) {
+			continue
+		}
+		if sub.filter.Block {
+			select {
+			case sub.changeChan <- change:
+			case <-sub.doneChan:
+			}
+		} else {
+			select {
+			case sub.changeChan <- change:
+			default:
+				atomic.AddInt32(&store.droppedChanges, 1)
+			}
+		}
+	}
+	store.subscriptionsLock.RUnlock()
+}
@@ -57,7 +57,7 @@ func (store *DefaultGroupStore) TombstoneDiscardPass() {
 // expired tombstones (deletion markers).
 func (store *DefaultGroupStore) EnableTombstoneDiscard() {
 	store.tombstoneDiscardState.notifyChanLock.Lock()
-	if store.tombstoneDiscardState.notifyChan == nil {
+	if store.tombstoneDiscardState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.tombstoneDiscardState.notifyChan = make(chan *bgNotification, 1)
 		go store.tombstoneDiscardLauncher(store.tombstoneDiscardState.notifyChan)
 	}
@@ -131,6 +131,9 @@ func (store *DefaultGroupStore) tombstoneDiscardPass(notifyChan chan *bgNotifica
 			store.logDebug("tombstone discard pass took %s\n", time.Now().Sub(begin))
 		}()
 	}
+	if n := store.tombstoneDiscardPassExpiredValues(notifyChan); n != nil {
+		return n
+	}
 	if n := store.tombstoneDiscardPassLocalRemovals(notifyChan); n != nil {
 		return n
 	}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/gholt/brimtime.v1"
+)
+
+// WriteWithTTL is the same as Write except that the value will expire ttl
+// after timestampmicro. Once expired, Read and Lookup will treat the value as
+// if it was deleted and the next tombstone discard pass will replace it with
+// a deletion marker (aka tombstone) with the same timestampmicro. Note that
+// the expiration is stored along with the value, so the value may be up to
+// 8 bytes less than ValueCap. Every node in a cluster must be running a
+// version supporting WriteWithTTL before it is used; see the package
+// documentation.
+func (store *DefaultGroupStore) WriteWithTTL(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampmicro int64, value []byte, ttl time.Duration) (int64, error) {
+	atomic.AddInt32(&store.writes, 1)
+	if timestampmicro < TIMESTAMPMICRO_MIN {
+		atomic.AddInt32(&store.writeErrors, 1)
+		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+	}
+	if timestampmicro > TIMESTAMPMICRO_MAX {
+		atomic.AddInt32(&store.writeErrors, 1)
+		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+	}
+	if ttl < time.Microsecond {
+		atomic.AddInt32(&store.writeErrors, 1)
+		return 0, fmt.Errorf("ttl %s < %s", ttl, time.Microsecond)
+	}
+
+	if nameKeyA == _GROUP_DELETION_NAME_KEY && nameKeyB == _GROUP_DELETION_NAME_KEY {
+		atomic.AddInt32(&store.writeErrors, 1)
+		return 0, ErrReservedName
+	}
+
+	expires := timestampmicro + int64(ttl/time.Microsecond)
+	if expires < timestampmicro {
+		expires = math.MaxInt64
+	}
+	v := make([]byte, _EXPIRES_LENGTH+len(value))
+	binary.BigEndian.PutUint64(v, uint64(expires))
+	copy(v[_EXPIRES_LENGTH:], value)
+	timestampbits, err := store.write(keyA, keyB, nameKeyA, nameKeyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_EXPIRES, v, false)
+	if err == nil {
+		err = store.syncWrites(context.Background())
+	}
+	if err != nil {
+		atomic.AddInt32(&store.writeErrors, 1)
+	} else if timestampmicro <= int64(timestampbits>>_TSB_UTIL_BITS) {
+		atomic.AddInt32(&store.writesOverridden, 1)
+	}
+	return int64(timestampbits >> _TSB_UTIL_BITS), err
+}
+
+// readUnexpired is the same as read except that values written with
+// WriteWithTTL have their expiration prefix removed or, if expired, result in
+// ErrNotFound.
+func (store *DefaultGroupStore) readUnexpired(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (uint64, []byte, error) {
+	start := len(value)
+	timestampbits, value, err := store.read(keyA, keyB, nameKeyA, nameKeyB, value)
+	if err != nil || timestampbits&_TSB_EXPIRES == 0 {
+		return timestampbits, value, err
+	}
+	if expiredValue(timestampbits, value[start:], brimtime.TimeToUnixMicro(time.Now())) {
+		return timestampbits, value[:start], ErrNotFound
+	}
+	return timestampbits, append(value[:start], value[start+_EXPIRES_LENGTH:]...), nil
+}
+
+// lookupUnexpired is the same as lookup except that values written with
+// WriteWithTTL have the expiration prefix removed from their length or, if
+// expired, result in ErrNotFound.
+func (store *DefaultGroupStore) lookupUnexpired(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (uint64, uint32, error) {
+	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB, nameKeyA, nameKeyB)
+	if id == 0 || timestampbits&_TSB_DELETION != 0 {
+		return timestampbits, 0, ErrNotFound
+	}
+	if timestampbits&_TSB_EXPIRES != 0 {
+		expired, err := store.expired(keyA, keyB, nameKeyA, nameKeyB, timestampbits, id, offset)
+		if err != nil {
+			return timestampbits, 0, err
+		}
+		if expired {
+			return timestampbits, 0, ErrNotFound
+		}
+		length -= _EXPIRES_LENGTH
+	}
+	return timestampbits, length, nil
+}
+
+// unexpiredValue returns value with any expiration prefix removed, or false
+// if the value has expired.
+func (store *DefaultGroupStore) unexpiredValue(timestampbits uint64, value []byte) ([]byte, bool) {
+	if timestampbits&_TSB_EXPIRES == 0 {
+		return value, true
+	}
+	if expiredValue(timestampbits, value, brimtime.TimeToUnixMicro(time.Now())) {
+		return nil, false
+	}
+	return value[_EXPIRES_LENGTH:], true
+}
+
+// expired reads just the expiration prefix of the stored value to determine
+// whether it has expired.
+func (store *DefaultGroupStore) expired(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, id uint32, offset uint32) (bool, error) {
+	var buf [_EXPIRES_LENGTH]byte
+	timestampbits, prefix, err := store.locBlock(id).read(keyA, keyB, nameKeyA, nameKeyB, timestampbits, offset, _EXPIRES_LENGTH, buf[:0])
+	if err != nil {
+		return false, err
+	}
+	return expiredValue(timestampbits, prefix, brimtime.TimeToUnixMicro(time.Now())), nil
+}
+
+// tombstoneDiscardPassExpiredValues scans for entries marked with _TSB_EXPIRES
+// (but not _TSB_DELETION or _TSB_LOCAL_REMOVAL) and replaces those that have
+// expired with deletion markers having the same timestamp. Since the deletion
+// marker wins over the value with the same timestamp, every replica ends up in
+// the same state whether they expired the value themselves or received the
+// deletion marker through replication.
+func (store *DefaultGroupStore) tombstoneDiscardPassExpiredValues(notifyChan chan *bgNotification) *bgNotification {
+	// Each worker will perform a pass on a subsection of each partition's key
+	// space. Additionally, each worker will start their work on different
+	// partition. This reduces contention for a given section of the locmap.
+	partitionShift := uint16(0)
+	partitionMax := uint64(0)
+	if store.msgRing != nil {
+		pbc := store.msgRing.Ring().PartitionBitCount()
+		partitionShift = 64 - pbc
+		partitionMax = (uint64(1) << pbc) - 1
+	}
+	workerMax := uint64(store.workers - 1)
+	workerPartitionPiece := (uint64(1) << partitionShift) / (workerMax + 1)
+	work := func(partition uint64, worker uint64, localRemovals []groupLocalRemovalEntry) {
+		partitionOnLeftBits := partition << partitionShift
+		rangeBegin := partitionOnLeftBits + (workerPartitionPiece * worker)
+		var rangeEnd uint64
+		// A little bit of complexity here to handle where the more general
+		// expressions would have overflow issues.
+		if worker != workerMax {
+			rangeEnd = partitionOnLeftBits + (workerPartitionPiece * (worker + 1)) - 1
+		} else {
+			if partition != partitionMax {
+				rangeEnd = ((partition + 1) << partitionShift) - 1
+			} else {
+				rangeEnd = math.MaxUint64
+			}
+		}
+		// Values can't expire before they're written, so anything newer than
+		// now can be skipped.
+		cutoff := uint64(brimtime.TimeToUnixMicro(time.Now())) << _TSB_UTIL_BITS
+		more := true
+		for more {
+			localRemovalsIndex := 0
+			// Since we shouldn't try to modify what we're scanning while we're
+			// scanning (lock contention) we instead record in localRemovals
+			// what to check and modify after the scan.
+			rangeBegin, more = store.locmap.ScanCallback(rangeBegin, rangeEnd, _TSB_EXPIRES, _TSB_DELETION|_TSB_LOCAL_REMOVAL, cutoff, uint64(store.tombstoneDiscardState.batchSize), func(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampbits uint64, length uint32) bool {
+				e := &localRemovals[localRemovalsIndex]
+				e.keyA = keyA
+				e.keyB = keyB
+
+				e.nameKeyA = nameKeyA
+				e.nameKeyB = nameKeyB
+
+				e.timestampbits = timestampbits
+				localRemovalsIndex++
+				return true
+			})
+			for i := 0; i < localRemovalsIndex; i++ {
+				e := &localRemovals[i]
+				timestampbits, id, offset, _ := store.locmap.Get(e.keyA, e.keyB, e.nameKeyA, e.nameKeyB)
+				if id == 0 || timestampbits != e.timestampbits {
+					continue
+				}
+				if expired, err := store.expired(e.keyA, e.keyB, e.nameKeyA, e.nameKeyB, timestampbits, id, offset); err != nil || !expired {
+					continue
+				}
+				// These writes go through the entire system, so they're
+				// persisted and therefore restored on restarts.
+				ptimestampbits, err := store.write(e.keyA, e.keyB, e.nameKeyA, e.nameKeyB, (timestampbits>>_TSB_UTIL_BITS<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
+				if err == nil && ptimestampbits == timestampbits {
+					atomic.AddInt32(&store.expiredValues, 1)
+				}
+			}
+		}
+	}
+	// To avoid memory churn, the localRemovals scratchpads are allocated just
+	// once and passed in to the workers.
+	for len(store.tombstoneDiscardState.localRemovals) <= int(workerMax) {
+		store.tombstoneDiscardState.localRemovals = append(store.tombstoneDiscardState.localRemovals, make([]groupLocalRemovalEntry, store.tombstoneDiscardState.batchSize))
+	}
+	var abort uint32
+	wg := &sync.WaitGroup{}
+	wg.Add(int(workerMax + 1))
+	for worker := uint64(0); worker <= workerMax; worker++ {
+		go func(worker uint64) {
+			localRemovals := store.tombstoneDiscardState.localRemovals[worker]
+			partitionBegin := (partitionMax + 1) / (workerMax + 1) * worker
+			for partition := partitionBegin; ; {
+				if atomic.LoadUint32(&abort) != 0 {
+					break
+				}
+				work(partition, worker, localRemovals)
+				partition++
+				if partition > partitionMax {
+					partition = 0
+				}
+				if partition == partitionBegin {
+					break
+				}
+			}
+			wg.Done()
+		}(worker)
+	}
+	waitChan := make(chan struct{}, 1)
+	go func() {
+		wg.Wait()
+		close(waitChan)
+	}()
+	select {
+	case notification := <-notifyChan:
+		atomic.AddUint32(&abort, 1)
+		<-waitChan
+		return notification
+	case <-waitChan:
+		return nil
+	}
+}
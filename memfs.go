@@ -0,0 +1,229 @@
+package store
+
+import (
+	"io"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps every file in memory, for tests and embedded use
+// where nothing should touch the disk. Directories exist implicitly, so
+// MkdirAll does nothing and listing a directory returns the files directly
+// within it. DiskUsage reports the bytes held against Size.
+type MemFS struct {
+	// Size is the total bytes DiskUsage reports; zero means unlimited.
+	Size  uint64
+	lock  sync.RWMutex
+	files map[string]*memBuf
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memBuf)}
+}
+
+func (fs *MemFS) Open(name string) (io.ReadSeeker, error) {
+	fs.lock.RLock()
+	buf := fs.files[path.Clean(name)]
+	fs.lock.RUnlock()
+	if buf == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{buf: buf}, nil
+}
+
+func (fs *MemFS) Create(name string) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	fs.lock.Lock()
+	buf := fs.files[name]
+	if buf == nil {
+		buf = &memBuf{}
+		fs.files[name] = buf
+	}
+	fs.lock.Unlock()
+	// Like os.Create, the existing file is truncated in place, which any
+	// links to it will see.
+	buf.lock.Lock()
+	buf.buf = nil
+	buf.modTime = time.Now()
+	buf.lock.Unlock()
+	return &memFile{buf: buf}, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.files[name] == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *MemFS) Rename(oldname string, newname string) error {
+	oldname = path.Clean(oldname)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[oldname]
+	if buf == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[path.Clean(newname)] = buf
+	return nil
+}
+
+func (fs *MemFS) Link(oldname string, newname string) error {
+	oldname = path.Clean(oldname)
+	newname = path.Clean(newname)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	buf := fs.files[oldname]
+	if buf == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if fs.files[newname] != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	fs.files[newname] = buf
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(name string) error {
+	return nil
+}
+
+func (fs *MemFS) ReadDirNames(name string) ([]string, error) {
+	name = path.Clean(name)
+	var names []string
+	fs.lock.RLock()
+	for n := range fs.files {
+		if path.Dir(n) == name {
+			names = append(names, path.Base(n))
+		}
+	}
+	fs.lock.RUnlock()
+	return names, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.lock.RLock()
+	buf := fs.files[path.Clean(name)]
+	fs.lock.RUnlock()
+	if buf == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	buf.lock.RLock()
+	defer buf.lock.RUnlock()
+	return &memFileInfo{name: path.Base(name), size: int64(len(buf.buf)), modTime: buf.modTime}, nil
+}
+
+func (fs *MemFS) DiskUsage(name string) (uint64, uint64) {
+	var used uint64
+	seen := make(map[*memBuf]bool)
+	fs.lock.RLock()
+	for _, buf := range fs.files {
+		if !seen[buf] {
+			seen[buf] = true
+			buf.lock.RLock()
+			used += uint64(len(buf.buf))
+			buf.lock.RUnlock()
+		}
+	}
+	fs.lock.RUnlock()
+	size := fs.Size
+	if size == 0 {
+		size = math.MaxUint64
+	}
+	if used > size {
+		return 0, size
+	}
+	return size - used, size
+}
+
+// SyncDir does nothing, as a MemFS has nothing to lose in a crash that it
+// wouldn't lose anyway.
+func (fs *MemFS) SyncDir(name string) error {
+	return nil
+}
+
+// memBuf is the contents of a MemFS file, shared by every memFile opened on
+// it.
+type memBuf struct {
+	lock    sync.RWMutex
+	buf     []byte
+	modTime time.Time
+}
+
+// memFile is an open MemFS file with its own position.
+type memFile struct {
+	buf *memBuf
+	pos int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.buf.lock.RLock()
+	var n int
+	if f.pos < int64(len(f.buf.buf)) {
+		n = copy(p, f.buf.buf[f.pos:])
+	}
+	f.buf.lock.RUnlock()
+	if n == 0 {
+		return 0, io.EOF
+	}
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+		f.pos = offset
+	case 1:
+		f.pos += offset
+	case 2:
+		f.buf.lock.RLock()
+		f.pos = int64(len(f.buf.buf)) + offset
+		f.buf.lock.RUnlock()
+	}
+	return f.pos, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.buf.lock.Lock()
+	if end := f.pos + int64(len(p)); end > int64(len(f.buf.buf)) {
+		if end > int64(cap(f.buf.buf)) {
+			buf := make([]byte, end, end*2)
+			copy(buf, f.buf.buf)
+			f.buf.buf = buf
+		} else {
+			f.buf.buf = f.buf.buf[:end]
+		}
+	}
+	copy(f.buf.buf[f.pos:], p)
+	f.buf.modTime = time.Now()
+	f.buf.lock.Unlock()
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// flateReaders holds flate readers for reads that have none of their own to
+// reuse, such as those from memory mappings.
+var flateReaders sync.Pool
+
+// mmapReader reads a closed file, as written through a checksummed writer and
+// possibly a blockCipherWriter, from a read only memory mapping. It presents
+// the same offsets a brimutil.ChecksummedReader, and blockCipherReader if
+// encrypted, would. Reads need no locking; each checksum interval is verified
+// the first time a read touches it.
+type mmapReader struct {
+	data     []byte
+	interval int64
+	aead     cipher.AEAD
+	prefix   int
+	verified []uint32
+	// lock covers users and closed; released is signalled once users drops
+	// to zero after closed is set.
+	lock     sync.Mutex
+	released *sync.Cond
+	users    int
+	closed   bool
+}
+
+// newMmapReader maps the file fp, which must have an Fd method as *os.File
+// does. The mapping stays valid after fp is closed.
+func newMmapReader(fp io.ReadSeeker, interval int, aead cipher.AEAD, prefix int) (*mmapReader, error) {
+	f, ok := fp.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return nil, errors.New("file does not support memory mapping")
+	}
+	size, err := fp.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	// The whole file has to fit in the address space, which only limits
+	// 32-bit builds.
+	if size <= 0 || size > int64(^uint(0)>>1) {
+		return nil, fmt.Errorf("file size of %d can't be memory mapped", size)
+	}
+	data, err := mmap(f.Fd(), int(size))
+	if err != nil {
+		return nil, err
+	}
+	blocks := (size + int64(interval) + 3) / (int64(interval) + 4)
+	m := &mmapReader{data: data, interval: int64(interval), aead: aead, prefix: prefix, verified: make([]uint32, (blocks+31)/32)}
+	m.released = sync.NewCond(&m.lock)
+	return m, nil
+}
+
+// ReadAt reads from the data as it was before checksumming and encryption.
+func (m *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	size := m.interval
+	if m.aead != nil {
+		size -= _ENCRYPTION_OVERHEAD
+	}
+	n := 0
+	for n < len(p) {
+		index := off / size
+		block, err := m.block(index)
+		if err != nil {
+			return n, err
+		}
+		o := int(off - index*size)
+		if o >= len(block) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], block[o:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// block returns the data of checksum interval index, decrypted if needed.
+func (m *mmapReader) block(index int64) ([]byte, error) {
+	start := index * (m.interval + 4)
+	if start >= int64(len(m.data)) {
+		return nil, nil
+	}
+	end := start + m.interval
+	var block []byte
+	if end+4 > int64(len(m.data)) {
+		// As with the checksummed writer, a final partial interval has no
+		// checksum.
+		block = m.data[start:]
+	} else {
+		block = m.data[start:end]
+		word, bit := &m.verified[index/32], uint32(1)<<uint(index%32)
+		if atomic.LoadUint32(word)&bit == 0 {
+			if murmur3.Sum32(block) != binary.BigEndian.Uint32(m.data[end:]) {
+				return nil, fmt.Errorf("checksum mismatch in interval %d", index)
+			}
+			for {
+				old := atomic.LoadUint32(word)
+				if atomic.CompareAndSwapUint32(word, old, old|bit) {
+					break
+				}
+			}
+		}
+	}
+	if m.aead == nil {
+		return block, nil
+	}
+	prefix := 0
+	if index == 0 {
+		prefix = m.prefix
+	}
+	return openBlock(m.aead, append([]byte(nil), block...), prefix, uint64(index))
+}
+
+// acquire returns true if the mapping may be read, in which case release
+// must be called once done; false means close has been called.
+func (m *mmapReader) acquire() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return false
+	}
+	m.users++
+	return true
+}
+
+func (m *mmapReader) release() {
+	m.lock.Lock()
+	m.users--
+	if m.users == 0 && m.closed {
+		m.released.Broadcast()
+	}
+	m.lock.Unlock()
+}
+
+// close unmaps the file once any reads in progress are done.
+func (m *mmapReader) close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed = true
+	for m.users != 0 {
+		m.released.Wait()
+	}
+	m.lock.Unlock()
+	return munmap(m.data)
+}
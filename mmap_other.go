@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package store
+
+import "errors"
+
+func mmap(fd uintptr, size int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -28,6 +28,12 @@
 // +0000 UTC. There are constants TIMESTAMPMICRO_MIN and TIMESTAMPMICRO_MAX
 // available for bounding usage.
 //
+// Two of those bits, for values written with WriteWithTTL or WriteStream, are
+// newer than the rest. Earlier versions of this package treat entries with
+// either bit set as inactive, so such entries replicated to a node running an
+// earlier version are hidden there and never expire. When upgrading a cluster,
+// upgrade every node before using WriteWithTTL or WriteStream.
+//
 // There are background tasks for:
 //
 // * TombstoneDiscard: This will discard older tombstones (deletion markers).
@@ -116,21 +122,79 @@ package store
 //go:generate got diskwatcher.got groupdiskwatcher_GEN_.go TT=GROUP T=Group t=group
 //go:generate got flusher.got valueflusher_GEN_.go TT=VALUE T=Value t=value
 //go:generate got flusher.got groupflusher_GEN_.go TT=GROUP T=Group t=group
+//go:generate got batch.got valuebatch_GEN_.go TT=VALUE T=Value t=value
+//go:generate got batch.got groupbatch_GEN_.go TT=GROUP T=Group t=group
+//go:generate got batch_test.got valuebatch_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got batch_test.got groupbatch_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got scan.got valuescan_GEN_.go TT=VALUE T=Value t=value
+//go:generate got scan.got groupscan_GEN_.go TT=GROUP T=Group t=group
+//go:generate got scan_test.got valuescan_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got scan_test.got groupscan_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got ttl.got valuettl_GEN_.go TT=VALUE T=Value t=value
+//go:generate got ttl.got groupttl_GEN_.go TT=GROUP T=Group t=group
+//go:generate got ttl_test.got valuettl_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got ttl_test.got groupttl_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got subscribe.got valuesubscribe_GEN_.go TT=VALUE T=Value t=value
+//go:generate got subscribe.got groupsubscribe_GEN_.go TT=GROUP T=Group t=group
+//go:generate got subscribe_test.got valuesubscribe_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got subscribe_test.got groupsubscribe_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got keyed.got valuekeyed_GEN_.go TT=VALUE T=Value t=value
+//go:generate got keyed.got groupkeyed_GEN_.go TT=GROUP T=Group t=group
+//go:generate got keyed_test.got valuekeyed_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got keyed_test.got groupkeyed_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got stream.got valuestream_GEN_.go TT=VALUE T=Value t=value
+//go:generate got stream.got groupstream_GEN_.go TT=GROUP T=Group t=group
+//go:generate got stream_test.got valuestream_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got stream_test.got groupstream_GEN_test.go TT=GROUP T=Group t=group
 //go:generate got stats.got valuestats_GEN_.go TT=VALUE T=Value t=value
 //go:generate got stats.got groupstats_GEN_.go TT=GROUP T=Group t=group
+//go:generate got fsck.got valuefsck_GEN_.go TT=VALUE T=Value t=value
+//go:generate got fsck.got groupfsck_GEN_.go TT=GROUP T=Group t=group
+//go:generate got fsck_test.got valuefsck_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got fsck_test.got groupfsck_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got inspect.got valueinspect_GEN_.go TT=VALUE T=Value t=value
+//go:generate got inspect.got groupinspect_GEN_.go TT=GROUP T=Group t=group
+//go:generate got inspect_test.got valueinspect_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got inspect_test.got groupinspect_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got export.got valueexport_GEN_.go TT=VALUE T=Value t=value
+//go:generate got export.got groupexport_GEN_.go TT=GROUP T=Group t=group
+//go:generate got export_test.got valueexport_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got export_test.got groupexport_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got snapshot.got valuesnapshot_GEN_.go TT=VALUE T=Value t=value
+//go:generate got snapshot.got groupsnapshot_GEN_.go TT=GROUP T=Group t=group
+//go:generate got snapshot_test.got valuesnapshot_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got snapshot_test.got groupsnapshot_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got checkpoint.got valuecheckpoint_GEN_.go TT=VALUE T=Value t=value
+//go:generate got checkpoint.got groupcheckpoint_GEN_.go TT=GROUP T=Group t=group
+//go:generate got checkpoint_test.got valuecheckpoint_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got checkpoint_test.got groupcheckpoint_GEN_test.go TT=GROUP T=Group t=group
+//go:generate got durability.got valuedurability_GEN_.go TT=VALUE T=Value t=value
+//go:generate got durability.got groupdurability_GEN_.go TT=GROUP T=Group t=group
+//go:generate got durability_test.got valuedurability_GEN_test.go TT=VALUE T=Value t=value
+//go:generate got durability_test.got groupdurability_GEN_test.go TT=GROUP T=Group t=group
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"path"
+	"time"
+
+	"github.com/spaolacci/murmur3"
 )
 
 const (
 	_TSB_UTIL_BITS = 8
-	_TSB_INACTIVE  = 0xfe
-	_TSB_DELETION  = 0x80
+	// _TSB_INACTIVE covers every utility bit except _TSB_EXPIRES and
+	// _TSB_MANIFEST, as those just describe how the value is stored. Earlier
+	// versions used 0xfe and so consider entries with those bits inactive;
+	// see the package documentation on upgrading.
+	_TSB_INACTIVE = 0xf2
+	_TSB_DELETION = 0x80
 	// _TSB_COMPACTION_REWRITE indicates an item is being or has been rewritten
 	// as part of compaction. Note that if this bit somehow ends up persisted,
 	// it won't be considered an inactive marker since it's outside the
@@ -142,8 +206,22 @@ const (
 	// for local removal will be retained in memory until the local removal
 	// marker is written to disk.
 	_TSB_LOCAL_REMOVAL = 0x02
+	// _TSB_EXPIRES indicates the stored value is prefixed with an
+	// _EXPIRES_LENGTH big endian expiration timestampmicro; see WriteWithTTL.
+	// Since the prefix is part of the stored value, it is persisted and
+	// replicated right along with it.
+	_TSB_EXPIRES = 0x04
+	// _TSB_MANIFEST indicates the stored value is a manifest describing chunk
+	// entries that together hold a value written with WriteStream.
+	_TSB_MANIFEST = 0x08
 )
 
+const _EXPIRES_LENGTH = 8
+
+// _TSB_EXPORT_MASK covers the bits carried over by Export; the others only
+// describe the state of the exporting store.
+const _TSB_EXPORT_MASK = math.MaxUint64 &^ (_TSB_COMPACTION_REWRITE | _TSB_LOCAL_REMOVAL)
+
 const (
 	TIMESTAMPMICRO_MIN = int64(uint64(1) << _TSB_UTIL_BITS)
 	TIMESTAMPMICRO_MAX = int64(uint64(math.MaxUint64) >> _TSB_UTIL_BITS)
@@ -151,9 +229,42 @@ const (
 
 var ErrNotFound error = errors.New("not found")
 var ErrDisabled error = errors.New("disabled")
+var ErrClosed error = errors.New("closed")
+
+// ErrConflict is returned by WriteIf when the current timestamp does not match
+// the expected timestamp.
+var ErrConflict error = errors.New("conflict")
+
+// ErrKeyCollision is returned by the Keyed stores when the stored key does
+// not match the requested key, meaning two keys hashed to the same value.
+var ErrKeyCollision error = errors.New("key collision")
+
+// ErrReservedName is returned by the GroupStore writes and deletes for the
+// nameKeyA, nameKeyB of math.MaxUint64, math.MaxUint64, which DeleteGroup
+// keeps its group deletion marker under.
+var ErrReservedName error = errors.New("reserved name")
+
+// ErrStream is returned by Read and Lookup for values written with
+// WriteStream, which have to be read with ReadStream or ReadTo instead.
+var ErrStream error = errors.New("stored as a stream")
 
 var toss []byte = make([]byte, 65536)
 
+// Hasher turns []byte keys into the 128 bit keys used by the stores; see
+// NewKeyedValueStore and NewKeyedGroupStore.
+type Hasher interface {
+	Hash(key []byte) (uint64, uint64)
+}
+
+// Murmur3Hasher is the default Hasher, using murmur3.Sum128. Its output is
+// stable across processes and releases, so it is safe to use for persisted
+// data.
+type Murmur3Hasher struct{}
+
+func (Murmur3Hasher) Hash(key []byte) (uint64, uint64) {
+	return murmur3.Sum128(key)
+}
+
 func osOpenReadSeeker(name string) (io.ReadSeeker, error) {
 	return os.Open(name)
 }
@@ -166,6 +277,43 @@ func osCreateWriteCloser(name string) (io.WriteCloser, error) {
 	return os.Create(name)
 }
 
+// timestampBitsFlags returns the names of the utility bits set in
+// timestampbits, for display; unknown bits are given in hex.
+func timestampBitsFlags(timestampbits uint64) []string {
+	var flags []string
+	for _, f := range []struct {
+		bit  uint64
+		name string
+	}{
+		{_TSB_DELETION, "deletion"},
+		{_TSB_MANIFEST, "manifest"},
+		{_TSB_EXPIRES, "expires"},
+		{_TSB_LOCAL_REMOVAL, "local-removal"},
+		{_TSB_COMPACTION_REWRITE, "compaction-rewrite"},
+	} {
+		if timestampbits&f.bit != 0 {
+			flags = append(flags, f.name)
+			timestampbits &^= f.bit
+		}
+	}
+	if other := timestampbits & (1<<_TSB_UTIL_BITS - 1); other != 0 {
+		flags = append(flags, fmt.Sprintf("0x%02x", other))
+	}
+	return flags
+}
+
+// expiredValue returns true if the stored value has an expiration prefix (see
+// _TSB_EXPIRES) at or before nowmicro.
+func expiredValue(timestampbits uint64, value []byte, nowmicro int64) bool {
+	if timestampbits&_TSB_EXPIRES == 0 {
+		return false
+	}
+	if len(value) < _EXPIRES_LENGTH {
+		return true
+	}
+	return int64(binary.BigEndian.Uint64(value)) <= nowmicro
+}
+
 type LogFunc func(format string, v ...interface{})
 
 type bgNotificationAction int
@@ -180,6 +328,165 @@ type bgNotification struct {
 	doneChan chan struct{}
 }
 
+// ScanOptions are given to Scan to restrict which entries are reported.
+type ScanOptions struct {
+	// SkipDeleted will cause deletion markers (aka tombstones) and expired
+	// values to not be reported.
+	SkipDeleted bool
+	// MinTimestampMicro, if not 0, will cause entries with older timestamps to
+	// not be reported.
+	MinTimestampMicro int64
+	// MaxTimestampMicro, if not 0, will cause entries with newer timestamps to
+	// not be reported.
+	MaxTimestampMicro int64
+	// Values will cause each entry's value to be read and given to the
+	// callback; otherwise the callback will receive a nil value.
+	Values bool
+	// BatchSize is how many entries to gather at a time before calling the
+	// callback for each. Defaults to 1024.
+	BatchSize int
+}
+
+// ChangeOrigin indicates where a change given to a subscriber came from; see
+// Subscribe.
+type ChangeOrigin int
+
+const (
+	// ChangeOriginLocal is for changes made directly to the store, including
+	// background changes such as expiring values.
+	ChangeOriginLocal ChangeOrigin = iota
+	// ChangeOriginReplication is for changes that arrived from other stores
+	// through replication.
+	ChangeOriginReplication
+)
+
+// SubscribeFilter is given to Subscribe to restrict which changes are sent and
+// how slow subscribers are handled.
+type SubscribeFilter struct {
+	// StartKeyA and StopKeyA restrict changes to those with
+	// StartKeyA <= keyA <= StopKeyA; a StopKeyA of 0 means no upper limit.
+	StartKeyA uint64
+	StopKeyA  uint64
+	// Replicated will include changes that arrived from other stores through
+	// replication; otherwise only local changes are sent.
+	Replicated bool
+	// Buffer is how many changes may be queued up for the subscriber.
+	// Defaults to 1024.
+	Buffer int
+	// Block will cause writes to wait for the subscriber when its buffer is
+	// full; otherwise such changes are dropped and counted in the stats. Note
+	// that blocking means a slow subscriber will slow down all writes.
+	Block bool
+}
+
+// ExportOptions are given to Export to restrict which entries are written.
+type ExportOptions struct {
+	// StartKeyA and StopKeyA restrict entries to those with
+	// StartKeyA <= keyA <= StopKeyA; a StopKeyA of 0 means no upper limit.
+	StartKeyA uint64
+	StopKeyA  uint64
+	// MinTimestampMicro, if not 0, will cause entries with older timestamps to
+	// be left out.
+	MinTimestampMicro int64
+	// MaxTimestampMicro, if not 0, will cause entries with newer timestamps to
+	// be left out.
+	MaxTimestampMicro int64
+	// SkipDeleted will cause deletion markers (aka tombstones) to be left
+	// out.
+	SkipDeleted bool
+}
+
+// ImportOptions are given to Import to restrict which entries are imported;
+// the fields are the same as for ExportOptions.
+type ImportOptions ExportOptions
+
+// filter returns a function reporting whether an entry with the given
+// timestampbits should be left out according to the timestamp and deletion
+// options.
+func (opts ExportOptions) filter() func(timestampbits uint64) bool {
+	var minbits uint64
+	if opts.MinTimestampMicro > 0 {
+		minbits = uint64(opts.MinTimestampMicro) << _TSB_UTIL_BITS
+	}
+	cutoff := uint64(math.MaxUint64)
+	if opts.MaxTimestampMicro > 0 && opts.MaxTimestampMicro < TIMESTAMPMICRO_MAX {
+		cutoff = (uint64(opts.MaxTimestampMicro+1) << _TSB_UTIL_BITS) - 1
+	}
+	return func(timestampbits uint64) bool {
+		return timestampbits < minbits || timestampbits > cutoff || (opts.SkipDeleted && timestampbits&_TSB_DELETION != 0)
+	}
+}
+
+// SnapshotInfo describes a snapshot made by Snapshot.
+type SnapshotInfo struct {
+	// Path is the directory the snapshot was written to.
+	Path string
+	// HighWater is the UnixNano time at which the store was flushed for the
+	// snapshot; everything written before then is in the snapshot, along
+	// with possibly some things written shortly after.
+	HighWater int64
+	// Files is the number of files in the snapshot, counting data and TOC
+	// files separately.
+	Files int
+	// Bytes is the total size of the files in the snapshot.
+	Bytes int64
+	// Copied is how many of the files had to be copied because they could not
+	// be hard linked, such as when the snapshot is on a different device.
+	Copied int
+}
+
+// FsckOptions are given to FsckValueStore and FsckGroupStore.
+type FsckOptions struct {
+	// KeyProvider is needed to check the contents of encrypted files; see
+	// ValueStoreConfig.KeyProvider.
+	KeyProvider KeyProvider
+	// QuarantinePath, if set, is a directory that any file pairs with errors
+	// will be moved into, keeping them from being loaded by a store.
+	QuarantinePath string
+}
+
+// FsckReport is the result of checking one data file and its TOC file; see
+// FsckValueStore and FsckGroupStore.
+type FsckReport struct {
+	// Name and TOCName are the paths of the data file and its TOC file.
+	Name    string
+	TOCName string
+	// Entries is how many entries were read from the TOC file.
+	Entries int
+	// BadEntries is how many of those entries reference data outside the
+	// data file or in a range that failed its checksum.
+	BadEntries int
+	// Errors lists every problem found with the file pair.
+	Errors []error
+	// Quarantined indicates the file pair was moved to
+	// FsckOptions.QuarantinePath.
+	Quarantined bool
+}
+
+// OK returns true if no problems were found with the file pair.
+func (r *FsckReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// fsckQuarantine moves the files of a bad pair into dir within fs, noting any
+// failures in the report.
+func fsckQuarantine(fs FS, report *FsckReport, dir string) {
+	if err := fs.MkdirAll(dir); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("quarantine: %s", err))
+		return
+	}
+	report.Quarantined = true
+	for _, name := range []string{report.Name, report.TOCName} {
+		if name == "" {
+			continue
+		}
+		if err := fs.Rename(name, path.Join(dir, path.Base(name))); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("quarantine: %s", err))
+			report.Quarantined = false
+		}
+	}
+}
+
 // Store is an interface for a disk-backed data structure that stores
 // []byte values referenced by keys with options for replication.
 //
@@ -198,6 +505,9 @@ type Store interface {
 	EnableAudit()
 	DisableAudit()
 	AuditPass()
+	EnableCheckpointer()
+	DisableCheckpointer()
+	Checkpoint() error
 	EnableOutPullReplication()
 	DisableOutPullReplication()
 	OutPullReplicationPass()
@@ -209,6 +519,7 @@ type Store interface {
 	Flush()
 	Stats(debug bool) fmt.Stringer
 	ValueCap() uint32
+	Close() error
 }
 
 // ValueStore is an interface for a disk-backed data structure that stores
@@ -220,7 +531,24 @@ type ValueStore interface {
 	Lookup(keyA uint64, keyB uint64) (int64, uint32, error)
 	Read(keyA uint64, keyB uint64, value []byte) (int64, []byte, error)
 	Write(keyA uint64, keyB uint64, timestamp int64, value []byte) (int64, error)
+	WriteIf(keyA uint64, keyB uint64, expectedTimestamp int64, newTimestamp int64, value []byte) (int64, error)
+	WriteWithTTL(keyA uint64, keyB uint64, timestamp int64, value []byte, ttl time.Duration) (int64, error)
+	Subscribe(filter SubscribeFilter) (<-chan ValueChange, func())
+	WriteStream(keyA uint64, keyB uint64, timestamp int64, r io.Reader) (int64, error)
+	ReadStream(keyA uint64, keyB uint64) (io.ReadCloser, error)
+	ReadTo(keyA uint64, keyB uint64, w io.Writer) (int64, error)
 	Delete(keyA uint64, keyB uint64, timestamp int64) (int64, error)
+	LookupContext(ctx context.Context, keyA uint64, keyB uint64) (int64, uint32, error)
+	ReadContext(ctx context.Context, keyA uint64, keyB uint64, value []byte) (int64, []byte, error)
+	WriteContext(ctx context.Context, keyA uint64, keyB uint64, timestamp int64, value []byte) (int64, error)
+	WriteIfContext(ctx context.Context, keyA uint64, keyB uint64, expectedTimestamp int64, newTimestamp int64, value []byte) (int64, error)
+	DeleteContext(ctx context.Context, keyA uint64, keyB uint64, timestamp int64) (int64, error)
+	WriteBatch(entries []ValueBatchEntry) []ValueBatchResult
+	DeleteBatch(entries []ValueBatchEntry) []ValueBatchResult
+	Scan(startKeyA uint64, stopKeyA uint64, opts ScanOptions, fn func(keyA uint64, keyB uint64, timestampMicro int64, length uint32, deleted bool, value []byte) bool)
+	Export(w io.Writer, opts ExportOptions) (int, error)
+	Import(r io.Reader, opts ImportOptions) (int, error)
+	Snapshot(dir string) (SnapshotInfo, error)
 }
 
 // GroupStore is an interface for a disk-backed data structure that stores
@@ -231,9 +559,30 @@ type GroupStore interface {
 	Store
 	Lookup(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (int64, uint32, error)
 	LookupGroup(keyA uint64, keyB uint64) []LookupGroupItem
+	LookupGroupPage(keyA uint64, keyB uint64, cursor []byte, limit int) ([]LookupGroupItem, []byte, error)
+	GroupSize(keyA uint64, keyB uint64) int
+	ReadGroup(keyA uint64, keyB uint64, opts ReadGroupOptions) ([]GroupItem, error)
+	DeleteGroup(keyA uint64, keyB uint64, timestampMicro int64) (int, error)
 	Read(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (int64, []byte, error)
 	Write(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64, value []byte) (int64, error)
+	WriteIf(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, expectedTimestamp int64, newTimestamp int64, value []byte) (int64, error)
+	WriteWithTTL(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64, value []byte, ttl time.Duration) (int64, error)
+	Subscribe(filter SubscribeFilter) (<-chan GroupChange, func())
+	WriteStream(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64, r io.Reader) (int64, error)
+	ReadStream(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (io.ReadCloser, error)
+	ReadTo(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, w io.Writer) (int64, error)
 	Delete(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64) (int64, error)
+	LookupContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64) (int64, uint32, error)
+	ReadContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, value []byte) (int64, []byte, error)
+	WriteContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64, value []byte) (int64, error)
+	WriteIfContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, expectedTimestamp int64, newTimestamp int64, value []byte) (int64, error)
+	DeleteContext(ctx context.Context, keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestamp int64) (int64, error)
+	WriteBatch(entries []GroupBatchEntry) []GroupBatchResult
+	DeleteBatch(entries []GroupBatchEntry) []GroupBatchResult
+	Scan(startKeyA uint64, stopKeyA uint64, opts ScanOptions, fn func(keyA uint64, keyB uint64, nameKeyA uint64, nameKeyB uint64, timestampMicro int64, length uint32, deleted bool, value []byte) bool)
+	Export(w io.Writer, opts ExportOptions) (int, error)
+	Import(r io.Reader, opts ImportOptions) (int, error)
+	Snapshot(dir string) (SnapshotInfo, error)
 }
 
 func closeIfCloser(thing interface{}) error {
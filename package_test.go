@@ -3,58 +3,42 @@ package store
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gholt/ring"
 )
 
-type memBuf struct {
-	buf []byte
+// syncCountingFS is a MemFS whose files count how often they're synced and
+// fail to sync with err, if set; directory syncs are counted separately.
+type syncCountingFS struct {
+	*MemFS
+	syncs    int32
+	dirSyncs int32
+	err      error
 }
 
-type memFile struct {
-	buf *memBuf
-	pos int64
+func (fs *syncCountingFS) SyncDir(name string) error {
+	atomic.AddInt32(&fs.dirSyncs, 1)
+	return fs.MemFS.SyncDir(name)
 }
 
-func (f *memFile) Read(p []byte) (int, error) {
-	n := copy(p, f.buf.buf[f.pos:])
-	if n == 0 {
-		return 0, io.EOF
+func (fs *syncCountingFS) Create(name string) (io.WriteCloser, error) {
+	fp, err := fs.MemFS.Create(name)
+	if err != nil {
+		return nil, err
 	}
-	f.pos += int64(n)
-	return n, nil
+	return &syncCountingFile{WriteCloser: fp, fs: fs}, nil
 }
 
-func (f *memFile) Seek(offset int64, whence int) (int64, error) {
-	switch whence {
-	case 0:
-		f.pos = offset
-	case 1:
-		f.pos += offset
-	case 2:
-		f.pos = int64(len(f.buf.buf)) + offset
-	}
-	return f.pos, nil
-}
-
-func (f *memFile) Write(p []byte) (int, error) {
-	pl := int64(len(p))
-	if int64(len(f.buf.buf))-f.pos < pl {
-		buf := make([]byte, int64(f.pos+pl))
-		copy(buf, f.buf.buf)
-		copy(buf[f.pos:], p)
-		f.buf.buf = buf
-		f.pos += pl
-		return int(pl), nil
-	}
-	copy(f.buf.buf[f.pos:], p)
-	f.pos += pl
-	return int(pl), nil
+type syncCountingFile struct {
+	io.WriteCloser
+	fs *syncCountingFS
 }
 
-func (f *memFile) Close() error {
-	return nil
+func (f *syncCountingFile) Sync() error {
+	atomic.AddInt32(&f.fs.syncs, 1)
+	return f.fs.err
 }
 
 type msgRingPlaceholder struct {
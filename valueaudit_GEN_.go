@@ -49,7 +49,7 @@ func (store *DefaultValueStore) AuditPass() {
 // errors.
 func (store *DefaultValueStore) EnableAudit() {
 	store.auditState.notifyChanLock.Lock()
-	if store.auditState.notifyChan == nil {
+	if store.auditState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.auditState.notifyChan = make(chan *bgNotification, 1)
 		go store.auditLauncher(store.auditState.notifyChan)
 	}
@@ -125,13 +125,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 			store.logDebug("audit: took %s", time.Now().Sub(begin))
 		}()
 	}
-	fp, err := os.Open(store.pathtoc)
-	if err != nil {
-		store.logError("audit: %s", err)
-		return nil
-	}
-	names, err := fp.Readdirnames(-1)
-	fp.Close()
+	names, err := store.fs.ReadDirNames(store.pathtoc)
 	if err != nil {
 		store.logError("audit: %s", err)
 		return nil
@@ -179,7 +173,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 		failedAudit := uint32(0)
 		canceledAudit := uint32(0)
 		dataName := names[i][:len(names[i])-3]
-		fpr, err := osOpenReadSeeker(path.Join(store.path, dataName))
+		fpr, err := store.fs.Open(store.valueFilePath(dataName))
 		if err != nil {
 			atomic.AddUint32(&failedAudit, 1)
 			if os.IsNotExist(err) {
@@ -192,6 +186,14 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 		} else {
 			corruptions, errs := valueChecksumVerify(fpr)
 			closeIfCloser(fpr)
+			// Values in newer files are stored in frames giving their stored
+			// lengths, which are read through frames. Reads through frames
+			// aren't synchronized, so there must only be the one worker below.
+			frames, framesFP, err := openValueFrames(store.fs.Open, store.valueFilePath(dataName), store.keyProvider)
+			if err != nil {
+				atomic.AddUint32(&failedAudit, 1)
+				store.logError("audit: error opening %s: %s", dataName, err)
+			}
 			for _, err := range errs {
 				if err != io.EOF && err != io.ErrUnexpectedEOF {
 					store.logError("audit: error with %s: %s", dataName, err)
@@ -235,7 +237,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 								if wr.TimestampBits&_TSB_DELETION != 0 {
 									continue
 								}
-								if valueInCorruptRange(wr.Offset, wr.Length, corruptions) {
+								if valueEntryCorrupt(frames, wr.Offset, wr.Length, 0, corruptions) {
 									if atomic.AddUint32(&failedAudit, 1) == 0 {
 										close(controlChan)
 									}
@@ -248,7 +250,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 					wg.Done()
 				}(pendingBatchChans[i], freeBatchChans[i])
 			}
-			fpr, err = osOpenReadSeeker(path.Join(store.pathtoc, names[i]))
+			fpr, err = store.fs.Open(path.Join(store.pathtoc, names[i]))
 			if err != nil {
 				atomic.AddUint32(&failedAudit, 1)
 				if !os.IsNotExist(err) {
@@ -257,7 +259,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 			} else {
 				// NOTE: The block ID is unimportant in this context, so it's
 				// just set 1 and ignored elsewhere.
-				_, errs := valueReadTOCEntriesBatched(fpr, 1, freeBatchChans, pendingBatchChans, controlChan)
+				_, errs := valueReadTOCEntriesBatched(fpr, store.keyProvider, 1, freeBatchChans, pendingBatchChans, controlChan)
 				closeIfCloser(fpr)
 				if len(errs) > 0 {
 					atomic.AddUint32(&failedAudit, 1)
@@ -270,6 +272,7 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 				pendingBatchChans[i] <- nil
 			}
 			wg.Wait()
+			closeIfCloser(framesFP)
 			close(controlChan)
 			if n := <-nextNotificationChan; n != nil {
 				return n
@@ -299,12 +302,14 @@ func (store *DefaultValueStore) auditPass(speed bool, notifyChan chan *bgNotific
 					store.logError("audit: %s", err)
 				}
 			}
-			if err = os.Remove(path.Join(store.pathtoc, names[i])); err != nil {
+			store.snapshotLock.RLock()
+			if err = store.fs.Remove(path.Join(store.pathtoc, names[i])); err != nil {
 				store.logError("audit: unable to remove %s: %s", names[i], err)
 			}
-			if err = os.Remove(path.Join(store.path, names[i][:len(names[i])-len("toc")])); err != nil {
+			if err = store.fs.Remove(store.valueFilePath(names[i][:len(names[i])-len("toc")])); err != nil {
 				store.logError("audit: unable to remove %s: %s", names[i][:len(names[i])-len("toc")], err)
 			}
+			store.snapshotLock.RUnlock()
 			if err = store.closeLocBlock(blockID); err != nil {
 				store.logError("audit: error closing in-memory block for %s: %s", names[i], err)
 			}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValueWriteBatchDeleteBatch(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	// Enough entries to exhaust the free write requests for each shard.
+	entries := make([]ValueBatchEntry, 100)
+	for i := range entries {
+		entries[i].KeyA = uint64(i)
+		entries[i].KeyB = uint64(i)
+
+		entries[i].TimestampMicro = 1000
+		entries[i].Value = []byte(fmt.Sprintf("value%d", i))
+	}
+	entries[50].TimestampMicro = 1
+	results := store.WriteBatch(entries)
+	if len(results) != len(entries) {
+		t.Fatal(len(results))
+	}
+	for i, result := range results {
+		if i == 50 {
+			if result.Err == nil {
+				t.Fatal(i)
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Fatal(i, result.Err)
+		}
+		if result.TimestampMicro != 0 {
+			t.Fatal(i, result.TimestampMicro)
+		}
+		_, value, err := store.Read(uint64(i), uint64(i), nil)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatal(i, string(value))
+		}
+	}
+	for i := range entries {
+		entries[i].TimestampMicro = 2000
+	}
+	results = store.DeleteBatch(entries)
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatal(i, result.Err)
+		}
+		if i == 50 {
+			if result.TimestampMicro != 0 {
+				t.Fatal(i, result.TimestampMicro)
+			}
+		} else if result.TimestampMicro != 1000 {
+			t.Fatal(i, result.TimestampMicro)
+		}
+		timestampMicro, _, err := store.Read(uint64(i), uint64(i), nil)
+		if err != ErrNotFound {
+			t.Fatal(i, err)
+		}
+		if timestampMicro != 2000 {
+			t.Fatal(i, timestampMicro)
+		}
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.WriteBatches != 1 || stats.DeleteBatches != 1 {
+		t.Fatal(stats.WriteBatches, stats.DeleteBatches)
+	}
+	if stats.Writes != 100 || stats.WriteErrors != 1 {
+		t.Fatal(stats.Writes, stats.WriteErrors)
+	}
+	if stats.Deletes != 100 || stats.DeleteErrors != 0 {
+		t.Fatal(stats.Deletes, stats.DeleteErrors)
+	}
+}
@@ -53,7 +53,7 @@ func (store *DefaultValueStore) bulkSetAckConfig(cfg *ValueStoreConfig) {
 // EnableInBulkSetAck will resume handling incoming bulk set ack messages.
 func (store *DefaultValueStore) EnableInBulkSetAck() {
 	store.bulkSetAckState.inNotifyChanLock.Lock()
-	if store.bulkSetAckState.inNotifyChan == nil {
+	if store.bulkSetAckState.inNotifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.bulkSetAckState.inNotifyChan = make(chan *bgNotification, 1)
 		go store.inBulkSetAckLauncher(store.bulkSetAckState.inNotifyChan)
 	}
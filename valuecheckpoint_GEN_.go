@@ -0,0 +1,441 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+	"gopkg.in/gholt/brimutil.v1"
+)
+
+// Checkpoint files are written to PathTOC, named by the time the checkpoint
+// started, and are checksummed, and encrypted with a KeyProvider, just as TOC
+// files are. After the header:
+//
+//	"VALUESTORECKPT v0          ":28, checksumInterval:4
+//
+// comes the list of TOC files covered:
+//
+//	count:8, nameTimestamp:8 * count
+//
+// followed by an entry for each key location:
+//
+//	keyA:8, keyB:8, timestampbits:8, nameTimestamp:8, offset:4, length:4
+//
+// where nameTimestamp identifies the value file. An entry with a
+// nameTimestamp of 0 and the count of entries as its keyA ends the list, and
+// the file ends with the same block of zeros and "TERM v0 " as TOC files.
+const _VALUE_CHECKPOINT_HEADER = "VALUESTORECKPT v0"
+
+const _VALUE_CHECKPOINT_ENTRY_SIZE = 40
+
+// _VALUE_CHECKPOINTS_KEPT is how many checkpoints are kept so that there is
+// still one to fall back on should the newest turn out to be damaged.
+const _VALUE_CHECKPOINTS_KEPT = 2
+
+type valueCheckpointState struct {
+	interval int
+	// lock keeps more than one checkpoint from being written at a time.
+	lock           sync.Mutex
+	notifyChanLock sync.Mutex
+	notifyChan     chan *bgNotification
+}
+
+type valueCheckpointEntry struct {
+	KeyA uint64
+	KeyB uint64
+
+	TimestampBits uint64
+	NameTimestamp int64
+	Offset        uint32
+	Length        uint32
+}
+
+func (store *DefaultValueStore) checkpointConfig(cfg *ValueStoreConfig) {
+	store.checkpointState.interval = cfg.CheckpointInterval
+}
+
+// EnableCheckpointer will start writing checkpoints every CheckpointInterval
+// seconds; see Checkpoint. It does nothing if CheckpointInterval was
+// negative.
+func (store *DefaultValueStore) EnableCheckpointer() {
+	if store.checkpointState.interval <= 0 {
+		return
+	}
+	store.checkpointState.notifyChanLock.Lock()
+	if store.checkpointState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
+		store.checkpointState.notifyChan = make(chan *bgNotification, 1)
+		go store.checkpointLauncher(store.checkpointState.notifyChan)
+	}
+	store.checkpointState.notifyChanLock.Unlock()
+}
+
+// DisableCheckpointer will stop writing checkpoints until EnableCheckpointer
+// is called.
+func (store *DefaultValueStore) DisableCheckpointer() {
+	store.checkpointState.notifyChanLock.Lock()
+	if store.checkpointState.notifyChan != nil {
+		c := make(chan struct{}, 1)
+		store.checkpointState.notifyChan <- &bgNotification{
+			action:   _BG_DISABLE,
+			doneChan: c,
+		}
+		<-c
+		store.checkpointState.notifyChan = nil
+	}
+	store.checkpointState.notifyChanLock.Unlock()
+}
+
+func (store *DefaultValueStore) checkpointLauncher(notifyChan chan *bgNotification) {
+	interval := float64(store.checkpointState.interval) * float64(time.Second)
+	store.randMutex.Lock()
+	nextRun := time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
+	store.randMutex.Unlock()
+	running := true
+	for running {
+		var notification *bgNotification
+		sleep := nextRun.Sub(time.Now())
+		if sleep > 0 {
+			select {
+			case notification = <-notifyChan:
+			case <-time.After(sleep):
+			}
+		} else {
+			select {
+			case notification = <-notifyChan:
+			default:
+			}
+		}
+		store.randMutex.Lock()
+		nextRun = time.Now().Add(time.Duration(interval + interval*store.rand.NormFloat64()*0.1))
+		store.randMutex.Unlock()
+		if notification != nil {
+			if notification.action == _BG_DISABLE {
+				running = false
+			} else {
+				store.logCritical("checkpoint: invalid action requested: %d", notification.action)
+			}
+			notification.doneChan <- struct{}{}
+			continue
+		}
+		if err := store.Checkpoint(); err != nil && err != ErrClosed {
+			store.logError("checkpoint: %s\n", err)
+		}
+	}
+}
+
+// Checkpoint writes the key locations for the value files that are no longer
+// being written to, along with the list of their TOC files, to a checkpoint
+// file in PathTOC. On the next start up, recovery will load the newest valid
+// checkpoint and only replay the TOC files it doesn't cover, falling back to
+// an older checkpoint, or to replaying every TOC file, if a checkpoint is
+// damaged. The two newest checkpoints are kept.
+//
+// Keys whose newest entry was still in memory or in a file being written to
+// are left out of the checkpoint, with recovery instead relying on the TOC
+// files written after it; so that those entries are sure to be on disk, the
+// store is flushed before the checkpoint is put in place. Otherwise their
+// older entries, in the covered files, would be lost to a crash.
+func (store *DefaultValueStore) Checkpoint() error {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return ErrClosed
+	}
+	store.checkpointState.lock.Lock()
+	defer store.checkpointState.lock.Unlock()
+	start := time.Now()
+	names, err := store.fs.ReadDirNames(store.pathtoc)
+	if err != nil {
+		return err
+	}
+	// As with Snapshot, the active TOCs are checked after listing the files
+	// and any TOC no longer active by then has been closed, with all its
+	// entries already in the locmap.
+	activeTOCA := atomic.LoadUint64(&store.activeTOCA)
+	activeTOCB := atomic.LoadUint64(&store.activeTOCB)
+	covered := make(map[int64]bool)
+	var checkpoints []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".valuecheckpoint") {
+			checkpoints = append(checkpoints, name)
+			continue
+		}
+		if strings.HasSuffix(name, ".valuecheckpoint.tmp") {
+			// Left over from a checkpoint that never finished.
+			store.fs.Remove(path.Join(store.pathtoc, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".valuetoc") {
+			continue
+		}
+		namets, err := strconv.ParseInt(name[:len(name)-len(".valuetoc")], 10, 64)
+		if err != nil || namets <= 0 || uint64(namets) == activeTOCA || uint64(namets) == activeTOCB {
+			continue
+		}
+		covered[namets] = true
+	}
+	name := path.Join(store.pathtoc, fmt.Sprintf("%d.valuecheckpoint", start.UnixNano()))
+	fpw, err := store.createFile(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	count, skipped, err := store.writeCheckpoint(fpw, covered)
+	if err != nil {
+		store.fs.Remove(name + ".tmp")
+		return err
+	}
+	if skipped > 0 {
+		store.flush()
+	}
+	if err = store.fs.Rename(name+".tmp", name); err != nil {
+		store.fs.Remove(name + ".tmp")
+		return err
+	}
+	if err = store.syncDir(store.pathtoc); err != nil {
+		return err
+	}
+	sort.Strings(checkpoints)
+	for i := 0; i < len(checkpoints)-(_VALUE_CHECKPOINTS_KEPT-1); i++ {
+		if err = store.fs.Remove(path.Join(store.pathtoc, checkpoints[i])); err != nil {
+			store.logError("checkpoint: unable to remove %s: %s\n", checkpoints[i], err)
+		}
+	}
+	atomic.AddInt32(&store.checkpoints, 1)
+	if store.logDebug != nil {
+		store.logDebug("checkpoint of %d key locations covering %d TOC files took %s\n", count, len(covered), time.Now().Sub(start))
+	}
+	return nil
+}
+
+// writeCheckpoint writes the checkpoint for the covered TOC files to fp,
+// closing it, and returns the number of entries written along with the number
+// of keys left out as their newest entries weren't in covered files.
+func (store *DefaultValueStore) writeCheckpoint(fp io.WriteCloser, covered map[int64]bool) (uint64, uint64, error) {
+	w, err := newValueChecksummedWriter(store, fp, _VALUE_CHECKPOINT_HEADER)
+	if err != nil {
+		fp.Close()
+		return 0, 0, err
+	}
+	bw := bufio.NewWriterSize(w, int(store.checksumInterval))
+	b := make([]byte, _VALUE_CHECKPOINT_ENTRY_SIZE)
+	binary.BigEndian.PutUint64(b, uint64(len(covered)))
+	bw.Write(b[:8])
+	for namets := range covered {
+		binary.BigEndian.PutUint64(b, uint64(namets))
+		bw.Write(b[:8])
+	}
+	var count uint64
+	var skipped uint64
+	entries := make([]valueScanEntry, 0, 1024)
+	for startKeyA, more := uint64(0), true; more; {
+		entries = entries[:0]
+		startKeyA, more = store.locmap.ScanCallback(startKeyA, math.MaxUint64, 0, _TSB_LOCAL_REMOVAL, math.MaxUint64, uint64(cap(entries)), func(keyA uint64, keyB uint64, timestampbits uint64, length uint32) bool {
+			entries = append(entries, valueScanEntry{keyA: keyA, keyB: keyB})
+			return true
+		})
+		for i := range entries {
+			e := &entries[i]
+			timestampbits, blockID, offset, length := store.locmap.Get(e.keyA, e.keyB)
+			if blockID == 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+				continue
+			}
+			fl, ok := store.locBlock(blockID).(*valueStoreFile)
+			if !ok || !covered[fl.nameTimestamp] {
+				skipped++
+				continue
+			}
+			binary.BigEndian.PutUint64(b[0:], e.keyA)
+			binary.BigEndian.PutUint64(b[8:], e.keyB)
+
+			binary.BigEndian.PutUint64(b[16:], timestampbits)
+			binary.BigEndian.PutUint64(b[24:], uint64(fl.nameTimestamp))
+			binary.BigEndian.PutUint32(b[32:], offset)
+			binary.BigEndian.PutUint32(b[36:], length)
+
+			if _, err = bw.Write(b); err != nil {
+				w.Close()
+				return count, skipped, err
+			}
+			count++
+		}
+		if atomic.LoadUint32(&store.closed) != 0 {
+			w.Close()
+			return count, skipped, ErrClosed
+		}
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	binary.BigEndian.PutUint64(b, count)
+	bw.Write(b)
+	bw.Write(newValueTermBlock(store.checksumInterval, store.keyProvider != nil))
+	if err = bw.Flush(); err != nil {
+		w.Close()
+		return count, skipped, err
+	}
+	return count, skipped, w.Close()
+}
+
+// valueReadCheckpoint reads the checkpoint from fpr, returning the
+// nameTimestamps of the TOC files it covers and the number of entries, and
+// calling f, if not nil, with each entry; the entry is reused between calls.
+// An error is returned if any part of the checkpoint is damaged or missing,
+// though f may have been called for entries before the damage.
+func valueReadCheckpoint(fpr io.ReadSeeker, keyProvider KeyProvider, f func(entry *valueCheckpointEntry)) ([]int64, uint64, error) {
+	header, checksumInterval, err := _readValueHeader(fpr, _VALUE_CHECKPOINT_HEADER)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := valueHeaderAEAD(header, keyProvider)
+	if err != nil {
+		return nil, 0, err
+	}
+	var r io.ReadSeeker = brimutil.NewChecksummedReader(fpr, int(checksumInterval), murmur3.New32)
+	if aead != nil {
+		r = newBlockCipherReader(r, aead, int(checksumInterval), _VALUE_FILE_HEADER_SIZE)
+	}
+	if _, err = r.Seek(_VALUE_FILE_HEADER_SIZE, 0); err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReaderSize(r, int(checksumInterval))
+	b := make([]byte, _VALUE_CHECKPOINT_ENTRY_SIZE)
+	if _, err = io.ReadFull(br, b[:8]); err != nil {
+		return nil, 0, err
+	}
+	// There can't be more value files than loc blocks.
+	n := binary.BigEndian.Uint64(b)
+	if n > math.MaxUint16 {
+		return nil, 0, fmt.Errorf("checkpoint covers too many files: %d", n)
+	}
+	covered := make([]int64, n)
+	for i := range covered {
+		if _, err = io.ReadFull(br, b[:8]); err != nil {
+			return nil, 0, err
+		}
+		covered[i] = int64(binary.BigEndian.Uint64(b))
+	}
+	entry := &valueCheckpointEntry{}
+	var count uint64
+	for {
+		if _, err = io.ReadFull(br, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, count, err
+		}
+		entry.KeyA = binary.BigEndian.Uint64(b[0:])
+		entry.KeyB = binary.BigEndian.Uint64(b[8:])
+
+		entry.TimestampBits = binary.BigEndian.Uint64(b[16:])
+		entry.NameTimestamp = int64(binary.BigEndian.Uint64(b[24:]))
+		entry.Offset = binary.BigEndian.Uint32(b[32:])
+		entry.Length = binary.BigEndian.Uint32(b[36:])
+
+		if entry.NameTimestamp == 0 {
+			if entry.KeyA != count {
+				return nil, count, fmt.Errorf("checkpoint ended after %d of %d entries", count, entry.KeyA)
+			}
+			break
+		}
+		if f != nil {
+			f(entry)
+		}
+		count++
+	}
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, count, err
+	}
+	if !bytes.Equal(rest, newValueTermBlock(checksumInterval, aead != nil)) {
+		return nil, count, errors.New("no terminator found")
+	}
+	return covered, count, nil
+}
+
+// recoveryCheckpoint returns the name of the newest checkpoint within names
+// that reads back without error, along with the TOC files it covers; an
+// empty name and nil are returned if there is no such checkpoint.
+func (store *DefaultValueStore) recoveryCheckpoint(names []string) (string, map[int64]bool) {
+	for i := len(names) - 1; i >= 0; i-- {
+		if !strings.HasSuffix(names[i], ".valuecheckpoint") {
+			continue
+		}
+		fpr, err := store.fs.Open(path.Join(store.pathtoc, names[i]))
+		if err != nil {
+			store.logError("error opening %s: %s\n", names[i], err)
+			continue
+		}
+		list, _, err := valueReadCheckpoint(fpr, store.keyProvider, nil)
+		closeIfCloser(fpr)
+		if err != nil {
+			store.logError("error with checkpoint %s, not using it: %s\n", names[i], err)
+			continue
+		}
+		covered := make(map[int64]bool, len(list))
+		for _, namets := range list {
+			covered[namets] = true
+		}
+		return names[i], covered
+	}
+	return "", nil
+}
+
+// recoveryLoadCheckpoint sets the entries from the checkpoint in the locmap
+// using the batches of recovery; entries for value files without a block ID
+// in blockIDs are skipped, since those files are gone or unreadable.
+func (store *DefaultValueStore) recoveryLoadCheckpoint(name string, blockIDs map[int64]uint32, freeBatchChans []chan []valueTOCEntry, pendingBatchChans []chan []valueTOCEntry) (int, error) {
+	fpr, err := store.fs.Open(path.Join(store.pathtoc, name))
+	if err != nil {
+		return 0, err
+	}
+	defer closeIfCloser(fpr)
+	workers := uint64(len(freeBatchChans))
+	batches := make([][]valueTOCEntry, workers)
+	batchesPos := make([]int, workers)
+	count := 0
+	_, _, err = valueReadCheckpoint(fpr, store.keyProvider, func(entry *valueCheckpointEntry) {
+		blockID := blockIDs[entry.NameTimestamp]
+		if blockID == 0 {
+			return
+		}
+		k := entry.KeyB % workers
+		if batches[k] == nil {
+			batches[k] = <-freeBatchChans[k]
+			batches[k] = batches[k][:cap(batches[k])]
+			batchesPos[k] = 0
+		}
+		batches[k][batchesPos[k]] = valueTOCEntry{
+			KeyA: entry.KeyA,
+			KeyB: entry.KeyB,
+
+			TimestampBits: entry.TimestampBits,
+			BlockID:       blockID,
+			Offset:        entry.Offset,
+			Length:        entry.Length,
+		}
+		batchesPos[k]++
+		if batchesPos[k] >= len(batches[k]) {
+			pendingBatchChans[k] <- batches[k]
+			batches[k] = nil
+		}
+		count++
+	})
+	for i := 0; i < len(batches); i++ {
+		if batches[i] != nil {
+			pendingBatchChans[i] <- batches[i][:batchesPos[i]]
+		}
+	}
+	return count, err
+}
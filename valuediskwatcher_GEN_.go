@@ -4,8 +4,6 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/ricochet2200/go-disk-usage/du"
 )
 
 type valueDiskWatcherState struct {
@@ -20,6 +18,7 @@ type valueDiskWatcherState struct {
 	freetoc                uint64
 	usedtoc                uint64
 	sizetoc                uint64
+	pathsFree              []uint64
 	notifyChanLock         sync.Mutex
 	notifyChan             chan *bgNotification
 }
@@ -30,11 +29,12 @@ func (store *DefaultValueStore) diskWatcherConfig(cfg *ValueStoreConfig) {
 	store.diskWatcherState.freeReenableThreshold = cfg.FreeReenableThreshold
 	store.diskWatcherState.usageDisableThreshold = cfg.UsageDisableThreshold
 	store.diskWatcherState.usageReenableThreshold = cfg.UsageReenableThreshold
+	store.diskWatcherState.pathsFree = make([]uint64, len(cfg.Paths))
 }
 
 func (store *DefaultValueStore) EnableDiskWatcher() {
 	store.diskWatcherState.notifyChanLock.Lock()
-	if store.diskWatcherState.notifyChan == nil {
+	if store.diskWatcherState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.diskWatcherState.notifyChan = make(chan *bgNotification, 1)
 		go store.diskWatcherLauncher(store.diskWatcherState.notifyChan)
 	}
@@ -88,19 +88,27 @@ func (store *DefaultValueStore) diskWatcherLauncher(notifyChan chan *bgNotificat
 			notification.doneChan <- struct{}{}
 			continue
 		}
-		u := du.NewDiskUsage(store.path)
-		utoc := u
-		if store.pathtoc != store.path {
-			utoc = du.NewDiskUsage(store.pathtoc)
+		// With several paths, the device that will fill first is the one
+		// watched: the one with the least free space when files take turns,
+		// or the most when new files go wherever there's the most room.
+		var free, size uint64
+		for i, p := range store.paths {
+			f, s := store.fs.DiskUsage(p)
+			atomic.StoreUint64(&store.diskWatcherState.pathsFree[i], f)
+			if i == 0 || (store.pathsByFreeSpace && f > free) || (!store.pathsByFreeSpace && f < free) {
+				free, size = f, s
+			}
+		}
+		freetoc, sizetoc := store.fs.DiskUsage(store.pathtoc)
+		used := size - free
+		usedtoc := sizetoc - freetoc
+		var usage, usagetoc float32
+		if size > 0 {
+			usage = float32(used) / float32(size)
+		}
+		if sizetoc > 0 {
+			usagetoc = float32(usedtoc) / float32(sizetoc)
 		}
-		free := u.Free()
-		used := u.Used()
-		size := u.Size()
-		usage := u.Usage()
-		freetoc := utoc.Free()
-		usedtoc := utoc.Used()
-		sizetoc := utoc.Size()
-		usagetoc := utoc.Usage()
 		atomic.StoreUint64(&store.diskWatcherState.free, free)
 		atomic.StoreUint64(&store.diskWatcherState.used, used)
 		atomic.StoreUint64(&store.diskWatcherState.size, size)
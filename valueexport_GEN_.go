@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// Export streams start with a header:
+//
+//	"VALUESTORE EXPORT v0        ":32
+//
+// followed by a record for each entry:
+//
+//	keyA:8, keyB:8, timestampbits:8, length:4, value:length, checksum:4
+//
+// where the checksum is the murmur3 Sum32 of the rest of the record. Deletions
+// are records with the _TSB_DELETION bit set and no value. The stream ends with
+// a record with all-zero keys and timestampbits whose 8 byte value is the
+// count of entry records, so a truncated stream can be detected.
+const _VALUE_EXPORT_HEADER = "VALUESTORE EXPORT v0"
+
+const _VALUE_EXPORT_HEADER_SIZE = 32
+
+const _VALUE_EXPORT_RECORD_HEADER_SIZE = 28
+
+// Export writes the entries of the store, including deletion markers, to w in
+// a form that Import on another store can read; opts can restrict which
+// entries are written. The number of entries written is returned.
+//
+// Values are exported as stored, so values written with WriteWithTTL keep
+// their expirations and streams written with WriteStream are exported as
+// their manifest and chunk entries. As with Scan, entries written during the
+// export may or may not be included.
+func (store *DefaultValueStore) Export(w io.Writer, opts ExportOptions) (int, error) {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return 0, ErrClosed
+	}
+	bw := bufio.NewWriter(w)
+	header := bytes.Repeat([]byte(" "), _VALUE_EXPORT_HEADER_SIZE)
+	copy(header, _VALUE_EXPORT_HEADER)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+	stopKeyA := opts.StopKeyA
+	if stopKeyA == 0 {
+		stopKeyA = math.MaxUint64
+	}
+	skip := opts.filter()
+	var count uint64
+	var value []byte
+	entries := make([]valueScanEntry, 0, 1024)
+	for startKeyA, more := opts.StartKeyA, true; more; {
+		entries = entries[:0]
+		startKeyA, more = store.locmap.ScanCallback(startKeyA, stopKeyA, 0, _TSB_LOCAL_REMOVAL, math.MaxUint64, uint64(cap(entries)), func(keyA uint64, keyB uint64, timestampbits uint64, length uint32) bool {
+			if !skip(timestampbits) {
+				entries = append(entries, valueScanEntry{keyA: keyA, keyB: keyB, timestampbits: timestampbits})
+			}
+			return true
+		})
+		for i := range entries {
+			e := &entries[i]
+			var err error
+			// The entry may have changed since it was gathered, in which
+			// case we export what is there now if it still qualifies.
+			e.timestampbits, value, err = store.read(e.keyA, e.keyB, value[:0])
+			if err == ErrNotFound {
+				if e.timestampbits == 0 || e.timestampbits&_TSB_LOCAL_REMOVAL != 0 || e.timestampbits&_TSB_DELETION == 0 {
+					continue
+				}
+				value = value[:0]
+			} else if err != nil {
+				return int(count), err
+			}
+			if skip(e.timestampbits) {
+				continue
+			}
+			if err = writeValueExportRecord(bw, e.keyA, e.keyB, e.timestampbits&_TSB_EXPORT_MASK, value); err != nil {
+				return int(count), err
+			}
+			count++
+		}
+		if atomic.LoadUint32(&store.closed) != 0 {
+			return int(count), ErrClosed
+		}
+	}
+	var trailer [8]byte
+	binary.BigEndian.PutUint64(trailer[:], count)
+	if err := writeValueExportRecord(bw, 0, 0, 0, trailer[:]); err != nil {
+		return int(count), err
+	}
+	return int(count), bw.Flush()
+}
+
+func writeValueExportRecord(w io.Writer, keyA uint64, keyB uint64, timestampbits uint64, value []byte) error {
+	var b [_VALUE_EXPORT_RECORD_HEADER_SIZE]byte
+	binary.BigEndian.PutUint64(b[0:], keyA)
+	binary.BigEndian.PutUint64(b[8:], keyB)
+
+	binary.BigEndian.PutUint64(b[16:], timestampbits)
+	binary.BigEndian.PutUint32(b[24:], uint32(len(value)))
+
+	h := murmur3.New32()
+	h.Write(b[:])
+	h.Write(value)
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(value); err != nil {
+		return err
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// Import reads entries written by Export from r and stores them, keeping
+// whichever of the imported and existing entries is newest just as
+// replication would; opts can restrict which entries are imported. The number
+// of entries read from r that were within opts is returned, whether or not
+// they replaced existing entries.
+//
+// The stream is checked as it is read, so an error part way through will
+// leave the entries before it imported.
+func (store *DefaultValueStore) Import(r io.Reader, opts ImportOptions) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, _VALUE_EXPORT_HEADER_SIZE)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if string(bytes.TrimRight(header, " ")) != _VALUE_EXPORT_HEADER {
+		return 0, errors.New("unknown export stream header")
+	}
+	stopKeyA := opts.StopKeyA
+	if stopKeyA == 0 {
+		stopKeyA = math.MaxUint64
+	}
+	skip := ExportOptions(opts).filter()
+	var b [_VALUE_EXPORT_RECORD_HEADER_SIZE]byte
+	var checksum [4]byte
+	var value []byte
+	var records uint64
+	var count int
+	for {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return count, err
+		}
+		keyA := binary.BigEndian.Uint64(b[0:])
+		keyB := binary.BigEndian.Uint64(b[8:])
+
+		timestampbits := binary.BigEndian.Uint64(b[16:])
+		length := binary.BigEndian.Uint32(b[24:])
+
+		if length > store.valueCap {
+			return count, fmt.Errorf("value length of %d > %d", length, store.valueCap)
+		}
+		if cap(value) < int(length) {
+			value = make([]byte, length)
+		}
+		value = value[:length]
+		if _, err := io.ReadFull(br, value); err != nil {
+			return count, err
+		}
+		if _, err := io.ReadFull(br, checksum[:]); err != nil {
+			return count, err
+		}
+		h := murmur3.New32()
+		h.Write(b[:])
+		h.Write(value)
+		if binary.BigEndian.Uint32(checksum[:]) != h.Sum32() {
+			return count, fmt.Errorf("checksum error in record %d", records+1)
+		}
+		if timestampbits == 0 {
+			if length != 8 || binary.BigEndian.Uint64(value) != records {
+				return count, fmt.Errorf("export stream trailer does not match the %d records read", records)
+			}
+			return count, store.syncWrites(context.Background())
+		}
+		records++
+		if keyA < opts.StartKeyA || keyA > stopKeyA || skip(timestampbits) {
+			continue
+		}
+		if timestampbits&_TSB_DELETION != 0 {
+			value = value[:0]
+		}
+
+		if _, err := store.write(keyA, keyB, timestampbits&_TSB_EXPORT_MASK, value, timestampbits&_TSB_DELETION != 0); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+}
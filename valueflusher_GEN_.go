@@ -20,7 +20,7 @@ func (store *DefaultValueStore) flusherConfig(cfg *ValueStoreConfig) {
 
 func (store *DefaultValueStore) EnableFlusher() {
 	store.flusherState.notifyChanLock.Lock()
-	if store.flusherState.notifyChan == nil {
+	if store.flusherState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.flusherState.notifyChan = make(chan *bgNotification, 1)
 		go store.flusherLauncher(store.flusherState.notifyChan)
 	}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FsckValueStore checks every value file and TOC file pair in the given
+// directories without needing a running store; dirs and dirtoc correspond to
+// ValueStoreConfig's Paths and PathTOC, with dirtoc defaulting to the first
+// of dirs. The headers, trailers, and checksums of each file are verified and
+// each TOC entry is checked against the bounds and corrupt ranges of its
+// value file. The returned reports are in file name order, one per pair; an
+// error is only returned if the directories themselves could not be read.
+//
+// The store should not be running against the directories at the time, as any
+// file being written will be reported as missing its trailer.
+func FsckValueStore(dirs []string, dirtoc string, opts *FsckOptions) ([]*FsckReport, error) {
+	if opts == nil {
+		opts = &FsckOptions{}
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no directories given")
+	}
+	if dirtoc == "" {
+		dirtoc = dirs[0]
+	}
+	// Map of name timestamps to the [value file, TOC file] names found.
+	pairs := map[string]*[2]string{}
+	for i, d := range append([]string{dirtoc}, dirs...) {
+		suffix := ".valuetoc"
+		if i > 0 {
+			suffix = ".value"
+		}
+		fp, err := os.Open(d)
+		if err != nil {
+			return nil, err
+		}
+		names, err := fp.Readdirnames(-1)
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			namets, err := strconv.ParseInt(name[:len(name)-len(suffix)], 10, 64)
+			if err != nil || namets == 0 {
+				continue
+			}
+			key := fmt.Sprintf("%019d", namets)
+			if pairs[key] == nil {
+				pairs[key] = &[2]string{}
+			}
+			if i == 0 {
+				pairs[key][1] = path.Join(d, name)
+			} else if pairs[key][0] == "" {
+				// Found the same way a store finds it, the first of dirs
+				// holding it.
+				pairs[key][0] = valueFilePathIn(dirs, name, os.Stat)
+			}
+		}
+	}
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	reports := make([]*FsckReport, 0, len(keys))
+	for _, key := range keys {
+		report := fsckValuePair(pairs[key][0], pairs[key][1], opts.KeyProvider)
+		if !report.OK() && opts.QuarantinePath != "" {
+			fsckQuarantine(OSFS{}, report, opts.QuarantinePath)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func fsckValuePair(name string, tocName string, keyProvider KeyProvider) *FsckReport {
+	report := &FsckReport{Name: name, TOCName: tocName}
+	if name == "" {
+		report.Errors = append(report.Errors, errors.New("missing value file"))
+	}
+	if tocName == "" {
+		report.Errors = append(report.Errors, errors.New("missing TOC file"))
+	}
+	// limit is how far into the value file entries may reference, or 0 if
+	// the value file couldn't be read well enough to know.
+	var limit int64
+	var corruptions []*valueCorruptRange
+	// frames is used to read the stored lengths of values in v1 files; any
+	// error opening it will have already been reported by fsckValueFile.
+	var frames io.ReadSeeker
+	if name != "" {
+		var errs []error
+		limit, corruptions, errs = fsckValueFile(name, keyProvider)
+		report.Errors = append(report.Errors, errs...)
+		var framesFP io.ReadSeeker
+		frames, framesFP, _ = openValueFrames(osOpenReadSeeker, name, keyProvider)
+		defer closeIfCloser(framesFP)
+	}
+	if tocName == "" {
+		return report
+	}
+	fpr, err := osOpenReadSeeker(tocName)
+	if err != nil {
+		report.Errors = append(report.Errors, err)
+		return report
+	}
+	pendingBatchChans := []chan []valueTOCEntry{make(chan []valueTOCEntry, 3)}
+	freeBatchChans := []chan []valueTOCEntry{make(chan []valueTOCEntry, cap(pendingBatchChans[0]))}
+	for i := 0; i < cap(freeBatchChans[0]); i++ {
+		freeBatchChans[0] <- make([]valueTOCEntry, 1024)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		for {
+			batch := <-pendingBatchChans[0]
+			if batch == nil {
+				break
+			}
+			for j := 0; j < len(batch); j++ {
+				wr := &batch[j]
+				if wr.TimestampBits&_TSB_DELETION != 0 {
+					continue
+				}
+				if wr.Offset < _VALUE_FILE_HEADER_SIZE || valueEntryCorrupt(frames, wr.Offset, wr.Length, limit, corruptions) {
+					report.BadEntries++
+				}
+			}
+			freeBatchChans[0] <- batch
+		}
+		wg.Done()
+	}()
+	var errs []error
+	report.Entries, errs = valueReadTOCEntriesBatched(fpr, keyProvider, 0, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	closeIfCloser(fpr)
+	pendingBatchChans[0] <- nil
+	wg.Wait()
+	for _, err := range errs {
+		report.Errors = append(report.Errors, fmt.Errorf("TOC: %s", err))
+	}
+	if report.BadEntries > 0 {
+		report.Errors = append(report.Errors, fmt.Errorf("%d TOC entries reference missing or corrupt data", report.BadEntries))
+	}
+	return report
+}
+
+// fsckValueFile checks the header, trailer, and checksums of a value file,
+// returning how far into the file (in decrypted offsets) entries may
+// reference and any corrupt ranges.
+func fsckValueFile(name string, keyProvider KeyProvider) (int64, []*valueCorruptRange, []error) {
+	var errs []error
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, nil, append(errs, err)
+	}
+	fpr, err := osOpenReadSeeker(name)
+	if err != nil {
+		return 0, nil, append(errs, err)
+	}
+	defer closeIfCloser(fpr)
+	header, checksumInterval, err := readValueHeader(fpr)
+	if err != nil {
+		return 0, nil, append(errs, fmt.Errorf("header: %s", err))
+	}
+	var limit int64
+	if aead, err := valueHeaderAEAD(header, keyProvider); err != nil {
+		errs = append(errs, err)
+	} else if size, trailer, err := valueReadTrailer(fpr, fi.Size(), checksumInterval, aead); err != nil {
+		errs = append(errs, fmt.Errorf("trailer: %s", err))
+	} else if !bytes.Equal(trailer, []byte("TERM v0 ")) {
+		errs = append(errs, errors.New("no terminator found"))
+		limit = size
+	} else {
+		blockSize := int64(checksumInterval)
+		if aead != nil {
+			blockSize -= _ENCRYPTION_OVERHEAD
+		}
+		// The trailer is written as a full block that no entry references.
+		limit = size - blockSize
+	}
+	fpr.Seek(0, 0)
+	corruptions, cerrs := valueChecksumVerify(fpr)
+	for _, err := range cerrs {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			errs = append(errs, err)
+		}
+	}
+	// The last range is always the unchecksummed tail of the file.
+	if len(corruptions) > 1 {
+		errs = append(errs, fmt.Errorf("there were %d checksum errors", len(corruptions)-1))
+	}
+	return limit, corruptions, errs
+}
+
+// valueReadTrailer returns the decrypted size of a value file, checksums
+// removed, along with its last _VALUE_FILE_TRAILER_SIZE bytes, which will be
+// nil if the file does not end with a partial block as closed files do.
+func valueReadTrailer(fpr io.ReadSeeker, size int64, checksumInterval uint32, aead cipher.AEAD) (int64, []byte, error) {
+	blocks := size / (int64(checksumInterval) + 4)
+	blockSize := int64(checksumInterval)
+	if aead != nil {
+		blockSize -= _ENCRYPTION_OVERHEAD
+	}
+	tail := make([]byte, size%(int64(checksumInterval)+4))
+	if len(tail) == 0 {
+		return blocks * blockSize, nil, nil
+	}
+	if _, err := fpr.Seek(size-int64(len(tail)), 0); err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.ReadFull(fpr, tail); err != nil {
+		return 0, nil, err
+	}
+	if aead != nil {
+		prefix := 0
+		if blocks == 0 {
+			prefix = _VALUE_FILE_HEADER_SIZE
+		}
+		var err error
+		if tail, err = openBlock(aead, tail, prefix, uint64(blocks)); err != nil {
+			return 0, nil, err
+		}
+	}
+	size = blocks*blockSize + int64(len(tail))
+	if len(tail) < _VALUE_FILE_TRAILER_SIZE {
+		return size, nil, nil
+	}
+	return size, tail[len(tail)-_VALUE_FILE_TRAILER_SIZE:], nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValueFsck(t *testing.T) {
+	for _, tc := range []struct {
+		encrypted  bool
+		compressed bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		dir := t.TempDir()
+		kp := &testValueKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		store := newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+			if tc.encrypted {
+				cfg.KeyProvider = kp
+			}
+			if tc.compressed {
+				// Compressed values are stored shorter than their lengths.
+				cfg.CompressionLevel = 6
+			}
+		})
+		for i := uint64(1); i <= 100; i++ {
+			if _, err := store.Write(i, i, 1000, bytes.Repeat([]byte{byte(i)}, 200)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Compressed, this ends well short of where its length would say.
+		if _, err := store.Write(101, 101, 1000, make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		opts := &FsckOptions{KeyProvider: kp}
+		reports, err := FsckValueStore([]string{dir}, "", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := 0
+		for _, report := range reports {
+			if !report.OK() {
+				t.Fatal(tc, report.Name, report.Errors)
+			}
+			entries += report.Entries
+		}
+		if entries != 101 {
+			t.Fatal(tc, entries)
+		}
+		// Without the key, the files can't be checked.
+		if tc.encrypted {
+			noKeyReports, err := FsckValueStore([]string{dir}, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if noKeyReports[0].OK() {
+				t.Fatal(noKeyReports[0])
+			}
+		}
+		// Damage the value file holding the values.
+		var bad *FsckReport
+		for _, report := range reports {
+			if report.Entries > 0 {
+				bad = report
+			}
+		}
+		b, err := ioutil.ReadFile(bad.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[_VALUE_FILE_HEADER_SIZE+100] ^= 0xff
+		if err := ioutil.WriteFile(bad.Name, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		// Leave a TOC file without its value file.
+		orphan := path.Join(dir, "1.valuetoc")
+		if err := ioutil.WriteFile(orphan, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		opts.QuarantinePath = path.Join(dir, "quarantine")
+		if reports, err = FsckValueStore([]string{dir}, "", opts); err != nil {
+			t.Fatal(err)
+		}
+		if reports[0].TOCName != orphan || reports[0].OK() || !reports[0].Quarantined {
+			t.Fatal(reports[0])
+		}
+		for _, report := range reports[1:] {
+			if report.Name != bad.Name {
+				if !report.OK() {
+					t.Fatal(tc, report.Name, report.Errors)
+				}
+				continue
+			}
+			if report.OK() || report.BadEntries == 0 || !report.Quarantined {
+				t.Fatal(tc, report)
+			}
+			if _, err := os.Stat(path.Join(opts.QuarantinePath, path.Base(bad.TOCName))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(bad.Name); !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+}
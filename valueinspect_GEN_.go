@@ -0,0 +1,231 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spaolacci/murmur3"
+	"gopkg.in/gholt/brimutil.v1"
+)
+
+// ValueInspectFile describes a value file and TOC file pair; see
+// InspectValueFiles.
+type ValueInspectFile struct {
+	// Name and TOCName are the paths of the value file and its TOC file;
+	// Name will be empty if the value file is missing.
+	Name    string
+	TOCName string
+	// NameTimestamp is the UnixNano time the files were created, as recorded
+	// in their names.
+	NameTimestamp int64
+	// Size is the size of the value file in bytes.
+	Size int64
+	// Entries is how many entries the TOC file holds, estimated from its
+	// size.
+	Entries int
+}
+
+// ValueInspectEntry is an entry read from a TOC file; see InspectValueTOC.
+type ValueInspectEntry struct {
+	// TOCName is the path of the TOC file the entry was read from.
+	TOCName string
+	KeyA    uint64
+	KeyB    uint64
+
+	TimestampBits uint64
+	// TimestampMicro and Flags are TimestampBits decoded, the flags being
+	// names such as "deletion" or "expires".
+	TimestampMicro int64
+	Flags          []string
+	Offset         uint32
+	Length         uint32
+	// Value is the value as stored, including any expiration prefix or
+	// stream manifest, if it was requested and the entry isn't a deletion.
+	Value []byte
+}
+
+// InspectValueFiles lists the value file and TOC file pairs in the given
+// directories, in name order; dirs and dirtoc correspond to
+// ValueStoreConfig's Paths and PathTOC, with dirtoc defaulting to the first
+// of dirs. Only TOC files are listed, as those are what a store loads.
+func InspectValueFiles(dirs []string, dirtoc string) ([]*ValueInspectFile, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("no directories given")
+	}
+	if dirtoc == "" {
+		dirtoc = dirs[0]
+	}
+	fp, err := os.Open(dirtoc)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fp.Readdirnames(-1)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var files []*ValueInspectFile
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".valuetoc") {
+			continue
+		}
+		namets, err := strconv.ParseInt(name[:len(name)-len(".valuetoc")], 10, 64)
+		if err != nil || namets == 0 {
+			continue
+		}
+		file := &ValueInspectFile{TOCName: path.Join(dirtoc, name), NameTimestamp: namets}
+		fullName := valueFilePathIn(dirs, name[:len(name)-3], os.Stat)
+		if fi, err := os.Stat(fullName); err == nil {
+			file.Name = fullName
+			file.Size = fi.Size()
+		}
+		if file.Entries, err = valueTOCStat(file.TOCName, os.Stat, osOpenReadSeeker); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// InspectValueTOC calls f with each entry in the TOC file, in the order
+// they are stored. The entry given to f is reused, so f must copy anything
+// it wants to keep.
+func InspectValueTOC(tocName string, keyProvider KeyProvider, f func(entry *ValueInspectEntry)) []error {
+	fpr, err := osOpenReadSeeker(tocName)
+	if err != nil {
+		return []error{err}
+	}
+	defer closeIfCloser(fpr)
+	pendingBatchChans := []chan []valueTOCEntry{make(chan []valueTOCEntry, 3)}
+	freeBatchChans := []chan []valueTOCEntry{make(chan []valueTOCEntry, cap(pendingBatchChans[0]))}
+	for i := 0; i < cap(freeBatchChans[0]); i++ {
+		freeBatchChans[0] <- make([]valueTOCEntry, 1024)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		entry := &ValueInspectEntry{TOCName: tocName}
+		for {
+			batch := <-pendingBatchChans[0]
+			if batch == nil {
+				break
+			}
+			for j := 0; j < len(batch); j++ {
+				wr := &batch[j]
+				entry.KeyA = wr.KeyA
+				entry.KeyB = wr.KeyB
+
+				entry.TimestampBits = wr.TimestampBits
+				entry.TimestampMicro = int64(wr.TimestampBits >> _TSB_UTIL_BITS)
+				entry.Flags = timestampBitsFlags(wr.TimestampBits)
+				entry.Offset = wr.Offset
+				entry.Length = wr.Length
+				f(entry)
+			}
+			freeBatchChans[0] <- batch
+		}
+		wg.Done()
+	}()
+	_, errs := valueReadTOCEntriesBatched(fpr, keyProvider, 0, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	pendingBatchChans[0] <- nil
+	wg.Wait()
+	return errs
+}
+
+// InspectValueHistory returns every entry for the key across all the TOC
+// files in the given directories, oldest file first; see InspectValueFiles.
+// If values is true, each entry's value is read from its value file.
+func InspectValueHistory(dirs []string, dirtoc string, keyProvider KeyProvider, keyA uint64, keyB uint64, values bool) ([]*ValueInspectEntry, []error) {
+	files, err := InspectValueFiles(dirs, dirtoc)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var history []*ValueInspectEntry
+	var errs []error
+	for _, file := range files {
+		start := len(history)
+		for _, err := range InspectValueTOC(file.TOCName, keyProvider, func(entry *ValueInspectEntry) {
+			if entry.KeyA == keyA && entry.KeyB == keyB {
+				e := *entry
+				history = append(history, &e)
+			}
+		}) {
+			errs = append(errs, fmt.Errorf("%s: %s", file.TOCName, err))
+		}
+		if !values || start == len(history) {
+			continue
+		}
+		if file.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: missing value file", file.TOCName))
+			continue
+		}
+		fl, err := openValueInspectFile(file.Name, keyProvider)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", file.Name, err))
+			continue
+		}
+		for _, entry := range history[start:] {
+			if entry.TimestampBits&_TSB_DELETION != 0 {
+				continue
+			}
+			entry.Value = make([]byte, entry.Length)
+			if err := fl.readAt(0, entry.Offset, entry.Value); err != nil {
+				entry.Value = nil
+				errs = append(errs, fmt.Errorf("%s: offset %d: %s", file.Name, entry.Offset, err))
+			}
+		}
+		fl.closeFiles()
+	}
+	return history, errs
+}
+
+// ResolveValueHistory returns the entry from history, as returned by
+// InspectValueHistory, that a store's recovery would load, or nil if the
+// key would be missing. The newest timestamp wins, ties going to the entry
+// read last, and an entry marked for local removal removes the key.
+func ResolveValueHistory(history []*ValueInspectEntry) *ValueInspectEntry {
+	var resolved *ValueInspectEntry
+	for _, entry := range history {
+		if resolved == nil || entry.TimestampBits >= resolved.TimestampBits {
+			resolved = entry
+		}
+	}
+	if resolved != nil && resolved.TimestampBits&_TSB_LOCAL_REMOVAL != 0 {
+		return nil
+	}
+	return resolved
+}
+
+// openValueInspectFile opens a value file for reading with readAt without
+// needing a store.
+func openValueInspectFile(name string, keyProvider KeyProvider) (*valueStoreFile, error) {
+	fp, err := osOpenReadSeeker(name)
+	if err != nil {
+		return nil, err
+	}
+	header, checksumInterval, err := readValueHeader(fp)
+	if err != nil {
+		closeIfCloser(fp)
+		return nil, err
+	}
+	fl := &valueStoreFile{name: name, version: valueHeaderVersion(header)}
+	if fl.aead, err = valueHeaderAEAD(header, keyProvider); err != nil {
+		closeIfCloser(fp)
+		return nil, err
+	}
+	fl.readerFPs = []brimutil.ChecksummedReader{brimutil.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)}
+	if fl.aead != nil {
+		fl.readerFPs[0] = newBlockCipherReader(fl.readerFPs[0], fl.aead, int(checksumInterval), _VALUE_FILE_HEADER_SIZE)
+	}
+	fl.readerLocks = make([]sync.Mutex, 1)
+	fl.readerFlates = make([]io.ReadCloser, 1)
+	return fl, nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// KeyedValueStore wraps a ValueStore so that it may be used with []byte
+// keys rather than 128 bit keys; they are turned into
+// keyA, keyB with a Hasher.
+type KeyedValueStore struct {
+	store            ValueStore
+	hasher           Hasher
+	detectCollisions bool
+}
+
+// NewKeyedValueStore returns a KeyedValueStore wrapping store; a nil hasher
+// will use Murmur3Hasher.
+//
+// If detectCollisions is true, the original key is stored along with
+// each value and Get will return ErrKeyCollision when it doesn't match what
+// was requested. This reduces the space available for the value itself by
+// the length of the key plus a few bytes. The same
+// detectCollisions setting must be used for the life of the stored data.
+func NewKeyedValueStore(store ValueStore, hasher Hasher, detectCollisions bool) *KeyedValueStore {
+	if hasher == nil {
+		hasher = Murmur3Hasher{}
+	}
+	return &KeyedValueStore{store: store, hasher: hasher, detectCollisions: detectCollisions}
+}
+
+// Get returns timestampmicro, value, err for key; see ValueStore.Read.
+func (ks *KeyedValueStore) Get(key []byte) (int64, []byte, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	timestampmicro, value, err := ks.store.Read(keyA, keyB, nil)
+	if err != nil || !ks.detectCollisions {
+		return timestampmicro, value, err
+	}
+	for _, k := range [][]byte{key} {
+		n, i := binary.Uvarint(value)
+		if i <= 0 || n > uint64(len(value)-i) || !bytes.Equal(value[i:i+int(n)], k) {
+			return timestampmicro, nil, ErrKeyCollision
+		}
+		value = value[i+int(n):]
+	}
+	return timestampmicro, value, nil
+}
+
+// Put stores timestampmicro, value for key; see ValueStore.Write.
+func (ks *KeyedValueStore) Put(key []byte, timestampmicro int64, value []byte) (int64, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	if ks.detectCollisions {
+		v := make([]byte, 0, binary.MaxVarintLen64*2+len(key)+len(value))
+		var scratch [binary.MaxVarintLen64]byte
+		for _, k := range [][]byte{key} {
+			v = append(v, scratch[:binary.PutUvarint(scratch[:], uint64(len(k)))]...)
+			v = append(v, k...)
+		}
+		value = append(v, value...)
+	}
+	return ks.store.Write(keyA, keyB, timestampmicro, value)
+}
+
+// Del marks key as deleted at timestampmicro; see ValueStore.Delete.
+func (ks *KeyedValueStore) Del(key []byte, timestampmicro int64) (int64, error) {
+	keyA, keyB := ks.hasher.Hash(key)
+
+	return ks.store.Delete(keyA, keyB, timestampmicro)
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"testing"
+)
+
+type constantValueHasher struct{}
+
+func (constantValueHasher) Hash(key []byte) (uint64, uint64) {
+	return 1, 2
+}
+
+func TestKeyedValueStore(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	ks := NewKeyedValueStore(store, nil, false)
+	if _, err := ks.Put([]byte("key"), 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	timestampMicro, value, err := ks.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 || string(value) != "testing" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	keyA, keyB := Murmur3Hasher{}.Hash([]byte("key"))
+
+	if _, value, err = store.Read(keyA, keyB, nil); err != nil || string(value) != "testing" {
+		t.Fatal(string(value), err)
+	}
+	if _, err := ks.Del([]byte("key"), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ks.Get([]byte("key")); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	ks = NewKeyedValueStore(store, constantValueHasher{}, true)
+	if _, err := ks.Put([]byte("one"), 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, value, err = ks.Get([]byte("one")); err != nil || string(value) != "testing" {
+		t.Fatal(string(value), err)
+	}
+	if _, _, err := ks.Get([]byte("two")); err != ErrKeyCollision {
+		t.Fatal(err)
+	}
+
+}
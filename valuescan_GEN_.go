@@ -0,0 +1,104 @@
+package store
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+type valueScanEntry struct {
+	keyA uint64
+	keyB uint64
+
+	timestampbits uint64
+	length        uint32
+}
+
+// Scan calls fn for each entry with startKeyA <= keyA <= stopKeyA until fn
+// returns false; opts can restrict which entries are reported and whether
+// values are loaded. The value given to fn is only valid for the duration of
+// that call. Entries are reported in the order the locmap stores them, which
+// is not keyA order; callers needing sorted output must sort it themselves.
+// Values written with WriteStream are reported with a 0 length and nil value,
+// as ReadStream has to be used for them, and their chunk entries are reported
+// as entries of their own.
+//
+// Entries are gathered in batches and fn is called outside of any internal
+// locks, so it is safe to scan while writes are occurring and fn may itself
+// call back into the store. However, this also means entries written during
+// the scan may or may not be reported. Nothing is reported once the store has
+// been closed.
+func (store *DefaultValueStore) Scan(startKeyA uint64, stopKeyA uint64, opts ScanOptions, fn func(keyA uint64, keyB uint64, timestampMicro int64, length uint32, deleted bool, value []byte) bool) {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return
+	}
+	batchSize := opts.BatchSize
+	if batchSize < 1 {
+		batchSize = 1024
+	}
+	var minbits uint64
+	if opts.MinTimestampMicro > 0 {
+		minbits = uint64(opts.MinTimestampMicro) << _TSB_UTIL_BITS
+	}
+	cutoff := uint64(math.MaxUint64)
+	if opts.MaxTimestampMicro > 0 && opts.MaxTimestampMicro < TIMESTAMPMICRO_MAX {
+		cutoff = (uint64(opts.MaxTimestampMicro+1) << _TSB_UTIL_BITS) - 1
+	}
+	skip := func(timestampbits uint64) bool {
+		return timestampbits < minbits || timestampbits > cutoff || (opts.SkipDeleted && timestampbits&_TSB_DELETION != 0)
+	}
+	entries := make([]valueScanEntry, 0, batchSize)
+	var buf []byte
+	for more := true; more; {
+		entries = entries[:0]
+		// We don't call fn from within the locmap callback since that would
+		// hold up writers and would deadlock should fn call back into the
+		// store.
+		startKeyA, more = store.locmap.ScanCallback(startKeyA, stopKeyA, 0, _TSB_LOCAL_REMOVAL, cutoff, uint64(batchSize), func(keyA uint64, keyB uint64, timestampbits uint64, length uint32) bool {
+			if !skip(timestampbits) {
+				entries = append(entries, valueScanEntry{keyA: keyA, keyB: keyB, timestampbits: timestampbits, length: length})
+			}
+			return true
+		})
+		for i := range entries {
+			e := &entries[i]
+			deleted := e.timestampbits&_TSB_DELETION != 0
+			var value []byte
+			// Values written with WriteWithTTL need their expirations checked
+			// and are reported as deleted once expired. Also, the entry may
+			// have changed since it was gathered, in which case we report
+			// what is there now if it still qualifies.
+			if opts.Values || (!deleted && e.timestampbits&_TSB_EXPIRES != 0) {
+				var err error
+				if opts.Values {
+					e.timestampbits, buf, err = store.readUnexpired(e.keyA, e.keyB, buf[:0])
+					value = buf
+					e.length = uint32(len(value))
+				} else {
+					e.timestampbits, e.length, err = store.lookupUnexpired(e.keyA, e.keyB)
+				}
+				if err == ErrNotFound {
+					if e.timestampbits == 0 || e.timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+						continue
+					}
+					deleted = true
+					value = nil
+					e.length = 0
+				} else if err != nil {
+					continue
+				} else {
+					deleted = false
+				}
+				if skip(e.timestampbits) || (opts.SkipDeleted && deleted) {
+					continue
+				}
+			}
+			if e.timestampbits&_TSB_MANIFEST != 0 {
+				value = nil
+				e.length = 0
+			}
+			if !fn(e.keyA, e.keyB, int64(e.timestampbits>>_TSB_UTIL_BITS), e.length, deleted, value) {
+				return
+			}
+		}
+	}
+}
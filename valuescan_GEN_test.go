@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValueScan(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	for i := uint64(0); i < 100; i++ {
+		if _, err := store.Write(i, i, int64(1000+i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(0); i < 100; i += 10 {
+		if _, err := store.Delete(i, i, 2000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	deleted := 0
+	store.Scan(10, 59, ScanOptions{BatchSize: 7}, func(keyA uint64, keyB uint64, timestampMicro int64, length uint32, d bool, value []byte) bool {
+		if keyA < 10 || keyA > 59 {
+			t.Fatal(keyA)
+		}
+		if value != nil {
+			t.Fatal(value)
+		}
+		count++
+		if d {
+			deleted++
+		}
+		return true
+	})
+	if count != 50 || deleted != 5 {
+		t.Fatal(count, deleted)
+	}
+	count = 0
+	store.Scan(0, 99, ScanOptions{SkipDeleted: true, MinTimestampMicro: 1020, MaxTimestampMicro: 1029, Values: true}, func(keyA uint64, keyB uint64, timestampMicro int64, length uint32, d bool, value []byte) bool {
+		if d || keyA < 21 || keyA > 29 || timestampMicro != int64(1000+keyA) {
+			t.Fatal(keyA, timestampMicro, d)
+		}
+		if string(value) != fmt.Sprintf("value%d", keyA) || length != uint32(len(value)) {
+			t.Fatal(keyA, string(value), length)
+		}
+		count++
+		return true
+	})
+	if count != 9 {
+		t.Fatal(count)
+	}
+	count = 0
+	store.Scan(0, 99, ScanOptions{}, func(keyA uint64, keyB uint64, timestampMicro int64, length uint32, d bool, value []byte) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot writes a consistent copy of the store's files into dir, which will
+// be created if needed, without stopping writes. The store is flushed and
+// every closed value file and TOC file pair is hard linked, or copied if
+// linking fails, into dir; both kinds of files go into dir, so it can be
+// opened with a ValueStoreConfig of just Path: dir. Files being written to
+// after the flush are left out.
+//
+// Compaction and audit will wait to remove any files until the snapshot is
+// done. Since hard linked files share their contents with the store's files,
+// they should be treated as read only until copied elsewhere.
+func (store *DefaultValueStore) Snapshot(dir string) (SnapshotInfo, error) {
+	info := SnapshotInfo{Path: dir}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return info, ErrClosed
+	}
+	if err := store.fs.MkdirAll(dir); err != nil {
+		return info, err
+	}
+	// The lock is taken before the flush so that compaction can't remove a
+	// file whose rewritten entries haven't yet reached a closed file.
+	store.snapshotLock.Lock()
+	defer store.snapshotLock.Unlock()
+	info.HighWater = time.Now().UnixNano()
+	store.flush()
+	names, err := store.fs.ReadDirNames(store.pathtoc)
+	if err != nil {
+		return info, err
+	}
+	// The active TOCs are checked after listing the files; a TOC no longer
+	// active by then has been closed, along with its value file. activeTOCA
+	// must be read first as the tocWriter moves it to activeTOCB.
+	activeTOCA := atomic.LoadUint64(&store.activeTOCA)
+	activeTOCB := atomic.LoadUint64(&store.activeTOCB)
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".valuetoc") {
+			continue
+		}
+		namets, err := strconv.ParseUint(name[:len(name)-len(".valuetoc")], 10, 64)
+		if err != nil || namets == 0 || namets == activeTOCA || namets == activeTOCB {
+			continue
+		}
+		dataName := name[:len(name)-len("toc")]
+		dataPath := store.valueFilePath(dataName)
+		if _, err = store.fs.Stat(dataPath); err != nil {
+			// Recovery couldn't use a TOC without its value file either.
+			continue
+		}
+		for _, src := range []string{dataPath, path.Join(store.pathtoc, name)} {
+			copied, n, err := linkOrCopy(store.fs, src, path.Join(dir, path.Base(src)))
+			if err != nil {
+				return info, err
+			}
+			if copied {
+				info.Copied++
+			}
+			info.Files++
+			info.Bytes += n
+		}
+	}
+	atomic.AddInt32(&store.snapshots, 1)
+	return info, nil
+}
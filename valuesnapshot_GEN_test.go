@@ -0,0 +1,67 @@
+package store
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestValueSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "store"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	store := newValueTestStore(t, path.Join(dir, "store"), nil)
+	for i := uint64(1); i <= 50; i++ {
+		if _, err := store.Write(i, i, 1000, []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Writes carry on during the snapshot.
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		for i := uint64(100); i < 200; i++ {
+			if _, err := store.Write(i, i, 1000, []byte("during")); err != nil {
+				t.Error(err)
+			}
+		}
+		wg.Done()
+	}()
+	info, err := store.Snapshot(path.Join(dir, "snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if info.Files == 0 || info.Files%2 != 0 || info.Bytes == 0 || info.HighWater == 0 {
+		t.Fatal(info)
+	}
+	if stats := store.Stats(false).(*ValueStoreStats); stats.Snapshots != 1 {
+		t.Fatal(stats.Snapshots)
+	}
+	// Changes after the snapshot, even compacting away the files, must not
+	// affect it.
+	for i := uint64(1); i <= 50; i++ {
+		if _, err := store.Delete(i, i, 2000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Flush()
+	store.compactionState.ageThreshold = 0
+	store.CompactionPass()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := newValueTestStore(t, info.Path, nil)
+	defer snapshot.Close()
+	for i := uint64(1); i <= 50; i++ {
+		ts, v, err := snapshot.Read(i, i, nil)
+		if err != nil || ts != 1000 || string(v) != "before" {
+			t.Fatal(i, ts, string(v), err)
+		}
+	}
+	if _, err := store.Snapshot(info.Path); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
@@ -17,28 +17,78 @@ type ValueStoreStats struct {
 	Lookups int32
 	// LookupErrors is the number of errors returned by Lookup.
 	LookupErrors int32
-	// Reads is the number of calls to Read.
+	// LookupTimeouts is the number of calls to Lookup that gave up due to their
+	// context being done.
+	LookupTimeouts int32
+	// Reads is the number of calls to Read and ReadTo.
 	// LookupGroups is the number of calls to LookupGroup.
 	LookupGroups int32
-	// LookupGroupItems is the number of items LookupGroup has encountered.
+	// LookupGroupItems is the number of items LookupGroup and LookupGroupPage
+	// have encountered.
 	LookupGroupItems int32
-	Reads            int32
-	// ReadErrors is the number of errors returned by Read.
+	// LookupGroupPages is the number of calls to LookupGroupPage.
+	LookupGroupPages int32
+	// ReadGroups is the number of calls to ReadGroup.
+	ReadGroups int32
+	// ReadGroupItems is the number of items ReadGroup has encountered.
+	ReadGroupItems int32
+	Reads          int32
+	// ReadErrors is the number of errors returned by Read and ReadTo.
 	ReadErrors int32
-	// Writes is the number of calls to Write.
+	// ReadTimeouts is the number of calls to Read that gave up due to their
+	// context being done.
+	ReadTimeouts int32
+	// ReadStreams is the number of calls to ReadStream.
+	ReadStreams int32
+	// ReadStreamErrors is the number of errors returned by ReadStream.
+	ReadStreamErrors int32
+	// Writes is the number of calls to Write, including each entry given to
+	// WriteBatch.
 	Writes int32
-	// WriteErrors is the number of errors returned by Write.
+	// WriteErrors is the number of errors returned by Write or for entries
+	// given to WriteBatch.
 	WriteErrors int32
+	// WriteTimeouts is the number of calls to Write that gave up due to their
+	// context being done.
+	WriteTimeouts int32
 	// WritesOverridden is the number of calls to Write that resulted in no
 	// change.
 	WritesOverridden int32
-	// Deletes is the number of calls to Delete.
+	// WriteBatches is the number of calls to WriteBatch.
+	WriteBatches int32
+	// WriteIfs is the number of calls to WriteIf.
+	WriteIfs int32
+	// WriteIfErrors is the number of errors returned by WriteIf, not
+	// including conflicts.
+	WriteIfErrors int32
+	// WriteIfConflicts is the number of calls to WriteIf that returned
+	// ErrConflict.
+	WriteIfConflicts int32
+	// WriteIfTimeouts is the number of calls to WriteIf that gave up due to
+	// their context being done.
+	WriteIfTimeouts int32
+	// WriteStreams is the number of calls to WriteStream.
+	WriteStreams int32
+	// WriteStreamErrors is the number of errors returned by WriteStream.
+	WriteStreamErrors int32
+	// Deletes is the number of calls to Delete, including each entry given to
+	// DeleteBatch.
 	Deletes int32
-	// DeleteErrors is the number of errors returned by Delete.
+	// DeleteErrors is the number of errors returned by Delete or for entries
+	// given to DeleteBatch.
 	DeleteErrors int32
+	// DeleteTimeouts is the number of calls to Delete that gave up due to their
+	// context being done.
+	DeleteTimeouts int32
 	// DeletesOverridden is the number of calls to Delete that resulted in no
 	// change.
 	DeletesOverridden int32
+	// DeleteBatches is the number of calls to DeleteBatch.
+	DeleteBatches int32
+	// DeleteGroups is the number of calls to DeleteGroup.
+	DeleteGroups int32
+	// DeleteGroupItems is the number of items DeleteGroup has removed.
+	DeleteGroupItems int32
 	// OutBulkSets is the number of outgoing bulk-set messages in response to
 	// incoming pull replication messages.
 	OutBulkSets int32
@@ -101,6 +151,12 @@ type ValueStoreStats struct {
 	// ExpiredDeletions is the number of recent deletes that have become old
 	// enough to be completely discarded.
 	ExpiredDeletions int32
+	// ExpiredValues is the number of values written with WriteWithTTL that
+	// have expired and been replaced with deletion markers.
+	ExpiredValues int32
+	// DroppedChanges is the number of changes not sent to subscribers because
+	// their buffers were full; see Subscribe.
+	DroppedChanges int32
 	// Compactions is the number of disk file sets compacted due to their
 	// contents exceeding a staleness threshold. For example, this happens when
 	// enough of the values have been overwritten or deleted in more recent
@@ -110,15 +166,41 @@ type ValueStoreStats struct {
 	// the entire file size being too small. For example, this may happen when
 	// the store is shutdown and restarted.
 	SmallFileCompactions int32
+	// RekeyCompactions is the number of disk file sets compacted because they were
+	// not encrypted with the Config.KeyProvider's current key.
+	RekeyCompactions int32
+	// Snapshots is the number of calls to Snapshot that completed successfully.
+	Snapshots int32
+	// Checkpoints is the number of checkpoints of key locations written.
+	Checkpoints int32
+	// Syncs is the number of flushes done for writes waiting on DurabilitySync,
+	// each covering any number of writes.
+	Syncs int32
+	// RecoveryTOCFiles is the number of TOC files read by recovery when the
+	// store was opened, not counting those covered by a checkpoint.
+	RecoveryTOCFiles int64
+	// RecoveryKeyLocations is the number of key locations loaded by recovery
+	// from TOC files and any checkpoint.
+	RecoveryKeyLocations int64
+	// RecoveryDuration is how long recovery took.
+	RecoveryDuration time.Duration
+	// CompressedBytes is the number of bytes values took up when written to
+	// disk with compression enabled; see Config.CompressionLevel.
+	CompressedBytes uint64
+	// UncompressedBytes is the number of bytes those same values would have
+	// taken up if written without compression.
+	UncompressedBytes uint64
 	// Free is the number of bytes free on the device containing the
-	// Config.Path for the DefaultValueStore.
+	// Config.Path for the DefaultValueStore; with several Config.Paths, it
+	// is of the device the disk watcher expects to fill first.
 	Free uint64
-	// Used is the number of bytes used on the device containing the
-	// Config.Path for the DefaultValueStore.
+	// Used is the number of bytes used on that same device.
 	Used uint64
-	// Size is the size in bytes of the device containing the Config.Path for
-	// the DefaultValueStore.
+	// Size is the size in bytes of that same device.
 	Size uint64
+	// PathsFree is the number of bytes free on the device containing each of
+	// the Config.Paths, in order.
+	PathsFree []uint64
 	// FreeTOC is the number of bytes free on the device containing the
 	// Config.PathTOC for the DefaultValueStore.
 	FreeTOC uint64
@@ -149,6 +231,7 @@ type ValueStoreStats struct {
 	maxLocBlockID              uint64
 	path                       string
 	pathtoc                    string
+	paths                      []string
 	workers                    int
 	tombstoneDiscardInterval   int
 	outPullReplicationWorkers  uint64
@@ -162,6 +245,7 @@ type ValueStoreStats struct {
 	tombstoneAge               int
 	fileCap                    uint32
 	fileReaders                int
+	mmapReads                  bool
 	checksumInterval           uint32
 	replicationIgnoreRecent    int
 	locmapDebugInfo            fmt.Stringer
@@ -189,16 +273,35 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 	stats := &ValueStoreStats{
 		Lookups:                      atomic.LoadInt32(&store.lookups),
 		LookupErrors:                 atomic.LoadInt32(&store.lookupErrors),
+		LookupTimeouts:               atomic.LoadInt32(&store.lookupTimeouts),
 		LookupGroups:                 atomic.LoadInt32(&store.lookupGroups),
 		LookupGroupItems:             atomic.LoadInt32(&store.lookupGroupItems),
+		LookupGroupPages:             atomic.LoadInt32(&store.lookupGroupPages),
+		ReadGroups:                   atomic.LoadInt32(&store.readGroups),
+		ReadGroupItems:               atomic.LoadInt32(&store.readGroupItems),
 		Reads:                        atomic.LoadInt32(&store.reads),
 		ReadErrors:                   atomic.LoadInt32(&store.readErrors),
+		ReadTimeouts:                 atomic.LoadInt32(&store.readTimeouts),
+		ReadStreams:                  atomic.LoadInt32(&store.readStreams),
+		ReadStreamErrors:             atomic.LoadInt32(&store.readStreamErrors),
 		Writes:                       atomic.LoadInt32(&store.writes),
 		WriteErrors:                  atomic.LoadInt32(&store.writeErrors),
+		WriteTimeouts:                atomic.LoadInt32(&store.writeTimeouts),
 		WritesOverridden:             atomic.LoadInt32(&store.writesOverridden),
+		WriteBatches:                 atomic.LoadInt32(&store.writeBatches),
+		WriteIfs:                     atomic.LoadInt32(&store.writeIfs),
+		WriteIfErrors:                atomic.LoadInt32(&store.writeIfErrors),
+		WriteIfConflicts:             atomic.LoadInt32(&store.writeIfConflicts),
+		WriteIfTimeouts:              atomic.LoadInt32(&store.writeIfTimeouts),
+		WriteStreams:                 atomic.LoadInt32(&store.writeStreams),
+		WriteStreamErrors:            atomic.LoadInt32(&store.writeStreamErrors),
 		Deletes:                      atomic.LoadInt32(&store.deletes),
 		DeleteErrors:                 atomic.LoadInt32(&store.deleteErrors),
+		DeleteTimeouts:               atomic.LoadInt32(&store.deleteTimeouts),
 		DeletesOverridden:            atomic.LoadInt32(&store.deletesOverridden),
+		DeleteBatches:                atomic.LoadInt32(&store.deleteBatches),
+		DeleteGroups:                 atomic.LoadInt32(&store.deleteGroups),
+		DeleteGroupItems:             atomic.LoadInt32(&store.deleteGroupItems),
 		OutBulkSets:                  atomic.LoadInt32(&store.outBulkSets),
 		OutBulkSetValues:             atomic.LoadInt32(&store.outBulkSetValues),
 		OutBulkSetPushes:             atomic.LoadInt32(&store.outBulkSetPushes),
@@ -221,8 +324,19 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 		InPullReplicationDrops:       atomic.LoadInt32(&store.inPullReplicationDrops),
 		InPullReplicationInvalids:    atomic.LoadInt32(&store.inPullReplicationInvalids),
 		ExpiredDeletions:             atomic.LoadInt32(&store.expiredDeletions),
+		ExpiredValues:                atomic.LoadInt32(&store.expiredValues),
+		DroppedChanges:               atomic.LoadInt32(&store.droppedChanges),
 		Compactions:                  atomic.LoadInt32(&store.compactions),
 		SmallFileCompactions:         atomic.LoadInt32(&store.smallFileCompactions),
+		RekeyCompactions:             atomic.LoadInt32(&store.rekeyCompactions),
+		Snapshots:                    atomic.LoadInt32(&store.snapshots),
+		Checkpoints:                  atomic.LoadInt32(&store.checkpoints),
+		Syncs:                        atomic.LoadInt32(&store.syncs),
+		RecoveryTOCFiles:             atomic.LoadInt64(&store.recoveryTOCFiles),
+		RecoveryKeyLocations:         atomic.LoadInt64(&store.recoveryKeyLocations),
+		RecoveryDuration:             time.Duration(atomic.LoadInt64(&store.recoveryDuration)),
+		CompressedBytes:              atomic.LoadUint64(&store.compressedBytes),
+		UncompressedBytes:            atomic.LoadUint64(&store.uncompressedBytes),
 		Free:                         atomic.LoadUint64(&store.diskWatcherState.free),
 		Used:                         atomic.LoadUint64(&store.diskWatcherState.used),
 		Size:                         atomic.LoadUint64(&store.diskWatcherState.size),
@@ -230,18 +344,41 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 		UsedTOC:                      atomic.LoadUint64(&store.diskWatcherState.usedtoc),
 		SizeTOC:                      atomic.LoadUint64(&store.diskWatcherState.sizetoc),
 	}
+	stats.PathsFree = make([]uint64, len(store.diskWatcherState.pathsFree))
+	for i := range stats.PathsFree {
+		stats.PathsFree[i] = atomic.LoadUint64(&store.diskWatcherState.pathsFree[i])
+	}
 	atomic.AddInt32(&store.lookups, -stats.Lookups)
 	atomic.AddInt32(&store.lookupErrors, -stats.LookupErrors)
+	atomic.AddInt32(&store.lookupTimeouts, -stats.LookupTimeouts)
 	atomic.AddInt32(&store.lookupGroups, -stats.LookupGroups)
 	atomic.AddInt32(&store.lookupGroupItems, -stats.LookupGroupItems)
+	atomic.AddInt32(&store.lookupGroupPages, -stats.LookupGroupPages)
+	atomic.AddInt32(&store.readGroups, -stats.ReadGroups)
+	atomic.AddInt32(&store.readGroupItems, -stats.ReadGroupItems)
 	atomic.AddInt32(&store.reads, -stats.Reads)
 	atomic.AddInt32(&store.readErrors, -stats.ReadErrors)
+	atomic.AddInt32(&store.readTimeouts, -stats.ReadTimeouts)
+	atomic.AddInt32(&store.readStreams, -stats.ReadStreams)
+	atomic.AddInt32(&store.readStreamErrors, -stats.ReadStreamErrors)
 	atomic.AddInt32(&store.writes, -stats.Writes)
 	atomic.AddInt32(&store.writeErrors, -stats.WriteErrors)
+	atomic.AddInt32(&store.writeTimeouts, -stats.WriteTimeouts)
 	atomic.AddInt32(&store.writesOverridden, -stats.WritesOverridden)
+	atomic.AddInt32(&store.writeBatches, -stats.WriteBatches)
+	atomic.AddInt32(&store.writeIfs, -stats.WriteIfs)
+	atomic.AddInt32(&store.writeIfErrors, -stats.WriteIfErrors)
+	atomic.AddInt32(&store.writeIfConflicts, -stats.WriteIfConflicts)
+	atomic.AddInt32(&store.writeIfTimeouts, -stats.WriteIfTimeouts)
+	atomic.AddInt32(&store.writeStreams, -stats.WriteStreams)
+	atomic.AddInt32(&store.writeStreamErrors, -stats.WriteStreamErrors)
 	atomic.AddInt32(&store.writes, -stats.Deletes)
 	atomic.AddInt32(&store.writeErrors, -stats.DeleteErrors)
+	atomic.AddInt32(&store.deleteTimeouts, -stats.DeleteTimeouts)
 	atomic.AddInt32(&store.writesOverridden, -stats.DeletesOverridden)
+	atomic.AddInt32(&store.deleteBatches, -stats.DeleteBatches)
+	atomic.AddInt32(&store.deleteGroups, -stats.DeleteGroups)
+	atomic.AddInt32(&store.deleteGroupItems, -stats.DeleteGroupItems)
 	atomic.AddInt32(&store.outBulkSets, -stats.OutBulkSets)
 	atomic.AddInt32(&store.outBulkSetValues, -stats.OutBulkSetValues)
 	atomic.AddInt32(&store.outBulkSetPushes, -stats.OutBulkSetPushes)
@@ -264,8 +401,16 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 	atomic.AddInt32(&store.inPullReplicationDrops, -stats.InPullReplicationDrops)
 	atomic.AddInt32(&store.inPullReplicationInvalids, -stats.InPullReplicationInvalids)
 	atomic.AddInt32(&store.expiredDeletions, -stats.ExpiredDeletions)
+	atomic.AddInt32(&store.expiredValues, -stats.ExpiredValues)
+	atomic.AddInt32(&store.droppedChanges, -stats.DroppedChanges)
 	atomic.AddInt32(&store.compactions, -stats.Compactions)
 	atomic.AddInt32(&store.smallFileCompactions, -stats.SmallFileCompactions)
+	atomic.AddInt32(&store.rekeyCompactions, -stats.RekeyCompactions)
+	atomic.AddInt32(&store.snapshots, -stats.Snapshots)
+	atomic.AddInt32(&store.checkpoints, -stats.Checkpoints)
+	atomic.AddInt32(&store.syncs, -stats.Syncs)
+	atomic.AddUint64(&store.compressedBytes, -stats.CompressedBytes)
+	atomic.AddUint64(&store.uncompressedBytes, -stats.UncompressedBytes)
 	store.statsLock.Unlock()
 	if !debug {
 		locmapStats := store.locmap.Stats(false)
@@ -299,6 +444,7 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 		stats.maxLocBlockID = atomic.LoadUint64(&store.locBlockIDer)
 		stats.path = store.path
 		stats.pathtoc = store.pathtoc
+		stats.paths = store.paths
 		stats.workers = store.workers
 		stats.tombstoneDiscardInterval = store.tombstoneDiscardState.interval
 		stats.outPullReplicationWorkers = store.pullReplicationState.outWorkers
@@ -312,6 +458,7 @@ func (store *DefaultValueStore) Stats(debug bool) fmt.Stringer {
 		stats.tombstoneAge = int((store.tombstoneDiscardState.age >> _TSB_UTIL_BITS) * 1000 / uint64(time.Second))
 		stats.fileCap = store.fileCap
 		stats.fileReaders = store.fileReaders
+		stats.mmapReads = store.mmapReads
 		stats.checksumInterval = store.checksumInterval
 		stats.replicationIgnoreRecent = int(store.replicationIgnoreRecent / uint64(time.Second))
 		locmapStats := store.locmap.Stats(true)
@@ -328,16 +475,35 @@ func (stats *ValueStoreStats) String() string {
 		{"ValueBytes", fmt.Sprintf("%d", stats.ValueBytes)},
 		{"Lookups", fmt.Sprintf("%d", stats.Lookups)},
 		{"LookupErrors", fmt.Sprintf("%d", stats.LookupErrors)},
+		{"LookupTimeouts", fmt.Sprintf("%d", stats.LookupTimeouts)},
 		{"LookupGroups", fmt.Sprintf("%d", stats.LookupGroups)},
 		{"LookupGroupItems", fmt.Sprintf("%d", stats.LookupGroupItems)},
+		{"LookupGroupPages", fmt.Sprintf("%d", stats.LookupGroupPages)},
+		{"ReadGroups", fmt.Sprintf("%d", stats.ReadGroups)},
+		{"ReadGroupItems", fmt.Sprintf("%d", stats.ReadGroupItems)},
 		{"Reads", fmt.Sprintf("%d", stats.Reads)},
 		{"ReadErrors", fmt.Sprintf("%d", stats.ReadErrors)},
+		{"ReadTimeouts", fmt.Sprintf("%d", stats.ReadTimeouts)},
+		{"ReadStreams", fmt.Sprintf("%d", stats.ReadStreams)},
+		{"ReadStreamErrors", fmt.Sprintf("%d", stats.ReadStreamErrors)},
 		{"Writes", fmt.Sprintf("%d", stats.Writes)},
 		{"WriteErrors", fmt.Sprintf("%d", stats.WriteErrors)},
+		{"WriteTimeouts", fmt.Sprintf("%d", stats.WriteTimeouts)},
 		{"WritesOverridden", fmt.Sprintf("%d", stats.WritesOverridden)},
+		{"WriteBatches", fmt.Sprintf("%d", stats.WriteBatches)},
+		{"WriteIfs", fmt.Sprintf("%d", stats.WriteIfs)},
+		{"WriteIfErrors", fmt.Sprintf("%d", stats.WriteIfErrors)},
+		{"WriteIfConflicts", fmt.Sprintf("%d", stats.WriteIfConflicts)},
+		{"WriteIfTimeouts", fmt.Sprintf("%d", stats.WriteIfTimeouts)},
+		{"WriteStreams", fmt.Sprintf("%d", stats.WriteStreams)},
+		{"WriteStreamErrors", fmt.Sprintf("%d", stats.WriteStreamErrors)},
 		{"Deletes", fmt.Sprintf("%d", stats.Deletes)},
 		{"DeleteErrors", fmt.Sprintf("%d", stats.DeleteErrors)},
+		{"DeleteTimeouts", fmt.Sprintf("%d", stats.DeleteTimeouts)},
 		{"DeletesOverridden", fmt.Sprintf("%d", stats.DeletesOverridden)},
+		{"DeleteBatches", fmt.Sprintf("%d", stats.DeleteBatches)},
+		{"DeleteGroups", fmt.Sprintf("%d", stats.DeleteGroups)},
+		{"DeleteGroupItems", fmt.Sprintf("%d", stats.DeleteGroupItems)},
 		{"OutBulkSets", fmt.Sprintf("%d", stats.OutBulkSets)},
 		{"OutBulkSetValues", fmt.Sprintf("%d", stats.OutBulkSetValues)},
 		{"OutBulkSetPushes", fmt.Sprintf("%d", stats.OutBulkSetPushes)},
@@ -360,11 +526,23 @@ func (stats *ValueStoreStats) String() string {
 		{"InPullReplicationDrops", fmt.Sprintf("%d", stats.InPullReplicationDrops)},
 		{"InPullReplicationInvalids", fmt.Sprintf("%d", stats.InPullReplicationInvalids)},
 		{"ExpiredDeletions", fmt.Sprintf("%d", stats.ExpiredDeletions)},
+		{"ExpiredValues", fmt.Sprintf("%d", stats.ExpiredValues)},
+		{"DroppedChanges", fmt.Sprintf("%d", stats.DroppedChanges)},
 		{"Compactions", fmt.Sprintf("%d", stats.Compactions)},
 		{"SmallFileCompactions", fmt.Sprintf("%d", stats.SmallFileCompactions)},
+		{"RekeyCompactions", fmt.Sprintf("%d", stats.RekeyCompactions)},
+		{"Snapshots", fmt.Sprintf("%d", stats.Snapshots)},
+		{"Checkpoints", fmt.Sprintf("%d", stats.Checkpoints)},
+		{"Syncs", fmt.Sprintf("%d", stats.Syncs)},
+		{"RecoveryTOCFiles", fmt.Sprintf("%d", stats.RecoveryTOCFiles)},
+		{"RecoveryKeyLocations", fmt.Sprintf("%d", stats.RecoveryKeyLocations)},
+		{"RecoveryDuration", stats.RecoveryDuration.String()},
+		{"CompressedBytes", fmt.Sprintf("%d", stats.CompressedBytes)},
+		{"UncompressedBytes", fmt.Sprintf("%d", stats.UncompressedBytes)},
 		{"Free", fmt.Sprintf("%d", stats.Free)},
 		{"Used", fmt.Sprintf("%d", stats.Used)},
 		{"Size", fmt.Sprintf("%d", stats.Size)},
+		{"PathsFree", fmt.Sprintf("%v", stats.PathsFree)},
 		{"FreeTOC", fmt.Sprintf("%d", stats.FreeTOC)},
 		{"UsedTOC", fmt.Sprintf("%d", stats.UsedTOC)},
 		{"SizeTOC", fmt.Sprintf("%d", stats.SizeTOC)},
@@ -391,6 +569,7 @@ func (stats *ValueStoreStats) String() string {
 			{"maxLocBlockID", fmt.Sprintf("%d", stats.maxLocBlockID)},
 			{"path", stats.path},
 			{"pathtoc", stats.pathtoc},
+			{"paths", fmt.Sprintf("%v", stats.paths)},
 			{"workers", fmt.Sprintf("%d", stats.workers)},
 			{"tombstoneDiscardInterval", fmt.Sprintf("%d", stats.tombstoneDiscardInterval)},
 			{"outPullReplicationWorkers", fmt.Sprintf("%d", stats.outPullReplicationWorkers)},
@@ -404,6 +583,7 @@ func (stats *ValueStoreStats) String() string {
 			{"tombstoneAge", fmt.Sprintf("%d", stats.tombstoneAge)},
 			{"fileCap", fmt.Sprintf("%d", stats.fileCap)},
 			{"fileReaders", fmt.Sprintf("%d", stats.fileReaders)},
+			{"mmapReads", fmt.Sprintf("%v", stats.mmapReads)},
 			{"checksumInterval", fmt.Sprintf("%d", stats.checksumInterval)},
 			{"replicationIgnoreRecent", fmt.Sprintf("%d", stats.replicationIgnoreRecent)},
 			{"locmapDebugInfo", stats.locmapDebugInfo.String()},
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,8 +19,6 @@ import (
 
 	"github.com/gholt/locmap"
 	"github.com/gholt/ring"
-	"github.com/spaolacci/murmur3"
-	"gopkg.in/gholt/brimutil.v1"
 )
 
 // DefaultValueStore instances are created with NewValueStore.
@@ -40,21 +39,33 @@ type DefaultValueStore struct {
 	pendingTOCBlockChan     chan []byte
 	activeTOCA              uint64
 	activeTOCB              uint64
+	flushLock               sync.Mutex
 	flushedChan             chan struct{}
+	syncedChan              chan struct{}
 	locBlocks               []valueLocBlock
 	locBlockIDer            uint64
 	path                    string
 	pathtoc                 string
+	paths                   []string
+	pathsByFreeSpace        bool
+	pathsNext               uint32
 	locmap                  locmap.ValueLocMap
 	workers                 int
 	recoveryBatchSize       int
+	recoveryReaders         int
 	valueCap                uint32
 	pageSize                uint32
 	minValueAlloc           int
 	writePagesPerWorker     int
 	fileCap                 uint32
 	fileReaders             int
+	mmapReads               bool
 	checksumInterval        uint32
+	compressionLevel        int
+	keyProvider             KeyProvider
+	fs                      FS
+	durability              Durability
+	syncState               valueSyncState
 	msgRing                 ring.MsgRing
 	tombstoneDiscardState   valueTombstoneDiscardState
 	auditState              valueAuditState
@@ -68,21 +79,50 @@ type DefaultValueStore struct {
 	userDisabled            bool
 	flusherState            valueFlusherState
 	diskWatcherState        valueDiskWatcherState
+	checkpointState         valueCheckpointState
 	restartChan             chan error
+	closeLock               sync.Mutex
+	// snapshotLock is held by Snapshot while it gathers files; compaction and
+	// audit take a read lock while removing files.
+	snapshotLock      sync.RWMutex
+	closed            uint32
+	shutdownDoneChan  chan struct{}
+	subscriptionsLock sync.RWMutex
+	subscriptions     []*valueSubscription
+	subscriptionCount int32
 
 	statsLock                    sync.Mutex
 	lookups                      int32
 	lookupErrors                 int32
+	lookupTimeouts               int32
 	lookupGroups                 int32
 	lookupGroupItems             int32
+	lookupGroupPages             int32
+	readGroups                   int32
+	readGroupItems               int32
 	reads                        int32
 	readErrors                   int32
+	readTimeouts                 int32
+	readStreams                  int32
+	readStreamErrors             int32
 	writes                       int32
 	writeErrors                  int32
+	writeTimeouts                int32
 	writesOverridden             int32
+	writeBatches                 int32
+	writeIfs                     int32
+	writeIfErrors                int32
+	writeIfConflicts             int32
+	writeIfTimeouts              int32
+	writeStreams                 int32
+	writeStreamErrors            int32
 	deletes                      int32
 	deleteErrors                 int32
+	deleteTimeouts               int32
 	deletesOverridden            int32
+	deleteBatches                int32
+	deleteGroups                 int32
+	deleteGroupItems             int32
 	outBulkSets                  int32
 	outBulkSetValues             int32
 	outBulkSetPushes             int32
@@ -105,8 +145,19 @@ type DefaultValueStore struct {
 	inPullReplicationDrops       int32
 	inPullReplicationInvalids    int32
 	expiredDeletions             int32
+	expiredValues                int32
+	droppedChanges               int32
 	compactions                  int32
 	smallFileCompactions         int32
+	rekeyCompactions             int32
+	snapshots                    int32
+	recoveryTOCFiles             int64
+	recoveryKeyLocations         int64
+	recoveryDuration             int64
+	checkpoints                  int32
+	syncs                        int32
+	compressedBytes              uint64
+	uncompressedBytes            uint64
 
 	// Used by the flusher only
 	modifications int32
@@ -120,12 +171,36 @@ type valueWriteReq struct {
 	value         []byte
 	errChan       chan error
 	internal      bool
+	// conditional indicates the write should only be applied if the current
+	// timestamp matches expectedbits; see WriteIfContext.
+	conditional  bool
+	expectedbits uint64
+	// replicated indicates the write came from another store; see
+	// writeReplicated.
+	replicated bool
+	// otimestampbits and omanifest are for the stream manifest this write
+	// would replace, if any; see supersededStreamManifest.
+	otimestampbits uint64
+	omanifest      []byte
 }
 
+// _VALUE_RECOVERY_PROGRESS_INTERVAL is how often recovery logs its
+// progress.
+const _VALUE_RECOVERY_PROGRESS_INTERVAL = 10 * time.Second
+
 var enableValueWriteReq *valueWriteReq = &valueWriteReq{}
 var disableValueWriteReq *valueWriteReq = &valueWriteReq{}
 var flushValueWriteReq *valueWriteReq = &valueWriteReq{}
+var syncValueWriteReq *valueWriteReq = &valueWriteReq{}
+var shutdownValueWriteReq *valueWriteReq = &valueWriteReq{}
 var flushValueMemBlock *valueMemBlock = &valueMemBlock{}
+var syncValueMemBlock *valueMemBlock = &valueMemBlock{}
+var shutdownValueMemBlock *valueMemBlock = &valueMemBlock{}
+
+// syncValueTOCBlock is passed on to the tocWriter by each memClearer that
+// reaches a sync; it is told apart by its length as real TOC blocks always
+// have an entry after their 8 byte timestamp.
+var syncValueTOCBlock []byte = make([]byte, 8)
 
 type valueLocBlock interface {
 	timestampnano() int64
@@ -145,9 +220,8 @@ type valueLocBlock interface {
 // bad entries due to the corruption.
 //
 // Note that a lot of buffering, multiple cores, and background processes can
-// be in use and therefore DisableAll() and Flush() should be called prior to
-// the process exiting to ensure all processing is done and the buffers are
-// flushed.
+// be in use and therefore Close() should be called prior to the process
+// exiting to ensure all processing is done and the buffers are flushed.
 func NewValueStore(c *ValueStoreConfig) (*DefaultValueStore, chan error, error) {
 	cfg := resolveValueStoreConfig(c)
 	lcmap := cfg.ValueLocMap
@@ -164,10 +238,14 @@ func NewValueStore(c *ValueStoreConfig) (*DefaultValueStore, chan error, error)
 		rand:                    cfg.Rand,
 		locBlocks:               make([]valueLocBlock, math.MaxUint16),
 		path:                    cfg.Path,
+		paths:                   cfg.Paths,
+		pathsByFreeSpace:        cfg.PathsByFreeSpace,
+		pathsNext:               uint32(cfg.Rand.Intn(len(cfg.Paths))),
 		pathtoc:                 cfg.PathTOC,
 		locmap:                  lcmap,
 		workers:                 cfg.Workers,
 		recoveryBatchSize:       cfg.RecoveryBatchSize,
+		recoveryReaders:         cfg.RecoveryReaders,
 		replicationIgnoreRecent: (uint64(cfg.ReplicationIgnoreRecent) * uint64(time.Second) / 1000) << _TSB_UTIL_BITS,
 		valueCap:                uint32(cfg.ValueCap),
 		pageSize:                uint32(cfg.PageSize),
@@ -175,9 +253,15 @@ func NewValueStore(c *ValueStoreConfig) (*DefaultValueStore, chan error, error)
 		writePagesPerWorker:     cfg.WritePagesPerWorker,
 		fileCap:                 uint32(cfg.FileCap),
 		fileReaders:             cfg.FileReaders,
+		mmapReads:               cfg.MmapReads,
 		checksumInterval:        uint32(cfg.ChecksumInterval),
+		compressionLevel:        cfg.CompressionLevel,
+		keyProvider:             cfg.KeyProvider,
+		fs:                      cfg.FS,
+		durability:              cfg.Durability,
 		msgRing:                 cfg.MsgRing,
 		restartChan:             make(chan error),
+		shutdownDoneChan:        make(chan struct{}),
 	}
 	store.freeableMemBlockChans = make([]chan *valueMemBlock, store.workers)
 	for i := 0; i < cap(store.freeableMemBlockChans); i++ {
@@ -190,6 +274,7 @@ func NewValueStore(c *ValueStoreConfig) (*DefaultValueStore, chan error, error)
 	store.freeTOCBlockChan = make(chan []byte, store.workers*2)
 	store.pendingTOCBlockChan = make(chan []byte, store.workers)
 	store.flushedChan = make(chan struct{}, 1)
+	store.syncedChan = make(chan struct{}, 1)
 	for i := 0; i < cap(store.freeMemBlockChan); i++ {
 		memBlock := &valueMemBlock{
 			store:  store,
@@ -232,6 +317,7 @@ func NewValueStore(c *ValueStoreConfig) (*DefaultValueStore, chan error, error)
 	store.bulkSetAckConfig(cfg)
 	store.flusherConfig(cfg)
 	store.diskWatcherConfig(cfg)
+	store.checkpointConfig(cfg)
 	err := store.recovery()
 	if err != nil {
 		return nil, nil, err
@@ -262,6 +348,7 @@ func (store *DefaultValueStore) DisableAllBackground() {
 		store.DisableInBulkSet,
 		store.DisableInBulkSetAck,
 		store.DisableTombstoneDiscard,
+		store.DisableCheckpointer,
 	} {
 		wg.Add(1)
 		go func(ii int, ff func()) {
@@ -273,6 +360,9 @@ func (store *DefaultValueStore) DisableAllBackground() {
 }
 
 func (store *DefaultValueStore) EnableAll() {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return
+	}
 	wg := &sync.WaitGroup{}
 	for _, f := range []func(){
 		store.EnableWrites,
@@ -286,6 +376,7 @@ func (store *DefaultValueStore) EnableAll() {
 		store.EnableAudit,
 		store.EnableFlusher,
 		store.EnableDiskWatcher,
+		store.EnableCheckpointer,
 	} {
 		wg.Add(1)
 		go func(ff func()) {
@@ -304,6 +395,10 @@ func (store *DefaultValueStore) DisableWrites() {
 
 func (store *DefaultValueStore) disableWrites(userCall bool) {
 	store.disableEnableWritesLock.Lock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		store.disableEnableWritesLock.Unlock()
+		return
+	}
 	if userCall {
 		store.userDisabled = true
 	}
@@ -320,6 +415,10 @@ func (store *DefaultValueStore) EnableWrites() {
 
 func (store *DefaultValueStore) enableWrites(userCall bool) {
 	store.disableEnableWritesLock.Lock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		store.disableEnableWritesLock.Unlock()
+		return
+	}
 	if userCall || !store.userDisabled {
 		store.userDisabled = false
 		for _, c := range store.pendingWriteReqChans {
@@ -330,23 +429,114 @@ func (store *DefaultValueStore) enableWrites(userCall bool) {
 }
 
 // Flush will ensure buffered data (at the time of the call) is written to
-// disk.
+// disk. With DurabilityNone that means handed to the operating system; with
+// DurabilityFlush or DurabilitySync the files are also fsynced before Flush
+// returns.
 func (store *DefaultValueStore) Flush() {
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return
+	}
+	store.flush()
+}
+
+func (store *DefaultValueStore) flush() {
+	// Flushes and syncs are done one at a time; the stages of the write
+	// pipeline count their requests and interleaved ones could be
+	// miscounted.
+	store.flushLock.Lock()
+	defer store.flushLock.Unlock()
 	for _, c := range store.pendingWriteReqChans {
 		c <- flushValueWriteReq
 	}
 	<-store.flushedChan
 }
 
+// Close will disable all background tasks, flush any buffered data to disk,
+// and then stop all the internal goroutines and close all open files. Once
+// closed, the store should be discarded; calls that would need the store to be
+// open will return ErrClosed or do nothing.
+//
+// Close should not be called while other calls to the store are in progress.
+func (store *DefaultValueStore) Close() error {
+	store.closeLock.Lock()
+	defer store.closeLock.Unlock()
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return ErrClosed
+	}
+	store.DisableAll()
+	// Subscriptions are canceled before flushing so a blocking subscriber
+	// that has stopped receiving can't stall the flush.
+	store.unsubscribeAll()
+	store.Flush()
+	if store.msgRing != nil {
+		store.msgRing.SetMsgHandler(_VALUE_BULK_SET_MSG_TYPE, nil)
+		store.msgRing.SetMsgHandler(_VALUE_BULK_SET_ACK_MSG_TYPE, nil)
+		store.msgRing.SetMsgHandler(_VALUE_PULL_REPLICATION_MSG_TYPE, nil)
+	}
+	store.disableEnableWritesLock.Lock()
+	atomic.StoreUint32(&store.closed, 1)
+	store.disableEnableWritesLock.Unlock()
+	// Each Enable* checks closed under its own lock, so disabling again stops
+	// anything enabled since DisableAll and nothing can be enabled after.
+	store.DisableAllBackground()
+	// Since everything has been flushed, each stage of the write pipeline is
+	// idle and can be shut down in order.
+	for _, c := range store.pendingWriteReqChans {
+		c <- shutdownValueWriteReq
+	}
+	for range store.pendingWriteReqChans {
+		<-store.shutdownDoneChan
+	}
+	store.fileMemBlockChan <- shutdownValueMemBlock
+	<-store.shutdownDoneChan
+	for _, c := range store.freeableMemBlockChans {
+		c <- shutdownValueMemBlock
+	}
+	for range store.freeableMemBlockChans {
+		<-store.shutdownDoneChan
+	}
+	close(store.pendingTOCBlockChan)
+	<-store.shutdownDoneChan
+	var reterr error
+	for _, block := range store.locBlocks {
+		if block == nil {
+			continue
+		}
+		if err := block.close(); err != nil && reterr == nil {
+			reterr = err
+		}
+	}
+	return reterr
+}
+
 // Lookup will return timestampmicro, length, err for keyA, keyB.
 //
 // Note that err == ErrNotFound with timestampmicro == 0 indicates keyA, keyB
 // was not known at all whereas err == ErrNotFound with timestampmicro != 0
 // indicates keyA, keyB
-// was known and had a deletion marker (aka tombstone).
+// was known and had a deletion marker (aka tombstone). Values written with
+// WriteStream give ErrStream along with their timestampmicro.
 func (store *DefaultValueStore) Lookup(keyA uint64, keyB uint64) (int64, uint32, error) {
+	return store.LookupContext(context.Background(), keyA, keyB)
+}
+
+// LookupContext is the same as Lookup but will return ctx.Err() instead if
+// ctx is done before the lookup begins.
+func (store *DefaultValueStore) LookupContext(ctx context.Context, keyA uint64, keyB uint64) (int64, uint32, error) {
 	atomic.AddInt32(&store.lookups, 1)
-	timestampbits, _, length, err := store.lookup(keyA, keyB)
+	if err := ctx.Err(); err != nil {
+		atomic.AddInt32(&store.lookupTimeouts, 1)
+		return 0, 0, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.lookupErrors, 1)
+		return 0, 0, ErrClosed
+	}
+	timestampbits, length, err := store.lookupUnexpired(keyA, keyB)
+	if err == nil && timestampbits&_TSB_MANIFEST != 0 {
+		length = 0
+		err = ErrStream
+	}
 	if err != nil {
 		atomic.AddInt32(&store.lookupErrors, 1)
 	}
@@ -368,15 +558,93 @@ func (store *DefaultValueStore) lookup(keyA uint64, keyB uint64) (uint64, uint32
 // Note that err == ErrNotFound with timestampmicro == 0 indicates keyA, keyB
 // was not known at all whereas err == ErrNotFound with timestampmicro != 0
 // indicates keyA, keyB was known and had a deletion marker (aka tombstone).
+// Values written with WriteStream give ErrStream along with their
+// timestampmicro; use ReadStream or ReadTo for those.
 func (store *DefaultValueStore) Read(keyA uint64, keyB uint64, value []byte) (int64, []byte, error) {
+	return store.ReadContext(context.Background(), keyA, keyB, value)
+}
+
+// ReadContext is the same as Read but will return ctx.Err() instead if ctx
+// is done before the read begins.
+func (store *DefaultValueStore) ReadContext(ctx context.Context, keyA uint64, keyB uint64, value []byte) (int64, []byte, error) {
 	atomic.AddInt32(&store.reads, 1)
-	timestampbits, value, err := store.read(keyA, keyB, value)
+	if err := ctx.Err(); err != nil {
+		atomic.AddInt32(&store.readTimeouts, 1)
+		return 0, value, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.readErrors, 1)
+		return 0, value, ErrClosed
+	}
+	start := len(value)
+	timestampbits, value, err := store.readUnexpired(keyA, keyB, value)
+	if err == nil && timestampbits&_TSB_MANIFEST != 0 {
+		value = value[:start]
+		err = ErrStream
+	}
 	if err != nil {
 		atomic.AddInt32(&store.readErrors, 1)
 	}
 	return int64(timestampbits >> _TSB_UTIL_BITS), value, err
 }
 
+// ReadTo is the same as Read except that the value is written to w rather than
+// returned. For values already flushed to disk, the value is copied from the
+// file in pieces so the whole value is never held in memory at once; values
+// still in memory are written from a copy. Values written with WriteStream are
+// also written to w in full.
+//
+// Any error from w is returned as is, in which case part of the value may have
+// already been written.
+func (store *DefaultValueStore) ReadTo(keyA uint64, keyB uint64, w io.Writer) (int64, error) {
+	atomic.AddInt32(&store.reads, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.readErrors, 1)
+		return 0, ErrClosed
+	}
+	timestampbits, err := store.readTo(keyA, keyB, w)
+	if err != nil {
+		atomic.AddInt32(&store.readErrors, 1)
+	}
+	return int64(timestampbits >> _TSB_UTIL_BITS), err
+}
+
+func (store *DefaultValueStore) readTo(keyA uint64, keyB uint64, w io.Writer) (uint64, error) {
+	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB)
+	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
+		return timestampbits, ErrNotFound
+	}
+	if timestampbits&_TSB_MANIFEST != 0 {
+		rc, err := store.ReadStream(keyA, keyB)
+		if err != nil {
+			return timestampbits, err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		return timestampbits, err
+	}
+	fl, ok := store.locBlock(id).(*valueStoreFile)
+	if !ok {
+		timestampbits, value, err := store.readUnexpired(keyA, keyB, nil)
+		if err != nil {
+			return timestampbits, err
+		}
+		_, err = w.Write(value)
+		return timestampbits, err
+	}
+	if timestampbits&_TSB_EXPIRES != 0 {
+		expired, err := store.expired(keyA, keyB, timestampbits, id, offset)
+		if err != nil {
+			return timestampbits, err
+		}
+		if expired {
+			return timestampbits, ErrNotFound
+		}
+		return timestampbits, fl.readTo(keyA, offset, length, _EXPIRES_LENGTH, w)
+	}
+	return timestampbits, fl.readTo(keyA, offset, length, 0, w)
+}
+
 func (store *DefaultValueStore) read(keyA uint64, keyB uint64, value []byte) (uint64, []byte, error) {
 	timestampbits, id, offset, length := store.locmap.Get(keyA, keyB)
 	if id == 0 || timestampbits&_TSB_DELETION != 0 || timestampbits&_TSB_LOCAL_REMOVAL != 0 {
@@ -389,8 +657,16 @@ func (store *DefaultValueStore) read(keyA uint64, keyB uint64, value []byte) (ui
 // and returns the previously stored timestampmicro or returns any error; a
 // newer timestampmicro already in place is not reported as an error. Note that
 // with a write and a delete for the exact same timestampmicro, the delete
-// wins.
+// wins. With DurabilitySync, Write waits until the value is on stable storage.
 func (store *DefaultValueStore) Write(keyA uint64, keyB uint64, timestampmicro int64, value []byte) (int64, error) {
+	return store.WriteContext(context.Background(), keyA, keyB, timestampmicro, value)
+}
+
+// WriteContext is the same as Write but will give up and return ctx.Err()
+// if ctx is done before the write has been accepted and acknowledged by the
+// internal writers. Note that a write given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultValueStore) WriteContext(ctx context.Context, keyA uint64, keyB uint64, timestampmicro int64, value []byte) (int64, error) {
 	atomic.AddInt32(&store.writes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.writeErrors, 1)
@@ -400,9 +676,17 @@ func (store *DefaultValueStore) Write(keyA uint64, keyB uint64, timestampmicro i
 		atomic.AddInt32(&store.writeErrors, 1)
 		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
 	}
-	timestampbits, err := store.write(keyA, keyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false)
+
+	timestampbits, err := store.writeContext(ctx, keyA, keyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, value, false, false, false, 0)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
 	if err != nil {
-		atomic.AddInt32(&store.writeErrors, 1)
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.writeTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.writeErrors, 1)
+		}
 	} else if timestampmicro <= int64(timestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.writesOverridden, 1)
 	}
@@ -410,32 +694,156 @@ func (store *DefaultValueStore) Write(keyA uint64, keyB uint64, timestampmicro i
 }
 
 func (store *DefaultValueStore) write(keyA uint64, keyB uint64, timestampbits uint64, value []byte, internal bool) (uint64, error) {
+	return store.writeContext(context.Background(), keyA, keyB, timestampbits, value, internal, false, false, 0)
+}
+
+// writeReplicated is the same as write but for data that arrived from another
+// store through replication; this is only used to inform subscribers of where
+// changes came from.
+func (store *DefaultValueStore) writeReplicated(keyA uint64, keyB uint64, timestampbits uint64, value []byte, internal bool) (uint64, error) {
+	return store.writeContext(context.Background(), keyA, keyB, timestampbits, value, internal, true, false, 0)
+}
+
+func (store *DefaultValueStore) writeContext(ctx context.Context, keyA uint64, keyB uint64, timestampbits uint64, value []byte, internal bool, replicated bool, conditional bool, expectedbits uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if atomic.LoadUint32(&store.closed) != 0 {
+		return 0, ErrClosed
+	}
+	otimestampbits, omanifest := store.supersededStreamManifest(keyA, keyB, timestampbits)
 	i := int(keyA>>1) % len(store.freeWriteReqChans)
-	writeReq := <-store.freeWriteReqChans[i]
+	var writeReq *valueWriteReq
+	select {
+	case writeReq = <-store.freeWriteReqChans[i]:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if ctx.Done() != nil && len(value) > 0 {
+		// If we give up on this request after handing it off, the memWriter
+		// may still be using the value after we've returned to the caller, so
+		// it needs its own copy.
+		value = append([]byte(nil), value...)
+	}
 	writeReq.keyA = keyA
 	writeReq.keyB = keyB
 
 	writeReq.timestampbits = timestampbits
 	writeReq.value = value
 	writeReq.internal = internal
-	store.pendingWriteReqChans[i] <- writeReq
-	err := <-writeReq.errChan
+	writeReq.replicated = replicated
+	writeReq.conditional = conditional
+	writeReq.expectedbits = expectedbits
+	writeReq.otimestampbits = otimestampbits
+	writeReq.omanifest = omanifest
+	select {
+	case store.pendingWriteReqChans[i] <- writeReq:
+	case <-ctx.Done():
+		writeReq.value = nil
+		writeReq.omanifest = nil
+		store.freeWriteReqChans[i] <- writeReq
+		return 0, ctx.Err()
+	}
+	select {
+	case err := <-writeReq.errChan:
+		return store.finishWriteReq(i, writeReq, timestampbits, err)
+	case <-ctx.Done():
+		// The memWriter still owns the writeReq and will respond on its
+		// errChan eventually; only then can it go back to the free list.
+		go func() {
+			store.finishWriteReq(i, writeReq, timestampbits, <-writeReq.errChan)
+		}()
+		return 0, ctx.Err()
+	}
+}
+
+// finishWriteReq returns writeReq, answered by the memWriter with err, to the
+// free list for shard i and then follows up on timestampbits having been
+// stored, such as removing the chunk entries of a stream manifest it
+// replaced. Every path that hands off a
+// writeReq must finish it this way.
+func (store *DefaultValueStore) finishWriteReq(i int, writeReq *valueWriteReq, timestampbits uint64, err error) (uint64, error) {
 	ptimestampbits := writeReq.timestampbits
+	keyA := writeReq.keyA
+	keyB := writeReq.keyB
+
+	otimestampbits := writeReq.otimestampbits
+	omanifest := writeReq.omanifest
 	writeReq.value = nil
+	writeReq.conditional = false
+	writeReq.replicated = false
+	writeReq.otimestampbits = 0
+	writeReq.omanifest = nil
 	store.freeWriteReqChans[i] <- writeReq
 	// This is for the flusher
 	if err == nil && ptimestampbits < timestampbits {
 		atomic.AddInt32(&store.modifications, 1)
 	}
+	if err == nil && otimestampbits != 0 && ptimestampbits == otimestampbits {
+		store.deleteStreamManifestChunks(keyA, keyB, otimestampbits, omanifest, int64(timestampbits>>_TSB_UTIL_BITS))
+	}
+
 	return ptimestampbits, err
 }
 
+// WriteIf is the same as Write except the write will only be stored if the
+// current timestampmicro for keyA, keyB is
+// expectedTimestampMicro, with 0 meaning no entry currently exists; otherwise
+// ErrConflict and the current timestampmicro will be returned. Note that a
+// deletion marker (aka tombstone) has a timestampmicro, as Lookup reports.
+func (store *DefaultValueStore) WriteIf(keyA uint64, keyB uint64, expectedTimestampMicro int64, newTimestampMicro int64, value []byte) (int64, error) {
+	return store.WriteIfContext(context.Background(), keyA, keyB, expectedTimestampMicro, newTimestampMicro, value)
+}
+
+// WriteIfContext is the same as WriteIf but will give up and return ctx.Err()
+// if ctx is done before the write has been accepted and acknowledged by the
+// internal writers. Note that a write given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultValueStore) WriteIfContext(ctx context.Context, keyA uint64, keyB uint64, expectedTimestampMicro int64, newTimestampMicro int64, value []byte) (int64, error) {
+	atomic.AddInt32(&store.writeIfs, 1)
+	if newTimestampMicro < TIMESTAMPMICRO_MIN {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d < %d", newTimestampMicro, TIMESTAMPMICRO_MIN)
+	}
+	if newTimestampMicro > TIMESTAMPMICRO_MAX {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d > %d", newTimestampMicro, TIMESTAMPMICRO_MAX)
+	}
+	if newTimestampMicro <= expectedTimestampMicro {
+		atomic.AddInt32(&store.writeIfErrors, 1)
+		return 0, fmt.Errorf("timestamp %d <= expected %d", newTimestampMicro, expectedTimestampMicro)
+	}
+
+	ptimestampbits, err := store.writeContext(ctx, keyA, keyB, uint64(newTimestampMicro)<<_TSB_UTIL_BITS, value, false, false, true, uint64(expectedTimestampMicro)<<_TSB_UTIL_BITS)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
+	if err == ErrConflict {
+		atomic.AddInt32(&store.writeIfConflicts, 1)
+	} else if err != nil {
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.writeIfTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.writeIfErrors, 1)
+		}
+	}
+	return int64(ptimestampbits >> _TSB_UTIL_BITS), err
+}
+
 // Delete stores timestampmicro for keyA, keyB
 // and returns the previously stored timestampmicro or returns any error; a
 // newer timestampmicro already in place is not reported as an error. Note that
 // with a write and a delete for the exact same timestampmicro, the delete
 // wins.
 func (store *DefaultValueStore) Delete(keyA uint64, keyB uint64, timestampmicro int64) (int64, error) {
+	return store.DeleteContext(context.Background(), keyA, keyB, timestampmicro)
+}
+
+// DeleteContext is the same as Delete but will give up and return ctx.Err()
+// if ctx is done before the delete has been accepted and acknowledged by the
+// internal writers. Note that a delete given up on after it was handed off may
+// still end up being stored.
+func (store *DefaultValueStore) DeleteContext(ctx context.Context, keyA uint64, keyB uint64, timestampmicro int64) (int64, error) {
 	atomic.AddInt32(&store.deletes, 1)
 	if timestampmicro < TIMESTAMPMICRO_MIN {
 		atomic.AddInt32(&store.deleteErrors, 1)
@@ -445,9 +853,17 @@ func (store *DefaultValueStore) Delete(keyA uint64, keyB uint64, timestampmicro
 		atomic.AddInt32(&store.deleteErrors, 1)
 		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
 	}
-	ptimestampbits, err := store.write(keyA, keyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
+
+	ptimestampbits, err := store.writeContext(ctx, keyA, keyB, (uint64(timestampmicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true, false, false, 0)
+	if err == nil {
+		err = store.syncWrites(ctx)
+	}
 	if err != nil {
-		atomic.AddInt32(&store.deleteErrors, 1)
+		if err == ctx.Err() {
+			atomic.AddInt32(&store.deleteTimeouts, 1)
+		} else {
+			atomic.AddInt32(&store.deleteErrors, 1)
+		}
 	} else if timestampmicro <= int64(ptimestampbits>>_TSB_UTIL_BITS) {
 		atomic.AddInt32(&store.deletesOverridden, 1)
 	}
@@ -496,6 +912,10 @@ func (store *DefaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBl
 	var tbOffset int
 	for {
 		memBlock := <-freeableMemBlockChan
+		if memBlock == shutdownValueMemBlock {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if memBlock == flushValueMemBlock {
 			if tb != nil {
 				store.pendingTOCBlockChan <- tb
@@ -504,6 +924,14 @@ func (store *DefaultValueStore) memClearer(freeableMemBlockChan chan *valueMemBl
 			store.pendingTOCBlockChan <- nil
 			continue
 		}
+		if memBlock == syncValueMemBlock {
+			if tb != nil {
+				store.pendingTOCBlockChan <- tb
+				tb = nil
+			}
+			store.pendingTOCBlockChan <- syncValueTOCBlock
+			continue
+		}
 		fl := store.locBlock(memBlock.fileID)
 		if tb != nil && tbTS != fl.timestampnano() {
 			store.pendingTOCBlockChan <- tb
@@ -566,6 +994,10 @@ func (store *DefaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 	var memBlockMemOffset int
 	for {
 		writeReq := <-pendingWriteReqChan
+		if writeReq == shutdownValueWriteReq {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if writeReq == enableValueWriteReq {
 			enabled = true
 			continue
@@ -582,10 +1014,28 @@ func (store *DefaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 			store.fileMemBlockChan <- flushValueMemBlock
 			continue
 		}
+		if writeReq == syncValueWriteReq {
+			if memBlock != nil && len(memBlock.toc) > 0 {
+				store.fileMemBlockChan <- memBlock
+				memBlock = nil
+			}
+			store.fileMemBlockChan <- syncValueMemBlock
+			continue
+		}
 		if !enabled && !writeReq.internal {
 			writeReq.errChan <- ErrDisabled
 			continue
 		}
+		if writeReq.conditional {
+			// Since this memWriter is the only one that handles this key, no
+			// other write can slip in between this check and the Set below.
+			ctimestampbits, _, _, _ := store.locmap.Get(writeReq.keyA, writeReq.keyB)
+			if ctimestampbits>>_TSB_UTIL_BITS != writeReq.expectedbits>>_TSB_UTIL_BITS {
+				writeReq.timestampbits = ctimestampbits
+				writeReq.errChan <- ErrConflict
+				continue
+			}
+		}
 		length := len(writeReq.value)
 		if length > int(store.valueCap) {
 			writeReq.errChan <- fmt.Errorf("value length of %d > %d", length, store.valueCap)
@@ -625,6 +1075,9 @@ func (store *DefaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 
 			memBlockTOCOffset += _VALUE_FILE_ENTRY_SIZE
 			memBlockMemOffset += alloc
+			if atomic.LoadInt32(&store.subscriptionCount) > 0 && writeReq.timestampbits&(_TSB_COMPACTION_REWRITE|_TSB_LOCAL_REMOVAL) == 0 {
+				store.notifySubscribers(writeReq, ptimestampbits)
+			}
 		} else {
 			memBlock.discardLock.Lock()
 			memBlock.values = memBlock.values[:memBlockMemOffset]
@@ -638,10 +1091,31 @@ func (store *DefaultValueStore) memWriter(pendingWriteReqChan chan *valueWriteRe
 func (store *DefaultValueStore) fileWriter() {
 	var fl *valueStoreFile
 	memWritersFlushLeft := len(store.pendingWriteReqChans)
+	memWritersSyncLeft := len(store.pendingWriteReqChans)
+	// unsynced is whether fl has been written to since it was last synced.
+	var unsynced bool
 	var tocLen uint64
-	var valueLen uint64
+	// valueLenFor is the most a memBlock can add to the value file.
+	valueLenFor := func(memBlock *valueMemBlock) uint64 {
+		valueLen := uint64(len(memBlock.values))
+		if store.compressionLevel > 0 {
+			// Each value gets a frame header and, at worst, is stored
+			// uncompressed.
+			valueLen += uint64(len(memBlock.toc) / _VALUE_FILE_ENTRY_SIZE * _VALUE_FRAME_SIZE)
+		}
+		if store.compressionLevel > 0 || store.durability == DurabilitySync {
+			// Then the checksum interval may be padded out, after the
+			// memBlock or by a sync.
+			valueLen += uint64(store.checksumInterval)
+		}
+		return valueLen
+	}
 	for {
 		memBlock := <-store.fileMemBlockChan
+		if memBlock == shutdownValueMemBlock {
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if memBlock == flushValueMemBlock {
 			memWritersFlushLeft--
 			if memWritersFlushLeft > 0 {
@@ -651,6 +1125,9 @@ func (store *DefaultValueStore) fileWriter() {
 				err := fl.closeWriting()
 				if err != nil {
 					store.logCritical("error closing %s: %s\n", fl.name, err)
+					store.durabilityFailed(err)
+				} else {
+					fl.mapReads()
 				}
 				fl = nil
 			}
@@ -660,27 +1137,94 @@ func (store *DefaultValueStore) fileWriter() {
 			memWritersFlushLeft = len(store.pendingWriteReqChans)
 			continue
 		}
-		if fl != nil && (tocLen+uint64(len(memBlock.toc)) >= uint64(store.fileCap) || valueLen+uint64(len(memBlock.values)) > uint64(store.fileCap)) {
+		if memBlock == syncValueMemBlock {
+			memWritersSyncLeft--
+			if memWritersSyncLeft > 0 {
+				continue
+			}
+			if fl != nil && unsynced {
+				if err := fl.sync(); err != nil {
+					store.logCritical("error syncing %s: %s\n", fl.name, err)
+					store.durabilityFailed(err)
+				}
+				unsynced = false
+			}
+			for i := 0; i < len(store.freeableMemBlockChans); i++ {
+				store.freeableMemBlockChans[i] <- syncValueMemBlock
+			}
+			memWritersSyncLeft = len(store.pendingWriteReqChans)
+			continue
+		}
+		if fl != nil && (tocLen+uint64(len(memBlock.toc)) >= uint64(store.fileCap) || uint64(atomic.LoadUint32(&fl.writerOffset))+valueLenFor(memBlock) > uint64(store.fileCap)) {
 			err := fl.closeWriting()
 			if err != nil {
 				store.logCritical("error closing %s: %s\n", fl.name, err)
+				store.durabilityFailed(err)
+			} else {
+				fl.mapReads()
 			}
 			fl = nil
 		}
 		if fl == nil {
 			var err error
-			fl, err = createValueReadWriteFile(store, osCreateWriteCloser, osOpenReadSeeker)
+			fl, err = createValueReadWriteFile(store, store.createFile, store.fs.Open)
 			if err != nil {
 				store.logCritical("fileWriter: %s\n", err)
 				break
 			}
 			tocLen = _VALUE_FILE_HEADER_SIZE
-			valueLen = _VALUE_FILE_HEADER_SIZE
 		}
-		fl.write(memBlock)
+		// The memBlock may be handed off for reuse by fl.write, so its length
+		// is taken beforehand; the value file's length is taken from fl's
+		// offset instead, as compression and padding change it.
 		tocLen += uint64(len(memBlock.toc))
-		valueLen += uint64(len(memBlock.values))
+		fl.write(memBlock)
+		unsynced = true
+	}
+}
+
+// valueFilePath returns the full path of the named value file, in
+// whichever of the store's paths holds it; the first path is assumed if none
+// do.
+func (store *DefaultValueStore) valueFilePath(name string) string {
+	return valueFilePathIn(store.paths, name, store.fs.Stat)
+}
+
+// valueFilePathIn is valueFilePath for the given paths, as also used by
+// FsckValueStore and InspectValueFiles when no store is running.
+func valueFilePathIn(paths []string, name string, stat func(name string) (os.FileInfo, error)) string {
+	if len(paths) > 1 {
+		for _, p := range paths {
+			if _, err := stat(path.Join(p, name)); err == nil {
+				return path.Join(p, name)
+			}
+		}
 	}
+	return path.Join(paths[0], name)
+}
+
+// newValueFileDirs returns the store's paths in the order a new value file
+// should try them: by most free space if pathsByFreeSpace is set, otherwise
+// taking turns. Those after the first are for when creating the file fails,
+// such as when a device is lost.
+func (store *DefaultValueStore) newValueFileDirs() []string {
+	dirs := make([]string, len(store.paths))
+	if store.pathsByFreeSpace {
+		copy(dirs, store.paths)
+		frees := make(map[string]uint64, len(dirs))
+		for _, dir := range dirs {
+			frees[dir], _ = store.fs.DiskUsage(dir)
+		}
+		sort.SliceStable(dirs, func(i int, j int) bool {
+			return frees[dirs[i]] > frees[dirs[j]]
+		})
+		return dirs
+	}
+	next := int(atomic.AddUint32(&store.pathsNext, 1) - 1)
+	for i := range dirs {
+		dirs[i] = store.paths[(next+i)%len(store.paths)]
+	}
+	return dirs
 }
 
 func (store *DefaultValueStore) tocWriter() {
@@ -688,21 +1232,62 @@ func (store *DefaultValueStore) tocWriter() {
 	// toc writerB is kept around in case a "late" key arrives to be flushed
 	// whom's value is actually in the previous value file.
 	memClearersFlushLeft := len(store.freeableMemBlockChans)
+	memClearersSyncLeft := len(store.freeableMemBlockChans)
+	// fpA and fpB are the files under writerA and writerB, for syncing, and
+	// unsyncedA and unsyncedB are whether they've been written to since.
 	var writerA io.WriteCloser
+	var fpA io.WriteCloser
 	var offsetA uint64
+	var unsyncedA bool
 	var writerB io.WriteCloser
+	var fpB io.WriteCloser
 	var offsetB uint64
+	var unsyncedB bool
 	var err error
-	head := []byte("VALUESTORETOC v0                ")
-	binary.BigEndian.PutUint32(head[28:], uint32(store.checksumInterval))
 	// Make sure any trailing data is covered by a checksum by writing an
 	// additional block of zeros (entry offsets of zero are ignored on
 	// recovery).
-	term := make([]byte, store.checksumInterval)
-	copy(term[len(term)-8:], []byte("TERM v0 "))
+	term := newValueTermBlock(store.checksumInterval, store.keyProvider != nil)
+	// A TOC file that fails to close, such as when it can't be synced, is
+	// noted but doesn't stop later TOC blocks from being written.
+	closeWriter := func(writer io.WriteCloser) {
+		if err := writer.Close(); err != nil {
+			store.logCritical("tocWriter: %s\n", err)
+			store.durabilityFailed(err)
+		}
+	}
+	// syncWriter pads the TOC file out with zeroed entries, which recovery
+	// ignores, until the checksum interval holding its last entry is
+	// complete and so written to fp; then fp is synced. This relies on the
+	// TOC writer being synchronous, as it is with DurabilitySync.
+	blockSize := uint64(store.checksumInterval)
+	if store.keyProvider != nil {
+		blockSize -= _ENCRYPTION_OVERHEAD
+	}
+	padding := make([]byte, blockSize+_VALUE_FILE_ENTRY_SIZE)
+	syncWriter := func(writer io.WriteCloser, fp io.WriteCloser, offset *uint64) {
+		if n := *offset % blockSize; n != 0 {
+			n = (blockSize - n + _VALUE_FILE_ENTRY_SIZE - 1) / _VALUE_FILE_ENTRY_SIZE * _VALUE_FILE_ENTRY_SIZE
+			if _, err := writer.Write(padding[:n]); err != nil {
+				store.logCritical("tocWriter: %s\n", err)
+				store.durabilityFailed(err)
+				return
+			}
+			*offset += n
+		}
+		if err := syncFile(fp); err != nil {
+			store.logCritical("tocWriter: %s\n", err)
+			store.durabilityFailed(err)
+		}
+	}
 OuterLoop:
 	for {
-		t := <-store.pendingTOCBlockChan
+		t, ok := <-store.pendingTOCBlockChan
+		if !ok {
+			// Closed by Close after a flush, so there are no open writers.
+			store.shutdownDoneChan <- struct{}{}
+			return
+		}
 		if t == nil {
 			memClearersFlushLeft--
 			if memClearersFlushLeft > 0 {
@@ -712,28 +1297,45 @@ OuterLoop:
 				if _, err = writerB.Write(term); err != nil {
 					break OuterLoop
 				}
-				if err = writerB.Close(); err != nil {
-					break OuterLoop
-				}
+				closeWriter(writerB)
 				writerB = nil
+				fpB = nil
 				atomic.StoreUint64(&store.activeTOCB, 0)
 				offsetB = 0
+				unsyncedB = false
 			}
 			if writerA != nil {
 				if _, err = writerA.Write(term); err != nil {
 					break OuterLoop
 				}
-				if err = writerA.Close(); err != nil {
-					break OuterLoop
-				}
+				closeWriter(writerA)
 				writerA = nil
+				fpA = nil
 				atomic.StoreUint64(&store.activeTOCA, 0)
 				offsetA = 0
+				unsyncedA = false
 			}
 			store.flushedChan <- struct{}{}
 			memClearersFlushLeft = len(store.freeableMemBlockChans)
 			continue
 		}
+		if len(t) == len(syncValueTOCBlock) {
+			memClearersSyncLeft--
+			if memClearersSyncLeft > 0 {
+				continue
+			}
+			if unsyncedB {
+				syncWriter(writerB, fpB, &offsetB)
+				unsyncedB = false
+			}
+			if unsyncedA {
+				syncWriter(writerA, fpA, &offsetA)
+				unsyncedA = false
+			}
+			store.syncedChan <- struct{}{}
+			memClearersSyncLeft = len(store.freeableMemBlockChans)
+			continue
+		}
 		if len(t) > 8 {
 			bts := binary.BigEndian.Uint64(t)
 			switch bts {
@@ -742,11 +1344,13 @@ OuterLoop:
 					break OuterLoop
 				}
 				offsetA += uint64(len(t) - 8)
+				unsyncedA = true
 			case atomic.LoadUint64(&store.activeTOCB):
 				if _, err = writerB.Write(t[8:]); err != nil {
 					break OuterLoop
 				}
 				offsetB += uint64(len(t) - 8)
+				unsyncedB = true
 			default:
 				// An assumption is made here: If the timestampnano for this
 				// toc block doesn't match the last two seen timestampnanos
@@ -756,33 +1360,33 @@ OuterLoop:
 					if _, err = writerB.Write(term); err != nil {
 						break OuterLoop
 					}
-					if err = writerB.Close(); err != nil {
-						break OuterLoop
-					}
+					closeWriter(writerB)
 				}
 				atomic.StoreUint64(&store.activeTOCB, atomic.LoadUint64(&store.activeTOCA))
 				writerB = writerA
+				fpB = fpA
 				offsetB = offsetA
+				unsyncedB = unsyncedA
 				atomic.StoreUint64(&store.activeTOCA, bts)
-				var fp *os.File
-				fp, err = os.Create(path.Join(store.pathtoc, fmt.Sprintf("%d.valuetoc", bts)))
+				fpA, err = store.createFile(path.Join(store.pathtoc, fmt.Sprintf("%d.valuetoc", bts)))
 				if err != nil {
 					break OuterLoop
 				}
-				writerA = brimutil.NewMultiCoreChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32, store.workers)
-				if _, err = writerA.Write(head); err != nil {
+				if writerA, err = newValueTOCWriter(store, fpA); err != nil {
 					break OuterLoop
 				}
 				if _, err = writerA.Write(t[8:]); err != nil {
 					break OuterLoop
 				}
 				offsetA = _VALUE_FILE_HEADER_SIZE + uint64(len(t)-8)
+				unsyncedA = true
 			}
 		}
 		store.freeTOCBlockChan <- t[:0]
 	}
 	if err != nil {
 		store.logCritical("tocWriter: %s\n", err)
+		store.durabilityFailed(err)
 	}
 	if writerA != nil {
 		writerA.Close()
@@ -838,19 +1442,14 @@ func (store *DefaultValueStore) recovery() error {
 		}
 		wg.Wait()
 	}
-	fp, err := os.Open(store.pathtoc)
-	if err != nil {
-		spindown()
-		return err
-	}
-	names, err := fp.Readdirnames(-1)
-	fp.Close()
+	names, err := store.fs.ReadDirNames(store.pathtoc)
 	if err != nil {
 		spindown()
 		return err
 	}
-	fromDiskCount := 0
 	sort.Strings(names)
+	var tocNames []string
+	var tocTimestamps []int64
 	for i := 0; i < len(names); i++ {
 		if !strings.HasSuffix(names[i], ".valuetoc") {
 			continue
@@ -864,31 +1463,113 @@ func (store *DefaultValueStore) recovery() error {
 			store.logError("bad timestamp in name: %#v\n", names[i])
 			continue
 		}
-		fpr, err := osOpenReadSeeker(path.Join(store.pathtoc, names[i]))
-		if err != nil {
-			store.logError("error opening %s: %s\n", names[i], err)
+		tocNames = append(tocNames, names[i])
+		tocTimestamps = append(tocTimestamps, namets)
+	}
+	// With a checkpoint, the TOC files it covers don't need to be replayed,
+	// though their value files are opened first so the checkpoint's entries
+	// can refer to them.
+	checkpointName, covered := store.recoveryCheckpoint(names)
+	blockIDs := make(map[int64]uint32)
+	for i, namets := range tocTimestamps {
+		if !covered[namets] {
 			continue
 		}
-		fl, err := newValueReadFile(store, namets, osOpenReadSeeker)
+		fl, err := newValueReadFile(store, namets, store.fs.Open)
 		if err != nil {
-			store.logError("error opening %s: %s\n", names[i][:len(names[i])-3], err)
-			closeIfCloser(fpr)
+			store.logError("error opening %s: %s\n", tocNames[i][:len(tocNames[i])-3], err)
 			continue
 		}
-		fdc, errs := valueReadTOCEntriesBatched(fpr, fl.id, freeBatchChans, pendingBatchChans, make(chan struct{}))
-		fromDiskCount += fdc
-		for _, err := range errs {
-			store.logError("error with %s: %s", names[i], err)
-			// TODO: The auditor should catch this eventually, but we should be
-			// proactive and notify the auditor of the issue here.
+		blockIDs[namets] = fl.id
+	}
+	if checkpointName != "" {
+		fdc, err := store.recoveryLoadCheckpoint(checkpointName, blockIDs, freeBatchChans, pendingBatchChans)
+		atomic.AddInt64(&store.recoveryKeyLocations, int64(fdc))
+		if err != nil {
+			// Replaying every TOC file on top of what was loaded still ends up
+			// with the newest entries, just as without the checkpoint.
+			store.logError("error with checkpoint %s, replaying all TOC files: %s\n", checkpointName, err)
+			covered = nil
+		} else if store.logDebug != nil {
+			store.logDebug("%d key locations loaded from %s covering %d TOC files\n", fdc, checkpointName, len(covered))
+		}
+	}
+	// Several TOC files can be read at once since the locmap keeps the entry
+	// with the newest timestamp no matter the order entries are set in.
+	tocChan := make(chan int, len(tocTimestamps))
+	for i, namets := range tocTimestamps {
+		if !covered[namets] {
+			tocChan <- i
 		}
-		closeIfCloser(fpr)
 	}
+	close(tocChan)
+	tocCount := len(tocChan)
+	progressDoneChan := make(chan struct{})
+	go store.recoveryProgress(start, tocCount, progressDoneChan)
+	readersWG := &sync.WaitGroup{}
+	for r := 0; r < store.recoveryReaders; r++ {
+		readersWG.Add(1)
+		go func() {
+			for i := range tocChan {
+				store.recoveryReadTOC(tocNames[i], tocTimestamps[i], blockIDs, freeBatchChans, pendingBatchChans)
+				atomic.AddInt64(&store.recoveryTOCFiles, 1)
+			}
+			readersWG.Done()
+		}()
+	}
+	readersWG.Wait()
 	spindown()
+	close(progressDoneChan)
+	dur := time.Now().Sub(start)
+	atomic.StoreInt64(&store.recoveryDuration, int64(dur))
 	if store.logDebug != nil {
-		dur := time.Now().Sub(start)
+		fromDiskCount := atomic.LoadInt64(&store.recoveryKeyLocations)
 		stats := store.Stats(false).(*ValueStoreStats)
 		store.logInfo("%d key locations loaded in %s, %.0f/s; %d caused change; %d resulting locations referencing %d bytes.\n", fromDiskCount, dur, float64(fromDiskCount)/(float64(dur)/float64(time.Second)), causedChangeCount, stats.Values, stats.ValueBytes)
 	}
 	return nil
 }
+
+// recoveryReadTOC sets the entries of a TOC file in the locmap using the
+// batches of recovery, opening its value file unless blockIDs already has
+// it.
+func (store *DefaultValueStore) recoveryReadTOC(name string, namets int64, blockIDs map[int64]uint32, freeBatchChans []chan []valueTOCEntry, pendingBatchChans []chan []valueTOCEntry) {
+	fpr, err := store.fs.Open(path.Join(store.pathtoc, name))
+	if err != nil {
+		store.logError("error opening %s: %s\n", name, err)
+		return
+	}
+	defer closeIfCloser(fpr)
+	blockID, ok := blockIDs[namets]
+	if !ok {
+		fl, err := newValueReadFile(store, namets, store.fs.Open)
+		if err != nil {
+			store.logError("error opening %s: %s\n", name[:len(name)-3], err)
+			return
+		}
+		blockID = fl.id
+	}
+	fdc, errs := valueReadTOCEntriesBatched(fpr, store.keyProvider, blockID, freeBatchChans, pendingBatchChans, make(chan struct{}))
+	atomic.AddInt64(&store.recoveryKeyLocations, int64(fdc))
+	for _, err := range errs {
+		store.logError("error with %s: %s", name, err)
+		// TODO: The auditor should catch this eventually, but we should be
+		// proactive and notify the auditor of the issue here.
+	}
+}
+
+// recoveryProgress logs how recovery is going every so often until doneChan
+// is closed.
+func (store *DefaultValueStore) recoveryProgress(start time.Time, tocCount int, doneChan chan struct{}) {
+	ticker := time.NewTicker(_VALUE_RECOVERY_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			keyLocations := atomic.LoadInt64(&store.recoveryKeyLocations)
+			store.logInfo("recovery: %d of %d TOC files done, %d key locations loaded, %.0f/s\n", atomic.LoadInt64(&store.recoveryTOCFiles), tocCount, keyLocations, float64(keyLocations)/time.Now().Sub(start).Seconds())
+		}
+	}
+}
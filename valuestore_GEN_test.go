@@ -1,6 +1,20 @@
 package store
 
-import "github.com/gholt/locmap"
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gholt/locmap"
+)
 
 func lowMemValueStoreConfig() *ValueStoreConfig {
 	locmap := locmap.NewValueLocMap(&locmap.ValueLocMapConfig{
@@ -22,3 +36,774 @@ func lowMemValueStoreConfig() *ValueStoreConfig {
 		OutPullReplicationBloomN:  1000,
 	}
 }
+
+// newValueTestStore returns a store at dir with writes enabled, using
+// lowMemValueStoreConfig as changed by configure, if not nil. The store is
+// closed when the test finishes, if the test didn't close it already.
+func newValueTestStore(t *testing.T, dir string, configure func(cfg *ValueStoreConfig)) *DefaultValueStore {
+	cfg := lowMemValueStoreConfig()
+	cfg.Path = dir
+	cfg.MsgRing = &msgRingPlaceholder{}
+	if configure != nil {
+		configure(cfg)
+	}
+	store, _, err := NewValueStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	store.EnableWrites()
+	return store
+}
+
+// stallValueMemWriters holds on to every free memBlock so the memWriters
+// stop at the next write they're given, until the returned func is called.
+func stallValueMemWriters(store *DefaultValueStore) func() {
+	// After a flush the memWriters have no memBlock of their own and every
+	// memBlock comes back to the free list.
+	store.Flush()
+	memBlocks := make([]*valueMemBlock, cap(store.freeMemBlockChan))
+	for i := range memBlocks {
+		memBlocks[i] = <-store.freeMemBlockChan
+	}
+	return func() {
+		for _, memBlock := range memBlocks {
+			store.freeMemBlockChan <- memBlock
+		}
+	}
+}
+
+func TestValueStoreContextCanceled(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	store.DisableWrites()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 1000, []byte("testing")); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteIfContext(ctx, 1, 2, 0, 1000, []byte("testing")); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteContext(ctx, 1, 2, 1000); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, _, err := store.LookupContext(ctx, 1, 2); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if _, _, err := store.ReadContext(ctx, 1, 2, nil); err != context.Canceled {
+		t.Fatal(err)
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.WriteTimeouts != 1 || stats.WriteErrors != 0 {
+		t.Fatal(stats.WriteTimeouts, stats.WriteErrors)
+	}
+	if stats.WriteIfTimeouts != 1 || stats.WriteIfErrors != 0 {
+		t.Fatal(stats.WriteIfTimeouts, stats.WriteIfErrors)
+	}
+	if stats.DeleteTimeouts != 1 || stats.DeleteErrors != 0 {
+		t.Fatal(stats.DeleteTimeouts, stats.DeleteErrors)
+	}
+	if stats.LookupTimeouts != 1 || stats.LookupErrors != 0 {
+		t.Fatal(stats.LookupTimeouts, stats.LookupErrors)
+	}
+	if stats.ReadTimeouts != 1 || stats.ReadErrors != 0 {
+		t.Fatal(stats.ReadTimeouts, stats.ReadErrors)
+	}
+	store.EnableWrites()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := store.ReadContext(ctx, 1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "testing" {
+		t.Fatal(string(value))
+	}
+}
+
+func TestValueStoreContextDeadline(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	release := stallValueMemWriters(store)
+	i := int(uint64(1)>>1) % len(store.freeWriteReqChans)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.WriteContext(ctx, 1, 2, 1000, []byte("testing")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if len(store.freeWriteReqChans[i]) == cap(store.freeWriteReqChans[i]) {
+		t.Fatal("write request was not handed off")
+	}
+	release()
+	// Once the memWriter answers, the abandoned write request has to make it
+	// back to the free list.
+	for j := 0; len(store.freeWriteReqChans[i]) != cap(store.freeWriteReqChans[i]); j++ {
+		if j == 1000 {
+			t.Fatal(len(store.freeWriteReqChans[i]), cap(store.freeWriteReqChans[i]))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := store.Stats(false).(*ValueStoreStats); stats.WriteTimeouts != 1 || stats.WriteErrors != 0 {
+		t.Fatal(stats.WriteTimeouts, stats.WriteErrors)
+	}
+	if _, err := store.Write(1, 2, 2000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStoreWriteIf(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	if _, err := store.WriteIf(1, 2, 0, 1000, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	timestampMicro, err := store.WriteIf(1, 2, 0, 2000, []byte("two"))
+	if err != ErrConflict {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 {
+		t.Fatal(timestampMicro)
+	}
+	if _, err := store.WriteIf(1, 2, 1000, 1000, []byte("two")); err == nil {
+		t.Fatal(err)
+	}
+	timestampMicro, err = store.WriteIf(1, 2, 1000, 2000, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 {
+		t.Fatal(timestampMicro)
+	}
+	timestampMicro, value, err := store.Read(1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 2000 || string(value) != "two" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.WriteIfs != 4 || stats.WriteIfConflicts != 1 || stats.WriteIfErrors != 1 {
+		t.Fatal(stats.WriteIfs, stats.WriteIfConflicts, stats.WriteIfErrors)
+	}
+}
+
+func TestValueStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	store := newValueTestStore(t, dir, nil)
+	if _, err := store.Write(1, 2, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(1, 2, 2000, []byte("testing")); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Read(1, 2, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Lookup(1, 2); err != ErrClosed {
+		t.Fatal(err)
+	}
+	// These should all just do nothing rather than block or panic.
+	store.Flush()
+	store.EnableWrites()
+	store.DisableWrites()
+	// Nor should background work start up again.
+	store.EnableAll()
+	store.EnableCompaction()
+	if store.compactionState.notifyChan != nil || store.auditState.notifyChan != nil || store.flusherState.notifyChan != nil {
+		t.Fatal("background work enabled after Close")
+	}
+	// A new store on the same path should find what was written.
+	store = newValueTestStore(t, dir, nil)
+	timestampMicro, value, err := store.Read(1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != 1000 || string(value) != "testing" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStoreReadTo(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	if _, err := store.Write(1, 2, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteWithTTL(5, 6, 1000, []byte("expires"), time.Duration(math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	for _, flushed := range []bool{false, true} {
+		if flushed {
+			store.Flush()
+		}
+		buf := &bytes.Buffer{}
+		timestampMicro, err := store.ReadTo(1, 2, buf)
+		if err != nil {
+			t.Fatal(flushed, err)
+		}
+		if timestampMicro != 1000 || buf.String() != "testing" {
+			t.Fatal(flushed, timestampMicro, buf.String())
+		}
+		buf.Reset()
+		if _, err := store.ReadTo(5, 6, buf); err != nil {
+			t.Fatal(flushed, err)
+		}
+		if buf.String() != "expires" {
+			t.Fatal(flushed, buf.String())
+		}
+	}
+	if _, err := store.ReadTo(9, 9, &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStoreCompression(t *testing.T) {
+	dir := t.TempDir()
+	store := newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+		cfg.CompressionLevel = 6
+	})
+	v1 := bytes.Repeat([]byte("compressible"), 50)
+	if _, err := store.Write(1, 2, 1000, v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(5, 6, 1000, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteWithTTL(9, 10, 1000, v1, time.Duration(math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	check := func(store *DefaultValueStore) {
+		if _, v, err := store.Read(1, 2, nil); err != nil || !bytes.Equal(v, v1) {
+			t.Fatal(string(v), err)
+		}
+		if _, v, err := store.Read(5, 6, nil); err != nil || string(v) != "x" {
+			t.Fatal(string(v), err)
+		}
+		if _, v, err := store.Read(9, 10, nil); err != nil || !bytes.Equal(v, v1) {
+			t.Fatal(string(v), err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := store.ReadTo(1, 2, buf); err != nil || !bytes.Equal(buf.Bytes(), v1) {
+			t.Fatal(buf.String(), err)
+		}
+		buf.Reset()
+		if _, err := store.ReadTo(9, 10, buf); err != nil || !bytes.Equal(buf.Bytes(), v1) {
+			t.Fatal(buf.String(), err)
+		}
+	}
+	check(store)
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.UncompressedBytes == 0 || stats.CompressedBytes >= stats.UncompressedBytes {
+		t.Fatal(stats.CompressedBytes, stats.UncompressedBytes)
+	}
+	// Audit has to go by the stored lengths of the compressed values; a
+	// highly compressible value last in the file shows the difference.
+	if _, err := store.Write(17, 18, 1000, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Compressed files must still load with compression turned off, alongside
+	// newly written uncompressed files.
+	store = newValueTestStore(t, dir, nil)
+	check(store)
+	store.auditState.ageThreshold = 0
+	if n := store.auditPass(true, make(chan *bgNotification)); n != nil {
+		t.Fatal("audit failed")
+	}
+	if _, err := store.Write(13, 14, 1000, v1); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if _, v, err := store.Read(13, 14, nil); err != nil || !bytes.Equal(v, v1) {
+		t.Fatal(string(v), err)
+	}
+	check(store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStoreCompressionPadding(t *testing.T) {
+	fs := NewMemFS()
+	store := newValueTestStore(t, "/store", func(cfg *ValueStoreConfig) {
+		cfg.CompressionLevel = 6
+		cfg.WritePagesPerWorker = 8
+		cfg.FS = fs
+	})
+	v := bytes.Repeat([]byte("compressible"), 50)
+	for i := uint64(1); i <= 1000; i++ {
+		if _, err := store.Write(i, i, 1000, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fs.ReadDirNames("/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, name := range names {
+		if strings.HasSuffix(name, ".value") {
+			fi, err := fs.Stat(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += fi.Size()
+		}
+	}
+	// Padding out the checksum interval behind every memBlock would make the
+	// file several times the size of the compressed values.
+	if stats.CompressedBytes == 0 || size > 2*int64(stats.CompressedBytes) {
+		t.Fatal(size, stats.CompressedBytes)
+	}
+}
+
+func TestValueStoreCompressionFileCap(t *testing.T) {
+	for _, tc := range []struct {
+		compressionLevel int
+		durability       Durability
+	}{
+		{6, DurabilityNone},
+		{6, DurabilitySync},
+		// Each sync pads out the checksum interval even when uncompressed.
+		{0, DurabilitySync},
+	} {
+		// FileCap is kept off the checksum interval so padding out to the
+		// interval could overshoot it.
+		fileCap := 16*1024 + 512
+		fs := NewMemFS()
+		store := newValueTestStore(t, "/store", func(cfg *ValueStoreConfig) {
+			cfg.CompressionLevel = tc.compressionLevel
+			cfg.Durability = tc.durability
+			cfg.FileCap = fileCap
+			cfg.FS = fs
+		})
+		// The frames of the values, and any padding out to the checksum
+		// interval, have to fit within FileCap too.
+		rnd := rand.New(rand.NewSource(1))
+		v := make([]byte, 100)
+		for i := uint64(1); i <= 1000; i++ {
+			rnd.Read(v)
+			if _, err := store.Write(i, i, 1000, v); err != nil {
+				t.Fatal(tc, err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(tc, err)
+		}
+		names, err := fs.ReadDirNames("/store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := 0
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".value") {
+				continue
+			}
+			files++
+			fi, err := fs.Stat(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp, err := fs.Open(path.Join("/store", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, checksumInterval, err := readValueHeader(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, _, err := valueReadTrailer(fp, fi.Size(), checksumInterval, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The terminating block isn't counted against FileCap.
+			if size-int64(checksumInterval) > int64(fileCap) {
+				t.Fatal(tc, name, size)
+			}
+		}
+		if files < 2 {
+			t.Fatal(tc, files)
+		}
+	}
+}
+
+type testValueKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (kp *testValueKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return kp.current, kp.keys[kp.current], nil
+}
+
+func (kp *testValueKeyProvider) Key(id uint32) ([]byte, error) {
+	if key, ok := kp.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestValueStoreEncryption(t *testing.T) {
+	dir := t.TempDir()
+	kp := &testValueKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 16)}}
+	newStore := func() *DefaultValueStore {
+		return newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+			cfg.KeyProvider = kp
+		})
+	}
+	store := newStore()
+	// Enough values to span several checksum intervals.
+	v := bytes.Repeat([]byte("plaintext"), 30)
+	for i := uint64(1); i <= 20; i++ {
+		if _, err := store.Write(i, i, 1000, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(store *DefaultValueStore, keyID uint32) {
+		for i := uint64(1); i <= 20; i++ {
+			if _, v2, err := store.Read(i, i, nil); err != nil || !bytes.Equal(v2, v) {
+				t.Fatal(i, string(v2), err)
+			}
+		}
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range names {
+			b, err := ioutil.ReadFile(dir + "/" + fi.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte("plaintext")) {
+				t.Fatal(fi.Name())
+			}
+			if id, encrypted := valueHeaderKeyID(b); !encrypted || id != keyID {
+				t.Fatal(fi.Name(), id, encrypted)
+			}
+		}
+	}
+	store.Flush()
+	check(store, 1)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newStore()
+	check(store, 1)
+	// Rotating the key should have compaction rewrite everything under it.
+	kp.current = 2
+	store.compactionState.ageThreshold = 0
+	store.CompactionPass()
+	store.Flush()
+	if stats := store.Stats(false).(*ValueStoreStats); stats.RekeyCompactions == 0 {
+		t.Fatal(stats.RekeyCompactions)
+	}
+	check(store, 2)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func() *DefaultValueStore {
+		return newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+			cfg.RecoveryReaders = 4
+		})
+	}
+	// Each session writes its own file, with later sessions overwriting some
+	// of the keys of earlier ones, so however the files are read at once the
+	// newest entries must be left.
+	for session := uint64(1); session <= 8; session++ {
+		store := newStore()
+		for i := session * 10; i < session*10+50; i++ {
+			if _, err := store.Write(i, i, int64(session*1000), []byte{byte(session)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := newStore()
+	defer store.Close()
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.RecoveryTOCFiles != 8 || stats.RecoveryKeyLocations != 8*50 || stats.RecoveryDuration <= 0 {
+		t.Fatal(stats.RecoveryTOCFiles, stats.RecoveryKeyLocations, stats.RecoveryDuration)
+	}
+	for i := uint64(10); i < 130; i++ {
+		session := i / 10
+		if session > 8 {
+			session = 8
+		}
+		ts, v, err := store.Read(i, i, nil)
+		if err != nil || ts != int64(session*1000) || !bytes.Equal(v, []byte{byte(session)}) {
+			t.Fatal(i, ts, v, err)
+		}
+	}
+}
+
+func TestValueStoreMemFS(t *testing.T) {
+	fs := NewMemFS()
+	newStore := func(path string) *DefaultValueStore {
+		return newValueTestStore(t, path, func(cfg *ValueStoreConfig) {
+			// The paths used exist only in fs.
+			cfg.FS = fs
+		})
+	}
+	store := newStore("/nonexistent/store")
+	for i := uint64(1); i <= 100; i++ {
+		if _, err := store.Write(i, i, 1000, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newStore("/nonexistent/store")
+	for i := uint64(50); i <= 150; i++ {
+		if _, err := store.Write(i, i, 2000, []byte("two")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Flush()
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Snapshot("/nonexistent/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Files != 4 || info.Copied != 0 {
+		t.Fatal(info)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/nonexistent/store", "/nonexistent/snapshot"} {
+		store = newStore(path)
+		for i := uint64(1); i <= 150; i++ {
+			ts, v, err := store.Read(i, i, nil)
+			wantTS, want := int64(1000), []byte{byte(i)}
+			if i >= 50 {
+				wantTS, want = 2000, []byte("two")
+			}
+			if err != nil || ts != wantTS || !bytes.Equal(v, want) {
+				t.Fatal(path, i, ts, v, err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat("/nonexistent"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestValueStorePaths(t *testing.T) {
+	fs := NewMemFS()
+	paths := []string{"/a", "/b", "/c"}
+	newStore := func() *DefaultValueStore {
+		return newValueTestStore(t, "", func(cfg *ValueStoreConfig) {
+			cfg.Paths = paths
+			cfg.PathTOC = "/toc"
+			cfg.FS = fs
+			// Small files so the writes are spread over many.
+			cfg.FileCap = 1
+		})
+	}
+	value := func(i uint64) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 600)
+	}
+	store := newStore()
+	for i := uint64(1); i <= 60; i++ {
+		if _, err := store.Write(i, i, 1000, value(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			store.Flush()
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if names, _ := fs.ReadDirNames(p); len(names) == 0 {
+			t.Fatal(p, "has no files")
+		}
+	}
+	store = newStore()
+	for i := uint64(1); i <= 60; i++ {
+		if ts, v, err := store.Read(i, i, nil); err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+			t.Fatal(i, ts, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Losing a directory only loses the values in its files.
+	lost, _ := fs.ReadDirNames(paths[1])
+	for _, name := range lost {
+		if err := fs.Remove(path.Join(paths[1], name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = newStore()
+	defer store.Close()
+	found := 0
+	for i := uint64(1); i <= 60; i++ {
+		ts, v, err := store.Read(i, i, nil)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+			t.Fatal(i, ts, err)
+		}
+		found++
+	}
+	if found == 0 || found == 60 {
+		t.Fatal(found)
+	}
+	if _, err := store.Write(100, 100, 2000, value(100)); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if ts, v, err := store.Read(100, 100, nil); err != nil || ts != 2000 || !bytes.Equal(v, value(100)) {
+		t.Fatal(ts, err)
+	}
+}
+
+func TestValueStoreMmapReads(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config func(cfg *ValueStoreConfig)
+	}{
+		{"plain", func(cfg *ValueStoreConfig) {}},
+		{"compressed", func(cfg *ValueStoreConfig) { cfg.CompressionLevel = 6 }},
+		{"encrypted", func(cfg *ValueStoreConfig) {
+			cfg.KeyProvider = &testValueKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		}},
+	} {
+		dir := t.TempDir()
+		newStore := func() *DefaultValueStore {
+			return newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+				cfg.MmapReads = true
+				tc.config(cfg)
+			})
+		}
+		// Enough values to span several checksum intervals.
+		value := func(i uint64) []byte {
+			return bytes.Repeat([]byte{byte(i)}, 50*int(i))
+		}
+		check := func(store *DefaultValueStore) {
+			mapped := 0
+			for _, block := range store.locBlocks {
+				if fl, ok := block.(*valueStoreFile); ok {
+					if m := fl.mapped(); m != nil {
+						m.release()
+						mapped++
+					}
+				}
+			}
+			if mapped == 0 {
+				t.Fatal(tc.name, "no files mapped")
+			}
+			for i := uint64(1); i <= 20; i++ {
+				if ts, v, err := store.Read(i, i, nil); err != nil || ts != 1000 || !bytes.Equal(v, value(i)) {
+					t.Fatal(tc.name, i, ts, err)
+				}
+				buf := &bytes.Buffer{}
+				if _, err := store.ReadTo(i, i, buf); err != nil || !bytes.Equal(buf.Bytes(), value(i)) {
+					t.Fatal(tc.name, i, err)
+				}
+			}
+			if tc.name == "compressed" {
+				// Reads reuse flate readers rather than each allocating a
+				// new one, with its 32K window.
+				v := make([]byte, 0, len(value(20)))
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				for j := 0; j < 100; j++ {
+					if _, _, err := store.Read(20, 20, v); err != nil {
+						t.Fatal(tc.name, err)
+					}
+				}
+				runtime.ReadMemStats(&after)
+				if n := (after.TotalAlloc - before.TotalAlloc) / 100; n > 16*1024 {
+					t.Fatal(tc.name, n)
+				}
+			}
+
+		}
+		store := newStore()
+		for i := uint64(1); i <= 20; i++ {
+			if _, err := store.Write(i, i, 1000, value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store.Flush()
+		check(store)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		store = newStore()
+		check(store)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A corrupted interval must still be caught.
+	dir := t.TempDir()
+	store := newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+		cfg.MmapReads = true
+	})
+	if _, err := store.Write(1, 2, 1000, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		if !strings.HasSuffix(fi.Name(), ".value") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[_VALUE_FILE_HEADER_SIZE] ^= 0xff
+		if err := ioutil.WriteFile(path.Join(dir, fi.Name()), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+		cfg.MmapReads = true
+	})
+	defer store.Close()
+	if _, _, err := store.Read(1, 2, nil); err == nil || err == ErrNotFound {
+		t.Fatal(err)
+	}
+}
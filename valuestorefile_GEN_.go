@@ -2,6 +2,8 @@ package store
 
 import (
 	"bytes"
+	"compress/flate"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,8 +21,24 @@ import (
 
 //    "VALUESTORETOC v0            ":28, checksumInterval:4
 // or "VALUESTORE v0               ":28, checksumInterval:4
+// or "VALUESTORE v1               ":28, checksumInterval:4
+// Encrypted files add " E" to the text and record the key ID:
+//
+//	"VALUESTORE v0 E        ":24, keyID:4, checksumInterval:4
+//
+// with each checksum interval after the header sealed with sealBlock.
 const _VALUE_FILE_HEADER_SIZE = 32
 
+// In v1 value files each value is stored in a frame, with the TOC offset
+// pointing to the frame and the TOC length remaining the value's length.
+// method:1, storedLength:4, stored:storedLength
+const _VALUE_FRAME_SIZE = 5
+
+const (
+	_VALUE_FRAME_RAW   = 0
+	_VALUE_FRAME_FLATE = 1
+)
+
 // keyA:8, keyB:8, timestampbits:8, offset:4, length:4
 const _VALUE_FILE_ENTRY_SIZE = 32
 
@@ -28,21 +46,36 @@ const _VALUE_FILE_ENTRY_SIZE = 32
 const _VALUE_FILE_TRAILER_SIZE = 8
 
 type valueStoreFile struct {
-	store                     *DefaultValueStore
-	name                      string
-	id                        uint32
-	nameTimestamp             int64
+	store            *DefaultValueStore
+	name             string
+	id               uint32
+	nameTimestamp    int64
+	version          int
+	aead             cipher.AEAD
+	checksumInterval uint32
+	// mmap is set once fl is mapped for reads; mmapClosed is set by
+	// closeFiles so no mapping is set up afterwards. Both are covered by
+	// mmapLock.
+	mmapLock                  sync.Mutex
+	mmap                      *mmapReader
+	mmapClosed                bool
 	readerFPs                 []brimutil.ChecksummedReader
 	readerLocks               []sync.Mutex
 	readerLens                [][]byte
+	readerFlates              []io.ReadCloser
 	writerFP                  io.WriteCloser
 	writerOffset              uint32
+	writerBlockSize           uint32
 	writerFreeBufChan         chan *valueStoreFileWriteBuf
 	writerChecksumBufChan     chan *valueStoreFileWriteBuf
 	writerToDiskBufChan       chan *valueStoreFileWriteBuf
 	writerDoneChan            chan struct{}
 	writerCurrentBuf          *valueStoreFileWriteBuf
+	writerFlate               *flate.Writer
+	writerFlateBuf            bytes.Buffer
 	freeableMemBlockChanIndex int
+	closeOnce                 sync.Once
+	closeErr                  error
 }
 
 type valueStoreFileWriteBuf struct {
@@ -50,14 +83,18 @@ type valueStoreFileWriteBuf struct {
 	buf       []byte
 	offset    uint32
 	memBlocks []*valueMemBlock
+	// synced is set, with no buf, for a sync request; see sync.
+	synced chan error
 }
 
 func newValueReadFile(store *DefaultValueStore, nameTimestamp int64, openReadSeeker func(name string) (io.ReadSeeker, error)) (*valueStoreFile, error) {
 	fl := &valueStoreFile{store: store, nameTimestamp: nameTimestamp}
-	fl.name = path.Join(store.path, fmt.Sprintf("%019d.value", fl.nameTimestamp))
+	fl.name = store.valueFilePath(fmt.Sprintf("%019d.value", fl.nameTimestamp))
 	fl.readerFPs = make([]brimutil.ChecksummedReader, store.fileReaders)
 	fl.readerLocks = make([]sync.Mutex, len(fl.readerFPs))
 	fl.readerLens = make([][]byte, len(fl.readerFPs))
+	fl.readerFlates = make([]io.ReadCloser, len(fl.readerFPs))
+	var header []byte
 	var checksumInterval uint32
 	for i := 0; i < len(fl.readerFPs); i++ {
 		fp, err := openReadSeeker(fl.name)
@@ -65,13 +102,23 @@ func newValueReadFile(store *DefaultValueStore, nameTimestamp int64, openReadSee
 			return nil, err
 		}
 		if i == 0 {
-			if _, checksumInterval, err = readValueHeader(fp); err != nil {
+			if header, checksumInterval, err = readValueHeader(fp); err != nil {
+				return nil, err
+			}
+			fl.version = valueHeaderVersion(header)
+			if fl.aead, err = valueHeaderAEAD(header, store.keyProvider); err != nil {
+				closeIfCloser(fp)
 				return nil, err
 			}
 		}
 		fl.readerFPs[i] = brimutil.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
+		if fl.aead != nil {
+			fl.readerFPs[i] = newBlockCipherReader(fl.readerFPs[i], fl.aead, int(checksumInterval), _VALUE_FILE_HEADER_SIZE)
+		}
 		fl.readerLens[i] = make([]byte, 4)
 	}
+	fl.checksumInterval = checksumInterval
+	fl.mapReads()
 	var err error
 	fl.id, err = store.addLocBlock(fl)
 	if err != nil {
@@ -83,8 +130,39 @@ func newValueReadFile(store *DefaultValueStore, nameTimestamp int64, openReadSee
 
 func createValueReadWriteFile(store *DefaultValueStore, createWriteCloser func(name string) (io.WriteCloser, error), openReadSeeker func(name string) (io.ReadSeeker, error)) (*valueStoreFile, error) {
 	fl := &valueStoreFile{store: store, nameTimestamp: time.Now().UnixNano()}
-	fl.name = path.Join(store.path, fmt.Sprintf("%019d.value", fl.nameTimestamp))
-	fp, err := createWriteCloser(fl.name)
+	text := "VALUESTORE v0"
+	if store.compressionLevel > 0 {
+		text = "VALUESTORE v1"
+		fl.version = 1
+		var err error
+		if fl.writerFlate, err = flate.NewWriter(&fl.writerFlateBuf, store.compressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	fl.checksumInterval = store.checksumInterval
+	fl.writerBlockSize = store.checksumInterval
+	var keyID uint32
+	if store.keyProvider != nil {
+		var key []byte
+		var err error
+		if keyID, key, err = store.keyProvider.CurrentKey(); err != nil {
+			return nil, err
+		}
+		if fl.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		fl.writerBlockSize -= _ENCRYPTION_OVERHEAD
+	}
+	head := newValueHeader(text, store.checksumInterval, fl.aead != nil, keyID)
+	var fp io.WriteCloser
+	var err error
+	for _, dir := range store.newValueFileDirs() {
+		fl.name = path.Join(dir, fmt.Sprintf("%019d.value", fl.nameTimestamp))
+		if fp, err = createWriteCloser(fl.name); err == nil {
+			break
+		}
+		store.logError("unable to create %s: %s\n", fl.name, err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -97,8 +175,6 @@ func createValueReadWriteFile(store *DefaultValueStore, createWriteCloser func(n
 	fl.writerToDiskBufChan = make(chan *valueStoreFileWriteBuf, store.workers)
 	fl.writerDoneChan = make(chan struct{})
 	fl.writerCurrentBuf = <-fl.writerFreeBufChan
-	head := []byte("VALUESTORE v0                   ")
-	binary.BigEndian.PutUint32(head[28:], store.checksumInterval)
 	fl.writerCurrentBuf.offset = uint32(copy(fl.writerCurrentBuf.buf, head))
 	atomic.StoreUint32(&fl.writerOffset, fl.writerCurrentBuf.offset)
 	go fl.writer()
@@ -108,6 +184,7 @@ func createValueReadWriteFile(store *DefaultValueStore, createWriteCloser func(n
 	fl.readerFPs = make([]brimutil.ChecksummedReader, store.fileReaders)
 	fl.readerLocks = make([]sync.Mutex, len(fl.readerFPs))
 	fl.readerLens = make([][]byte, len(fl.readerFPs))
+	fl.readerFlates = make([]io.ReadCloser, len(fl.readerFPs))
 	for i := 0; i < len(fl.readerFPs); i++ {
 		fp, err := openReadSeeker(fl.name)
 		if err != nil {
@@ -118,6 +195,9 @@ func createValueReadWriteFile(store *DefaultValueStore, createWriteCloser func(n
 			return nil, err
 		}
 		fl.readerFPs[i] = brimutil.NewChecksummedReader(fp, int(store.checksumInterval), murmur3.New32)
+		if fl.aead != nil {
+			fl.readerFPs[i] = newBlockCipherReader(fl.readerFPs[i], fl.aead, int(store.checksumInterval), _VALUE_FILE_HEADER_SIZE)
+		}
 		fl.readerLens[i] = make([]byte, 4)
 	}
 	fl.id, err = store.addLocBlock(fl)
@@ -135,9 +215,6 @@ func (fl *valueStoreFile) read(keyA uint64, keyB uint64, timestampbits uint64, o
 	if timestampbits&_TSB_DELETION != 0 {
 		return timestampbits, value, ErrNotFound
 	}
-	i := int(keyA>>1) % len(fl.readerFPs)
-	fl.readerLocks[i].Lock()
-	fl.readerFPs[i].Seek(int64(offset), 0)
 	end := len(value) + int(length)
 	if end <= cap(value) {
 		value = value[:end]
@@ -146,14 +223,166 @@ func (fl *valueStoreFile) read(keyA uint64, keyB uint64, timestampbits uint64, o
 		copy(value2, value)
 		value = value2
 	}
-	if _, err := io.ReadFull(fl.readerFPs[i], value[len(value)-int(length):]); err != nil {
-		fl.readerLocks[i].Unlock()
+	if err := fl.readValueAt(int(keyA>>1)%len(fl.readerFPs), offset, value[len(value)-int(length):]); err != nil {
 		return timestampbits, value, err
 	}
-	fl.readerLocks[i].Unlock()
 	return timestampbits, value, nil
 }
 
+// readAt fills value with the start of the value stored at offset, using
+// reader i; the caller must hold fl.readerLocks[i].
+func (fl *valueStoreFile) readAt(i int, offset uint32, value []byte) error {
+	fl.readerFPs[i].Seek(int64(offset), 0)
+	return fl.readValue(fl.readerFPs[i], &fl.readerFlates[i], offset, value)
+}
+
+// readValueAt is readAt for callers not holding a reader lock: the memory
+// mapping is used if fl has one, otherwise reader i under its lock.
+func (fl *valueStoreFile) readValueAt(i int, offset uint32, value []byte) error {
+	if m := fl.mapped(); m != nil {
+		flr, _ := flateReaders.Get().(io.ReadCloser)
+		err := fl.readValue(io.NewSectionReader(m, int64(offset), math.MaxInt64-int64(offset)), &flr, offset, value)
+		if flr != nil {
+			flateReaders.Put(flr)
+		}
+		m.release()
+		return err
+	}
+	fl.readerLocks[i].Lock()
+	err := fl.readAt(i, offset, value)
+	fl.readerLocks[i].Unlock()
+	return err
+}
+
+// readValue fills value with the start of the value stored at offset, reading
+// from r which is positioned there. For v1 files this handles the frame and
+// any decompression, reusing the flate reader in *flr if flr isn't nil.
+func (fl *valueStoreFile) readValue(r io.Reader, flr *io.ReadCloser, offset uint32, value []byte) error {
+	if fl.version == 0 {
+		_, err := io.ReadFull(r, value)
+		return err
+	}
+	var frame [_VALUE_FRAME_SIZE]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return err
+	}
+	switch frame[0] {
+	case _VALUE_FRAME_RAW:
+		_, err := io.ReadFull(r, value)
+		return err
+	case _VALUE_FRAME_FLATE:
+		lr := io.LimitReader(r, int64(binary.BigEndian.Uint32(frame[1:])))
+		var fr io.ReadCloser
+		if flr != nil {
+			fr = *flr
+		}
+		if fr == nil {
+			fr = flate.NewReader(lr)
+			if flr != nil {
+				*flr = fr
+			}
+		} else if err := fr.(flate.Resetter).Reset(lr, nil); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(fr, value)
+		return err
+	}
+	return fmt.Errorf("unknown frame method %d at offset %d in %s", frame[0], offset, fl.name)
+}
+
+// mapReads memory maps fl for reads if the store has MmapReads set; fl must
+// no longer be written to. Failing to map isn't an error, reads just keep
+// using the file's readers.
+func (fl *valueStoreFile) mapReads() {
+	if !fl.store.mmapReads {
+		return
+	}
+	fp, err := fl.store.fs.Open(fl.name)
+	if err != nil {
+		if fl.store.logDebug != nil {
+			fl.store.logDebug("unable to open %s for memory mapping: %s\n", fl.name, err)
+		}
+		return
+	}
+	m, err := newMmapReader(fp, int(fl.checksumInterval), fl.aead, _VALUE_FILE_HEADER_SIZE)
+	closeIfCloser(fp)
+	if err != nil {
+		if fl.store.logDebug != nil {
+			fl.store.logDebug("unable to memory map %s: %s\n", fl.name, err)
+		}
+		return
+	}
+	fl.mmapLock.Lock()
+	if fl.mmapClosed {
+		// fl was closed in the meantime.
+		fl.mmapLock.Unlock()
+		m.close()
+		return
+	}
+	fl.mmap = m
+	fl.mmapLock.Unlock()
+}
+
+// mapped returns fl's memory mapping, which the caller must release once
+// done, or nil if reads should use the file's readers.
+func (fl *valueStoreFile) mapped() *mmapReader {
+	fl.mmapLock.Lock()
+	m := fl.mmap
+	fl.mmapLock.Unlock()
+	if m == nil || !m.acquire() {
+		return nil
+	}
+	return m
+}
+
+// readTo writes the value of length bytes at offset to w, less its first skip
+// bytes. The reader lock, or memory mapping, is only held while filling each
+// piece of the buffer so a slow w doesn't hold up other readers or closing.
+// For v1 files the whole value is read before being written to w.
+func (fl *valueStoreFile) readTo(keyA uint64, offset uint32, length uint32, skip uint32, w io.Writer) error {
+	if fl.version > 0 {
+		value := make([]byte, length)
+		if err := fl.readValueAt(int(keyA>>1)%len(fl.readerFPs), offset, value); err != nil {
+			return err
+		}
+		_, err := w.Write(value[skip:])
+		return err
+	}
+	offset += skip
+	length -= skip
+	size := length
+	if size > 65536 {
+		size = 65536
+	}
+	buf := make([]byte, size)
+	i := int(keyA>>1) % len(fl.readerFPs)
+	for length > 0 {
+		n := uint32(len(buf))
+		if n > length {
+			n = length
+		}
+		var err error
+		if m := fl.mapped(); m != nil {
+			_, err = m.ReadAt(buf[:n], int64(offset))
+			m.release()
+		} else {
+			fl.readerLocks[i].Lock()
+			fl.readerFPs[i].Seek(int64(offset), 0)
+			_, err = io.ReadFull(fl.readerFPs[i], buf[:n])
+			fl.readerLocks[i].Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
 func (fl *valueStoreFile) write(memBlock *valueMemBlock) {
 	if memBlock == nil {
 		return
@@ -168,18 +397,20 @@ func (fl *valueStoreFile) write(memBlock *valueMemBlock) {
 		}
 		return
 	}
-	left := len(memBlock.values)
-	for left > 0 {
-		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], memBlock.values[len(memBlock.values)-left:])
-		atomic.AddUint32(&fl.writerOffset, uint32(n))
-		fl.writerCurrentBuf.offset += uint32(n)
-		if fl.writerCurrentBuf.offset >= fl.store.checksumInterval {
-			s := fl.writerCurrentBuf.seq
-			fl.writerChecksumBufChan <- fl.writerCurrentBuf
-			fl.writerCurrentBuf = <-fl.writerFreeBufChan
-			fl.writerCurrentBuf.seq = s + 1
+	if fl.version == 0 {
+		fl.writeBytes(memBlock.values)
+	} else {
+		fl.writeFrames(memBlock)
+		// Compressed values may leave this memBlock, and those before it,
+		// waiting on a partial buffer until later memBlocks fill it. Once so
+		// many are waiting that the memWriters could run out of memBlocks,
+		// and so never send the ones that would fill it, the buffer is padded
+		// out instead. The TOC won't reference the padding.
+		if fl.writerCurrentBuf.offset != 0 && len(fl.writerCurrentBuf.memBlocks)+1 >= cap(fl.store.freeMemBlockChan)-len(fl.store.pendingWriteReqChans) {
+			fl.writerCurrentBuf.memBlocks = append(fl.writerCurrentBuf.memBlocks, memBlock)
+			fl.writeBytes(make([]byte, fl.writerBlockSize-fl.writerCurrentBuf.offset))
+			return
 		}
-		left -= n
 	}
 	if fl.writerCurrentBuf.offset == 0 {
 		fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
@@ -192,6 +423,70 @@ func (fl *valueStoreFile) write(memBlock *valueMemBlock) {
 	}
 }
 
+// writeFrames writes each of memBlock's values as a v1 frame, compressing
+// those that shrink, and updates the TOC offsets in memBlock to refer to the
+// frames (still relative to memBlock.fileOffset).
+func (fl *valueStoreFile) writeFrames(memBlock *valueMemBlock) {
+	var frame [_VALUE_FRAME_SIZE]byte
+	for memBlockTOCOffset := 0; memBlockTOCOffset < len(memBlock.toc); memBlockTOCOffset += _VALUE_FILE_ENTRY_SIZE {
+
+		entry := memBlock.toc[memBlockTOCOffset+24:]
+
+		offset := binary.BigEndian.Uint32(entry)
+		length := binary.BigEndian.Uint32(entry[4:])
+		binary.BigEndian.PutUint32(entry, atomic.LoadUint32(&fl.writerOffset)-memBlock.fileOffset)
+		stored := memBlock.values[offset : offset+length]
+		frame[0] = _VALUE_FRAME_RAW
+		if length > 0 {
+			fl.writerFlateBuf.Reset()
+			fl.writerFlate.Reset(&fl.writerFlateBuf)
+			fl.writerFlate.Write(stored)
+			fl.writerFlate.Close()
+			if fl.writerFlateBuf.Len() < len(stored) {
+				frame[0] = _VALUE_FRAME_FLATE
+				stored = fl.writerFlateBuf.Bytes()
+			}
+		}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(stored)))
+		fl.writeBytes(frame[:])
+		fl.writeBytes(stored)
+		atomic.AddUint64(&fl.store.compressedBytes, uint64(len(stored)))
+		atomic.AddUint64(&fl.store.uncompressedBytes, uint64(length))
+	}
+}
+
+func (fl *valueStoreFile) writeBytes(b []byte) {
+	left := len(b)
+	for left > 0 {
+		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.writerBlockSize], b[len(b)-left:])
+		atomic.AddUint32(&fl.writerOffset, uint32(n))
+		fl.writerCurrentBuf.offset += uint32(n)
+		if fl.writerCurrentBuf.offset >= fl.writerBlockSize {
+			s := fl.writerCurrentBuf.seq
+			fl.writerChecksumBufChan <- fl.writerCurrentBuf
+			fl.writerCurrentBuf = <-fl.writerFreeBufChan
+			fl.writerCurrentBuf.seq = s + 1
+		}
+		left -= n
+	}
+}
+
+// sync pads out the checksum interval being filled, if anything is in it, so
+// that it's sent on to disk along with the memBlocks waiting on it, and then
+// waits for the writer to have written everything so far and synced the file.
+// The TOC won't reference the padding.
+func (fl *valueStoreFile) sync() error {
+	if fl.writerChecksumBufChan == nil {
+		return nil
+	}
+	if fl.writerCurrentBuf.offset != 0 {
+		fl.writeBytes(make([]byte, fl.writerBlockSize-fl.writerCurrentBuf.offset))
+	}
+	synced := make(chan error, 1)
+	fl.writerToDiskBufChan <- &valueStoreFileWriteBuf{seq: fl.writerCurrentBuf.seq, synced: synced}
+	return <-synced
+}
+
 func (fl *valueStoreFile) closeWriting() error {
 	if fl.writerChecksumBufChan == nil {
 		return nil
@@ -206,13 +501,16 @@ func (fl *valueStoreFile) closeWriting() error {
 	// Make sure any trailing data is covered by a checksum by writing an
 	// additional block of zeros (since this is a value file and the TOC won't
 	// reference these additional locations, they are effectively ignored).
-	term := make([]byte, fl.store.checksumInterval)
+	term := make([]byte, fl.writerBlockSize)
 	copy(term[len(term)-8:], []byte("TERM v0 "))
 	left := len(term)
 	for left > 0 {
-		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.store.checksumInterval], term[len(term)-left:])
+		n := copy(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:fl.writerBlockSize], term[len(term)-left:])
 		left -= n
 		fl.writerCurrentBuf.offset += uint32(n)
+		if fl.aead != nil {
+			fl.writerCurrentBuf.offset = uint32(len(fl.seal(fl.writerCurrentBuf.buf[:fl.writerCurrentBuf.offset], fl.writerCurrentBuf.seq)))
+		}
 		if left > 0 {
 			binary.BigEndian.PutUint32(fl.writerCurrentBuf.buf[fl.writerCurrentBuf.offset:], murmur3.Sum32(fl.writerCurrentBuf.buf[:fl.writerCurrentBuf.offset]))
 			fl.writerCurrentBuf.offset += 4
@@ -224,6 +522,7 @@ func (fl *valueStoreFile) closeWriting() error {
 			break
 		}
 		fl.writerCurrentBuf.offset = 0
+		fl.writerCurrentBuf.seq++
 	}
 	if err := fl.writerFP.Close(); err != nil {
 		if reterr == nil {
@@ -246,8 +545,31 @@ func (fl *valueStoreFile) closeWriting() error {
 	return reterr
 }
 
+// close may be called more than once, such as by compaction and then again by
+// the store's Close; only the first call has any effect.
 func (fl *valueStoreFile) close() error {
+	fl.closeOnce.Do(func() {
+		fl.closeErr = fl.closeFiles()
+	})
+	return fl.closeErr
+}
+
+func (fl *valueStoreFile) closeFiles() error {
 	reterr := fl.closeWriting()
+	// Once cleared no new reads will use the mapping; close waits for any
+	// in progress before unmapping.
+	fl.mmapLock.Lock()
+	m := fl.mmap
+	fl.mmap = nil
+	fl.mmapClosed = true
+	fl.mmapLock.Unlock()
+	if m != nil {
+		if err := m.close(); err != nil {
+			if reterr == nil {
+				reterr = err
+			}
+		}
+	}
 	for i, fp := range fl.readerFPs {
 		// This will let any ongoing reads complete.
 		fl.readerLocks[i].Lock()
@@ -273,15 +595,34 @@ func (fl *valueStoreFile) writingChecksummer() {
 		if buf == nil {
 			break
 		}
+		if fl.aead != nil {
+			fl.seal(buf.buf[:fl.writerBlockSize], buf.seq)
+		}
 		binary.BigEndian.PutUint32(buf.buf[fl.store.checksumInterval:], murmur3.Sum32(buf.buf[:fl.store.checksumInterval]))
 		fl.writerToDiskBufChan <- buf
 	}
 	fl.writerDoneChan <- struct{}{}
 }
 
+// seal encrypts the block with the given sequence number in place; the first
+// block's header is left in the clear.
+func (fl *valueStoreFile) seal(block []byte, seq int) []byte {
+	prefix := 0
+	if seq == 0 {
+		prefix = _VALUE_FILE_HEADER_SIZE
+	}
+	return sealBlock(fl.aead, block, prefix, uint64(seq))
+}
+
 func (fl *valueStoreFile) writer() {
 	var seq int
 	lastWasNil := false
+	// Once a write fails, later buffers are dropped rather than written, but
+	// are otherwise handled as usual so nothing waiting on them is stuck.
+	var err error
+	// syncReq is a sync request held until the buffers before it are
+	// written; see sync.
+	var syncReq *valueStoreFileWriteBuf
 	for {
 		buf := <-fl.writerToDiskBufChan
 		if buf == nil {
@@ -293,27 +634,40 @@ func (fl *valueStoreFile) writer() {
 			continue
 		}
 		lastWasNil = false
-		if buf.seq != seq {
+		if buf.synced != nil {
+			syncReq = buf
+		} else if buf.seq != seq {
 			fl.writerToDiskBufChan <- buf
 			continue
-		}
-		if _, err := fl.writerFP.Write(buf.buf); err != nil {
-			fl.store.logCritical("%s %s\n", fl.name, err)
-			break
-		}
-		if len(buf.memBlocks) > 0 {
-			for _, memBlock := range buf.memBlocks {
-				fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
-				fl.freeableMemBlockChanIndex++
-				if fl.freeableMemBlockChanIndex >= len(fl.store.freeableMemBlockChans) {
-					fl.freeableMemBlockChanIndex = 0
+		} else {
+			if err == nil {
+				if _, err = fl.writerFP.Write(buf.buf); err != nil {
+					fl.store.logCritical("%s %s\n", fl.name, err)
+					fl.store.durabilityFailed(err)
 				}
 			}
-			buf.memBlocks = buf.memBlocks[:0]
+			if len(buf.memBlocks) > 0 {
+				for _, memBlock := range buf.memBlocks {
+					fl.store.freeableMemBlockChans[fl.freeableMemBlockChanIndex] <- memBlock
+					fl.freeableMemBlockChanIndex++
+					if fl.freeableMemBlockChanIndex >= len(fl.store.freeableMemBlockChans) {
+						fl.freeableMemBlockChanIndex = 0
+					}
+				}
+				buf.memBlocks = buf.memBlocks[:0]
+			}
+			buf.offset = 0
+			fl.writerFreeBufChan <- buf
+			seq++
+		}
+		if syncReq != nil && syncReq.seq == seq {
+			if err == nil {
+				syncReq.synced <- syncFile(fl.writerFP)
+			} else {
+				syncReq.synced <- err
+			}
+			syncReq = nil
 		}
-		buf.offset = 0
-		fl.writerFreeBufChan <- buf
-		seq++
 	}
 	fl.writerDoneChan <- struct{}{}
 }
@@ -321,27 +675,30 @@ func (fl *valueStoreFile) writer() {
 // Returns the header bytes and checksum interval stored in the header for a
 // value file or any error discovered; fpr is assumed to be at file position 0.
 func readValueHeader(fpr io.Reader) ([]byte, uint32, error) {
-	return _readValueHeader(fpr, false)
+	return _readValueHeader(fpr, "")
 }
 
 // Returns the header bytes and checksum interval stored in the header for a
 // TOC file or any error discovered; fpr is assumed to be at file position 0.
 func readValueHeaderTOC(fpr io.Reader) ([]byte, uint32, error) {
-	return _readValueHeader(fpr, true)
+	return _readValueHeader(fpr, "VALUESTORETOC v0")
 }
 
-func _readValueHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
+// _readValueHeader reads a header expected to start with text, or with
+// either value file version's text if text is empty.
+func _readValueHeader(fpr io.Reader, text string) ([]byte, uint32, error) {
 	buf := make([]byte, _VALUE_FILE_HEADER_SIZE)
 	if n, err := io.ReadFull(fpr, buf); err != nil {
 		return buf[:n], 0, err
 	}
-	var cmp []byte
-	if toc {
-		cmp = []byte("VALUESTORETOC v0            ")
-	} else {
-		cmp = []byte("VALUESTORE v0               ")
+	if text == "" {
+		text = "VALUESTORE v0"
+		if valueHeaderVersion(buf) == 1 {
+			text = "VALUESTORE v1"
+		}
 	}
-	if !bytes.Equal(buf[:28], cmp) {
+	keyID, encrypted := valueHeaderKeyID(buf)
+	if !bytes.Equal(buf[:28], newValueHeader(text, 0, encrypted, keyID)[:28]) {
 		return buf, 0, errors.New("unknown file type in header")
 	}
 	checksumInterval := binary.BigEndian.Uint32(buf[28:])
@@ -351,6 +708,105 @@ func _readValueHeader(fpr io.Reader, toc bool) ([]byte, uint32, error) {
 	return buf, checksumInterval, nil
 }
 
+// valueHeaderVersion returns the format version of a value file from its
+// header bytes; 0 is the original format and 1 adds value frames.
+func valueHeaderVersion(header []byte) int {
+	if bytes.HasPrefix(header, []byte("VALUESTORE v1")) {
+		return 1
+	}
+	return 0
+}
+
+// newValueHeader returns a file header starting with text, such as
+// "VALUESTORE v0"; if encrypted, the text is marked and keyID recorded.
+func newValueHeader(text string, checksumInterval uint32, encrypted bool, keyID uint32) []byte {
+	head := bytes.Repeat([]byte(" "), _VALUE_FILE_HEADER_SIZE)
+	if encrypted {
+		copy(head, text+" E")
+		binary.BigEndian.PutUint32(head[24:], keyID)
+	} else {
+		copy(head, text)
+	}
+	binary.BigEndian.PutUint32(head[28:], checksumInterval)
+	return head
+}
+
+// newValueTermBlock returns the block of zeros ending in "TERM v0 " written
+// at the end of TOC files so that any trailing data is covered by a checksum.
+func newValueTermBlock(checksumInterval uint32, encrypted bool) []byte {
+	term := make([]byte, checksumInterval)
+	if encrypted {
+		term = term[_ENCRYPTION_OVERHEAD:]
+	}
+	copy(term[len(term)-_VALUE_FILE_TRAILER_SIZE:], []byte("TERM v0 "))
+	return term
+}
+
+// valueHeaderKeyID returns the key ID from a file header and whether the file
+// is encrypted at all.
+func valueHeaderKeyID(header []byte) (uint32, bool) {
+	if len(header) < _VALUE_FILE_HEADER_SIZE || !bytes.HasSuffix(bytes.TrimRight(header[:24], " "), []byte(" E")) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(header[24:]), true
+}
+
+// valueHeaderAEAD returns the AEAD for decrypting the file with the given
+// header, or nil if the file isn't encrypted.
+func valueHeaderAEAD(header []byte, keyProvider KeyProvider) (cipher.AEAD, error) {
+	keyID, encrypted := valueHeaderKeyID(header)
+	if !encrypted {
+		return nil, nil
+	}
+	if keyProvider == nil {
+		return nil, fmt.Errorf("file encrypted with key %d but no KeyProvider configured", keyID)
+	}
+	key, err := keyProvider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// newValueTOCWriter returns a writer for a new TOC file, encrypting it if
+// the store has a KeyProvider, with the header already written.
+func newValueTOCWriter(store *DefaultValueStore, fp io.WriteCloser) (io.WriteCloser, error) {
+	return newValueChecksummedWriter(store, fp, "VALUESTORETOC v0")
+}
+
+// newValueChecksummedWriter returns a checksummed writer, encrypting if the
+// store has a KeyProvider, with a header starting with text already written.
+func newValueChecksummedWriter(store *DefaultValueStore, fp io.WriteCloser, text string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	if store.durability == DurabilitySync {
+		// Syncs need each checksum interval written to fp as soon as it's
+		// complete, which the multicore writer doesn't promise.
+		w = brimutil.NewChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32)
+	} else {
+		w = brimutil.NewMultiCoreChecksummedWriter(fp, int(store.checksumInterval), murmur3.New32, store.workers)
+	}
+	var keyID uint32
+	if store.keyProvider != nil {
+		var key []byte
+		var err error
+		if keyID, key, err = store.keyProvider.CurrentKey(); err != nil {
+			w.Close()
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = newBlockCipherWriter(w, aead, int(store.checksumInterval), _VALUE_FILE_HEADER_SIZE)
+	}
+	if _, err := w.Write(newValueHeader(text, store.checksumInterval, store.keyProvider != nil, keyID)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
 type valueTOCEntry struct {
 	KeyA uint64
 	KeyB uint64
@@ -361,21 +817,30 @@ type valueTOCEntry struct {
 	Length        uint32
 }
 
-func valueReadTOCEntriesBatched(fpr io.ReadSeeker, blockID uint32, freeBatchChans []chan []valueTOCEntry, pendingBatchChans []chan []valueTOCEntry, controlChan chan struct{}) (int, []error) {
+func valueReadTOCEntriesBatched(fpr io.ReadSeeker, keyProvider KeyProvider, blockID uint32, freeBatchChans []chan []valueTOCEntry, pendingBatchChans []chan []valueTOCEntry, controlChan chan struct{}) (int, []error) {
 	// There is an assumption that the checksum interval is greater than the
 	// _VALUE_FILE_HEADER_SIZE and that the _VALUE_FILE_ENTRY_SIZE is
 	// greater than the _VALUE_FILE_TRAILER_SIZE.
 	var errs []error
 	var checksumInterval int
-	if _, ci, err := readValueHeaderTOC(fpr); err != nil {
+	var aead cipher.AEAD
+	if header, ci, err := readValueHeaderTOC(fpr); err != nil {
+		return 0, append(errs, err)
+	} else if aead, err = valueHeaderAEAD(header, keyProvider); err != nil {
 		return 0, append(errs, err)
 	} else {
 		checksumInterval = int(ci)
 	}
+	overhead := 0
+	if aead != nil {
+		overhead = _ENCRYPTION_OVERHEAD
+	}
 	fpr.Seek(0, 0)
 	buf := make([]byte, checksumInterval+4+_VALUE_FILE_ENTRY_SIZE)
 	rpos := 0
 	checksumErrors := 0
+	decryptErrors := 0
+	var index uint64
 	workers := uint64(len(freeBatchChans))
 	batches := make([][]valueTOCEntry, workers)
 	batches[0] = <-freeBatchChans[0]
@@ -404,12 +869,29 @@ L1:
 			rbuf = rbuf[:len(rbuf)-4]
 			if binary.BigEndian.Uint32(cbuf) != murmur3.Sum32(rbuf) {
 				checksumErrors++
-				rbuf = buf[:rpos+len(rbuf)]
+				rbuf = buf[:rpos+len(rbuf)-overhead]
+				skipNext = _VALUE_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _VALUE_FILE_ENTRY_SIZE)
+				rpos = 0
+				index++
+				continue
+			}
+		}
+		if aead != nil && len(rbuf) > 0 {
+			prefix := 0
+			if index == 0 {
+				prefix = _VALUE_FILE_HEADER_SIZE
+			}
+			var err error
+			if rbuf, err = openBlock(aead, rbuf, prefix, index); err != nil {
+				decryptErrors++
+				rbuf = buf[:rpos+checksumInterval-overhead]
 				skipNext = _VALUE_FILE_ENTRY_SIZE - ((skipNext + len(rbuf)) % _VALUE_FILE_ENTRY_SIZE)
 				rpos = 0
+				index++
 				continue
 			}
 		}
+		index++
 		if skipNext != 0 {
 			rbuf = rbuf[skipNext:]
 			skipNext = 0
@@ -432,7 +914,21 @@ L1:
 				keyB := binary.BigEndian.Uint64(rbuf[8:])
 				k := keyB % workers
 				if batches[k] == nil {
-					batches[k] = <-freeBatchChans[k]
+					select {
+					case batches[k] = <-freeBatchChans[k]:
+					default:
+						// Hand off any partly filled batches before waiting
+						// so that when several files are read at once, the
+						// readers can't all be waiting on batches held by
+						// each other.
+						for i := 0; i < len(batches); i++ {
+							if batches[i] != nil {
+								pendingBatchChans[i] <- batches[i][:batchesPos[i]]
+								batches[i] = nil
+							}
+						}
+						batches[k] = <-freeBatchChans[k]
+					}
 					batches[k] = batches[k][:cap(batches[k])]
 					batchesPos[k] = 0
 				}
@@ -463,6 +959,9 @@ L1:
 	if checksumErrors > 0 {
 		errs = append(errs, fmt.Errorf("there were %d checksum errors", checksumErrors))
 	}
+	if decryptErrors > 0 {
+		errs = append(errs, fmt.Errorf("there were %d blocks that failed decryption", decryptErrors))
+	}
 	return fromDiskCount, errs
 }
 
@@ -476,15 +975,21 @@ func valueTOCStat(path string, statter func(name string) (os.FileInfo, error), o
 	if err != nil {
 		return 0, err
 	}
-	_, checksumInterval, err := readValueHeaderTOC(fpr)
+	header, checksumInterval, err := readValueHeaderTOC(fpr)
 	closeIfCloser(fpr)
 	if err != nil {
 		return 0, err
 	}
 	size := fileInfo.Size()
 	checksumsRemoved := size - size/(int64(checksumInterval)+4)*4
-	// NOTE: Store always writes the trailer as a full checksum interval block.
-	headerAndTrailerRemoved := checksumsRemoved - _VALUE_FILE_HEADER_SIZE - int64(checksumInterval)
+	blockSize := int64(checksumInterval)
+	if _, encrypted := valueHeaderKeyID(header); encrypted {
+		blockSize -= _ENCRYPTION_OVERHEAD
+		blocks := (size + int64(checksumInterval) + 3) / (int64(checksumInterval) + 4)
+		checksumsRemoved -= blocks * _ENCRYPTION_OVERHEAD
+	}
+	// NOTE: Store always writes the trailer as a full block.
+	headerAndTrailerRemoved := checksumsRemoved - _VALUE_FILE_HEADER_SIZE - blockSize
 	return int(headerAndTrailerRemoved / _VALUE_FILE_ENTRY_SIZE), nil
 }
 
@@ -494,7 +999,8 @@ type valueCorruptRange struct {
 }
 
 // Scans a file for checksum errors and returns all the corrupt ranges and
-// errors encountered.
+// errors encountered. For encrypted files the ranges are in terms of the
+// decrypted offsets.
 func valueChecksumVerify(fpr io.Reader) ([]*valueCorruptRange, []error) {
 	header, checksumInterval, err := readValueHeader(fpr)
 	if err != nil {
@@ -505,8 +1011,12 @@ func valueChecksumVerify(fpr io.Reader) ([]*valueCorruptRange, []error) {
 	if _, err := io.ReadFull(fpr, buf[len(header):]); err != nil {
 		return []*valueCorruptRange{&valueCorruptRange{0, math.MaxUint32}}, []error{err}
 	}
+	blockSize := checksumInterval
+	if _, encrypted := valueHeaderKeyID(header); encrypted {
+		blockSize -= _ENCRYPTION_OVERHEAD
+	}
 	start := uint32(0)
-	stop := checksumInterval - 1
+	stop := blockSize - 1
 	var corruptions []*valueCorruptRange
 	var errs []error
 	for {
@@ -514,7 +1024,7 @@ func valueChecksumVerify(fpr io.Reader) ([]*valueCorruptRange, []error) {
 			corruptions = append(corruptions, &valueCorruptRange{start, stop})
 		}
 		start = stop + 1
-		stop = stop + checksumInterval
+		stop = stop + blockSize
 		if _, err := io.ReadFull(fpr, buf); err != nil {
 			corruptions = append(corruptions, &valueCorruptRange{start, math.MaxUint32})
 			errs = append(errs, err)
@@ -524,21 +1034,77 @@ func valueChecksumVerify(fpr io.Reader) ([]*valueCorruptRange, []error) {
 	return corruptions, errs
 }
 
-func valueInCorruptRange(offset uint32, length uint32, corruptions []*valueCorruptRange) bool {
+func valueInCorruptRange(offset uint32, length int64, corruptions []*valueCorruptRange) bool {
 	// Offset == 0 means a filler offset as offset zero is always the header.
 	// Length == 0 means it really doesn't matter if it's in a corrupted range
 	// since it's zero bytes long anyway.
 	if offset == 0 || length == 0 {
 		return false
 	}
-	end := offset + length - 1
+	end := int64(offset) + length - 1
 	for _, corruption := range corruptions {
 		if offset >= corruption.start && offset <= corruption.stop {
 			return true
 		}
-		if end >= corruption.start && end <= corruption.stop {
+		if end >= int64(corruption.start) && end <= int64(corruption.stop) {
 			return true
 		}
 	}
 	return false
 }
+
+// openValueFrames opens name with open for use with valueEntryCorrupt,
+// returning a reader of the value file as a valueStoreFile reads it along
+// with the file to close once done. For v0 files, which have no frames, the
+// reader is nil.
+func openValueFrames(open func(name string) (io.ReadSeeker, error), name string, keyProvider KeyProvider) (io.ReadSeeker, io.ReadSeeker, error) {
+	fp, err := open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, checksumInterval, err := readValueHeader(fp)
+	if err != nil {
+		closeIfCloser(fp)
+		return nil, nil, err
+	}
+	if valueHeaderVersion(header) == 0 {
+		closeIfCloser(fp)
+		return nil, nil, nil
+	}
+	aead, err := valueHeaderAEAD(header, keyProvider)
+	if err != nil {
+		closeIfCloser(fp)
+		return nil, nil, err
+	}
+	var frames io.ReadSeeker = brimutil.NewChecksummedReader(fp, int(checksumInterval), murmur3.New32)
+	if aead != nil {
+		frames = newBlockCipherReader(frames, aead, int(checksumInterval), _VALUE_FILE_HEADER_SIZE)
+	}
+	return frames, fp, nil
+}
+
+// valueEntryCorrupt reports whether the value of a TOC entry falls within any
+// of corruptions or, if limit isn't 0, extends past limit. For v1 files,
+// frames is from openValueFrames and the length the value is stored with,
+// which may be compressed, is read from its frame header; frames is nil for
+// v0 files, where values are stored with just their length.
+func valueEntryCorrupt(frames io.ReadSeeker, offset uint32, length uint32, limit int64, corruptions []*valueCorruptRange) bool {
+	stored := int64(length)
+	if frames != nil {
+		if valueInCorruptRange(offset, _VALUE_FRAME_SIZE, corruptions) {
+			return true
+		}
+		var frame [_VALUE_FRAME_SIZE]byte
+		if _, err := frames.Seek(int64(offset), 0); err != nil {
+			return true
+		}
+		if _, err := io.ReadFull(frames, frame[:]); err != nil {
+			return true
+		}
+		stored = _VALUE_FRAME_SIZE + int64(binary.BigEndian.Uint32(frame[1:]))
+	}
+	if limit > 0 && int64(offset)+stored > limit {
+		return true
+	}
+	return valueInCorruptRange(offset, stored, corruptions)
+}
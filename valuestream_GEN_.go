@@ -0,0 +1,238 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// manifest: length:8, chunkSize:4, chunks:4
+const _VALUE_STREAM_MANIFEST_LENGTH = 16
+
+// WriteStream stores timestampmicro and everything read from r until io.EOF
+// for keyA, keyB, returning the previously stored
+// timestampmicro or any error, just as Write does. There is no limit to the
+// length; the value is split into chunk entries of up to ValueCap bytes each
+// and then a manifest entry is written at keyA, keyB describing
+// them, so the value only appears once it is complete.
+//
+// The chunk entries share keyA with the manifest so they all belong to the
+// same ring partition, but each is still replicated on its own just like any
+// other entry; nothing makes the stream arrive at another replica as a whole.
+// Until every chunk has arrived there, ReadStream on that replica will return
+// an error for the missing chunk. Every node in a cluster must be running a
+// version supporting WriteStream before it is used; see the package
+// documentation.
+//
+// Values written with WriteStream have to be read with ReadStream or ReadTo;
+// Read and Lookup return ErrStream for them. Once the value is replaced or
+// deleted, by whatever means, its chunk entries are removed as well. The
+// chunk entries of a WriteStream that returns an error are removed too, but
+// those of one cut short by a crash are not and are simply left in place.
+func (store *DefaultValueStore) WriteStream(keyA uint64, keyB uint64, timestampmicro int64, r io.Reader) (int64, error) {
+	atomic.AddInt32(&store.writeStreams, 1)
+	ptimestampbits, err := store.writeStream(keyA, keyB, timestampmicro, r)
+	if err == nil {
+		err = store.syncWrites(context.Background())
+	}
+	if err != nil {
+		atomic.AddInt32(&store.writeStreamErrors, 1)
+	}
+	return int64(ptimestampbits >> _TSB_UTIL_BITS), err
+}
+
+func (store *DefaultValueStore) writeStream(keyA uint64, keyB uint64, timestampmicro int64, r io.Reader) (uint64, error) {
+	if timestampmicro < TIMESTAMPMICRO_MIN {
+		return 0, fmt.Errorf("timestamp %d < %d", timestampmicro, TIMESTAMPMICRO_MIN)
+	}
+	if timestampmicro > TIMESTAMPMICRO_MAX {
+		return 0, fmt.Errorf("timestamp %d > %d", timestampmicro, TIMESTAMPMICRO_MAX)
+	}
+
+	chunkSize := store.valueCap
+	buf := make([]byte, chunkSize)
+	var length uint64
+	var chunks uint32
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			ckeyA, ckeyB := valueStreamChunkKeys(keyA, keyB, timestampmicro, chunks)
+			if _, werr := store.write(ckeyA, ckeyB, uint64(timestampmicro)<<_TSB_UTIL_BITS, buf[:n], false); werr != nil {
+				store.deleteStreamChunks(keyA, keyB, timestampmicro, chunks, timestampmicro)
+				return 0, werr
+			}
+			length += uint64(n)
+			chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			store.deleteStreamChunks(keyA, keyB, timestampmicro, chunks, timestampmicro)
+			return 0, err
+		}
+	}
+	manifest := make([]byte, _VALUE_STREAM_MANIFEST_LENGTH)
+	binary.BigEndian.PutUint64(manifest, length)
+	binary.BigEndian.PutUint32(manifest[8:], chunkSize)
+	binary.BigEndian.PutUint32(manifest[12:], chunks)
+	timestampbits := (uint64(timestampmicro) << _TSB_UTIL_BITS) | _TSB_MANIFEST
+	ptimestampbits, err := store.write(keyA, keyB, timestampbits, manifest, false)
+	if ptimestampbits>>_TSB_UTIL_BITS == uint64(timestampmicro) && ptimestampbits&_TSB_MANIFEST != 0 {
+		// The same stream was already in place; the chunks are its own.
+		return ptimestampbits, err
+	}
+	if err != nil || ptimestampbits >= timestampbits {
+		// Either way, our chunks are of no use to anyone.
+		store.deleteStreamChunks(keyA, keyB, timestampmicro, chunks, timestampmicro)
+		return ptimestampbits, err
+	}
+	return ptimestampbits, nil
+}
+
+// ReadStream returns an io.ReadCloser for the value stored for keyA, keyB
+// with WriteStream; the chunk entries are read as needed so the whole value
+// is never held in memory at once. Values stored with Write may also be read
+// this way. The errors returned are the same as for Read.
+func (store *DefaultValueStore) ReadStream(keyA uint64, keyB uint64) (io.ReadCloser, error) {
+	atomic.AddInt32(&store.readStreams, 1)
+	if atomic.LoadUint32(&store.closed) != 0 {
+		atomic.AddInt32(&store.readStreamErrors, 1)
+		return nil, ErrClosed
+	}
+	timestampbits, value, err := store.readUnexpired(keyA, keyB, nil)
+	if err != nil {
+		atomic.AddInt32(&store.readStreamErrors, 1)
+		return nil, err
+	}
+	if timestampbits&_TSB_MANIFEST == 0 {
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+	if len(value) != _VALUE_STREAM_MANIFEST_LENGTH {
+		atomic.AddInt32(&store.readStreamErrors, 1)
+		return nil, fmt.Errorf("stream manifest length of %d != %d", len(value), _VALUE_STREAM_MANIFEST_LENGTH)
+	}
+	return &valueStreamReader{
+		store: store,
+		keyA:  keyA,
+		keyB:  keyB,
+
+		timestampmicro: int64(timestampbits >> _TSB_UTIL_BITS),
+		chunks:         binary.BigEndian.Uint32(value[12:]),
+	}, nil
+}
+
+// supersededStreamManifest returns the timestampbits and manifest of the
+// value written with WriteStream stored for keyA, keyB, if
+// there is one a write of timestampbits would replace, so its chunk entries
+// can be removed once the write is in place.
+func (store *DefaultValueStore) supersededStreamManifest(keyA uint64, keyB uint64, timestampbits uint64) (uint64, []byte) {
+	if timestampbits&(_TSB_LOCAL_REMOVAL|_TSB_COMPACTION_REWRITE) != 0 {
+		// Removing our local copy leaves the chunks to be handed off too, and
+		// compaction just moves the very same manifest.
+		return 0, nil
+	}
+	otimestampbits, _, _, _ := store.locmap.Get(keyA, keyB)
+	if otimestampbits&_TSB_MANIFEST == 0 {
+		return 0, nil
+	}
+	// Only the timestamps themselves matter; the same manifest may come back
+	// with other util bits, such as when replicated. A deletion marker with
+	// the same timestamp does win though.
+	if otimestampbits>>_TSB_UTIL_BITS > timestampbits>>_TSB_UTIL_BITS || (otimestampbits>>_TSB_UTIL_BITS == timestampbits>>_TSB_UTIL_BITS && timestampbits&_TSB_DELETION == 0) {
+		return 0, nil
+	}
+	otimestampbits, omanifest, err := store.read(keyA, keyB, nil)
+	if err != nil || otimestampbits&_TSB_MANIFEST == 0 {
+		return 0, nil
+	}
+	return otimestampbits, omanifest
+}
+
+// deleteStreamManifestChunks removes the chunk entries described by manifest,
+// if timestampbits indicates it is one.
+func (store *DefaultValueStore) deleteStreamManifestChunks(keyA uint64, keyB uint64, timestampbits uint64, manifest []byte, deletemicro int64) {
+	if timestampbits&_TSB_MANIFEST == 0 || timestampbits&_TSB_DELETION != 0 || len(manifest) != _VALUE_STREAM_MANIFEST_LENGTH {
+		return
+	}
+	store.deleteStreamChunks(keyA, keyB, int64(timestampbits>>_TSB_UTIL_BITS), binary.BigEndian.Uint32(manifest[12:]), deletemicro)
+}
+
+// deleteStreamChunks writes deletion markers with deletemicro for the first
+// chunks chunk entries of the stream written at timestampmicro. Since a
+// deletion marker wins over a value with the same timestamp, deletemicro may
+// be timestampmicro itself.
+func (store *DefaultValueStore) deleteStreamChunks(keyA uint64, keyB uint64, timestampmicro int64, chunks uint32, deletemicro int64) {
+	for chunk := uint32(0); chunk < chunks; chunk++ {
+		ckeyA, ckeyB := valueStreamChunkKeys(keyA, keyB, timestampmicro, chunk)
+		store.write(ckeyA, ckeyB, (uint64(deletemicro)<<_TSB_UTIL_BITS)|_TSB_DELETION, nil, true)
+	}
+}
+
+// valueStreamChunkKeys returns the keys for the given chunk of the stream
+// written at timestampmicro. keyA is kept so the chunks land in the same
+// partition as the manifest.
+func valueStreamChunkKeys(keyA uint64, keyB uint64, timestampmicro int64, chunk uint32) (uint64, uint64) {
+	var b [28]byte
+	binary.BigEndian.PutUint64(b[0:], keyA)
+	binary.BigEndian.PutUint64(b[8:], keyB)
+
+	binary.BigEndian.PutUint64(b[16:], uint64(timestampmicro))
+	binary.BigEndian.PutUint32(b[24:], chunk)
+
+	h1, h2 := murmur3.Sum128(b[:])
+
+	return keyA, h1 ^ h2
+
+}
+
+type valueStreamReader struct {
+	store *DefaultValueStore
+	keyA  uint64
+	keyB  uint64
+
+	timestampmicro int64
+	chunks         uint32
+	chunk          uint32
+	buf            []byte
+	offset         int
+	closed         bool
+}
+
+func (sr *valueStreamReader) Read(p []byte) (int, error) {
+	if sr.closed {
+		return 0, errors.New("read of closed stream")
+	}
+	for sr.offset >= len(sr.buf) {
+		if sr.chunk >= sr.chunks {
+			return 0, io.EOF
+		}
+		ckeyA, ckeyB := valueStreamChunkKeys(sr.keyA, sr.keyB, sr.timestampmicro, sr.chunk)
+		var err error
+		_, sr.buf, err = sr.store.read(ckeyA, ckeyB, sr.buf[:0])
+		if err == ErrNotFound {
+			return 0, fmt.Errorf("stream chunk %d of %d not found", sr.chunk, sr.chunks)
+		}
+		if err != nil {
+			return 0, err
+		}
+		sr.offset = 0
+		sr.chunk++
+	}
+	n := copy(p, sr.buf[sr.offset:])
+	sr.offset += n
+	return n, nil
+}
+
+func (sr *valueStreamReader) Close() error {
+	sr.closed = true
+	sr.buf = nil
+	return nil
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestValueSubscribe(t *testing.T) {
+	store := newValueTestStore(t, t.TempDir(), nil)
+	all, cancelAll := store.Subscribe(SubscribeFilter{Replicated: true})
+	ranged, cancelRanged := store.Subscribe(SubscribeFilter{StartKeyA: 10, StopKeyA: 19, Block: true})
+	small, cancelSmall := store.Subscribe(SubscribeFilter{Buffer: 1})
+	defer cancelSmall()
+	if _, err := store.Write(5, 5, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(15, 15, 1000, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	// Overridden, so no change should be sent.
+	if _, err := store.Write(15, 15, 999, []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(15, 15, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.writeReplicated(25, 25, 1000<<_TSB_UTIL_BITS, []byte("testing"), false); err != nil {
+		t.Fatal(err)
+	}
+	c := <-all
+	if c.KeyA != 5 || c.PreviousTimestampMicro != 0 || c.TimestampMicro != 1000 || c.Deleted || c.Origin != ChangeOriginLocal {
+		t.Fatal(c)
+	}
+	c = <-all
+	if c.KeyA != 15 || c.TimestampMicro != 1000 || c.Deleted {
+		t.Fatal(c)
+	}
+	c = <-all
+	if c.KeyA != 15 || c.PreviousTimestampMicro != 1000 || c.TimestampMicro != 2000 || !c.Deleted {
+		t.Fatal(c)
+	}
+	c = <-all
+	if c.KeyA != 25 || c.Origin != ChangeOriginReplication {
+		t.Fatal(c)
+	}
+	c = <-ranged
+	if c.KeyA != 15 || c.Deleted {
+		t.Fatal(c)
+	}
+	c = <-ranged
+	if c.KeyA != 15 || !c.Deleted {
+		t.Fatal(c)
+	}
+	cancelRanged()
+	if _, ok := <-ranged; ok {
+		t.Fatal("expected closed channel")
+	}
+	if c = <-small; c.KeyA != 5 {
+		t.Fatal(c)
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.DroppedChanges != 2 {
+		t.Fatal(stats.DroppedChanges)
+	}
+	cancelAll()
+	cancelAll()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-small; ok {
+		t.Fatal("expected closed channel")
+	}
+}
@@ -54,7 +54,7 @@ func (store *DefaultValueStore) TombstoneDiscardPass() {
 // expired tombstones (deletion markers).
 func (store *DefaultValueStore) EnableTombstoneDiscard() {
 	store.tombstoneDiscardState.notifyChanLock.Lock()
-	if store.tombstoneDiscardState.notifyChan == nil {
+	if store.tombstoneDiscardState.notifyChan == nil && atomic.LoadUint32(&store.closed) == 0 {
 		store.tombstoneDiscardState.notifyChan = make(chan *bgNotification, 1)
 		go store.tombstoneDiscardLauncher(store.tombstoneDiscardState.notifyChan)
 	}
@@ -128,6 +128,9 @@ func (store *DefaultValueStore) tombstoneDiscardPass(notifyChan chan *bgNotifica
 			store.logDebug("tombstone discard pass took %s\n", time.Now().Sub(begin))
 		}()
 	}
+	if n := store.tombstoneDiscardPassExpiredValues(notifyChan); n != nil {
+		return n
+	}
 	if n := store.tombstoneDiscardPassLocalRemovals(notifyChan); n != nil {
 		return n
 	}
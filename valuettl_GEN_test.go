@@ -0,0 +1,68 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gholt/ring"
+	"gopkg.in/gholt/brimtime.v1"
+)
+
+func TestValueWriteWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	b := ring.NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	store := newValueTestStore(t, dir, func(cfg *ValueStoreConfig) {
+		cfg.MsgRing = &msgRingPlaceholder{ring: r}
+	})
+	nowmicro := brimtime.TimeToUnixMicro(time.Now())
+	if _, err = store.WriteWithTTL(1, 2, nowmicro, []byte("testing"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.WriteWithTTL(5, 6, nowmicro-2000000, []byte("testing"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	timestampMicro, value, err := store.Read(1, 2, []byte("prefix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != nowmicro || string(value) != "prefixtesting" {
+		t.Fatal(timestampMicro, string(value))
+	}
+	timestampMicro, length, err := store.Lookup(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestampMicro != nowmicro || length != 7 {
+		t.Fatal(timestampMicro, length)
+	}
+	timestampMicro, value, err = store.Read(5, 6, nil)
+	if err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if timestampMicro != nowmicro-2000000 || len(value) != 0 {
+		t.Fatal(timestampMicro, value)
+	}
+	if _, _, err = store.Lookup(5, 6); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	store.TombstoneDiscardPass()
+	timestampbits, _, _, _ := store.locmap.Get(5, 6)
+	if timestampbits != (uint64(nowmicro-2000000)<<_TSB_UTIL_BITS)|_TSB_DELETION {
+		t.Fatal(timestampbits)
+	}
+	timestampbits, _, _, _ = store.locmap.Get(1, 2)
+	if timestampbits != (uint64(nowmicro)<<_TSB_UTIL_BITS)|_TSB_EXPIRES {
+		t.Fatal(timestampbits)
+	}
+	stats := store.Stats(false).(*ValueStoreStats)
+	if stats.ExpiredValues != 1 {
+		t.Fatal(stats.ExpiredValues)
+	}
+}